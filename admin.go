@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const ADMIN_UNIX_PREFIX = "unix:"
+
+var (
+	adminAddress    string
+	adminSocketMode os.FileMode = 0660
+	adminMux                    = http.NewServeMux()
+	// Left out of /debug/vars: the command line holds the passwords of the
+	// flags (-redis_password...), and read-only tokens can get the metrics
+	hiddenVars = map[string]bool{"cmdline": true}
+)
+
+/*
+ * Serves the metrics and the admin API
+ */
+func startAdmin() {
+	adminMux.HandleFunc("/debug/vars", varsHandler)
+	adminMux.HandleFunc("/metrics", openMetricsHandler)
+	adminMux.HandleFunc("/drain", drainHandler)
+	adminMux.HandleFunc("/redis", redisHandler)
+	adminMux.HandleFunc("/cluster", clusterHandler)
+	adminMux.HandleFunc("/state", stateHandler)
+	adminMux.HandleFunc("/check", checkHandler)
+	adminMux.HandleFunc("/events", eventsHandler)
+	adminMux.HandleFunc("/history", historyHandler)
+	adminMux.HandleFunc("/outages", outagesHandler)
+	l, err := listenAdmin(adminAddress)
+	if err != nil {
+		log.Println("Cannot start the admin listener:", err.Error())
+		return
+	}
+	go func() {
+		log.Println("Admin listener on", adminAddress)
+		err := http.Serve(l, requireToken(adminMux))
+		log.Println("Admin listener stopped:", err)
+	}()
+}
+
+/*
+ * GET /debug/vars returns the metrics as JSON, like expvar.Handler without
+ * the hidden variables
+ */
+func varsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if hiddenVars[kv.Key] == true {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+/*
+ * Listens on a TCP address, or on a Unix socket with "unix:<path>". The
+ * socket left by a previous run is replaced, and its permissions are set
+ * to -admin_socket_mode
+ */
+func listenAdmin(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, ADMIN_UNIX_PREFIX) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, ADMIN_UNIX_PREFIX)
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, adminSocketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+/*
+ * GET /redis returns the address of Hipache's Redis, POST switches to
+ * another one: {"address": "10.0.0.2:6379", "password": "secret"}
+ */
+func redisHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req struct {
+			Address  string `json:"address"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+			req.Address == "" {
+			http.Error(w, "Expected {\"address\": ..., \"password\": ...}",
+				http.StatusBadRequest)
+			return
+		}
+		if err := cache.SetRedis(req.Address, req.Password); err != nil {
+			http.Error(w, "Cannot connect: "+err.Error(),
+				http.StatusBadGateway)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"address": getRedisAddress()})
+}
+
+/*
+ * GET /state returns the backends checked by the instance, as the state
+ * dump
+ */
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getState(cache))
+}
+
+/*
+ * POST /check?backend=<backend_url> probes a backend right away. With a
+ * JSON check as the body, the backend is handled as a dead notification.
+ */
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Content-Type") == "application/json" {
+		check := &Check{}
+		if err := json.NewDecoder(r.Body).Decode(check); err != nil {
+			http.Error(w, "Invalid check: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println(check.BackendUrl, "Check requested on the admin API")
+		startCheck("admin", check)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	backendUrl, err := parseBackendUrl(r.FormValue("backend"))
+	if err != nil {
+		http.Error(w, "Invalid backend: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, check := range watchedCheckList() {
+		if check.BackendUrl == backendUrl {
+			check.Recheck()
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+	http.Error(w, "Backend not checked by this instance", http.StatusNotFound)
+}
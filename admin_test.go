@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckHandler(t *testing.T) {
+	check, err := NewCheck("www.foo.com;http://10.0.0.1:80;0;2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchCheck(check, nil)
+	defer unwatchCheck(check)
+	for _, test := range []struct {
+		method  string
+		backend string
+		code    int
+	}{
+		{"GET", "http://10.0.0.1:80", 405},
+		{"POST", "10.0.0.1", 400},
+		{"POST", "http://10.0.0.2:80", 404},
+		{"POST", "http://10.0.0.1:80/", 202},
+	} {
+		w := httptest.NewRecorder()
+		checkHandler(w, httptest.NewRequest(test.method,
+			"/check?backend="+test.backend, nil))
+		if w.Code != test.code {
+			t.Errorf("%s /check %s: expected %d, got %d", test.method,
+				test.backend, test.code, w.Code)
+		}
+	}
+	select {
+	case <-check.recheck:
+	default:
+		t.Error("Expected a forced check")
+	}
+}
+
+func TestCheckHandlerJSON(t *testing.T) {
+	_, c := setupCache(t)
+	cache = c
+	defer func() { cache = nil }()
+	// Already checked, the new frontend joins
+	cache.LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2"))
+	for _, test := range []struct {
+		body string
+		code int
+	}{
+		{`{"frontend_key": "www.bar.com", "backend_url": "10.0.0.1"}`, 400},
+		{`{"frontend_key": "", "backend_url": "http://10.0.0.1:80"}`, 400},
+		{`{"frontend_key": "www.bar.com", "backend_url": "http://10.0.0.1:80/",
+		   "backend_id": 1, "backend_group_length": 2}`, 202},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/check",
+			strings.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/json")
+		checkHandler(w, req)
+		if w.Code != test.code {
+			t.Errorf("POST /check %s: expected %d, got %d", test.body,
+				test.code, w.Code)
+		}
+	}
+	if id, exists := cache.mapping.Frontends("http://10.0.0.1:80")["www.bar.com"]; !exists || id != 1 {
+		t.Error("Expected the check to be handled as a dead notification")
+	}
+}
+
+func TestListenAdminUnix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hchecker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+	adminSocketMode = 0600
+	defer func() { adminSocketMode = 0660 }()
+	// A socket left by a previous run is replaced
+	for i := 0; i < 2; i++ {
+		l, err := listenAdmin(ADMIN_UNIX_PREFIX + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// Leave the socket file behind, as a crash would
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			l.Close()
+			continue
+		}
+		defer l.Close()
+		go http.Serve(l, http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "ok")
+			}))
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected the socket to be 0600, got %v", fi.Mode().Perm())
+	}
+	client := &http.Client{Transport: &http.Transport{DialContext: func(
+		ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial("unix", path)
+	}}}
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0644)
+	if _, err := listenAdmin(ADMIN_UNIX_PREFIX + file); err == nil {
+		t.Error("Expected a regular file not to be replaced")
+	}
+}
+
+func TestVarsHandlerHidesSecrets(t *testing.T) {
+	h := requireToken(http.HandlerFunc(varsHandler))
+	adminTokens = map[string]string{"dash": ROLE_READ}
+	args := os.Args
+	defer func() { adminTokens, os.Args = nil, args }()
+	os.Args = []string{"hchecker", "-redis_password=s3cr3t-redis",
+		"-meta_redis_password=s3cr3t-meta",
+		"-redlock_password=s3cr3t-redlock"}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/debug/vars", nil)
+	r.Header.Set("Authorization", "Bearer dash")
+	h.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("Expected the metrics to be readable, got %d", w.Code)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("Invalid JSON: %s", err)
+	}
+	if _, exists := vars["locks"]; !exists {
+		t.Error("Expected the metrics in /debug/vars")
+	}
+	if _, exists := vars["cmdline"]; exists ||
+		strings.Contains(w.Body.String(), "s3cr3t") {
+		t.Errorf("Expected no secret flag in /debug/vars, got %s",
+			w.Body.String())
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h := requireToken(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	adminTokens = map[string]string{"s3cr3t": ROLE_ADMIN, "dash": ROLE_READ}
+	defer func() { adminTokens = nil }()
+	for _, test := range []struct {
+		method string
+		token  string
+		code   int
+	}{
+		{"GET", "", 401},
+		{"GET", "wrong", 401},
+		{"GET", "dash", 200},
+		{"POST", "dash", 403},
+		{"DELETE", "dash", 403},
+		{"GET", "s3cr3t", 200},
+		{"POST", "s3cr3t", 200},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, "/drain", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		h.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s with %q: expected %d, got %d", test.method,
+				test.token, test.code, w.Code)
+		}
+	}
+	adminTokens = nil
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/drain", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected the admin API to be open without tokens, got %d",
+			w.Code)
+	}
+}
+
+func TestRedisHandler(t *testing.T) {
+	old, next := newFakeRedis(), newFakeRedis()
+	oldAddress, nextAddress := old.serve(t), next.serve(t)
+	redisAddress = oldAddress
+	defer func() { redisAddress = "" }()
+	c, _ := NewCache()
+	cache = c
+	defer func() { cache = nil }()
+	// An idle connection to the current Redis
+	conn := c.pool.Get()
+	if _, err := conn.Do("PING"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// Not in use yet
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	unreachable := l.Addr().String()
+	l.Close()
+	for _, test := range []struct {
+		method  string
+		body    string
+		code    int
+		address string
+	}{
+		{"GET", "", 200, oldAddress},
+		{"DELETE", "", 405, oldAddress},
+		{"POST", `{"password": "secret"}`, 400, oldAddress},
+		{"POST", `{"address": "` + unreachable + `"}`, 502, oldAddress},
+		{"POST", `{"address": "` + nextAddress + `"}`, 200, nextAddress},
+	} {
+		w := httptest.NewRecorder()
+		redisHandler(w, httptest.NewRequest(test.method, "/redis",
+			strings.NewReader(test.body)))
+		if w.Code != test.code {
+			t.Errorf("%s /redis %s: expected %d, got %d", test.method,
+				test.body, test.code, w.Code)
+		}
+		if address := getRedisAddress(); address != test.address {
+			t.Errorf("%s /redis %s: expected to use %s, got %s", test.method,
+				test.body, test.address, address)
+		}
+	}
+	var reply map[string]string
+	w := httptest.NewRecorder()
+	redisHandler(w, httptest.NewRequest("GET", "/redis", nil))
+	if json.NewDecoder(w.Body).Decode(&reply); reply["address"] != nextAddress {
+		t.Errorf("Expected the new address, got %v", reply)
+	}
+	// The idle connection to the old Redis is dropped
+	conn = c.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SET", "switched", "1"); err != nil {
+		t.Fatal(err)
+	}
+	next.lock.Lock()
+	defer next.lock.Unlock()
+	if !next.exists("switched") {
+		t.Error("Expected the commands to go to the new Redis")
+	}
+}
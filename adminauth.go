@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Can use the read-only endpoints (GET)
+	ROLE_READ = "read"
+	// Can also change the state of the checker (POST, DELETE...)
+	ROLE_ADMIN = "admin"
+)
+
+var (
+	adminTokensFile string
+	// Roles of the bearer tokens, the admin API is open when empty
+	adminTokens map[string]string
+)
+
+/*
+ * Loads the bearer tokens of the admin API from a JSON file:
+ * {"s3cr3t": "admin", "dashboard-token": "read"}
+ */
+func loadAdminTokens(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	tokens := make(map[string]string)
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("Cannot parse admin tokens file %q: %s",
+			filename, err)
+	}
+	for token, role := range tokens {
+		if token == "" {
+			return fmt.Errorf("Empty token in %q", filename)
+		}
+		if role != ROLE_READ && role != ROLE_ADMIN {
+			return fmt.Errorf("Invalid role %q in %q", role, filename)
+		}
+	}
+	adminTokens = tokens
+	return nil
+}
+
+/*
+ * Returns the role of a bearer token, empty if the token is unknown
+ */
+func tokenRole(token string) string {
+	role := ""
+	// Compare all the tokens in constant time, not to leak them
+	for t, r := range adminTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			role = r
+		}
+	}
+	return role
+}
+
+/*
+ * Checks the bearer token of the admin requests: reading needs any known
+ * token, the other methods need an admin one
+ */
+func requireToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(adminTokens) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		role := ""
+		if strings.HasPrefix(auth, "Bearer ") {
+			role = tokenRole(strings.TrimPrefix(auth, "Bearer "))
+		}
+		if role == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hchecker"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		readOnly := r.Method == "GET" || r.Method == "HEAD"
+		if !readOnly && role != ROLE_ADMIN {
+			http.Error(w, "Forbidden: read-only token", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Refresh the OAuth2 tokens 30 seconds before they expire
+	OAUTH2_EXPIRY_DELTA = 30
+	// Timeout of the requests to the OAuth2 server
+	OAUTH2_TIMEOUT = 10
+)
+
+var (
+	oauth2Clients     = make(map[string]*oauth2Auth)
+	oauth2ClientsLock sync.Mutex
+	oauth2HttpClient  = &http.Client{
+		Timeout: time.Duration(OAUTH2_TIMEOUT) * time.Second,
+	}
+)
+
+/*
+ * Adds credentials to the probe requests
+ */
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+type basicAuth struct {
+	username string
+	password string
+}
+
+func (a *basicAuth) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.username, a.password)
+	return nil
+}
+
+type bearerAuth struct {
+	token string
+}
+
+func (a *bearerAuth) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+/*
+ * OAuth2 client credentials grant. The token is shared by all the probes
+ * using the same client and refreshed before it expires.
+ */
+type oauth2Auth struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	scope        string
+	// Only used by the refresh in progress
+	tokenUrl string
+
+	lock      sync.Mutex
+	token     string
+	refreshAt time.Time
+	expiry    time.Time
+	// Closed once the refresh in progress is done, nil if none
+	refreshing chan struct{}
+	refreshErr error
+}
+
+func (a *oauth2Auth) Authenticate(req *http.Request) error {
+	token, err := a.getToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+/*
+ * Returns the current token. A single probe asks for a new one, out of the
+ * lock: the others keep using the current token until it expires, and only
+ * wait for the new one when there is none.
+ */
+func (a *oauth2Auth) getToken() (string, error) {
+	a.lock.Lock()
+	now := time.Now()
+	valid := a.token != "" && now.Before(a.expiry)
+	if valid && (now.Before(a.refreshAt) || a.refreshing != nil) {
+		token := a.token
+		a.lock.Unlock()
+		return token, nil
+	}
+	if done := a.refreshing; done != nil {
+		a.lock.Unlock()
+		<-done
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if a.token == "" || time.Now().After(a.expiry) {
+			return "", a.refreshErr
+		}
+		return a.token, nil
+	}
+	done := make(chan struct{})
+	a.refreshing = done
+	a.lock.Unlock()
+	token, expiresIn, err := a.refresh()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.refreshing, a.refreshErr = nil, err
+	close(done)
+	if err != nil {
+		if valid {
+			// Retried by the next probe
+			return a.token, nil
+		}
+		return "", err
+	}
+	now = time.Now()
+	a.token = token
+	a.expiry = now.Add(expiresIn)
+	a.refreshAt = a.expiry
+	if expiresIn > time.Duration(OAUTH2_EXPIRY_DELTA)*time.Second {
+		a.refreshAt = a.expiry.Add(-time.Duration(OAUTH2_EXPIRY_DELTA) *
+			time.Second)
+	}
+	return token, nil
+}
+
+/*
+ * Finds the token endpoint of the issuer with the OpenID discovery document
+ */
+func (a *oauth2Auth) discover() error {
+	resp, err := oauth2HttpClient.Get(strings.TrimRight(a.issuer, "/") +
+		"/.well-known/openid-configuration")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OAuth2 discovery failed: %s", resp.Status)
+	}
+	var doc struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return err
+	}
+	if doc.TokenEndpoint == "" {
+		return errors.New("OAuth2 discovery failed: no token endpoint")
+	}
+	a.tokenUrl = doc.TokenEndpoint
+	return nil
+}
+
+/*
+ * Asks for a new token, returns it with its lifetime
+ */
+func (a *oauth2Auth) refresh() (string, time.Duration, error) {
+	if a.tokenUrl == "" {
+		if err := a.discover(); err != nil {
+			return "", 0, err
+		}
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if a.scope != "" {
+		form.Set("scope", a.scope)
+	}
+	req, _ := http.NewRequest("POST", a.tokenUrl,
+		strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.clientId),
+		url.QueryEscape(a.clientSecret))
+	resp, err := oauth2HttpClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("OAuth2 token request failed: %s",
+			resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, err
+	}
+	if token.AccessToken == "" {
+		return "", 0, errors.New("OAuth2 token request failed: no access token")
+	}
+	if token.ExpiresIn <= 0 {
+		// No expiry given, ask for a new token every hour
+		token.ExpiresIn = 3600
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second,
+		nil
+}
+
+/*
+ * Returns the Authenticator configured for a frontend, nil if the probes
+ * are sent without credentials
+ */
+func getAuthenticator(frontendKey string) Authenticator {
+	fc := getFrontendConfig(frontendKey)
+	if fc == nil {
+		return nil
+	}
+	switch {
+	case fc.OAuth2ClientId != "":
+		key := fc.OAuth2Issuer + ";" + fc.OAuth2TokenUrl + ";" +
+			fc.OAuth2ClientId
+		secret := getSecret(fc.OAuth2ClientSecret, fc.OAuth2ClientSecretFile)
+		oauth2ClientsLock.Lock()
+		defer oauth2ClientsLock.Unlock()
+		a, exists := oauth2Clients[key]
+		if !exists || a.clientSecret != secret || a.scope != fc.OAuth2Scope {
+			a = &oauth2Auth{
+				issuer:       fc.OAuth2Issuer,
+				tokenUrl:     fc.OAuth2TokenUrl,
+				clientId:     fc.OAuth2ClientId,
+				clientSecret: secret,
+				scope:        fc.OAuth2Scope,
+			}
+			oauth2Clients[key] = a
+		}
+		return a
+	case fc.Token != "" || fc.TokenFile != "":
+		return &bearerAuth{token: getSecret(fc.Token, fc.TokenFile)}
+	case fc.Username != "":
+		return &basicAuth{username: fc.Username,
+			password: getSecret(fc.Password, fc.PasswordFile)}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ * OAuth2 server issuing "token-1", "token-2"... The token requests wait
+ * until release is closed, if set.
+ */
+type fakeOAuth2Server struct {
+	*httptest.Server
+	requests  int32
+	expiresIn int
+	release   chan struct{}
+	failing   bool
+}
+
+func newFakeOAuth2Server(t *testing.T) *fakeOAuth2Server {
+	s := &fakeOAuth2Server{expiresIn: 3600}
+	s.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/.well-known/openid-configuration":
+				fmt.Fprintf(w, `{"token_endpoint": "%s/token"}`, s.URL)
+				return
+			case "/token":
+			default:
+				w.WriteHeader(404)
+				return
+			}
+			id, secret, _ := r.BasicAuth()
+			if r.FormValue("grant_type") != "client_credentials" ||
+				r.FormValue("scope") != "health" || id != "hchecker" ||
+				secret != "s3cr3t" {
+				t.Errorf("Unexpected token request %v", r.Form)
+			}
+			n := atomic.AddInt32(&s.requests, 1)
+			if s.release != nil {
+				<-s.release
+			}
+			if s.failing {
+				w.WriteHeader(500)
+				return
+			}
+			fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": %d}`,
+				n, s.expiresIn)
+		}))
+	return s
+}
+
+func authorization(t *testing.T, a Authenticator) string {
+	req, _ := http.NewRequest("GET", "http://10.0.0.1/health", nil)
+	if err := a.Authenticate(req); err != nil {
+		t.Fatal(err)
+	}
+	return req.Header.Get("Authorization")
+}
+
+func TestOAuth2Token(t *testing.T) {
+	srv := newFakeOAuth2Server(t)
+	defer srv.Close()
+	a := &oauth2Auth{issuer: srv.URL, clientId: "hchecker",
+		clientSecret: "s3cr3t", scope: "health"}
+	// Found with the discovery document, then cached
+	for i := 0; i < 3; i++ {
+		if auth := authorization(t, a); auth != "Bearer token-1" {
+			t.Errorf("Expected the first token, got %q", auth)
+		}
+	}
+	if n := atomic.LoadInt32(&srv.requests); n != 1 {
+		t.Errorf("Expected a single token request, got %d", n)
+	}
+	if a.tokenUrl != srv.URL+"/token" {
+		t.Errorf("Expected the discovered token endpoint, got %q", a.tokenUrl)
+	}
+	if until := time.Until(a.refreshAt); until < time.Hour-time.Minute ||
+		until > time.Hour-time.Duration(OAUTH2_EXPIRY_DELTA)*time.Second {
+		t.Errorf("Expected a refresh 30s before the expiry, in %s", until)
+	}
+	// Refreshed before it expires
+	a.refreshAt = time.Now()
+	if auth := authorization(t, a); auth != "Bearer token-2" {
+		t.Errorf("Expected a new token, got %q", auth)
+	}
+	// Expired while the token server fails
+	srv.failing = true
+	a.refreshAt, a.expiry = time.Now(), time.Now()
+	req, _ := http.NewRequest("GET", "http://10.0.0.1/health", nil)
+	if err := a.Authenticate(req); err == nil {
+		t.Error("Expected the probe to fail without a token")
+	}
+}
+
+func TestOAuth2SlowRefresh(t *testing.T) {
+	srv := newFakeOAuth2Server(t)
+	defer srv.Close()
+	a := &oauth2Auth{tokenUrl: srv.URL + "/token", clientId: "hchecker",
+		clientSecret: "s3cr3t", scope: "health"}
+	authorization(t, a)
+	// The token is renewed while still valid: a single probe asks for the
+	// new one, the others keep using the current one
+	srv.release = make(chan struct{})
+	a.refreshAt = time.Now()
+	refreshed := make(chan string)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://10.0.0.1/health", nil)
+		a.Authenticate(req)
+		refreshed <- req.Header.Get("Authorization")
+	}()
+	waitFor(t, "the token request", func() bool {
+		return atomic.LoadInt32(&srv.requests) == 2
+	})
+	if auth := authorization(t, a); auth != "Bearer token-1" {
+		t.Errorf("Expected the current token during the refresh, got %q", auth)
+	}
+	close(srv.release)
+	if auth := <-refreshed; auth != "Bearer token-2" {
+		t.Errorf("Expected the new token, got %q", auth)
+	}
+	// Without a valid token, the probes wait for a single request
+	srv.release = make(chan struct{})
+	a.refreshAt, a.expiry = time.Now(), time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if auth := authorization(t, a); auth != "Bearer token-3" {
+				t.Errorf("Expected the new token, got %q", auth)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(srv.release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&srv.requests); n != 3 {
+		t.Errorf("Expected a single request for the new token, got %d", n-2)
+	}
+}
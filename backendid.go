@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+)
+
+const (
+	// Members of the dead sets: the index of the backend in the frontend
+	// list, as Hipache does, or the SHA-1 of its URL, for the forks which
+	// don't depend on the order of the list
+	BACKEND_ID_INDEX = "index"
+	BACKEND_ID_URL   = "url"
+)
+
+var backendIdScheme = BACKEND_ID_INDEX
+
+func isValidBackendIdScheme(scheme string) bool {
+	return scheme == BACKEND_ID_INDEX || scheme == BACKEND_ID_URL
+}
+
+/*
+ * Returns the member of the dead sets (and the suffix of the keys about a
+ * backend of a frontend) identifying a backend, given its id in the list
+ */
+func deadMember(backendUrl string, backendId int) string {
+	if backendIdScheme == BACKEND_ID_URL {
+		sum := sha1.Sum([]byte(backendUrl))
+		return hex.EncodeToString(sum[:])
+	}
+	return strconv.Itoa(backendId)
+}
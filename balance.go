@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+// Instances checking 20% more backends than the average hand off the excess
+const REBALANCE_TOLERANCE = 0.2
+
+var (
+	loadInterval time.Duration
+	rebalance    bool
+)
+
+/*
+ * Reports the number of backends we check at a regular interval, and hands
+ * off the excess when we check more than the others (see -rebalance)
+ */
+func reportLoad(cache *Cache) {
+	for {
+		n := len(watchedCheckList())
+		if err := cache.ReportLoad(n); err != nil {
+			logError("Cannot report the load:", err.Error())
+		} else if rebalance == true {
+			rebalanceBackends(n)
+		}
+		if !cache.wait(loadInterval) {
+			return
+		}
+	}
+}
+
+/*
+ * Average number of backends checked by the instances reporting their load
+ */
+func averageLoad() (float64, error) {
+	loads, err := cache.GetLoads(3 * loadInterval)
+	if err != nil || len(loads) == 0 {
+		return 0, err
+	}
+	total := 0
+	for _, n := range loads {
+		total += n
+	}
+	return float64(total) / float64(len(loads)), nil
+}
+
+func rebalanceBackends(n int) {
+	avg, err := averageLoad()
+	if err != nil {
+		logError("Cannot read the load of the instances:", err.Error())
+		return
+	}
+	if float64(n) <= avg*(1+REBALANCE_TOLERANCE) {
+		return
+	}
+	excess := n - int(math.Ceil(avg))
+	if excess <= 0 {
+		return
+	}
+	log.Printf("Rebalancing %d backends (%d checked, %.1f on average)",
+		excess, n, avg)
+	shedChecks(excess, true)
+	rebalancedBackendsMetric.Add(int64(excess))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetLoads(t *testing.T) {
+	r, cache := setupCache(t)
+	cache.ReportLoad(3)
+	// Stopped reporting a while ago
+	r.zsets["hchecker:load"]["host#2"] = 10
+	r.zsets["hchecker:load_time"]["host#2"] = float64(time.Now().Add(-time.Hour).Unix())
+	loads, err := cache.GetLoads(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]int{"host#1": 3}; !reflect.DeepEqual(loads, expected) {
+		t.Errorf("Expected %v, got %v", expected, loads)
+	}
+	if _, exists := r.zsets["hchecker:load"]["host#2"]; exists {
+		t.Error("Expected the stale instance to be removed")
+	}
+	cache.RemoveLoad()
+	if r.exists("hchecker:load") || r.exists("hchecker:load_time") {
+		t.Error("Expected our load to be removed")
+	}
+}
+
+func TestRebalanceBackends(t *testing.T) {
+	r, c := setupCache(t)
+	cache = c
+	loadInterval = time.Minute
+	defer func() {
+		cache, loadInterval = nil, 0
+		watchedChecks = make(map[*Check]*backendController)
+	}()
+	for _, line := range []string{
+		"www.foo.com;http://10.0.0.1:80;0;2",
+		"www.foo.com;http://10.0.0.2:80;1;2",
+		"www.foo.com;http://10.0.0.3:80;2;3",
+		"www.foo.com;http://10.0.0.4:80;2;3",
+	} {
+		check := newTestCheck(t, line)
+		if locked, ctl := cache.LockBackend(check); locked == true {
+			watchCheck(check, ctl)
+		}
+	}
+	// 4 backends here, none on the other instance: 2 on average
+	cache.ReportLoad(4)
+	r.zsets["hchecker:load"]["host#2"] = 0
+	r.zsets["hchecker:load_time"]["host#2"] = float64(time.Now().Unix())
+	rebalanceBackends(4)
+	if len(watchedChecks) != 2 {
+		t.Errorf("Expected 2 backends left, got %d", len(watchedChecks))
+	}
+	if len(r.published) != 1 {
+		t.Fatalf("Expected a handoff message, got %v", r.published)
+	}
+	// Balanced
+	rebalanceBackends(2)
+	if len(r.published) != 1 {
+		t.Errorf("Expected no more handoff, got %v", r.published)
+	}
+}
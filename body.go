@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Only the first 64KB of the body are matched
+const MAX_BODY_SIZE = 64 * 1024
+
+/*
+ * Reads the body of a response, decoding it according to its
+ * Content-Encoding (gzip or deflate)
+ */
+func readBody(resp *http.Response) ([]byte, error) {
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_BODY_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(
+		resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return raw, nil
+	case "gzip", "x-gzip":
+		if r, err = gzip.NewReader(bytes.NewReader(raw)); err != nil {
+			return nil, err
+		}
+	case "deflate":
+		// Should be zlib wrapped, some servers send raw deflate
+		if r, err = zlib.NewReader(bytes.NewReader(raw)); err != nil {
+			r = flate.NewReader(bytes.NewReader(raw))
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported Content-Encoding %q",
+			resp.Header.Get("Content-Encoding"))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, MAX_BODY_SIZE))
+	// The compressed body may have been truncated
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return body, nil
+}
+
+/*
+ * Returns an error if the body of the response doesn't contain the expected
+ * string
+ */
+func matchBody(resp *http.Response, expected string) error {
+	body, err := readBody(resp)
+	if err != nil {
+		return fmt.Errorf("Cannot read the body: %s", err)
+	}
+	if !bytes.Contains(body, []byte(expected)) {
+		return fmt.Errorf("Body doesn't contain %q", expected)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func compress(encoding string, data string) []byte {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+	)
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	w.Write([]byte(data))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestExpectBodyCompressed(t *testing.T) {
+	var acceptEncoding string
+	encoding := ""
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			acceptEncoding = r.Header.Get("Accept-Encoding")
+			if r.Method != "GET" {
+				t.Errorf("Expected a GET probe, got %s", r.Method)
+			}
+			switch encoding {
+			case "":
+				w.Write([]byte("status: OK"))
+			case "raw-deflate":
+				w.Header().Set("Content-Encoding", "deflate")
+				w.Write(compress(encoding, "status: OK"))
+			default:
+				w.Header().Set("Content-Encoding", encoding)
+				w.Write(compress(encoding, "status: OK"))
+			}
+		}))
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	frontendConfigs = map[string]*FrontendConfig{
+		"www.foo.com": {ExpectBody: "status: OK"}}
+	defer func() { frontendConfigs = make(map[string]*FrontendConfig) }()
+	check := &Check{BackendUrl: srv.URL, FrontendKey: "www.foo.com"}
+	for _, encoding = range []string{"", "gzip", "deflate", "raw-deflate"} {
+		if check.checkStatus() == false {
+			t.Errorf("Expected the %q body to match: %s", encoding,
+				check.lastError)
+		}
+	}
+	if acceptEncoding != "gzip, deflate" {
+		t.Errorf("Unexpected Accept-Encoding %q", acceptEncoding)
+	}
+	frontendConfigs["www.foo.com"].IdentityEncoding = true
+	frontendConfigs["www.foo.com"].ExpectBody = "status: KO"
+	encoding = ""
+	if check.checkStatus() == true || check.lastReason != "body mismatch" {
+		t.Errorf("Expected a body mismatch, got %q", check.lastReason)
+	}
+	if acceptEncoding != "identity" {
+		t.Errorf("Expected Accept-Encoding: identity, got %q", acceptEncoding)
+	}
+}
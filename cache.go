@@ -1,9 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"hash/fnv"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,6 +20,46 @@ const (
 	REDIS_PASSWORD     = ""
 	REDIS_IDLE_TIMEOUT = 120
 	REDIS_MAX_IDLE     = 3
+	// A suspect record expires if nobody refreshes it within 30 seconds
+	SUSPECT_TTL = 30
+	// Forget about a backend not checked for a week
+	SEEN_TTL = 604800
+	// Same TTL as the dead sets
+	REASON_TTL = 60
+	// Attempts of the Redis operations the state of the backends depends on
+	REDIS_ATTEMPTS = 3
+	// Takes the lock of a backend (or a redundant slot) and records its
+	// signature and the sync key in one step. Returns the locked field, "" if
+	// the backend is already ours, or nil if someone else checks it.
+	LOCK_SCRIPT = `
+local url, syncKey, sig = ARGV[1], ARGV[2], ARGV[3]
+local field = url
+local locked = redis.call('HSETNX', KEYS[1], url, sig) == 1
+if not locked then
+	if redis.call('HEXISTS', KEYS[1], syncKey) == 1 then
+		return ''
+	end
+	for i = 2, tonumber(ARGV[4]) do
+		field = url .. '#' .. i
+		locked = redis.call('HSETNX', KEYS[1], field, sig) == 1
+		if locked then break end
+	end
+	if not locked then
+		return false
+	end
+end
+redis.call('HSET', KEYS[1], syncKey, 1)
+return field
+`
+	// Removes a lock taken by a goroutine (if it still holds it) and the
+	// sync key taken along with it
+	UNLOCK_SCRIPT = `
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[3] then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+redis.call('HDEL', KEYS[1], ARGV[2])
+return 1
+`
 )
 
 var (
@@ -21,17 +68,56 @@ var (
 	redisSuffix      string
 	redisMaxIdle     int
 	redisIdleTimeout int
+	aliveChannel     string
+	// Ramp-up period of the resurrected backends (see -slow_start)
+	slowStart time.Duration
+	// Optional Redis for hchecker's own data
+	metaRedisAddress  string
+	metaRedisPassword string
+	// Protects the address and password of Hipache's Redis, which can be
+	// changed at runtime
+	redisLock sync.Mutex
+	// Bumped when the address or the password of Redis changes, to drop the
+	// old connections
+	redisGeneration int32
+	lockScript      = redis.NewScript(1, LOCK_SCRIPT)
+	unlockScript    = redis.NewScript(1, UNLOCK_SCRIPT)
+	// Delay before the first retry of a failed Redis operation, doubled
+	// after each attempt
+	redisRetryDelay = 100 * time.Millisecond
 )
 
 type Cache struct {
-	pool     *redis.Pool
-	redisKey string
-	// Maintain a mapping between a backends and several frontend
-	// -> map[BACKEND_URL][FRONTEND_NAME] = BACKEND_ID
-	backendsMapping map[string]map[string]int
-	// Channel used to notify goroutine when a frontend has been added to the
-	// backendsMapping
-	channelMapping map[string]chan int
+	// Hipache's Redis: notifications, frontends and dead sets
+	pool *redis.Pool
+	// Redis holding hchecker's own data (locks, heartbeats...), same as pool
+	// unless -meta_redis is set
+	metaPool *redis.Pool
+	// Independent Redis nodes holding the locks with -lock_strategy=redlock
+	redlockPools []*redis.Pool
+	redisKey     string
+	// Maintain a mapping between a backends and several frontend, and the
+	// channels notifying the check loops
+	mapping *backendMapping
+	// Pubsub stats per channel
+	statsLock       sync.Mutex
+	channelMessages map[string]int64
+	channelErrors   map[string]int64
+	// Connections of the subscriptions, closed when Redis changes
+	subscribers map[redis.Conn]*subscription
+	// Closed by Close, the subscriptions and the background tasks stop
+	closing   chan struct{}
+	closeOnce sync.Once
+	// Goroutines of the subscriptions and of the consumers of the dead
+	// notifications, which run the callbacks
+	listeners sync.WaitGroup
+}
+
+type subscription struct {
+	channel string
+	psc     redis.PubSubConn
+	// Last message or pong received (unix nanoseconds)
+	lastSeen int64
 }
 
 func NewCache() (*Cache, error) {
@@ -43,35 +129,399 @@ func NewCache() (*Cache, error) {
 	}
 	cache := &Cache{
 		redisKey:        redisKey,
-		backendsMapping: make(map[string]map[string]int),
-		channelMapping:  make(map[string]chan int),
+		mapping:         newBackendMapping(),
+		channelMessages: make(map[string]int64),
+		channelErrors:   make(map[string]int64),
+		subscribers:     make(map[redis.Conn]*subscription),
+		closing:         make(chan struct{}),
+	}
+	cache.pool = newPool(cache.getConn)
+	if metaRedisAddress != "" {
+		cache.metaPool = newPool(cache.getMetaConn)
+	} else {
+		cache.metaPool = cache.pool
+	}
+	if lockStrategy == LOCK_REDLOCK {
+		cache.redlockPools = newRedlockPools()
+	}
+	return cache, nil
+}
+
+/*
+ * We're starting, let's clear the meta-data left by the previous processes
+ * of this machine. The instances of the other machines are left alone.
+ * WARNING: This can be a problem if there are several processes sharing
+ * the same redis on the same machine - without specifying redis_suffix option.
+ * If one of them is restarted, it'll clear the meta-data of the others...
+ */
+func (c *Cache) ClearMetadata() {
+	hostPrefix := myId[:strings.LastIndex(myId, "#")+1]
+	_, err := c.PurgeInstances(func(instance string) bool {
+		return strings.HasPrefix(instance, hostPrefix) && instance != myId
+	}, false)
+	if err != nil {
+		log.Println("Cannot clear the previous meta-data:", err.Error())
+	}
+}
+
+/*
+ * Returns the keys matching a pattern
+ */
+func scanKeys(conn redis.Conn, pattern string) ([]string, error) {
+	var (
+		keys   []string
+		cursor = 0
+	)
+	for {
+		resp, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern,
+			"COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		var page []string
+		if _, err := redis.Scan(resp, &cursor, &page); err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+/*
+ * Removes all the keys owned by hchecker. Returns what has been (or would
+ * be, in dry run) removed.
+ */
+func (c *Cache) PurgeAll(dryRun bool) ([]string, error) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	keys, err := scanKeys(conn, c.metaKey("*"))
+	if err != nil {
+		return nil, err
+	}
+	if len(c.redlockPools) == 0 {
+		keys = append(keys, c.redisKey)
+	}
+	if redisSuffix == "" {
+		// Heartbeat shared by all the instances of the older versions
+		keys = append(keys, "hchecker_ping")
+	}
+	var removed []string
+	for _, key := range keys {
+		n, err := redis.Int(conn.Do("EXISTS", key))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			continue
+		}
+		removed = append(removed, "key "+key)
+		if dryRun == false {
+			if _, err := conn.Do("DEL", key); err != nil {
+				return removed, err
+			}
+		}
+	}
+	for _, pool := range c.redlockPools {
+		lockConn := pool.Get()
+		n, err := redis.Int(lockConn.Do("EXISTS", c.redisKey))
+		if err == nil && n > 0 && dryRun == false {
+			_, err = lockConn.Do("DEL", c.redisKey)
+		}
+		lockConn.Close()
+		if err != nil {
+			return removed, err
+		}
+		if n > 0 {
+			removed = append(removed, "key "+c.redisKey+" of a Redlock node")
+		}
+	}
+	return removed, nil
+}
+
+/*
+ * Removes the locks, sync keys, state snapshots, heartbeats and check
+ * results of the instances matching. Returns what has been (or would be, in dry run)
+ * removed.
+ */
+func (c *Cache) PurgeInstances(match func(instance string) bool,
+	dryRun bool) ([]string, error) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	var removed []string
+	del := func(desc string, args ...interface{}) error {
+		removed = append(removed, desc)
+		if dryRun == true {
+			return nil
+		}
+		_, err := conn.Do(args[0].(string), args[1:]...)
+		return err
+	}
+	for _, pool := range c.lockNodes() {
+		lockConn := pool.Get()
+		err := c.purgeLocks(lockConn, match, dryRun, &removed)
+		lockConn.Close()
+		if err != nil {
+			return removed, err
+		}
+	}
+	for _, prefix := range []string{c.metaKey("state:"), c.heartbeatKey("")} {
+		keys, err := scanKeys(conn, prefix+"*")
+		if err != nil {
+			return removed, err
+		}
+		for _, key := range keys {
+			if !match(strings.TrimPrefix(key, prefix)) {
+				continue
+			}
+			if err := del("key "+key, "DEL", key); err != nil {
+				return removed, err
+			}
+		}
+	}
+	instances, err := redis.Strings(conn.Do("HKEYS", c.metaKey("heartbeats")))
+	if err != nil {
+		return removed, err
 	}
-	cache.pool = &redis.Pool{
+	for _, instance := range instances {
+		if !match(instance) {
+			continue
+		}
+		err := del(fmt.Sprintf("field %s of %s", instance,
+			c.metaKey("heartbeats")), "HDEL", c.metaKey("heartbeats"), instance)
+		if err != nil {
+			return removed, err
+		}
+	}
+	results, err := scanKeys(conn, c.metaKey("results:*"))
+	if err != nil {
+		return removed, err
+	}
+	for _, key := range results {
+		instances, err := redis.Strings(conn.Do("HKEYS", key))
+		if err != nil {
+			return removed, err
+		}
+		for _, instance := range instances {
+			if !match(instance) {
+				continue
+			}
+			err := del(fmt.Sprintf("field %s of %s", instance, key),
+				"HDEL", key, instance)
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+/*
+ * Removes the locks and sync keys of the instances matching
+ */
+func (c *Cache) purgeLocks(conn redis.Conn, match func(instance string) bool,
+	dryRun bool, removed *[]string) error {
+	// Locks hold the goroutine signature "instance;timestamp", sync keys
+	// are "backend_url;instance"
+	locks, err := redis.StringMap(conn.Do("HGETALL", c.redisKey))
+	if err != nil {
+		return err
+	}
+	for field, value := range locks {
+		instance := ""
+		if i := strings.LastIndex(value, ";"); i >= 0 {
+			instance = value[:i]
+		} else if i := strings.LastIndex(field, ";"); i >= 0 {
+			instance = field[i+1:]
+		}
+		if instance == "" || !match(instance) {
+			continue
+		}
+		*removed = append(*removed, fmt.Sprintf("field %s of %s", field,
+			c.redisKey))
+		if dryRun == true {
+			continue
+		}
+		if _, err := conn.Do("HDEL", c.redisKey, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Runs a Redis operation, up to REDIS_ATTEMPTS times while it fails. The
+ * operation must take a new connection each time, a failed one may be
+ * broken. The failed attempts are counted in the redis_errors metric.
+ */
+func retryRedis(operation string, f func() error) error {
+	delay := redisRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := errChaos
+		if !injectFault(CHAOS_REDIS_DROP) {
+			err = f()
+		}
+		if err == nil {
+			return nil
+		}
+		redisErrorsMetric.Add(operation, 1)
+		if attempt == REDIS_ATTEMPTS {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+/*
+ * Returns the name of a key (or channel) owned by hchecker
+ */
+func (c *Cache) metaKey(name string) string {
+	return c.redisKey + ":" + name
+}
+
+/*
+ * Connection tagged with the generation of the Redis address it was opened
+ * with
+ */
+type generationConn struct {
+	redis.Conn
+	generation int32
+}
+
+func newPool(dial func() (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
 		MaxIdle:     redisMaxIdle,
 		IdleTimeout: time.Duration(redisIdleTimeout) * time.Second,
-		Dial:        cache.getConn,
+		Dial: func() (redis.Conn, error) {
+			generation := atomic.LoadInt32(&redisGeneration)
+			conn, err := dial()
+			if err != nil {
+				return nil, err
+			}
+			return &generationConn{conn, generation}, nil
+		},
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if gc, ok := c.(*generationConn); ok &&
+				gc.generation != atomic.LoadInt32(&redisGeneration) {
+				return errors.New("Redis address changed")
+			}
 			_, err := c.Do("PING")
 			return err
 		},
 	}
-	// We're starting, let's clear any previous meta-data
-	// WARNING: This can be a problem if there are several processes sharing
-	// the same redis on the same machine - without specifying redis_suffix option.
-	// If one of them is restarted, it'll clear the meta-data of everyone...
-	conn := cache.pool.Get()
-	defer conn.Close()
-	conn.Send("DEL", cache.redisKey)
-	return cache, nil
 }
 
 func (c *Cache) getConn() (redis.Conn, error) {
-	conn, err := redis.Dial("tcp", redisAddress)
+	redisLock.Lock()
+	address, password := redisAddress, redisPassword
+	redisLock.Unlock()
+	return dialRedis(address, getSecret(password, redisPasswordFile))
+}
+
+/*
+ * Switches to another Hipache's Redis without restarting: the new
+ * connections go to the new address, the idle ones are dropped and the
+ * subscriptions are re-established
+ */
+func (c *Cache) SetRedis(address string, password string) error {
+	conn, err := dialRedis(address, getSecret(password, redisPasswordFile))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("PING")
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	redisLock.Lock()
+	redisAddress, redisPassword = address, password
+	redisLock.Unlock()
+	c.Redial()
+	log.Println("Now using Redis on", address)
+	return nil
+}
+
+/*
+ * Stops the subscriptions, the consumers of the dead notifications and the
+ * background tasks using the cache. The pools stay usable, e.g. to hand off
+ * the backends.
+ */
+func (c *Cache) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.statsLock.Lock()
+		for subscriber := range c.subscribers {
+			subscriber.Close()
+		}
+		c.statsLock.Unlock()
+	})
+}
+
+/*
+ * Waits for the subscriptions and the consumers of the dead notifications
+ * to return once the cache is closed: no callback runs afterwards
+ */
+func (c *Cache) WaitListeners() {
+	c.listeners.Wait()
+}
+
+func (c *Cache) isClosed() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+ * Waits for a duration, returns false if the cache is closed meanwhile
+ */
+func (c *Cache) wait(d time.Duration) bool {
+	select {
+	case <-c.closing:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+/*
+ * Drops the idle connections to Redis and re-establishes the subscriptions,
+ * the new connections are opened with the current address and password
+ */
+func (c *Cache) Redial() {
+	atomic.AddInt32(&redisGeneration, 1)
+	c.statsLock.Lock()
+	for subscriber := range c.subscribers {
+		subscriber.Close()
+	}
+	c.statsLock.Unlock()
+}
+
+func getRedisAddress() string {
+	redisLock.Lock()
+	defer redisLock.Unlock()
+	return redisAddress
+}
+
+func (c *Cache) getMetaConn() (redis.Conn, error) {
+	if metaRedisAddress == "" {
+		return c.getConn()
+	}
+	return dialRedis(metaRedisAddress,
+		getSecret(metaRedisPassword, metaRedisPasswordFile))
+}
+
+func dialRedis(address string, password string) (redis.Conn, error) {
+	conn, err := redis.Dial("tcp", address, redisTLSOptions()...)
 	if err != nil {
 		return nil, err
 	}
-	if redisPassword != "" {
-		if _, err := conn.Do("AUTH", redisPassword); err != nil {
+	if password != "" {
+		if _, err := conn.Do("AUTH", password); err != nil {
 			conn.Close()
 			return nil, err
 		}
@@ -83,203 +533,1065 @@ func (c *Cache) getConn() (redis.Conn, error) {
  * Maintain a mapping between Frontends and Backends ID
  */
 func (c *Cache) updateFrontendMapping(check *Check) {
-	m, exists := c.backendsMapping[check.BackendUrl]
-	if !exists {
-		m = make(map[string]int)
-	}
-	m[check.FrontendKey] = check.BackendId
-	c.backendsMapping[check.BackendUrl] = m
-	// Notify the goroutine that we added a frontend
-	ch, exists := c.channelMapping[check.BackendUrl]
-	if exists {
-		// Non-blocking send
-		select {
-		case ch <- 1:
-		default:
-		}
-	}
+	// Notifies the goroutine that we added a frontend
+	c.mapping.Add(check.BackendUrl, check.FrontendKey, check.BackendId)
 }
 
 /*
  * Lock a backend in Redis by its URL
  */
-func (c *Cache) LockBackend(check *Check) (bool, chan int) {
+func (c *Cache) LockBackend(check *Check) (bool, *backendController) {
 	// The syncKey makes sure an entire backend mapping is keep in the same
 	// process (we never update a backend mapping from 2 different processes)
 	syncKey := check.BackendUrl + ";" + myId
-	// Lock the backend with a temporary value, we'll update this with the
-	// goroutine signature later
-	var locked bool
-	var isMine bool
-	conn := c.pool.Get()
-	defer conn.Close()
-	conn.Send("MULTI")
-	conn.Send("HSETNX", c.redisKey, check.BackendUrl, 1)
-	conn.Send("HEXISTS", c.redisKey, syncKey)
-	resp, _ := redis.Values(conn.Do("EXEC"))
-	redis.Scan(resp, &locked, &isMine)
-	if locked == false && isMine == false {
+	// Create a unique sig for the goroutine, the nanoseconds garanty that no
+	// routine will get the same sig
+	t := time.Now()
+	sig := fmt.Sprintf("%s;%d.%d", myId, t.Unix(), t.Nanosecond())
+	var lockField string
+	var err error
+	locksMetric.Add("attempts", 1)
+	if len(c.redlockPools) > 0 {
+		lockField, err = c.redlock(check.BackendUrl, syncKey, sig)
+	} else {
+		conn := c.metaPool.Get()
+		lockField, err = redis.String(lockScript.Do(conn, c.redisKey,
+			check.BackendUrl, syncKey, sig, redundancy))
+		conn.Close()
+	}
+	if err == redis.ErrNil {
 		// The backend is being monitored by someone else
+		locksMetric.Add("contended", 1)
+		return false, nil
+	} else if err != nil {
+		logError(check.BackendUrl, "Cannot lock:", err.Error())
+		locksMetric.Add("errors", 1)
 		return false, nil
 	}
-	if locked == false {
+	if lockField == "" {
+		// Already checked by this process, a new frontend uses it
+		locksMetric.Add("joined", 1)
 		c.updateFrontendMapping(check)
 		return false, nil
 	}
-	// we got the lock, let's create a unique sig for the goroutine
-	t := time.Now()
-	// This one is done in the lock, this will garanty that no routine
-	// will get the same sig
-	sig := fmt.Sprintf("%s;%d.%d", myId, t.Unix(), t.Nanosecond())
-	conn.Send("HSET", c.redisKey, check.BackendUrl, sig)
-	conn.Send("HSET", c.redisKey, syncKey, 1)
-	conn.Flush()
+	locksMetric.Add("acquired", 1)
 	check.routineSig = sig
-	// Create the channel
-	ch := make(chan int, 1)
-	c.channelMapping[check.BackendUrl] = ch
+	check.lockField = lockField
+	ctl := c.mapping.Watch(check.BackendUrl)
 	c.updateFrontendMapping(check)
-	return true, ch
+	return true, ctl
 }
 
 func (c *Cache) IsUnlockedBackend(check *Check) bool {
 	// On top of checking the lock, we compare the lock content to make sure
 	// we still own the lock
-	conn := c.pool.Get()
-	defer conn.Close()
-	conn.Send("HGET", c.redisKey, check.BackendUrl)
-	conn.Flush()
-	resp, _ := redis.String(conn.Receive())
+	if len(c.redlockPools) > 0 {
+		return !c.redlockHeld(check)
+	}
+	if lockEvents == true {
+		// Pushed by the lock watcher, see CheckLocks
+		return atomic.LoadInt32(&check.lockLost) == 1
+	}
+	var resp string
+	err := retryRedis("lock_check", func() error {
+		conn := c.metaPool.Get()
+		defer conn.Close()
+		var err error
+		resp, err = redis.String(conn.Do("HGET", c.redisKey, check.lockField))
+		if err == redis.ErrNil {
+			// Nobody holds the lock
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		// Redis failed, it doesn't mean we lost the lock
+		logError(check.BackendUrl, "Cannot check the lock:", err.Error())
+		return false
+	}
 	return (resp != check.routineSig)
 }
 
 func (c *Cache) UnlockBackend(check *Check) {
-	conn := c.pool.Get()
+	// Forget the backend before another loop can take the lock, it must not
+	// get our stopped controller
+	c.mapping.Remove(check.BackendUrl)
+	c.ReleaseLock(check)
+	conn := c.metaPool.Get()
 	defer conn.Close()
-	conn.Send("HDEL", c.redisKey, check.BackendUrl, check.BackendUrl+";"+myId)
+	if redundancy > 1 {
+		conn.Send("HDEL", c.metaKey("results:"+check.BackendUrl), myId)
+	}
 	conn.Flush()
-	delete(c.backendsMapping, check.BackendUrl)
-	delete(c.channelMapping, check.BackendUrl)
+}
+
+/*
+ * Removes the lock of a check, unless someone else took it meanwhile, and
+ * the sync key
+ */
+func (c *Cache) ReleaseLock(check *Check) {
+	for _, pool := range c.lockNodes() {
+		err := retryRedis("unlock", func() error {
+			conn := pool.Get()
+			defer conn.Close()
+			_, err := unlockScript.Do(conn, c.redisKey, check.lockField,
+				check.BackendUrl+";"+myId, check.routineSig)
+			return err
+		})
+		if err != nil {
+			// The lock will be taken over once the check is stale
+			logError(check.BackendUrl, "Cannot release the lock:", err.Error())
+		}
+	}
+}
+
+/*
+ * Removes the locks (all the slots) and the sync keys of a backend,
+ * whatever the instance owning them. Returns the removed fields.
+ */
+func (c *Cache) ForceUnlock(backendUrl string) ([]string, error) {
+	var removed []string
+	seen := make(map[string]bool)
+	for _, pool := range c.lockNodes() {
+		conn := pool.Get()
+		fields, err := c.forceUnlock(conn, backendUrl)
+		conn.Close()
+		if err != nil {
+			return removed, err
+		}
+		for _, field := range fields {
+			if seen[field] == false {
+				seen[field] = true
+				removed = append(removed, field)
+			}
+		}
+	}
+	return removed, nil
+}
+
+func (c *Cache) forceUnlock(conn redis.Conn, backendUrl string) ([]string, error) {
+	fields, err := redis.Strings(conn.Do("HKEYS", c.redisKey))
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, field := range fields {
+		if field == backendUrl ||
+			strings.HasPrefix(field, backendUrl+"#") ||
+			strings.HasPrefix(field, backendUrl+";") {
+			removed = append(removed, field)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	args := redis.Args{}.Add(c.redisKey).AddFlat(removed)
+	if _, err := conn.Do("HDEL", args...); err != nil {
+		return nil, err
+	}
+	return removed, nil
 }
 
 /*
  * Before changing the state (dead or alive) in the Redis, we make sure
  * the backend is still both in memory and in Redis so we'll avoid wrong
- * updates.
+ * updates. Returns an error when Redis cannot tell, the mapping is left
+ * as is.
  */
 func (c *Cache) checkBackendMapping(check *Check, frontendKey string,
-	backendId int, mapping *map[string]int) bool {
+	backendId int, mapping *map[string]int) (bool, error) {
+	var backends []string
+	err := retryRedis("mapping_check", func() error {
+		conn := c.pool.Get()
+		defer conn.Close()
+		resp, err := redis.String(conn.Do("LINDEX", "frontend:"+frontendKey,
+			backendId+1))
+		if err == nil && resp == check.BackendUrl {
+			backends = nil
+			return nil
+		} else if err != nil && err != redis.ErrNil {
+			return err
+		}
+		// The list may have been rewritten with the backends in another
+		// order, look for the new id of the backend
+		backends, err = redis.Strings(conn.Do("LRANGE",
+			"frontend:"+frontendKey, 1, -1))
+		if backends == nil {
+			// Removed, not the same as the backend in place
+			backends = []string{}
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if backends == nil {
+		return true, nil
+	}
+	for i, backend := range backends {
+		if u, _ := parseBackendUrl(backend); u != check.BackendUrl {
+			continue
+		}
+		log.Printf("%s Backend id changed for %s: %d -> %d",
+			check.BackendUrl, frontendKey, backendId, i)
+		if backendIdScheme == BACKEND_ID_INDEX {
+			// Identified by its URL, the backend keeps its mark
+			c.removeDeadMark(check, frontendKey, backendId)
+		}
+		(*mapping)[frontendKey] = i
+		c.mapping.SetId(check.BackendUrl, frontendKey, i)
+		return true, nil
+	}
+	log.Println(check.BackendUrl, "Mapping changed for", frontendKey)
+	c.removeDeadMark(check, frontendKey, backendId)
+	delete(*mapping, frontendKey)
+	c.mapping.RemoveFrontend(check.BackendUrl, frontendKey)
+	return false, nil
+}
+
+/*
+ * The backend id of a frontend now maps to another backend (or to nothing),
+ * removes it from the dead set if we put it there. Otherwise the new backend
+ * reusing the id would stay dead. A dead reason saved by another backend
+ * means the new one has been flagged dead meanwhile, the mark is kept.
+ */
+func (c *Cache) removeDeadMark(check *Check, frontendKey string, backendId int) {
+	member := deadMember(check.BackendUrl, backendId)
+	if marked, exists := check.markedDead[frontendKey]; !exists ||
+		marked != member {
+		return
+	}
+	delete(check.markedDead, frontendKey)
+	reasonKey := c.metaKey("reason:" + frontendKey + ":" + member)
+	metaConn := c.metaPool.Get()
+	defer metaConn.Close()
+	owner, err := redis.String(metaConn.Do("HGET", reasonKey, "backend_url"))
+	if err != nil && err != redis.ErrNil {
+		logError(check.BackendUrl, "Cannot read the dead reason:", err.Error())
+		return
+	} else if err == nil && owner != check.BackendUrl {
+		return
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SREM", "dead:"+frontendKey, member); err != nil {
+		logError(check.BackendUrl, "Cannot remove the dead mark of",
+			frontendKey+":", err.Error())
+		return
+	}
+	metaConn.Do("DEL", reasonKey)
+	log.Printf("%s Removed our dead mark %s of %s", check.BackendUrl,
+		member, frontendKey)
+	staleDeadMarksMetric.Add(1)
+}
+
+/*
+ * Drops the frontends of a backend which have been removed from Redis
+ * (Hipache deleted the frontend:<key> list). Returns the number of
+ * frontends left.
+ */
+func (c *Cache) PruneDeletedFrontends(check *Check) int {
+	m := c.mapping.Frontends(check.BackendUrl)
+	var frontendKeys []string
 	conn := c.pool.Get()
 	defer conn.Close()
-	conn.Send("LINDEX", "frontend:"+frontendKey, backendId+1)
+	for frontendKey := range m {
+		frontendKeys = append(frontendKeys, frontendKey)
+		conn.Send("EXISTS", "frontend:"+frontendKey)
+	}
 	conn.Flush()
-	resp, _ := redis.String(conn.Receive())
-	if resp == check.BackendUrl {
-		return true
+	for _, frontendKey := range frontendKeys {
+		n, err := redis.Int(conn.Receive())
+		if err != nil {
+			// Keep probing, Redis may only be unavailable for a while
+			return len(m)
+		}
+		if n == 0 {
+			log.Println(check.BackendUrl, "Frontend", frontendKey,
+				"has been removed")
+			delete(m, frontendKey)
+			c.mapping.RemoveFrontend(check.BackendUrl, frontendKey)
+		}
 	}
-	log.Println(check.BackendUrl, "Mapping changed for", frontendKey)
-	delete(*mapping, frontendKey)
-	return false
+	return len(m)
 }
 
 /*
- * Flag the backend dead in Redis
- * Returns false if no update has been performed (backend unlock)
+ * Re-reads a frontend list after a change, and updates the mapping of the
+ * backends we check: new frontends, new ids or removed frontends
  */
-func (c *Cache) MarkBackendDead(check *Check) bool {
+func (c *Cache) RefreshFrontend(frontendKey string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	backends, err := redis.Strings(conn.Do("LRANGE", "frontend:"+frontendKey,
+		1, -1))
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]int)
+	for i, backend := range backends {
+		backendUrl, err := parseBackendUrl(backend)
+		if err != nil {
+			continue
+		}
+		if _, exists := ids[backendUrl]; !exists {
+			ids[backendUrl] = i
+		}
+	}
+	for backendUrl, m := range c.mapping.All() {
+		id, listed := ids[backendUrl]
+		oldId, mapped := m[frontendKey]
+		if listed == true && (mapped == false || oldId != id) {
+			log.Printf("%s Backend id for %s is now %d", backendUrl,
+				frontendKey, id)
+			c.updateFrontendMapping(NewBackendCheck(frontendKey,
+				backendUrl, id, len(backends)))
+		} else if listed == false && mapped == true {
+			log.Println(backendUrl, "Removed from", frontendKey)
+			c.mapping.RemoveFrontend(backendUrl, frontendKey)
+		}
+	}
+	return nil
+}
+
+/*
+ * Makes sure Redis publishes the keyspace notifications of the list
+ * commands and the generic ones (DEL, RENAME...), keeping the other
+ * notifications already enabled
+ */
+func (c *Cache) EnableKeyspaceEvents() error {
 	conn := c.pool.Get()
 	defer conn.Close()
-	m, exists := c.backendsMapping[check.BackendUrl]
-	if !exists {
+	values, err := redis.Strings(conn.Do("CONFIG", "GET",
+		"notify-keyspace-events"))
+	if err != nil {
+		return err
+	}
+	current := ""
+	if len(values) == 2 {
+		current = values[1]
+	}
+	flags := mergeKeyspaceFlags(current, "Klg")
+	if flags == current {
+		return nil
+	}
+	_, err = conn.Do("CONFIG", "SET", "notify-keyspace-events", flags)
+	return err
+}
+
+/*
+ * Adds the missing event classes to the notify-keyspace-events flags
+ */
+func mergeKeyspaceFlags(flags string, classes string) string {
+	for _, flag := range classes {
+		if strings.ContainsRune(flags, flag) {
+			continue
+		}
+		// "A" is an alias for all the event classes
+		if flag != 'K' && strings.ContainsRune(flags, 'A') {
+			continue
+		}
+		flags += string(flag)
+	}
+	return flags
+}
+
+/*
+ * Runs commands in a MULTI block, again while it fails (see retryRedis).
+ * Returns the replies of the commands.
+ */
+func execRedis(pool *redis.Pool, operation string,
+	commands [][]interface{}) ([]interface{}, error) {
+	if len(commands) == 0 {
+		return nil, nil
+	}
+	var replies []interface{}
+	err := retryRedis(operation, func() error {
+		conn := pool.Get()
+		defer conn.Close()
+		conn.Send("MULTI")
+		for _, command := range commands {
+			conn.Send(command[0].(string), command[1:]...)
+		}
+		var err error
+		replies, err = redis.Values(conn.Do("EXEC"))
+		return err
+	})
+	return replies, err
+}
+
+/*
+ * Flag the backend dead in Redis
+ * Returns false if no update has been performed (backend unlock). When Redis
+ * fails, the check loop is notified to write the state again at the next
+ * cycle.
+ */
+func (c *Cache) MarkBackendDead(check *Check) bool {
+	m := c.mapping.Frontends(check.BackendUrl)
+	if m == nil {
 		c.UnlockBackend(check)
 		return false
 	}
-	conn.Send("MULTI")
+	var (
+		frontends []string
+		commands  [][]interface{}
+		failed    = false
+	)
 	for frontendKey, id := range m {
-		if r := c.checkBackendMapping(check, frontendKey, id, &m); r == false {
+		r, err := c.checkBackendMapping(check, frontendKey, id, &m)
+		if err != nil {
+			logError(check.BackendUrl, "Cannot check the mapping of",
+				frontendKey+":", err.Error())
+			failed = true
+			continue
+		} else if r == false {
+			continue
+		}
+		if isLogOnly(frontendKey) == true {
+			log.Println(check.BackendUrl, "Would flag dead on", frontendKey,
+				"(log only)")
+			logOnlyMetric.Add("dead", 1)
 			continue
 		}
 		deadKey := "dead:" + frontendKey
-		conn.Send("SADD", deadKey, id)
 		// Better way would be to set the same TTL than Hipache. Not
 		// critical since we'll clean the backend list
-		conn.Send("EXPIRE", deadKey, 60)
+		commands = append(commands, []interface{}{"SADD", deadKey,
+			deadMember(check.BackendUrl, m[frontendKey])},
+			[]interface{}{"EXPIRE", deadKey, 60})
+		frontends = append(frontends, frontendKey)
 	}
-	conn.Do("EXEC")
 	if len(m) == 0 {
 		// checkBackenMapping() removed all frontend mapping, no need to check
 		// this backend anymore...
 		c.UnlockBackend(check)
 		return false
 	}
+	if _, err := execRedis(c.pool, "mark_dead", commands); err != nil {
+		logError(check.BackendUrl, "Cannot flag dead:", err.Error())
+		failed = true
+	} else if len(frontends) > 0 {
+		if check.markedDead == nil {
+			check.markedDead = make(map[string]string)
+		}
+		// Not on the log-only frontends, Hipache doesn't see them dead
+		marked := make(map[string]int)
+		for _, frontendKey := range frontends {
+			check.markedDead[frontendKey] = deadMember(check.BackendUrl,
+				m[frontendKey])
+			marked[frontendKey] = m[frontendKey]
+		}
+		c.saveDeadReason(check, marked)
+	}
+	if failed == true {
+		c.mapping.Notify(check.BackendUrl)
+	}
 	return true
 }
 
 /*
- * Flag the backend live in Redis
- * Returns false if no update has been performed (backend unlock)
+ * Removes the members of the dead sets which are not a backend id of their
+ * frontend anymore (the frontend list has been edited or removed). Returns
+ * what has been (or would be, in dry run) removed.
  */
-func (c *Cache) MarkBackendAlive(check *Check) bool {
+func (c *Cache) CleanDeadSets(dryRun bool) ([]string, error) {
 	conn := c.pool.Get()
 	defer conn.Close()
-	m, exists := c.backendsMapping[check.BackendUrl]
-	if !exists {
+	keys, err := scanKeys(conn, "dead:*")
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, deadKey := range keys {
+		frontendKey := strings.TrimPrefix(deadKey, "dead:")
+		if isFrontendIncluded(frontendKey) == false {
+			// Left to the instances checking it
+			continue
+		}
+		// The first element of the list is the frontend name
+		backends, err := redis.Strings(conn.Do("LRANGE",
+			"frontend:"+frontendKey, 1, -1))
+		if err != nil {
+			return removed, err
+		}
+		members := make(map[string]bool)
+		for i, backend := range backends {
+			if u, err := parseBackendUrl(backend); err == nil {
+				backend = u
+			}
+			members[deadMember(backend, i)] = true
+		}
+		ids, err := redis.Strings(conn.Do("SMEMBERS", deadKey))
+		if err != nil {
+			return removed, err
+		}
+		for _, id := range ids {
+			if members[id] == true {
+				continue
+			}
+			removed = append(removed, fmt.Sprintf("%s of %s", id, deadKey))
+			if dryRun == true {
+				continue
+			}
+			if _, err := conn.Do("SREM", deadKey, id); err != nil {
+				return removed, err
+			}
+			metaConn := c.metaPool.Get()
+			metaConn.Do("DEL", c.metaKey("reason:"+frontendKey+":"+id))
+			metaConn.Close()
+		}
+	}
+	return removed, nil
+}
+
+/*
+ * Tell why the backend has been flagged dead, for each frontend
+ */
+func (c *Cache) saveDeadReason(check *Check, mapping map[string]int) {
+	reason, lastError, code := check.lastResult()
+	if reason == "" {
+		return
+	}
+	var commands [][]interface{}
+	for frontendKey, id := range mapping {
+		key := c.metaKey("reason:" + frontendKey + ":" +
+			deadMember(check.BackendUrl, id))
+		commands = append(commands, []interface{}{"HMSET", key,
+			"reason", reason, "code", code, "error", lastError,
+			"backend_url", check.BackendUrl, "instance", myId,
+			"time", time.Now().Unix()},
+			[]interface{}{"EXPIRE", key, REASON_TTL})
+	}
+	if _, err := execRedis(c.metaPool, "dead_reason", commands); err != nil {
+		logError(check.BackendUrl, "Cannot save the dead reason:", err.Error())
+	}
+}
+
+func (c *Cache) clearDeadReason(check *Check, mapping map[string]int) {
+	var commands [][]interface{}
+	for frontendKey, id := range mapping {
+		commands = append(commands, []interface{}{"DEL",
+			c.metaKey("reason:" + frontendKey + ":" +
+				deadMember(check.BackendUrl, id))})
+	}
+	if _, err := execRedis(c.metaPool, "dead_reason", commands); err != nil {
+		logError(check.BackendUrl, "Cannot clear the dead reason:", err.Error())
+	}
+}
+
+/*
+ * Flag the backend live in Redis
+ * Returns false if no update has been performed (backend unlock). When Redis
+ * fails, the check loop is notified to write the state again at the next
+ * cycle.
+ */
+func (c *Cache) MarkBackendAlive(check *Check) bool {
+	m := c.mapping.Frontends(check.BackendUrl)
+	if m == nil {
 		c.UnlockBackend(check)
 		return false
 	}
-	conn.Send("MULTI")
+	var (
+		frontends []string
+		commands  [][]interface{}
+		failed    = false
+	)
 	for frontendKey, id := range m {
-		if r := c.checkBackendMapping(check, frontendKey, id, &m); r == false {
+		r, err := c.checkBackendMapping(check, frontendKey, id, &m)
+		if err != nil {
+			logError(check.BackendUrl, "Cannot check the mapping of",
+				frontendKey+":", err.Error())
+			failed = true
+			continue
+		} else if r == false {
+			continue
+		}
+		if isLogOnly(frontendKey) == true {
+			log.Println(check.BackendUrl, "Would flag alive on", frontendKey,
+				"(log only)")
+			logOnlyMetric.Add("alive", 1)
 			continue
 		}
-		conn.Send("SREM", "dead:"+frontendKey, id)
+		commands = append(commands, []interface{}{"SREM", "dead:" + frontendKey,
+			deadMember(check.BackendUrl, m[frontendKey])})
+		frontends = append(frontends, frontendKey)
 	}
-	conn.Do("EXEC")
 	if len(m) == 0 {
 		c.UnlockBackend(check)
 		return false
 	}
+	replies, err := execRedis(c.pool, "mark_alive", commands)
+	if err != nil {
+		logError(check.BackendUrl, "Cannot flag alive:", err.Error())
+		failed = true
+	} else {
+		for _, frontendKey := range frontends {
+			delete(check.markedDead, frontendKey)
+		}
+	}
+	if failed == true {
+		c.mapping.Notify(check.BackendUrl)
+	}
+	c.clearDeadReason(check, m)
+	removed, _ := redis.Ints(replies, nil)
+	if slowStart > 0 && len(removed) > 0 {
+		c.startSlowStart(check, frontends, removed, m)
+	}
+	if aliveChannel != "" && len(removed) > 0 {
+		// Tell Hipache the backend has been resurrected, using the same
+		// format as the dead notifications
+		conn := c.pool.Get()
+		defer conn.Close()
+		for i, frontendKey := range frontends {
+			if i >= len(removed) || removed[i] == 0 {
+				continue
+			}
+			conn.Send("PUBLISH", aliveChannel, fmt.Sprintf("%s;%s;%d",
+				frontendKey, check.BackendUrl, m[frontendKey]))
+		}
+		conn.Flush()
+	}
 	return true
 }
 
-func (c *Cache) ListenToChannel(channel string, callback func(line string)) error {
+/*
+ * Writes the hchecker:slowstart:<frontend>:<id> keys of a resurrected
+ * backend, holding when it was flagged alive and expiring after -slow_start.
+ * The Hipache forks with weighted routing ramp its traffic up meanwhile.
+ */
+func (c *Cache) startSlowStart(check *Check, frontends []string,
+	removed []int, mapping map[string]int) {
+	var commands [][]interface{}
+	for i, frontendKey := range frontends {
+		if i >= len(removed) || removed[i] == 0 {
+			continue
+		}
+		// Read by Hipache, the same whatever the -redis_suffix
+		commands = append(commands, []interface{}{"SET",
+			REDIS_PREFFIX + ":slowstart:" + frontendKey + ":" +
+				deadMember(check.BackendUrl, mapping[frontendKey]),
+			time.Now().Unix(), "EX", int(slowStart / time.Second)})
+	}
+	if _, err := execRedis(c.pool, "slow_start", commands); err != nil {
+		logError(check.BackendUrl, "Cannot write the slow start keys:", err.Error())
+	}
+}
+
+/*
+ * Same as ListenToChannel on the Redis holding hchecker's own data
+ */
+func (c *Cache) ListenToMetaChannel(channel string, callback func(line string)) error {
+	return c.listen(c.getMetaConn, channel, isPattern(channel),
+		func(_ string, line string) { callback(line) })
+}
+
+/*
+ * Listens to a channel, or to all the channels matching a glob pattern
+ * (e.g. "dead-*"). The callback gets the channel of each message.
+ */
+func (c *Cache) ListenToChannel(channel string,
+	callback func(channel string, line string)) error {
+	return c.listen(c.getConn, channel, isPattern(channel), callback)
+}
+
+func isPattern(channel string) bool {
+	return strings.ContainsAny(channel, "*?[")
+}
+
+/*
+ * Listens to the keyspace notifications of Hipache's Redis matching a
+ * pattern, the callback gets the key and the event
+ */
+func (c *Cache) ListenToKeyspace(pattern string,
+	callback func(key string, event string)) error {
+	prefix := "__keyspace@0__:"
+	return c.listen(c.getConn, prefix+pattern, true,
+		func(channel string, event string) {
+			callback(strings.TrimPrefix(channel, prefix), event)
+		})
+}
+
+func (c *Cache) listen(dial func() (redis.Conn, error), channel string,
+	pattern bool, callback func(channel string, data string)) error {
 	// Listening on the "dead" channel to get dead notifications by Hipache
 	// Format received on the channel is:
 	// -> frontend_key;backend_url;backend_id;number_of_backends
 	// Example: "localhost;http://localhost:4242;0;1"
+	c.listeners.Add(1)
 	go func() {
+		defer c.listeners.Done()
 		for {
-			err := c.connectAndListen(channel, callback)
+			err := c.connectAndListen(dial, channel, pattern, callback)
+			if c.isClosed() {
+				return
+			}
 			if err != nil {
-				log.Printf("Error subscribing channel %q: %s. Reconnecting...", channel, err.Error())
+				c.statsLock.Lock()
+				c.channelErrors[channel] += 1
+				c.statsLock.Unlock()
+				logError(fmt.Sprintf("Error subscribing channel %q: %s. Reconnecting...", channel, err.Error()))
+			}
+			if !c.wait(5 * time.Second) {
+				return
 			}
-			time.Sleep(5 * time.Second)
 		}
 	}()
 	return nil
 }
 
-func (c *Cache) connectAndListen(channel string, callback func(line string)) error {
-	conn, err := c.getConn()
+func (c *Cache) connectAndListen(dial func() (redis.Conn, error),
+	channel string, pattern bool,
+	callback func(channel string, data string)) error {
+	conn, err := dial()
 	if err != nil {
 		return err
 	}
-	psc := redis.PubSubConn{conn}
+	psc := redis.PubSubConn{Conn: conn}
 	defer psc.Close()
-	psc.Subscribe(channel)
+	if pattern == true {
+		psc.PSubscribe(channel)
+	} else {
+		psc.Subscribe(channel)
+	}
+	sub := &subscription{channel: channel, psc: psc,
+		lastSeen: time.Now().UnixNano()}
+	c.statsLock.Lock()
+	if c.isClosed() {
+		// Closed while subscribing, after the other subscriptions
+		c.statsLock.Unlock()
+		return nil
+	}
+	c.subscribers[conn] = sub
+	c.statsLock.Unlock()
+	defer func() {
+		c.statsLock.Lock()
+		delete(c.subscribers, conn)
+		c.statsLock.Unlock()
+	}()
 	for {
 		switch v := psc.Receive().(type) {
 		case redis.Message:
-			callback(string(v.Data[:]))
+			atomic.StoreInt64(&sub.lastSeen, time.Now().UnixNano())
+			c.statsLock.Lock()
+			c.channelMessages[v.Channel] += 1
+			c.statsLock.Unlock()
+			callback(v.Channel, string(v.Data[:]))
+		case redis.PMessage:
+			atomic.StoreInt64(&sub.lastSeen, time.Now().UnixNano())
+			// Counted per matching channel
+			c.statsLock.Lock()
+			c.channelMessages[v.Channel] += 1
+			c.statsLock.Unlock()
+			callback(v.Channel, string(v.Data[:]))
+		case redis.Pong:
+			atomic.StoreInt64(&sub.lastSeen, time.Now().UnixNano())
 		case error:
 			return v
 		}
 	}
 }
 
-func (c *Cache) PingAlive() {
+/*
+ * Sends a ping on every subscription, the pongs are received by the
+ * listeners
+ */
+func (c *Cache) PingSubscriptions() {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	for _, sub := range c.subscribers {
+		sub.psc.Ping("")
+	}
+}
+
+/*
+ * Closes the subscriptions which got neither a message nor a pong since a
+ * given time, they are established again by their listener. Returns their
+ * channels.
+ */
+func (c *Cache) CloseStaleSubscriptions(since time.Time) []string {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	var channels []string
+	for conn, sub := range c.subscribers {
+		if atomic.LoadInt64(&sub.lastSeen) < since.UnixNano() {
+			channels = append(channels, sub.channel)
+			conn.Close()
+		}
+	}
+	return channels
+}
+
+/*
+ * Returns a digest of the members of all the dead sets, to find out if
+ * they change
+ */
+func (c *Cache) DeadSetsDigest() (uint64, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	keys, err := scanKeys(conn, "dead:*")
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, deadKey := range keys {
+		ids, err := redis.Strings(conn.Do("SMEMBERS", deadKey))
+		if err != nil {
+			return 0, err
+		}
+		sort.Strings(ids)
+		fmt.Fprintf(h, "%s %s\n", deadKey, strings.Join(ids, " "))
+	}
+	return h.Sum64(), nil
+}
+
+/*
+ * Returns the first time a backend has been checked by any instance
+ */
+func (c *Cache) FirstSeen(check *Check) time.Time {
+	var seen int64
+	key := c.metaKey("seen:" + check.BackendUrl)
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SETNX", key, time.Now().Unix())
+	conn.Send("EXPIRE", key, SEEN_TTL)
+	conn.Send("GET", key)
+	resp, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return time.Now()
+	}
+	redis.Scan(resp, nil, nil, &seen)
+	return time.Unix(seen, 0)
+}
+
+/*
+ * Stores the state snapshot of this instance
+ */
+func (c *Cache) SaveState(data []byte, ttl time.Duration) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	conn.Send("SETEX", c.metaKey("state:"+myId), int64(ttl/time.Second), data)
+	conn.Flush()
+}
+
+/*
+ * Publishes a notification on the dead channel, like Hipache does.
+ * Returns the number of clients which received it.
+ */
+func (c *Cache) PublishDead(line string) (int, error) {
 	conn := c.pool.Get()
 	defer conn.Close()
-	conn.Send("SET", "hchecker_ping", time.Now().Unix())
+	return redis.Int(conn.Do("PUBLISH", deadChannel, line))
+}
+
+func (c *Cache) PublishEvent(data []byte) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	conn.Send("PUBLISH", c.metaKey("events"), data)
 	conn.Flush()
 }
+
+/*
+ * Lets the other instances know about the backends we stopped checking.
+ * Returns the number of instances which received the message.
+ */
+func (c *Cache) PublishHandoff(data []byte) (int, error) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	return redis.Int(conn.Do("PUBLISH", c.metaKey("handoff"), data))
+}
+
+/*
+ * Records the number of backends we check in the hchecker:load sorted set,
+ * and when we did it in hchecker:load_time
+ */
+func (c *Cache) ReportLoad(count int) error {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("ZADD", c.metaKey("load"), count, myId)
+	conn.Send("ZADD", c.metaKey("load_time"), time.Now().Unix(), myId)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+/*
+ * Returns the load of the instances which reported it recently, the others
+ * are forgotten
+ */
+func (c *Cache) GetLoads(maxAge time.Duration) (map[string]int, error) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	times, err := redis.Int64Map(conn.Do("ZRANGE", c.metaKey("load_time"),
+		0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	loads, err := redis.IntMap(conn.Do("ZRANGE", c.metaKey("load"), 0, -1,
+		"WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	limit := time.Now().Add(-maxAge).Unix()
+	for instance := range loads {
+		if t, exists := times[instance]; exists && t >= limit {
+			continue
+		}
+		conn.Send("ZREM", c.metaKey("load"), instance)
+		conn.Send("ZREM", c.metaKey("load_time"), instance)
+		delete(loads, instance)
+	}
+	conn.Flush()
+	return loads, nil
+}
+
+func (c *Cache) RemoveLoad() {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	conn.Send("ZREM", c.metaKey("load"), myId)
+	conn.Send("ZREM", c.metaKey("load_time"), myId)
+	conn.Flush()
+}
+
+/*
+ * Makes sure Redis is reachable
+ */
+func (c *Cache) Ping() error {
+	for _, pool := range []*redis.Pool{c.pool, c.metaPool} {
+		conn := pool.Get()
+		_, err := conn.Do("PING")
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Writes our heartbeat, and records its key in hchecker:heartbeats: the
+ * other instances only tell we crashed from the heartbeats they know about
+ * (see ReleaseStaleLock)
+ */
+func (c *Cache) PingAlive(hb heartbeat, ttl time.Duration) error {
+	data, _ := json.Marshal(hb)
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	conn.Send("HSET", c.metaKey("heartbeats"), myId, c.heartbeatKey(myId))
+	_, err := conn.Do("SETEX", c.heartbeatKey(myId), int(ttl.Seconds()), data)
+	return err
+}
+
+/*
+ * Removes our heartbeat, when stopping
+ */
+func (c *Cache) ClearAlive() {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	conn.Send("HDEL", c.metaKey("heartbeats"), myId)
+	conn.Do("DEL", c.heartbeatKey(myId))
+}
+
+/*
+ * Record that this instance sees the backend failing and ask the other
+ * instances to confirm it with their own probe.
+ * Returns the number of instances which saw the failure so far.
+ */
+func (c *Cache) SuspectBackend(check *Check) int {
+	var count int
+	key := c.metaKey("suspect:" + check.BackendUrl)
+	resp, err := execRedis(c.metaPool, "suspect", [][]interface{}{
+		{"SADD", key, myId},
+		{"EXPIRE", key, SUSPECT_TTL},
+		{"SCARD", key},
+		{"PUBLISH", c.metaKey("suspect"),
+			check.FrontendKey + ";" + check.BackendUrl + ";" + myId}})
+	if err != nil {
+		// Not confirmed by anyone as far as we know
+		logError(check.BackendUrl, "Cannot record the suspicion:", err.Error())
+		return 0
+	}
+	redis.Scan(resp, nil, nil, &count)
+	return count
+}
+
+/*
+ * Add this instance to the ones which saw the suspected backend failing
+ */
+func (c *Cache) ConfirmSuspect(backendUrl string) {
+	key := c.metaKey("suspect:" + backendUrl)
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	// The owner may have cleared the record in the meantime, only confirm
+	// a suspicion which still exists
+	exists, err := redis.Bool(conn.Do("EXISTS", key))
+	if err != nil {
+		logError(backendUrl, "Cannot confirm the suspicion:", err.Error())
+		return
+	} else if exists == false {
+		return
+	}
+	conn.Send("SADD", key, myId)
+	conn.Send("EXPIRE", key, SUSPECT_TTL)
+	conn.Flush()
+}
+
+func (c *Cache) ClearSuspect(check *Check) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	conn.Send("DEL", c.metaKey("suspect:"+check.BackendUrl))
+	conn.Flush()
+}
+
+/*
+ * Record the status seen by this instance and reconcile it with the ones
+ * seen by the other instances checking the same backend (see -redundancy).
+ * The backend is considered dead only if every instance sees it failing.
+ * Backends on which the instances disagree are flagged in a Redis set.
+ */
+func (c *Cache) ReconcileStatus(check *Check, status bool) bool {
+	key := c.metaKey("results:" + check.BackendUrl)
+	now := time.Now().Unix()
+	// Results not refreshed for a few intervals are from instances which
+	// stopped checking the backend
+	maxAge := int64(3 * checkInterval / time.Second)
+	var values []string
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("HSET", key, myId, fmt.Sprintf("%t;%d", status, now))
+	conn.Send("EXPIRE", key, maxAge)
+	conn.Send("HVALS", key)
+	resp, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return status
+	}
+	redis.Scan(resp, nil, nil, &values)
+	alive, dead := 0, 0
+	for _, v := range values {
+		var (
+			s bool
+			t int64
+		)
+		if _, err := fmt.Sscanf(v, "%t;%d", &s, &t); err != nil {
+			continue
+		}
+		if now-t > maxAge {
+			continue
+		}
+		if s == true {
+			alive += 1
+		} else {
+			dead += 1
+		}
+	}
+	if alive > 0 && dead > 0 {
+		log.Printf("%s Checkers disagree (%d alive, %d dead)",
+			check.BackendUrl, alive, dead)
+		conn.Do("SADD", c.metaKey("disagreements"), check.BackendUrl)
+	} else {
+		conn.Do("SREM", c.metaKey("disagreements"), check.BackendUrl)
+	}
+	return alive > 0
+}
@@ -0,0 +1,769 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func setupCache(t *testing.T) (*fakeRedis, *Cache) {
+	myId = "host#1"
+	redundancy = 1
+	aliveChannel = ""
+	r := newFakeRedis()
+	return r, r.cache()
+}
+
+func newTestCheck(t *testing.T, line string) *Check {
+	check, err := NewCheck(line)
+	if err != nil {
+		t.Fatalf("NewCheck(%q) failed: %s", line, err)
+	}
+	return check
+}
+
+func TestLockBackend(t *testing.T) {
+	r, cache := setupCache(t)
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	locked, ctl := cache.LockBackend(check)
+	if locked == false || ctl == nil {
+		t.Fatal("Expected to lock the backend")
+	}
+	if sig := r.hashes["hchecker"]["http://10.0.0.1:80"]; sig != check.routineSig {
+		t.Errorf("Expected the lock to hold %q, got %q", check.routineSig, sig)
+	}
+	if _, exists := r.hashes["hchecker"]["http://10.0.0.1:80;host#1"]; !exists {
+		t.Error("Expected the sync key to be set")
+	}
+	// Same backend from another frontend: the running check gets the new
+	// mapping and is notified
+	other := newTestCheck(t, "www.bar.com;http://10.0.0.1:80;1;2")
+	if locked, _ := cache.LockBackend(other); locked == true {
+		t.Fatal("Expected the backend to be locked already")
+	}
+	expected := map[string]int{"www.foo.com": 0, "www.bar.com": 1}
+	if m := cache.mapping.Frontends("http://10.0.0.1:80"); !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected mapping %v, got %v", expected, m)
+	}
+	if ctl.Updated() == false {
+		t.Error("Expected the check to be notified of the new frontend")
+	}
+}
+
+func TestLockBackendOwnedByOtherInstance(t *testing.T) {
+	r, cache := setupCache(t)
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	cache.LockBackend(check)
+	// Concurrent notifications received by the other instances
+	for _, id := range []string{"host#2", "other#1", "other#2"} {
+		myId = id
+		c := r.cache()
+		if locked, _ := c.LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")); locked == true {
+			t.Errorf("Instance %s locked a backend owned by host#1", id)
+		}
+		if c.mapping.Len() != 0 {
+			t.Errorf("Instance %s mapped a backend it doesn't own", id)
+		}
+	}
+}
+
+func TestLockMetrics(t *testing.T) {
+	r, cache := setupCache(t)
+	locksMetric.Init()
+	cache.LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2"))
+	cache.LockBackend(newTestCheck(t, "www.bar.com;http://10.0.0.1:80;1;2"))
+	myId = "other#1"
+	r.cache().LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2"))
+	expected := `{"acquired": 1, "attempts": 3, "contended": 1, "joined": 1}`
+	if s := locksMetric.String(); s != expected {
+		t.Errorf("Expected %s, got %s", expected, s)
+	}
+}
+
+func TestLockBackendRedundancy(t *testing.T) {
+	r, _ := setupCache(t)
+	redundancy = 2
+	fields := []string{}
+	for _, id := range []string{"host#1", "host#2", "host#3"} {
+		myId = id
+		check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+		if locked, _ := r.cache().LockBackend(check); locked == true {
+			fields = append(fields, check.lockField)
+		}
+	}
+	expected := []string{"http://10.0.0.1:80", "http://10.0.0.1:80#2"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected locks %v, got %v", expected, fields)
+	}
+}
+
+func TestReconcileStatus(t *testing.T) {
+	r, cache := setupCache(t)
+	redundancy = 2
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	if cache.ReconcileStatus(check, false) == true {
+		t.Error("Expected a single failing checker to see the backend dead")
+	}
+	// Another checker sees it alive: alive until all of them see it failing
+	myId = "host#2"
+	if cache.ReconcileStatus(check, true) == false {
+		t.Error("Expected the backend to stay alive")
+	}
+	if !r.sets["hchecker:disagreements"]["http://10.0.0.1:80"] {
+		t.Error("Expected the disagreement to be flagged")
+	}
+	if cache.ReconcileStatus(check, false) == true {
+		t.Error("Expected the backend to be dead once all the checkers agree")
+	}
+	if r.sets["hchecker:disagreements"]["http://10.0.0.1:80"] {
+		t.Error("Expected the disagreement to be cleared")
+	}
+	// The results of the instances which stopped checking are ignored
+	r.hashes["hchecker:results:http://10.0.0.1:80"]["host#1"] = "true;1"
+	if cache.ReconcileStatus(check, false) == true {
+		t.Error("Expected an outdated result to be ignored")
+	}
+	if ttl := r.ttls["hchecker:results:http://10.0.0.1:80"]; ttl != int64(
+		3*checkInterval/time.Second) {
+		t.Errorf("Expected the results to expire, got a TTL of %d", ttl)
+	}
+}
+
+func TestIsUnlockedBackend(t *testing.T) {
+	r, cache := setupCache(t)
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	cache.LockBackend(check)
+	if cache.IsUnlockedBackend(check) == true {
+		t.Error("Expected the backend to be locked")
+	}
+	// Another instance took over the lock
+	r.hashes["hchecker"]["http://10.0.0.1:80"] = "host#2;1.2"
+	if cache.IsUnlockedBackend(check) == false {
+		t.Error("Expected the lock to be lost")
+	}
+}
+
+func TestUnlockBackend(t *testing.T) {
+	r, cache := setupCache(t)
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	cache.LockBackend(check)
+	cache.UnlockBackend(check)
+	if len(r.hashes["hchecker"]) != 0 {
+		t.Errorf("Expected the lock and sync key to be removed, got %v",
+			r.hashes["hchecker"])
+	}
+	if cache.mapping.Len() != 0 ||
+		cache.mapping.IsWatched("http://10.0.0.1:80") == true {
+		t.Error("Expected the backend to be removed from the mappings")
+	}
+}
+
+func TestMetaRedis(t *testing.T) {
+	r, cache := setupCache(t)
+	meta := newFakeRedis()
+	cache.metaPool = meta.pool()
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.1:80"}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	if locked, _ := cache.LockBackend(check); locked == false {
+		t.Fatal("Expected to lock the backend")
+	}
+	cache.MarkBackendDead(check)
+	cache.PingAlive(heartbeat{}, time.Minute)
+	// The locks and heartbeats stay off Hipache's Redis
+	if meta.hashes["hchecker"]["http://10.0.0.1:80"] != check.routineSig ||
+		!meta.exists(cache.heartbeatKey(myId)) {
+		t.Errorf("Expected the lock and the heartbeat in hchecker's Redis, got %v",
+			meta.hashes)
+	}
+	if r.exists("hchecker") || r.exists(cache.heartbeatKey(myId)) {
+		t.Error("Expected no hchecker data in Hipache's Redis")
+	}
+	if !r.sets["dead:www.foo.com"]["0"] || meta.exists("dead:www.foo.com") {
+		t.Error("Expected the dead set in Hipache's Redis only")
+	}
+}
+
+func TestMarkBackendDead(t *testing.T) {
+	r, cache := setupCache(t)
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.2:80",
+		"http://10.0.0.1:80"}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;1;2")
+	cache.LockBackend(check)
+	check.lastReason, check.lastError = "timeout", "i/o timeout"
+	if cache.MarkBackendDead(check) == false {
+		t.Fatal("Expected the backend to be flagged dead")
+	}
+	if !r.sets["dead:www.foo.com"]["1"] {
+		t.Errorf("Expected backend 1 in the dead set, got %v",
+			r.sets["dead:www.foo.com"])
+	}
+	if r.ttls["dead:www.foo.com"] != 60 {
+		t.Errorf("Expected the dead set to expire, TTL %d",
+			r.ttls["dead:www.foo.com"])
+	}
+	reason := r.hashes["hchecker:reason:www.foo.com:1"]
+	if reason["reason"] != "timeout" || reason["error"] != "i/o timeout" {
+		t.Errorf("Expected the dead reason to be stored, got %v", reason)
+	}
+}
+
+func TestMarkBackendLogOnly(t *testing.T) {
+	r, cache := setupCache(t)
+	frontendConfigs = map[string]*FrontendConfig{"*.canary.com": {LogOnly: true}}
+	defer func() { frontendConfigs = make(map[string]*FrontendConfig) }()
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.1:80",
+		"http://10.0.0.2:80"}
+	r.lists["frontend:www.canary.com"] = []string{"canary", "http://10.0.0.1:80",
+		"http://10.0.0.3:80"}
+	for _, line := range []string{"www.foo.com;http://10.0.0.1:80;0;2",
+		"www.canary.com;http://10.0.0.1:80;0;2"} {
+		cache.LockBackend(newTestCheck(t, line))
+	}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	check.setLastResult("timeout", "i/o timeout")
+	logOnlyMetric.Init()
+	if cache.MarkBackendDead(check) == false {
+		t.Fatal("Expected the backend to be flagged dead")
+	}
+	if !r.sets["dead:www.foo.com"]["0"] || len(r.sets["dead:www.canary.com"]) != 0 {
+		t.Errorf("Expected the backend dead on www.foo.com only, got %v and %v",
+			r.sets["dead:www.foo.com"], r.sets["dead:www.canary.com"])
+	}
+	// Hipache never saw it dead on the log-only frontend
+	if !r.exists("hchecker:reason:www.foo.com:0") ||
+		r.exists("hchecker:reason:www.canary.com:0") {
+		t.Errorf("Expected the dead reason on www.foo.com only, got %v",
+			r.hashes)
+	}
+	if v := logOnlyMetric.Get("dead"); v == nil || v.String() != "1" {
+		t.Errorf("Expected the log-only flag to be counted, got %v", v)
+	}
+	r.sets["dead:www.canary.com"] = map[string]bool{"0": true}
+	if cache.MarkBackendAlive(check) == false {
+		t.Fatal("Expected the backend to be flagged alive")
+	}
+	if len(r.sets["dead:www.foo.com"]) != 0 || !r.sets["dead:www.canary.com"]["0"] {
+		t.Errorf("Expected the backend alive on www.foo.com only, got %v and %v",
+			r.sets["dead:www.foo.com"], r.sets["dead:www.canary.com"])
+	}
+}
+
+func TestMarkBackendDeadMappingChanged(t *testing.T) {
+	r, cache := setupCache(t)
+	// The backend id 1 now points to another backend
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.2:80",
+		"http://10.0.0.3:80"}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;1;2")
+	cache.LockBackend(check)
+	if cache.MarkBackendDead(check) == true {
+		t.Fatal("Expected no update when the mapping changed")
+	}
+	if len(r.sets["dead:www.foo.com"]) != 0 {
+		t.Error("Expected the dead set to be left untouched")
+	}
+	if len(r.hashes["hchecker"]) != 0 || cache.mapping.Len() != 0 {
+		t.Error("Expected the backend to be unlocked")
+	}
+}
+
+func TestMarkBackendDeadReordered(t *testing.T) {
+	r, cache := setupCache(t)
+	// The list has been rewritten, the backend moved from id 0 to 1
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.2:80",
+		"http://10.0.0.1:80/"}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	cache.LockBackend(check)
+	if cache.MarkBackendDead(check) == false {
+		t.Fatal("Expected the backend to be flagged dead")
+	}
+	if expected := map[string]bool{"1": true}; !reflect.DeepEqual(r.sets["dead:www.foo.com"], expected) {
+		t.Errorf("Expected the dead set to be %v, got %v", expected,
+			r.sets["dead:www.foo.com"])
+	}
+	if id := cache.mapping.Frontends("http://10.0.0.1:80")["www.foo.com"]; id != 1 {
+		t.Errorf("Expected the backend id to be remapped to 1, got %d", id)
+	}
+}
+
+func TestMarkBackendDeadByUrl(t *testing.T) {
+	r, cache := setupCache(t)
+	backendIdScheme = BACKEND_ID_URL
+	defer func() { backendIdScheme = BACKEND_ID_INDEX }()
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.1:80",
+		"http://10.0.0.2:80"}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	cache.LockBackend(check)
+	if cache.MarkBackendDead(check) == false {
+		t.Fatal("Expected the backend to be flagged dead")
+	}
+	// SHA-1 of the URL, whatever its place in the list
+	member := "a52ad146961f11095240e0c7406d3cbbfb7c1039"
+	if !r.sets["dead:www.foo.com"][member] {
+		t.Fatalf("Expected the hash of the URL, got %v",
+			r.sets["dead:www.foo.com"])
+	}
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.2:80",
+		"http://10.0.0.1:80"}
+	if cache.MarkBackendDead(check) == false {
+		t.Fatal("Expected the backend to be flagged dead")
+	}
+	if expected := map[string]bool{member: true}; !reflect.DeepEqual(r.sets["dead:www.foo.com"], expected) {
+		t.Errorf("Expected the dead set to be %v, got %v", expected,
+			r.sets["dead:www.foo.com"])
+	}
+	// The janitor only removes the members not matching a backend
+	r.sets["dead:www.foo.com"]["0"] = true
+	removed, err := cache.CleanDeadSets(false)
+	if err != nil || len(removed) != 1 || !r.sets["dead:www.foo.com"][member] {
+		t.Errorf("Expected only the index to be removed, got %v (%v)", removed,
+			err)
+	}
+	if cache.MarkBackendAlive(check) == false ||
+		len(r.sets["dead:www.foo.com"]) != 0 {
+		t.Error("Expected the backend to be flagged alive")
+	}
+}
+
+func TestRemoveOurDeadMark(t *testing.T) {
+	r, cache := setupCache(t)
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.1:80",
+		"http://10.0.0.2:80"}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	cache.LockBackend(check)
+	check.lastReason = "timeout"
+	if cache.MarkBackendDead(check) == false {
+		t.Fatal("Expected the backend to be flagged dead")
+	}
+	// Reconfigured: the backend moved to id 1, a new one reuses id 0
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.3:80",
+		"http://10.0.0.1:80"}
+	staleDeadMarksMetric.Set(0)
+	if cache.MarkBackendDead(check) == false {
+		t.Fatal("Expected the backend to be flagged dead")
+	}
+	if expected := map[string]bool{"1": true}; !reflect.DeepEqual(r.sets["dead:www.foo.com"], expected) {
+		t.Errorf("Expected the dead set to be %v, got %v", expected,
+			r.sets["dead:www.foo.com"])
+	}
+	if staleDeadMarksMetric.Value() != 1 {
+		t.Error("Expected the stale dead mark to be counted")
+	}
+	// The new backend of id 1 has been flagged dead by another checker
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.3:80",
+		"http://10.0.0.4:80"}
+	r.hashes["hchecker:reason:www.foo.com:1"]["backend_url"] = "http://10.0.0.4:80"
+	if cache.MarkBackendAlive(check) == true {
+		t.Fatal("Expected no update when the backend has been removed")
+	}
+	if !r.sets["dead:www.foo.com"]["1"] {
+		t.Error("Expected the dead mark of the new backend to be kept")
+	}
+}
+
+func TestMarkBackendAlive(t *testing.T) {
+	r, cache := setupCache(t)
+	aliveChannel = "alive"
+	slowStart = time.Minute
+	defer func() { slowStart = 0 }()
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.1:80"}
+	r.lists["frontend:www.bar.com"] = []string{"bar", "http://10.0.0.2:80",
+		"http://10.0.0.1:80"}
+	r.sets["dead:www.foo.com"] = map[string]bool{"0": true}
+	foo := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	bar := newTestCheck(t, "www.bar.com;http://10.0.0.1:80;1;2")
+	cache.LockBackend(foo)
+	cache.LockBackend(bar)
+	if cache.MarkBackendAlive(foo) == false {
+		t.Fatal("Expected the backend to be flagged alive")
+	}
+	if len(r.sets["dead:www.foo.com"]) != 0 {
+		t.Error("Expected the backend to be removed from the dead set")
+	}
+	// Only the frontend on which it was dead is notified
+	expected := []fakeMessage{{"alive", "www.foo.com;http://10.0.0.1:80;0"}}
+	if !reflect.DeepEqual(r.published, expected) {
+		t.Errorf("Expected %v to be published, got %v", expected, r.published)
+	}
+	// And slowly started
+	key := "hchecker:slowstart:www.foo.com:0"
+	if _, exists := r.strings[key]; !exists || r.ttls[key] != 60 {
+		t.Errorf("Expected the slow start key to expire in 60s, got %d",
+			r.ttls[key])
+	}
+	if _, exists := r.strings["hchecker:slowstart:www.bar.com:1"]; exists {
+		t.Error("Expected no slow start of a backend which wasn't dead")
+	}
+}
+
+func TestSlowStartSuffix(t *testing.T) {
+	setupCache(t)
+	slowStart, redisSuffix = time.Minute, "blog"
+	defer func() { slowStart, redisSuffix = 0, "" }()
+	r := newFakeRedis()
+	cache := r.cache()
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.1:80"}
+	r.sets["dead:www.foo.com"] = map[string]bool{"0": true}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	cache.LockBackend(check)
+	if cache.MarkBackendAlive(check) == false {
+		t.Fatal("Expected the backend to be flagged alive")
+	}
+	// The key read by Hipache, not one of hchecker's own keys
+	if _, exists := r.strings["hchecker:slowstart:www.foo.com:0"]; !exists {
+		t.Errorf("Expected the slow start key without the suffix, got %v",
+			r.keys())
+	}
+	if _, exists := r.hashes["hchecker_blog"]; !exists {
+		t.Error("Expected the lock under the suffixed key")
+	}
+}
+
+func TestMarkBackendAliveSilent(t *testing.T) {
+	r, cache := setupCache(t)
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.1:80"}
+	r.sets["dead:www.foo.com"] = map[string]bool{"0": true}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	cache.LockBackend(check)
+	if cache.MarkBackendAlive(check) == false {
+		t.Fatal("Expected the backend to be flagged alive")
+	}
+	// Without -alive_channel, the resurrection isn't announced
+	if len(r.published) != 0 {
+		t.Errorf("Expected nothing to be published, got %v", r.published)
+	}
+	// Already alive, nothing removed from the dead set: no announcement
+	aliveChannel = "alive"
+	if cache.MarkBackendAlive(check) == false {
+		t.Fatal("Expected the backend to stay alive")
+	}
+	if len(r.published) != 0 {
+		t.Errorf("Expected nothing to be published, got %v", r.published)
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	r, cache := setupCache(t)
+	cache.LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2"))
+	cache.LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.10:80;1;2"))
+	removed, err := cache.ForceUnlock("http://10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("Expected the lock and sync key to be removed, got %v", removed)
+	}
+	if len(r.hashes["hchecker"]) != 2 {
+		t.Errorf("Expected the other backend to stay locked, got %v",
+			r.hashes["hchecker"])
+	}
+}
+
+func TestClearMetadata(t *testing.T) {
+	r, _ := setupCache(t)
+	backends := map[string]string{"host#1": "http://10.0.0.1:80",
+		"other#1": "http://10.0.0.2:80"}
+	for id, backendUrl := range backends {
+		myId = id
+		r.cache().LockBackend(newTestCheck(t,
+			"www.foo.com;"+backendUrl+";0;2"))
+		r.strings["hchecker:state:"+id] = "{}"
+		r.cache().PingAlive(heartbeat{Instance: id}, time.Minute)
+	}
+	// Restarted on host with a new pid
+	myId = "host#2"
+	r.cache().ClearMetadata()
+	expected := map[string]string{
+		"http://10.0.0.2:80":         r.hashes["hchecker"]["http://10.0.0.2:80"],
+		"http://10.0.0.2:80;other#1": "1",
+	}
+	if !reflect.DeepEqual(r.hashes["hchecker"], expected) {
+		t.Errorf("Expected only the other host's locks to remain, got %v",
+			r.hashes["hchecker"])
+	}
+	if _, exists := r.strings["hchecker:state:host#1"]; exists {
+		t.Error("Expected the state of the previous process to be removed")
+	}
+	if _, exists := r.strings["hchecker:state:other#1"]; !exists {
+		t.Error("Expected the state of the other host to remain")
+	}
+	if heartbeats := r.hashes["hchecker:heartbeats"]; len(heartbeats) != 1 ||
+		heartbeats["other#1"] == "" {
+		t.Errorf("Expected only the other host's heartbeat key to remain, got %v",
+			heartbeats)
+	}
+}
+
+func TestReleaseLockTakenByOtherInstance(t *testing.T) {
+	r, cache := setupCache(t)
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	cache.LockBackend(check)
+	// The lock has been handed off and taken by another instance
+	r.hashes["hchecker"]["http://10.0.0.1:80"] = "host#2;1.1"
+	cache.ReleaseLock(check)
+	if sig := r.hashes["hchecker"]["http://10.0.0.1:80"]; sig != "host#2;1.1" {
+		t.Errorf("Expected the lock of host#2 to be kept, got %q", sig)
+	}
+	if _, exists := r.hashes["hchecker"]["http://10.0.0.1:80;host#1"]; exists {
+		t.Error("Expected the sync key to be removed")
+	}
+}
+
+func TestCleanDeadSets(t *testing.T) {
+	r, cache := setupCache(t)
+	r.lists["frontend:www.foo.com"] = []string{"www", "http://10.0.0.1:80",
+		"http://10.0.0.2:80"}
+	r.sets["dead:www.foo.com"] = map[string]bool{"1": true, "2": true}
+	r.sets["dead:www.gone.com"] = map[string]bool{"0": true}
+	r.hashes["hchecker:reason:www.foo.com:2"] = map[string]string{"reason": "timeout"}
+	removed, err := cache.CleanDeadSets(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || len(r.sets["dead:www.foo.com"]) != 2 {
+		t.Errorf("Expected 2 orphans to be listed only, got %v", removed)
+	}
+	cache.CleanDeadSets(false)
+	if expected := map[string]bool{"1": true}; !reflect.DeepEqual(r.sets["dead:www.foo.com"], expected) {
+		t.Errorf("Expected %v to be left, got %v", expected, r.sets["dead:www.foo.com"])
+	}
+	if r.exists("dead:www.gone.com") || r.exists("hchecker:reason:www.foo.com:2") {
+		t.Error("Expected the orphans and their reason to be removed")
+	}
+}
+
+func TestDeadSetsDigest(t *testing.T) {
+	r, cache := setupCache(t)
+	r.sets["dead:www.foo.com"] = map[string]bool{"1": true}
+	before, err := cache.DeadSetsDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := cache.DeadSetsDigest(); after != before {
+		t.Error("Expected the same digest without changes")
+	}
+	r.sets["dead:www.foo.com"]["2"] = true
+	if after, _ := cache.DeadSetsDigest(); after == before {
+		t.Error("Expected the digest to change with the dead sets")
+	}
+}
+
+func TestCloseStaleSubscriptions(t *testing.T) {
+	r, cache := setupCache(t)
+	pinged := time.Now()
+	for channel, lastSeen := range map[string]time.Time{
+		"dead":             pinged.Add(-time.Minute),
+		"hchecker:handoff": pinged.Add(time.Millisecond),
+	} {
+		conn := r.pool().Get()
+		cache.subscribers[conn] = &subscription{channel: channel,
+			psc: redis.PubSubConn{Conn: conn}, lastSeen: lastSeen.UnixNano()}
+	}
+	channels := cache.CloseStaleSubscriptions(pinged)
+	if !reflect.DeepEqual(channels, []string{"dead"}) {
+		t.Errorf("Expected the dead subscription to be stale, got %v", channels)
+	}
+}
+
+/*
+ * Subscribed connection replaying the replies of Redis, then closed
+ */
+type replayConn struct {
+	sent    [][]interface{}
+	replies []interface{}
+}
+
+func (c *replayConn) Close() error { return nil }
+func (c *replayConn) Err() error   { return nil }
+func (c *replayConn) Flush() error { return nil }
+
+func (c *replayConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return nil, c.Send(cmd, args...)
+}
+
+func (c *replayConn) Send(cmd string, args ...interface{}) error {
+	c.sent = append(c.sent, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+func (c *replayConn) Receive() (interface{}, error) {
+	if len(c.replies) == 0 {
+		return nil, io.EOF
+	}
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	return reply, nil
+}
+
+func pubSubReply(values ...interface{}) []interface{} {
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			values[i] = []byte(s)
+		}
+	}
+	return values
+}
+
+func TestListenToPattern(t *testing.T) {
+	_, cache := setupCache(t)
+	conn := &replayConn{replies: []interface{}{
+		pubSubReply("psubscribe", "dead-*", int64(1)),
+		pubSubReply("pmessage", "dead-*", "dead-eu", "www.foo.com;http://10.0.0.1:80;0;2"),
+		pubSubReply("pmessage", "dead-*", "dead-us", "www.bar.com;http://10.0.0.2:80;0;1"),
+		pubSubReply("pmessage", "dead-*", "dead-eu", "www.foo.com;http://10.0.0.3:80;1;2"),
+	}}
+	var received []fakeMessage
+	err := cache.connectAndListen(func() (redis.Conn, error) { return conn, nil },
+		"dead-*", isPattern("dead-*"), func(channel string, line string) {
+			received = append(received, fakeMessage{channel, line})
+		})
+	if err != io.EOF {
+		t.Errorf("Expected the listener to stop when closed, got %v", err)
+	}
+	if len(conn.sent) == 0 || !reflect.DeepEqual(conn.sent[0],
+		[]interface{}{"PSUBSCRIBE", "dead-*"}) {
+		t.Errorf("Expected a pattern subscription, got %v", conn.sent)
+	}
+	// With the channel each message was published on
+	expected := []fakeMessage{
+		{"dead-eu", "www.foo.com;http://10.0.0.1:80;0;2"},
+		{"dead-us", "www.bar.com;http://10.0.0.2:80;0;1"},
+		{"dead-eu", "www.foo.com;http://10.0.0.3:80;1;2"},
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected %v, got %v", expected, received)
+	}
+	if cache.channelMessages["dead-eu"] != 2 || cache.channelMessages["dead-us"] != 1 {
+		t.Errorf("Expected the messages counted per channel, got %v",
+			cache.channelMessages)
+	}
+	// A plain channel is subscribed as is
+	if isPattern("dead") {
+		t.Error("Expected a channel without wildcards not to be a pattern")
+	}
+}
+
+func TestPruneDeletedFrontends(t *testing.T) {
+	r, cache := setupCache(t)
+	r.lists["frontend:www.foo.com"] = []string{"www", "http://10.0.0.1:80"}
+	r.lists["frontend:www.bar.com"] = []string{"www", "http://10.0.0.1:80"}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	cache.LockBackend(check)
+	cache.LockBackend(newTestCheck(t, "www.bar.com;http://10.0.0.1:80;0;2"))
+	if n := cache.PruneDeletedFrontends(check); n != 2 {
+		t.Errorf("Expected 2 frontends left, got %d", n)
+	}
+	delete(r.lists, "frontend:www.bar.com")
+	if n := cache.PruneDeletedFrontends(check); n != 1 {
+		t.Errorf("Expected 1 frontend left, got %d", n)
+	}
+	if _, exists := cache.mapping.Frontends("http://10.0.0.1:80")["www.bar.com"]; exists {
+		t.Error("Expected the removed frontend to be unmapped")
+	}
+	delete(r.lists, "frontend:www.foo.com")
+	if n := cache.PruneDeletedFrontends(check); n != 0 {
+		t.Errorf("Expected no frontend left, got %d", n)
+	}
+}
+
+func TestRefreshFrontend(t *testing.T) {
+	r, cache := setupCache(t)
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.1:80"}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	cache.LockBackend(check)
+	other := newTestCheck(t, "www.bar.com;http://10.0.0.2:80;0;2")
+	cache.LockBackend(other)
+	// The backend has been added to www.bar.com and moved in www.foo.com
+	r.lists["frontend:www.bar.com"] = []string{"bar", "http://10.0.0.2:80",
+		"http://10.0.0.1:80"}
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.3:80",
+		"http://10.0.0.1:80"}
+	cache.RefreshFrontend("www.bar.com")
+	cache.RefreshFrontend("www.foo.com")
+	expected := map[string]int{"www.foo.com": 1, "www.bar.com": 1}
+	if m := cache.mapping.Frontends("http://10.0.0.1:80"); !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected mapping %v, got %v", expected, m)
+	}
+	// Frontend removed
+	delete(r.lists, "frontend:www.bar.com")
+	cache.RefreshFrontend("www.bar.com")
+	if m := cache.mapping.Frontends("http://10.0.0.2:80"); len(m) != 0 {
+		t.Errorf("Expected the frontend to be removed, got %v", m)
+	}
+}
+
+func TestMergeKeyspaceFlags(t *testing.T) {
+	for flags, expected := range map[string]string{
+		"":    "Klg",
+		"Ex":  "ExKlg",
+		"KA":  "KA",
+		"Kl":  "Klg",
+		"EA":  "EAK",
+		"Klg": "Klg",
+	} {
+		if merged := mergeKeyspaceFlags(flags, "Klg"); merged != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, flags, merged)
+		}
+	}
+	// The lock events (see -lock_events)
+	for flags, expected := range map[string]string{
+		"":    "Kgh",
+		"Klg": "Klgh",
+		"KA":  "KA",
+	} {
+		if merged := mergeKeyspaceFlags(flags, "Kgh"); merged != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, flags, merged)
+		}
+	}
+}
+
+func TestRedisErrors(t *testing.T) {
+	r, cache := setupCache(t)
+	redisRetryDelay = time.Millisecond
+	defer func() {
+		redisRetryDelay, lastError = 100*time.Millisecond, ""
+	}()
+	redisErrorsMetric.Init()
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.1:80",
+		"http://10.0.0.2:80"}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	_, ctl := cache.LockBackend(check)
+	ctl.Updated()
+	// Retried until it works
+	r.failures = REDIS_ATTEMPTS - 1
+	if cache.IsUnlockedBackend(check) == true {
+		t.Error("Expected the lock to be held")
+	}
+	r.failures = REDIS_ATTEMPTS - 1
+	if cache.MarkBackendDead(check) == false || !r.sets["dead:www.foo.com"]["0"] {
+		t.Fatal("Expected the backend to be flagged dead after a retry")
+	}
+	if ctl.Updated() == true {
+		t.Error("Expected no rewrite of the state")
+	}
+	// Redis failing is not a lost lock nor a changed mapping
+	r.failures = 100
+	if cache.IsUnlockedBackend(check) == true {
+		t.Error("Expected the lock to be held when Redis fails")
+	}
+	if cache.MarkBackendAlive(check) == false {
+		t.Error("Expected the check to go on when Redis fails")
+	}
+	r.failures = 0
+	if m := cache.mapping.Frontends(check.BackendUrl); len(m) != 1 {
+		t.Errorf("Expected the mapping to be kept, got %v", m)
+	}
+	if ctl.Updated() == false {
+		t.Error("Expected the check loop to be told to write the state again")
+	}
+	if !r.sets["dead:www.foo.com"]["0"] {
+		t.Error("Expected the dead set to be left as is")
+	}
+	for _, operation := range []string{"lock_check", "mapping_check"} {
+		if v := redisErrorsMetric.Get(operation); v == nil || v.String() == "0" {
+			t.Errorf("Expected the %s errors to be counted, got %v",
+				operation, v)
+		}
+	}
+}
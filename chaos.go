@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Faults injected by -chaos
+const (
+	CHAOS_PROBE_DELAY = "probe_delay"
+	CHAOS_REDIS_DROP  = "redis_drop"
+	CHAOS_LOCK_LOSS   = "lock_loss"
+	// Maximum delay of the probes (milliseconds)
+	CHAOS_DELAY = 5000
+)
+
+var (
+	// Rate of each fault, between 0 and 1 (see -chaos)
+	chaosRates map[string]float64
+	chaosDelay time.Duration
+	errChaos   = errors.New("chaos: Redis operation dropped")
+)
+
+/*
+ * Parses -chaos: comma separated faults with their rate, e.g.
+ * "probe_delay=0.1,redis_drop=0.05,lock_loss=0.01"
+ */
+func parseChaos(spec string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, item := range strings.Split(spec, ",") {
+		fault, value, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found {
+			return nil, fmt.Errorf("Invalid fault %q, expected NAME=RATE", item)
+		}
+		if fault != CHAOS_PROBE_DELAY && fault != CHAOS_REDIS_DROP &&
+			fault != CHAOS_LOCK_LOSS {
+			return nil, fmt.Errorf("Unknown fault %q", fault)
+		}
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("Invalid rate %q of %s, expected 0 to 1",
+				value, fault)
+		}
+		rates[fault] = rate
+	}
+	return rates, nil
+}
+
+/*
+ * Returns true if a fault must be injected now, at the rate of -chaos
+ */
+func injectFault(fault string) bool {
+	rate := chaosRates[fault]
+	if rate <= 0 || rand.Float64() >= rate {
+		return false
+	}
+	chaosMetric.Add(fault, 1)
+	return true
+}
+
+/*
+ * Delays a probe by up to -chaos_delay, as a slow backend or network would
+ */
+func chaosDelayProbe(c *Check) {
+	if chaosDelay <= 0 || !injectFault(CHAOS_PROBE_DELAY) {
+		return
+	}
+	delay := time.Duration(rand.Int63n(int64(chaosDelay)))
+	log.Println(c.BackendUrl, "CHAOS: delaying the probe by", delay)
+	time.Sleep(delay)
+}
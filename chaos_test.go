@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChaos(t *testing.T) {
+	rates, err := parseChaos("probe_delay=0.1, redis_drop=1,lock_loss=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rates[CHAOS_PROBE_DELAY] != 0.1 || rates[CHAOS_REDIS_DROP] != 1 {
+		t.Errorf("Unexpected rates %v", rates)
+	}
+	for _, invalid := range []string{"probe_delay", "disk_full=0.1",
+		"redis_drop=2", "lock_loss=-0.1"} {
+		if _, err := parseChaos(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+	chaosRates = rates
+	redisRetryDelay = time.Millisecond
+	chaosMetric.Init()
+	redisErrorsMetric.Init()
+	defer func() {
+		chaosRates, redisRetryDelay = nil, 100*time.Millisecond
+	}()
+	// Every Redis operation is dropped, and retried
+	called := false
+	err = retryRedis("mark_dead", func() error {
+		called = true
+		return nil
+	})
+	if err != errChaos || called {
+		t.Errorf("Expected the operation to be dropped, got %v", err)
+	}
+	if v := chaosMetric.Get(CHAOS_REDIS_DROP).String(); v != "3" {
+		t.Errorf("Expected 3 dropped attempts, got %s", v)
+	}
+	if v := redisErrorsMetric.Get("mark_dead").String(); v != "3" {
+		t.Errorf("Expected 3 failed attempts, got %s", v)
+	}
+	// Never injected at a rate of 0
+	if injectFault(CHAOS_LOCK_LOSS) {
+		t.Error("Expected no lock loss")
+	}
+}
@@ -1,21 +1,31 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
 	// The HTTP method used for each test
 	HTTP_METHOD = "HEAD"
+	// HEAD, falling back to GET on the backends refusing it
+	METHOD_AUTO = "auto"
 	// The HTTP URI
 	HTTP_URI = "/CloudHealthCheck"
 	// HTTP Host header
@@ -30,61 +40,276 @@ const (
 	CONNECTION_TIMEOUT = 3
 	// IO timeout applies after the connection
 	IO_TIMEOUT = 3
+	// HTTP/2 modes of the probes: HTTP/2 on TLS when the backend supports
+	// it, or HTTP/2 everywhere (h2c on cleartext backends)
+	HTTP2_OFF  = ""
+	HTTP2_AUTO = "auto"
+	HTTP2_H2C  = "h2c"
+	// Connecting to a dual-stack backend, the other address family is tried
+	// after 300ms without a connection
+	HAPPY_EYEBALLS_DELAY = 300
+	// Backends listening on a Unix socket: http+unix:///var/run/app.sock
+	UNIX_SCHEME = "http+unix"
+	// Parsing modes of the dead notifications
+	PARSE_STRICT   = "strict"
+	PARSE_TOLERANT = "tolerant"
+	// The probes confirming a resurrected backend are spread over 10 seconds
+	ALIVE_BURST_PERIOD = 10
 )
 
 var (
-	httpTransport      *http.Transport
-	httpMethod         string
-	httpUri            string
-	httpHost           string
-	httpUserAgent      string
-	checkInterval      time.Duration
+	httpTransports     = make(map[string]*http.Transport)
+	httpTransportsLock sync.Mutex
+	httpVersion        string
+	parseMode          = PARSE_STRICT
+	allowedSchemes     = map[string]bool{"http": true, "https": true}
+	allowLoopback      = false
+	// Backend URLs never probed (see -blacklist)
+	blacklist  *regexp.Regexp
+	httpMethod string
+	// Backends which answered 405 or 501 to HEAD, in -method=auto mode
+	headRefused       = make(map[string]bool)
+	headRefusedLock   sync.Mutex
+	httpUri           string
+	httpHost          string
+	checkInterval     time.Duration
+	fastCheckInterval time.Duration
+	fastCheckWindow   time.Duration
+	// Probes a dead backend must all pass before flagged alive again (see
+	// -alive_burst)
+	aliveBurst         int
+	aliveBurstPeriod   time.Duration
 	checkDuration      = time.Duration(CHECK_DURATION) * time.Second
 	checkBreakInterval = time.Duration(CHECK_BREAK_INTERVAL) * time.Second
 	connectionTimeout  time.Duration
+	certExpiryWindow   time.Duration
+	certExpiryDead     bool
 	ioTimeout          time.Duration
+	ttfbTimeout        time.Duration
+	probeDeadline      time.Duration
+	happyEyeballsDelay = time.Duration(HAPPY_EYEBALLS_DELAY) * time.Millisecond
+
+	httpUserAgent = fmt.Sprintf("dotCloud-HealthCheck/%s %s", VERSION,
+		runtime.Version())
 )
 
+/*
+ * A backend of a frontend, as notified by Hipache, and the state of its
+ * check loop. Only the notification is serialized:
+ *
+ *	{"frontend_key": "www.example.com", "backend_url": "http://10.0.0.1:80",
+ *	 "backend_id": 0, "backend_group_length": 2}
+ */
 type Check struct {
-	BackendUrl         string
-	BackendId          int
-	BackendGroupLength int
-	FrontendKey        string
+	BackendUrl         string `json:"backend_url"`
+	BackendId          int    `json:"backend_id"`
+	BackendGroupLength int    `json:"backend_group_length"`
+	FrontendKey        string `json:"frontend_key"`
 
 	// Goroutine unique signature
 	routineSig string
+	// Set while the backend is failing but not confirmed dead by enough
+	// checker instances (see -quorum)
+	awaitingQuorum bool
+	// Field of the hchecker hash holding our lock
+	lockField string
+	// Set when the lock watcher saw our lock go away (see -lock_events)
+	lockLost int32
+	// Failures are ignored until then, unless the backend was seen alive
+	warmupEnd time.Time
+	// Start of the last check cycle (unix nanoseconds), read by the watchdog
+	lastCycle int64
+	// Number of times the watchdog replaced the check loop
+	generation int32
+	// Closed when the watchdog replaced the loop by a fresh check, the
+	// stuck loop must exit without a trace
+	abandoned chan struct{}
+	// Removes the loop from checkLoops, once it returned or was abandoned
+	loopDone func()
+	// Number of probes and failed probes
+	probes   int64
+	failures int64
+	// Result and duration (nanoseconds) of the last probe
+	lastStatus  int32
+	lastLatency int64
+	// When the backend was flagged dead (unix nanoseconds, 0 when alive)
+	deadSince int64
+	// Set to stop the check loop at the next cycle
+	stopped int32
+	// Wakes the check loop up for an immediate probe
+	recheck chan struct{}
+	// Set while waiting for a probe slot (see -max_probes)
+	queued int32
+	// Last warning about the TLS certificate expiry
+	lastCertWarning time.Time
+	// Why the last probe failed, and its failure code, read by the admin
+	// and the event paths (see lastResult)
+	resultLock sync.Mutex
+	lastReason string
+	lastError  string
+	lastCode   string
+	// Members we added to the dead sets, by frontend, only touched by the
+	// check loop
+	markedDead map[string]string
 
 	// Called when backend dies
 	deadCallback func() bool
 	// Called when the backend comes back to life
 	aliveCallback func() bool
+	// Called after each probe with its result, returns the status to use
+	reconcileCallback func(status bool) bool
 	// Called every CHECK_BREAK_INTERVAL to stop the routine if returned true
 	checkIfBreakCallback func() bool
+	// Called before each probe, returns false when no frontend uses the
+	// backend anymore
+	frontendsCallback func() bool
+	// Called on a failed probe, returns why the failure must be ignored
+	// (empty to count it)
+	ignoreCallback func() string
 	// Called when the check exits
 	exitCallback func()
 }
 
-func NewCheck(line string) (*Check, error) {
+/*
+ * Splits a dead notification: "frontend;url;id;total". In strict mode, any
+ * other format is rejected. In tolerant mode, extra trailing fields are
+ * ignored and the URL may contain semicolons (e.g. in the query string).
+ * Returns the fields of the notification: frontend, URL, id and total.
+ */
+func splitCheckLine(line string) ([]string, bool, error) {
 	parts := strings.Split(strings.TrimSpace(line), ";")
-	if len(parts) != 4 {
-		return nil, errors.New("Invalid check line")
+	if len(parts) < 4 {
+		return nil, false, errors.New("Invalid check line")
+	}
+	if parseMode == PARSE_STRICT || len(parts) == 4 {
+		if len(parts) != 4 {
+			return nil, false, errors.New("Invalid check line")
+		}
+		return parts, false, nil
+	}
+	// Look for the first "id;total" pair after the URL, what follows is
+	// ignored
+	for i := 2; i+1 < len(parts); i++ {
+		if !isNumber(parts[i]) || !isNumber(parts[i+1]) {
+			continue
+		}
+		fields := []string{parts[0], strings.Join(parts[1:i], ";"),
+			parts[i], parts[i+1]}
+		return fields, true, nil
+	}
+	return nil, false, errors.New("Invalid check line")
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func NewCheck(line string) (*Check, error) {
+	parts, tolerated, err := splitCheckLine(line)
+	if err != nil {
+		parseErrorsMetric.Add(1)
+		return nil, err
+	}
+	if tolerated == true {
+		parseToleratedMetric.Add(1)
 	}
 	u, err := url.Parse(parts[1])
 	if err != nil {
+		parseErrorsMetric.Add(1)
 		return nil, err
 	}
-	backendUrl := fmt.Sprintf("%s://%s", u.Scheme, u.Host)
-	backendId, _ := strconv.Atoi(parts[2])
-	backendGroupLength, _ := strconv.Atoi(parts[3])
-	c := &Check{BackendUrl: backendUrl, BackendId: backendId,
-		BackendGroupLength: backendGroupLength, FrontendKey: parts[0]}
-	if len(httpUserAgent) == 0 {
-		httpUserAgent = fmt.Sprintf("dotCloud-HealthCheck/%s %s", VERSION,
-			runtime.Version())
+	// Unix sockets are identified by their path, not by a host
+	address := u.Host
+	if u.Scheme == UNIX_SCHEME {
+		address = u.Path
+	}
+	if parseMode == PARSE_STRICT && (u.Scheme == "" || address == "") {
+		parseErrorsMetric.Add(1)
+		return nil, errors.New("Invalid backend URL")
+	}
+	backendUrl := fmt.Sprintf("%s://%s", u.Scheme, address)
+	backendId, err := strconv.Atoi(parts[2])
+	if err != nil {
+		parseErrorsMetric.Add(1)
+		return nil, errors.New("Invalid backend id")
+	}
+	backendGroupLength, err := strconv.Atoi(parts[3])
+	if err != nil {
+		parseErrorsMetric.Add(1)
+		return nil, errors.New("Invalid number of backends")
+	}
+	c := NewBackendCheck(parts[0], backendUrl, backendId, backendGroupLength)
+	if err := c.Validate(); err != nil {
+		parseErrorsMetric.Add(1)
+		return nil, err
 	}
 	return c, nil
 }
 
+/*
+ * Returns the check of a backend of a frontend, the URL must be normalized
+ * (see parseBackendUrl)
+ */
+func NewBackendCheck(frontendKey string, backendUrl string, backendId int,
+	backendGroupLength int) *Check {
+	c := &Check{}
+	c.init(frontendKey, backendUrl, backendId, backendGroupLength)
+	return c
+}
+
+func (c *Check) init(frontendKey string, backendUrl string, backendId int,
+	backendGroupLength int) {
+	c.BackendUrl, c.BackendId = backendUrl, backendId
+	c.BackendGroupLength, c.FrontendKey = backendGroupLength, frontendKey
+	c.lockField = backendUrl
+	c.recheck = make(chan struct{}, 1)
+	c.abandoned = make(chan struct{})
+}
+
+/*
+ * Returns an error if the check cannot be a backend of a frontend
+ */
+func (c *Check) Validate() error {
+	switch {
+	case c.FrontendKey == "":
+		return errors.New("Invalid frontend")
+	case c.BackendUrl == "":
+		return errors.New("Invalid backend URL")
+	case c.BackendId < 0:
+		return errors.New("Invalid backend id")
+	case c.BackendGroupLength < 0:
+		return errors.New("Invalid number of backends")
+	}
+	return nil
+}
+
+/*
+ * Returns the dead notification of the check, "frontend;url;id;total"
+ */
+func (c *Check) String() string {
+	return fmt.Sprintf("%s;%s;%d;%d", c.FrontendKey, c.BackendUrl,
+		c.BackendId, c.BackendGroupLength)
+}
+
+/*
+ * Decodes a check, normalizing and validating its backend URL
+ */
+func (c *Check) UnmarshalJSON(data []byte) error {
+	// Without the methods of Check
+	type notification Check
+	var n notification
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	backendUrl, err := parseBackendUrl(n.BackendUrl)
+	if err != nil {
+		return err
+	}
+	c.init(n.FrontendKey, backendUrl, n.BackendId, n.BackendGroupLength)
+	return c.Validate()
+}
+
 func (c *Check) SetDeadCallback(callback func() bool) {
 	c.deadCallback = callback
 }
@@ -93,39 +318,596 @@ func (c *Check) SetAliveCallback(callback func() bool) {
 	c.aliveCallback = callback
 }
 
+func (c *Check) SetReconcileCallback(callback func(status bool) bool) {
+	c.reconcileCallback = callback
+}
+
 func (c *Check) SetCheckIfBreakCallback(callback func() bool) {
 	c.checkIfBreakCallback = callback
 }
 
+func (c *Check) SetFrontendsCallback(callback func() bool) {
+	c.frontendsCallback = callback
+}
+
+func (c *Check) SetIgnoreCallback(callback func() string) {
+	c.ignoreCallback = callback
+}
+
 func (c *Check) SetExitCallback(callback func()) {
 	c.exitCallback = callback
 }
 
-func (c *Check) doHttpRequest() (*http.Response, error) {
-	if httpTransport == nil {
-		httpDial := func(proto string, addr string) (net.Conn, error) {
-			conn, err := net.DialTimeout(proto, addr, connectionTimeout)
-			if err != nil {
-				return nil, err
-			}
-			conn.SetDeadline(time.Now().Add(ioTimeout))
-			return conn, nil
+/*
+ * Stops the check loop, the exit callback is called at the next cycle
+ */
+func (c *Check) Stop() {
+	atomic.StoreInt32(&c.stopped, 1)
+}
+
+/*
+ * Returns true once the watchdog replaced the check loop
+ */
+func (c *Check) isAbandoned() bool {
+	select {
+	case <-c.abandoned:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+ * Probes the backend right away instead of waiting for the next cycle
+ */
+func (c *Check) Recheck() {
+	select {
+	case c.recheck <- struct{}{}:
+	default:
+		// Already requested
+	}
+}
+
+/*
+ * Records why the last probe failed, empty if it passed
+ */
+func (c *Check) setLastResult(reason, err string) {
+	c.resultLock.Lock()
+	defer c.resultLock.Unlock()
+	c.lastReason, c.lastError = reason, err
+	c.lastCode = reasonCode(reason)
+}
+
+/*
+ * Returns why the last probe failed, its error and its failure code
+ */
+func (c *Check) lastResult() (reason, err, code string) {
+	c.resultLock.Lock()
+	defer c.resultLock.Unlock()
+	return c.lastReason, c.lastError, c.lastCode
+}
+
+/*
+ * Returns the dialer of the probes. On dual-stack backends, the other address
+ * family is raced after -happy_eyeballs.
+ */
+func newDialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: connectionTimeout,
+		FallbackDelay: happyEyeballsDelay}
+	if len(sourceIPs) > 0 {
+		dialer.Control = bindSource
+	}
+	return dialer
+}
+
+// Context key holding the socket path of the backends on a Unix socket
+type unixSocketKey struct{}
+
+/*
+ * Returns the transport of the probes for an HTTP/2 mode (see -http2) and a
+ * TLS server name (empty = the host of the backend URL)
+ */
+func getTransport(mode, serverName string) *http.Transport {
+	httpTransportsLock.Lock()
+	defer httpTransportsLock.Unlock()
+	key := mode + ";" + serverName
+	if t, exists := httpTransports[key]; exists {
+		return t
+	}
+	httpDial := func(ctx context.Context, proto string, addr string) (net.Conn, error) {
+		if path, ok := ctx.Value(unixSocketKey{}).(string); ok {
+			proto, addr = "unix", path
 		}
-		httpTransport = &http.Transport{
-			DisableKeepAlives:  true,
-			DisableCompression: true,
-			Dial:               httpDial,
+		// Bounded by the probe deadline as well, DNS resolution included
+		dialer := newDialer()
+		conn, err := dialer.DialContext(ctx, proto, addr)
+		if err != nil {
+			return nil, err
 		}
+		conn.SetDeadline(time.Now().Add(ioTimeout))
+		return conn, nil
+	}
+	t := &http.Transport{
+		DisableKeepAlives:  true,
+		DisableCompression: true,
+		DialContext:        httpDial,
+	}
+	// Client certificate and CA bundle of -tls_cert and -tls_ca
+	t.TLSClientConfig = tlsMaterial.get()
+	if serverName != "" {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.ServerName = serverName
+	}
+	switch mode {
+	case HTTP2_AUTO:
+		// Negotiated with ALPN on TLS backends
+		t.ForceAttemptHTTP2 = true
+	case HTTP2_H2C:
+		// Prior knowledge on cleartext backends
+		t.ForceAttemptHTTP2 = true
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP2(true)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+	httpTransports[key] = t
+	return t
+}
+
+/*
+ * Sends the probe. In -method=auto mode, the backends refusing HEAD are
+ * probed again with GET right away, and then always with GET.
+ */
+func (c *Check) doHttpRequest(ctx context.Context,
+	uri string) (*http.Response, error) {
+	if fc := getFrontendConfig(c.FrontendKey); fc != nil && fc.ExpectBody != "" {
+		// The body is needed
+		return c.sendRequest(ctx, "GET", uri)
+	}
+	if httpMethod != METHOD_AUTO {
+		return c.sendRequest(ctx, httpMethod, uri)
 	}
-	req, _ := http.NewRequest(httpMethod, c.BackendUrl, nil)
-	req.URL.Path = httpUri
+	headRefusedLock.Lock()
+	method := "HEAD"
+	if headRefused[c.BackendUrl] == true {
+		method = "GET"
+	}
+	headRefusedLock.Unlock()
+	resp, err := c.sendRequest(ctx, method, uri)
+	if err != nil || method != "HEAD" ||
+		(resp.StatusCode != 405 && resp.StatusCode != 501) {
+		return resp, err
+	}
+	resp.Body.Close()
+	log.Println(c.BackendUrl, "HEAD refused with", resp.StatusCode,
+		"falling back to GET")
+	headRefusedLock.Lock()
+	headRefused[c.BackendUrl] = true
+	headRefusedLock.Unlock()
+	return c.sendRequest(ctx, "GET", uri)
+}
+
+func (c *Check) sendRequest(ctx context.Context,
+	method, uri string) (*http.Response, error) {
+	var req *http.Request
+	if strings.HasPrefix(c.BackendUrl, UNIX_SCHEME+"://") {
+		// The host is not used, the transport dials the socket instead
+		path := strings.TrimPrefix(c.BackendUrl, UNIX_SCHEME+"://")
+		ctx = context.WithValue(ctx, unixSocketKey{}, path)
+		req, _ = http.NewRequestWithContext(ctx, method, "http://unix", nil)
+	} else {
+		req, _ = http.NewRequestWithContext(ctx, method, c.probeUrl(), nil)
+	}
+	req.URL.Path = uri
 	req.Host = httpHost
 	req.Header.Add("User-Agent", httpUserAgent)
+	if auth := getAuthenticator(c.FrontendKey); auth != nil {
+		if err := auth.Authenticate(req); err != nil {
+			// Our credentials are not the backend's fault, probe it anyway
+			log.Println(c.BackendUrl, "Cannot authenticate the probe:", err)
+		}
+	}
 	req.Close = true
-	return httpTransport.RoundTrip(req)
+	mode, serverName := httpVersion, ""
+	fc := getFrontendConfig(c.FrontendKey)
+	if fc != nil && fc.HTTP2 != nil {
+		mode = *fc.HTTP2
+	}
+	if fc != nil && fc.Host != "" {
+		req.Host, serverName = fc.Host, fc.Host
+	}
+	if fc != nil && fc.SNI != "" {
+		serverName = fc.SNI
+	}
+	if fc != nil && fc.ExpectBody != "" {
+		// Decoded by readBody
+		if fc.IdentityEncoding == true {
+			req.Header.Set("Accept-Encoding", "identity")
+		} else {
+			req.Header.Set("Accept-Encoding", "gzip, deflate")
+		}
+	}
+	t := getTransport(mode, serverName)
+	resp, err := t.RoundTrip(req)
+	if err == nil && fc != nil && fc.FollowRedirects == true {
+		return followRedirects(t, resp)
+	}
+	return resp, err
+}
+
+/*
+ * Returns the URL of the HTTP probes: the backend URL, on the health port of
+ * its frontend if any
+ */
+func (c *Check) probeUrl() string {
+	fc := getFrontendConfig(c.FrontendKey)
+	if fc == nil || fc.HealthPort == 0 {
+		return c.BackendUrl
+	}
+	u, err := url.Parse(c.BackendUrl)
+	if err != nil {
+		return c.BackendUrl
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(fc.HealthPort))
+	return u.String()
 }
 
-func (c *Check) PingUrl(ch chan int) {
+/*
+ * Makes sure a backend URL received from Redis is worth probing: the scheme
+ * is whitelisted, the host is a valid hostname or IP address, and it does not
+ * point to the checker itself (unless -allow_loopback is set). Hostnames are
+ * not resolved.
+ */
+func validateBackendUrl(backendUrl string) error {
+	if blacklist != nil && blacklist.MatchString(backendUrl) {
+		return errors.New("Blacklisted backend")
+	}
+	u, err := url.Parse(backendUrl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == UNIX_SCHEME {
+		// A Unix socket is always local
+		if allowLoopback == false {
+			return fmt.Errorf("Unix socket %q is not allowed", u.Path)
+		}
+		if !strings.HasPrefix(u.Path, "/") {
+			return fmt.Errorf("Invalid Unix socket path %q", u.Path)
+		}
+		return nil
+	}
+	if allowedSchemes[u.Scheme] == false {
+		return fmt.Errorf("Scheme %q is not allowed", u.Scheme)
+	}
+	host := u.Hostname()
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("Invalid port %q", port)
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if allowLoopback == false && (ip.IsLoopback() || ip.IsUnspecified()) {
+			return fmt.Errorf("Loopback address %q is not allowed", host)
+		}
+		return nil
+	}
+	if isValidHostname(host) == false {
+		return fmt.Errorf("Invalid hostname %q", host)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if allowLoopback == false && (host == "localhost" ||
+		strings.HasSuffix(host, ".localhost")) {
+		return fmt.Errorf("Loopback address %q is not allowed", host)
+	}
+	return nil
+}
+
+/*
+ * Parses -blacklist: comma separated patterns of backend URLs where "*"
+ * matches anything, e.g. "http://placeholder*,*:1", or a regular expression
+ * between slashes
+ */
+func parseBlacklist(spec string) (*regexp.Regexp, error) {
+	if len(spec) > 1 && strings.HasPrefix(spec, "/") &&
+		strings.HasSuffix(spec, "/") {
+		return regexp.Compile(spec[1 : len(spec)-1])
+	}
+	var patterns []string
+	for _, pattern := range strings.Split(spec, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			return nil, fmt.Errorf("Empty backend pattern in %q", spec)
+		}
+		patterns = append(patterns, strings.Replace(
+			regexp.QuoteMeta(pattern), `\*`, ".*", -1))
+	}
+	return regexp.Compile("^(" + strings.Join(patterns, "|") + ")$")
+}
+
+func isValidHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' ||
+			label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') &&
+				(c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+ * Describes why a probe failed at the connection level
+ */
+func errorReason(err error) string {
+	var (
+		netErr  net.Error
+		dnsErr  *net.DNSError
+		certErr *tls.CertificateVerificationError
+		recErr  tls.RecordHeaderError
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connect refused"
+	case errors.As(err, &certErr), errors.As(err, &recErr):
+		return "tls"
+	}
+	return "connection error"
+}
+
+/*
+ * Probes the backend once. Returns true if the backend is alive
+ */
+func (c *Check) checkStatus() bool {
+	var r probeResult
+	start := time.Now()
+	chaosDelayProbe(c)
+	if fc := getFrontendConfig(c.FrontendKey); fc != nil && len(fc.Probes) > 0 {
+		r = c.runProbes(fc.Probes, fc.ProbesMode)
+	} else {
+		r = c.probeHTTP(httpUri)
+	}
+	atomic.StoreInt64(&c.lastLatency, int64(time.Since(start)))
+	c.setLastResult(r.reason, r.err)
+	probeCache.set(c, r, time.Now())
+	return r.ok
+}
+
+/*
+ * Sends an HTTP probe to the backend
+ */
+func (c *Check) probeHTTP(uri string) probeResult {
+	var r probeResult
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var slow int32
+	if ttfbTimeout > 0 {
+		ctx = withTTFBDeadline(ctx, cancel, &slow)
+	}
+	var phase atomic.Value
+	if probeDeadline > 0 {
+		ctx, cancel = context.WithTimeout(ctx, probeDeadline)
+		defer cancel()
+		ctx = withPhaseTrace(ctx, &phase)
+	}
+	resp, err := c.doHttpRequest(ctx, uri)
+	var redirErr *redirectError
+	if err != nil && atomic.LoadInt32(&slow) == 1 {
+		log.Println(c.BackendUrl, "No response within", ttfbTimeout)
+		r.reason = "ttfb"
+		r.err = fmt.Sprintf("No response byte within %s", ttfbTimeout)
+	} else if errors.As(err, &redirErr) {
+		log.Println(c.BackendUrl, err.Error())
+		r.reason, r.err = redirErr.reason, err.Error()
+	} else if err != nil {
+		// TCP error
+		log.Println(c.BackendUrl, "TCP error:", err.Error())
+		r.reason, r.err = errorReason(err), err.Error()
+	} else {
+		// No TCP error, checking HTTP code
+		if resp.StatusCode >= 500 && resp.StatusCode < 600 &&
+			resp.StatusCode != 503 {
+			log.Println(c.BackendUrl, "HTTP error:", resp.Status)
+			r.reason = strconv.Itoa(resp.StatusCode)
+			r.err = "HTTP error: " + resp.Status
+		} else if err := c.checkBody(resp); err != nil {
+			log.Println(c.BackendUrl, err.Error())
+			r.reason, r.err = "body mismatch", err.Error()
+		} else {
+			r.ok = true
+			log.Println(c.BackendUrl, "OK", resp.StatusCode)
+		}
+		if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 &&
+			c.checkCertificate(resp.TLS.PeerCertificates[0].NotAfter) == false {
+			r.ok = false
+			r.reason = "certificate expiring"
+			r.err = "TLS certificate expires on " +
+				resp.TLS.PeerCertificates[0].NotAfter.Format(time.RFC1123)
+		}
+	}
+	if r.ok == false && ctx.Err() == context.DeadlineExceeded {
+		// Whatever failed, it's because of the deadline
+		current, _ := phase.Load().(string)
+		log.Println(c.BackendUrl, "Deadline exceeded in phase", current)
+		r.reason = "deadline (" + current + ")"
+		r.err = fmt.Sprintf("Probe deadline of %s exceeded in phase %s",
+			probeDeadline, current)
+	}
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+	return r
+}
+
+/*
+ * Records the current phase of the probe: "dns", "connect", "tls", "write"
+ * (sending the request), "response" (waiting for it) and "read"
+ */
+func withPhaseTrace(ctx context.Context, phase *atomic.Value) context.Context {
+	phase.Store("connect")
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			phase.Store("dns")
+		},
+		ConnectStart: func(string, string) {
+			phase.Store("connect")
+		},
+		TLSHandshakeStart: func() {
+			phase.Store("tls")
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			phase.Store("write")
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			phase.Store("response")
+		},
+		GotFirstResponseByte: func() {
+			phase.Store("read")
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace)
+}
+
+/*
+ * Matches the body of the response against the expected content of the
+ * frontend, if any
+ */
+func (c *Check) checkBody(resp *http.Response) error {
+	fc := getFrontendConfig(c.FrontendKey)
+	if fc == nil || fc.ExpectBody == "" {
+		return nil
+	}
+	return matchBody(resp, fc.ExpectBody)
+}
+
+/*
+ * Cancels the probe if the first byte of the response doesn't come within
+ * -ttfb once the request is sent. Sets expired when it does.
+ */
+func withTTFBDeadline(ctx context.Context, cancel context.CancelFunc,
+	expired *int32) context.Context {
+	var (
+		lock      sync.Mutex
+		timer     *time.Timer
+		firstByte = false
+	)
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			lock.Lock()
+			defer lock.Unlock()
+			if firstByte == false {
+				timer = time.AfterFunc(ttfbTimeout, func() {
+					atomic.StoreInt32(expired, 1)
+					cancel()
+				})
+			}
+		},
+		GotFirstResponseByte: func() {
+			lock.Lock()
+			defer lock.Unlock()
+			firstByte = true
+			if timer != nil {
+				timer.Stop()
+			}
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace)
+}
+
+/*
+ * Records the expiry of the backend's TLS certificate. Returns false if it
+ * expires soon and such backends must be flagged dead (see
+ * -cert_expiry_dead)
+ */
+func (c *Check) checkCertificate(notAfter time.Time) bool {
+	setGauge(certExpiryMetric, c.BackendUrl, notAfter.Unix())
+	if certExpiryWindow <= 0 || time.Until(notAfter) >= certExpiryWindow {
+		return true
+	}
+	certExpiringMetric.Add(1)
+	// Don't flood the log, once an hour is enough
+	if time.Since(c.lastCertWarning) >= time.Hour {
+		log.Println(c.BackendUrl, "WARNING: TLS certificate expires on",
+			notAfter.Format(time.RFC1123))
+		c.lastCertWarning = time.Now()
+	}
+	if certExpiryDead == true {
+		log.Println(c.BackendUrl, "TLS certificate expires soon")
+		return false
+	}
+	return true
+}
+
+/*
+ * Probes the backend once, in a probe slot, and records the result. Unless
+ * fresh, the result of a probe within -probe_cache can be reused. Fresh
+ * results are cached for the others all the same.
+ */
+func (c *Check) probe(fresh bool) bool {
+	var status bool
+	probeSlots.acquire(c)
+	if fresh == true {
+		status = c.checkStatus()
+	} else {
+		status = c.cachedCheckStatus()
+	}
+	probeSlots.release()
+	recordResult(c, status)
+	atomic.AddInt64(&c.probes, 1)
+	if status == false {
+		atomic.AddInt64(&c.failures, 1)
+		atomic.StoreInt32(&c.lastStatus, 0)
+		_, _, code := c.lastResult()
+		failureCodesMetric.Add(code, 1)
+	} else {
+		atomic.StoreInt32(&c.lastStatus, 1)
+	}
+	return status
+}
+
+/*
+ * A backend flagged dead by the loop passing a probe again gets a burst of
+ * -alive_burst probes over -alive_burst_period, which must all pass before
+ * it's flagged alive.
+ * Catches the apps accepting connections for a moment while starting, then
+ * crashing.
+ */
+func (c *Check) confirmAlive() bool {
+	if aliveBurst <= 0 {
+		return true
+	}
+	interval := aliveBurstPeriod / time.Duration(aliveBurst)
+	for i := 0; i < aliveBurst; i++ {
+		time.Sleep(interval)
+		atomic.StoreInt64(&c.lastCycle, time.Now().UnixNano())
+		if atomic.LoadInt32(&c.stopped) == 1 || c.isAbandoned() {
+			return false
+		}
+		if c.probe(true) == false {
+			log.Printf("%s Failed probe %d of %d confirming it's alive",
+				c.BackendUrl, i+1, aliveBurst)
+			aliveBurstsMetric.Add("failed", 1)
+			return false
+		}
+	}
+	aliveBurstsMetric.Add("passed", 1)
+	return true
+}
+
+func (c *Check) PingUrl(ctl *backendController) {
 	// Current status, true for alive, false for dead
 	var (
 		lastDeadCall    time.Time
@@ -133,39 +915,63 @@ func (c *Check) PingUrl(ch chan int) {
 		status          = false
 		newStatus       = true
 		firstCheck      = true
+		intake          = true
 		i               = time.Duration(0)
 	)
+	// The watchdog abandons a stuck loop, which must exit silently if it
+	// ever wakes up: checked after each blocking call
 	for {
-		select {
-		case <-ch:
+		atomic.StoreInt64(&c.lastCycle, time.Now().UnixNano())
+		if ctl.Updated() == true {
 			// If we added a frontend to the mapping, we consider it's the
 			// first check
 			firstCheck = true
-		default:
+			intake = true
 		}
-		resp, err := c.doHttpRequest()
-		if err != nil {
-			// TCP error
+		if c.frontendsCallback != nil && c.frontendsCallback() == false {
+			log.Println(c.BackendUrl, "All its frontends have been removed")
+			break
+		}
+		// Only the first probe after a dead notification may reuse a recent
+		// result, the loop's own probes are always fresh
+		newStatus = c.probe(intake == false)
+		intake = false
+		// Only after a failure seen by the loop, not on the first probe
+		if newStatus == true && atomic.LoadInt64(&c.deadSince) > 0 &&
+			c.confirmAlive() == false {
 			newStatus = false
-			log.Println(c.BackendUrl, "TCP error:", err.Error())
-		} else {
-			// No TCP error, checking HTTP code
-			if resp.StatusCode >= 500 && resp.StatusCode < 600 &&
-				resp.StatusCode != 503 {
-				newStatus = false
-				log.Println(c.BackendUrl, "HTTP error:", resp.Status)
-			} else {
-				newStatus = true
-				log.Println(c.BackendUrl, "OK", resp.StatusCode)
+		}
+		if c.isAbandoned() {
+			log.Println(c.BackendUrl, "Stuck check woke up, exiting")
+			return
+		}
+		if c.reconcileCallback != nil {
+			newStatus = c.reconcileCallback(newStatus)
+		}
+		// Failures of a freshly registered backend don't count until it
+		// had time to start, nor those ignored by the callback
+		ignored := false
+		if newStatus == true {
+			c.warmupEnd = time.Time{}
+		} else if time.Now().Before(c.warmupEnd) {
+			ignored = true
+			log.Println(c.BackendUrl, "Warming up, failure ignored")
+		} else if c.ignoreCallback != nil {
+			if reason := c.ignoreCallback(); reason != "" {
+				ignored = true
+				log.Println(c.BackendUrl, reason+", failure ignored")
 			}
 		}
-		if resp != nil && resp.Body != nil {
-			resp.Body.Close()
+		if c.isAbandoned() {
+			return
 		}
 		// Check if the status changed before updating Redis
-		if newStatus != status || firstCheck == true {
+		if ignored == true {
+			// Nothing to update
+		} else if newStatus != status || firstCheck == true {
 			lastStateChange = time.Now()
 			if newStatus == true {
+				atomic.StoreInt64(&c.deadSince, 0)
 				if c.aliveCallback != nil {
 					if r := c.aliveCallback(); r == false {
 						log.Println(c.BackendUrl, "Backend not found in Redis")
@@ -174,6 +980,9 @@ func (c *Check) PingUrl(ch chan int) {
 				}
 				lastDeadCall = time.Time{}
 			} else {
+				if atomic.LoadInt64(&c.deadSince) == 0 {
+					atomic.StoreInt64(&c.deadSince, time.Now().UnixNano())
+				}
 				if c.deadCallback != nil {
 					if r := c.deadCallback(); r == false {
 						log.Println(c.BackendUrl, "Backend not found in Redis")
@@ -184,10 +993,11 @@ func (c *Check) PingUrl(ch chan int) {
 			}
 		} else if newStatus == false {
 			// Backend is still dead. Mark it as dead every 30 seconds to keep
-			// it dead despite the Redis TTL
-			if lastDeadCall.IsZero() == false &&
+			// it dead despite the Redis TTL. While waiting for other
+			// instances to confirm the failure, try on every check.
+			if c.awaitingQuorum == true || (lastDeadCall.IsZero() == false &&
 				time.Since(lastDeadCall) >=
-					(time.Duration(30)*time.Second) {
+					(time.Duration(30)*time.Second)) {
 				if c.deadCallback != nil {
 					if r := c.deadCallback(); r == false {
 						log.Println(c.BackendUrl, "Backend not found in Redis")
@@ -197,12 +1007,30 @@ func (c *Check) PingUrl(ch chan int) {
 				lastDeadCall = time.Now()
 			}
 		}
-		status = newStatus
-		firstCheck = false
-		time.Sleep(checkInterval)
-		i += checkInterval
+		if ignored == false {
+			status = newStatus
+			firstCheck = false
+		}
+		interval := checkInterval
+		if fastCheckInterval > 0 &&
+			time.Since(lastStateChange) < fastCheckWindow {
+			// Confirm quickly the new state after a change
+			interval = fastCheckInterval
+		}
+		select {
+		case <-time.After(interval):
+		case <-c.recheck:
+			log.Println(c.BackendUrl, "Forced check")
+		case <-c.abandoned:
+			return
+		}
+		i += interval
+		if atomic.LoadInt32(&c.stopped) == 1 {
+			break
+		}
 		// At longer interval, we check if still have the lock on the backend
-		if i >= checkBreakInterval {
+		// (right away when the lock watcher saw it go away)
+		if i >= checkBreakInterval || atomic.LoadInt32(&c.lockLost) == 1 {
 			if c.checkIfBreakCallback != nil &&
 				c.checkIfBreakCallback() == true {
 				log.Println(c.BackendUrl, "Lost the lock")
@@ -216,6 +1044,10 @@ func (c *Check) PingUrl(ch chan int) {
 			i = time.Duration(0)
 		}
 	}
+	if c.isAbandoned() {
+		// The fresh check owns the lock now
+		return
+	}
 	if c.exitCallback != nil {
 		log.Println(c.BackendUrl, "Removed check")
 		c.exitCallback()
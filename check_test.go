@@ -0,0 +1,715 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSplitCheckLine(t *testing.T) {
+	tests := []struct {
+		mode      string
+		line      string
+		fields    []string
+		tolerated bool
+	}{
+		{PARSE_STRICT, "www.foo.com;http://10.0.0.1:80;0;2",
+			[]string{"www.foo.com", "http://10.0.0.1:80", "0", "2"}, false},
+		{PARSE_STRICT, "www.foo.com;http://10.0.0.1:80;0;2;extra", nil, false},
+		{PARSE_STRICT, "www.foo.com;http://10.0.0.1:80;0", nil, false},
+		{PARSE_TOLERANT, "www.foo.com;http://10.0.0.1:80;0;2",
+			[]string{"www.foo.com", "http://10.0.0.1:80", "0", "2"}, false},
+		{PARSE_TOLERANT, "www.foo.com;http://10.0.0.1:80;0;2;extra;3",
+			[]string{"www.foo.com", "http://10.0.0.1:80", "0", "2"}, true},
+		{PARSE_TOLERANT, "www.foo.com;http://10.0.0.1:80/?a=1;b=2;1;3",
+			[]string{"www.foo.com", "http://10.0.0.1:80/?a=1;b=2", "1", "3"}, true},
+		{PARSE_TOLERANT, "www.foo.com;http://10.0.0.1:80;a;b;c", nil, false},
+	}
+	defer func() { parseMode = PARSE_STRICT }()
+	for _, test := range tests {
+		parseMode = test.mode
+		fields, tolerated, err := splitCheckLine(test.line)
+		if test.fields == nil {
+			if err == nil {
+				t.Errorf("%s: expected %q to be rejected", test.mode, test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: cannot parse %q: %s", test.mode, test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(fields, test.fields) || tolerated != test.tolerated {
+			t.Errorf("%s: expected %q (tolerated: %t) for %q, got %q (%t)",
+				test.mode, test.fields, test.tolerated, test.line, fields,
+				tolerated)
+		}
+	}
+}
+
+func TestCheckJSON(t *testing.T) {
+	check := &Check{}
+	err := json.Unmarshal([]byte(`{"frontend_key": "www.foo.com",
+		"backend_url": "http://10.0.0.1:80/path", "backend_id": 1,
+		"backend_group_length": 3}`), check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.String() != "www.foo.com;http://10.0.0.1:80;1;3" ||
+		check.lockField != check.BackendUrl || check.recheck == nil {
+		t.Errorf("Unexpected check %+v", check)
+	}
+	data, err := json.Marshal(check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"backend_url":"http://10.0.0.1:80","backend_id":1,` +
+		`"backend_group_length":3,"frontend_key":"www.foo.com"}`
+	if string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+	for _, invalid := range []string{
+		`{"frontend_key": "www.foo.com", "backend_url": "10.0.0.1"}`,
+		`{"backend_url": "http://10.0.0.1:80"}`,
+		`{"frontend_key": "www.foo.com", "backend_url": "http://10.0.0.1:80",
+		  "backend_id": -1}`,
+		`["www.foo.com"]`,
+	} {
+		if err := json.Unmarshal([]byte(invalid), &Check{}); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+	if _, err := NewCheck(";http://10.0.0.1:80;0;2"); err == nil {
+		t.Error("Expected a notification without frontend to be rejected")
+	}
+}
+
+func TestNewCheckRejectsInvalidNumbers(t *testing.T) {
+	errors := parseErrorsMetric.Value()
+	for _, line := range []string{
+		"www.foo.com;http://10.0.0.1:80;x;2",
+		"www.foo.com;http://10.0.0.1:80;0;",
+		"www.foo.com;10.0.0.1;0;2",
+	} {
+		if _, err := NewCheck(line); err == nil {
+			t.Errorf("Expected %q to be rejected", line)
+		}
+	}
+	if n := parseErrorsMetric.Value() - errors; n != 3 {
+		t.Errorf("Expected 3 parse errors to be counted, got %d", n)
+	}
+}
+
+func TestValidateBackendUrl(t *testing.T) {
+	tests := []struct {
+		url      string
+		loopback bool
+		valid    bool
+	}{
+		{"http://10.0.0.1:8080", false, true},
+		{"https://backend-1.example.com", false, true},
+		{"http://[2001:db8::1]:80", false, true},
+		{"ftp://10.0.0.1", false, false},
+		{"://", false, false},
+		{"http://bad_host$name", false, false},
+		{"http://-foo.example.com", false, false},
+		{"http://foo..example.com", false, false},
+		{"http://10.0.0.1:99999", false, false},
+		{"http://127.0.0.1:8080", false, false},
+		{"http://[::1]:8080", false, false},
+		{"http://0.0.0.0:8080", false, false},
+		{"http://localhost:8080", false, false},
+		{"http://LocalHost.:8080", false, false},
+		{"http://127.0.0.1:8080", true, true},
+		{"http://localhost:8080", true, true},
+	}
+	defer func() { allowLoopback = false }()
+	for _, test := range tests {
+		allowLoopback = test.loopback
+		err := validateBackendUrl(test.url)
+		if test.valid && err != nil {
+			t.Errorf("Expected %q to be valid: %s", test.url, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("Expected %q to be rejected", test.url)
+		}
+	}
+}
+
+func TestUnixSocketBackend(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hchecker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uri string
+	srv := &http.Server{Handler: http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			uri = r.URL.Path
+		})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	httpUri = "/CloudHealthCheck"
+	check, err := NewCheck("www.foo.com;http+unix://" + path + ";0;2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.BackendUrl != "http+unix://"+path {
+		t.Errorf("Unexpected backend URL %q", check.BackendUrl)
+	}
+	if err := validateBackendUrl(check.BackendUrl); err == nil {
+		t.Error("Expected the Unix socket to be rejected without -allow_loopback")
+	}
+	resp, err := check.doHttpRequest(context.Background(), httpUri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || uri != httpUri {
+		t.Errorf("Expected a probe on %q, got %d on %q", httpUri,
+			resp.StatusCode, uri)
+	}
+}
+
+func TestTTFBTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(200)
+		}))
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	defer func() { ttfbTimeout = 0 }()
+	check := &Check{BackendUrl: srv.URL}
+	ttfbTimeout = 50 * time.Millisecond
+	if check.checkStatus() == true || check.lastReason != "ttfb" {
+		t.Errorf("Expected the slow backend to fail, got %q", check.lastReason)
+	}
+	ttfbTimeout = 500 * time.Millisecond
+	if check.checkStatus() == false {
+		t.Errorf("Expected the backend to answer in time: %s", check.lastError)
+	}
+}
+
+func TestMethodAuto(t *testing.T) {
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			methods = append(methods, r.Method)
+			if r.Method == "HEAD" {
+				w.WriteHeader(405)
+			}
+		}))
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	httpMethod = METHOD_AUTO
+	defer func() { httpMethod = "" }()
+	check := &Check{BackendUrl: srv.URL}
+	for i := 0; i < 2; i++ {
+		if check.checkStatus() == false {
+			t.Fatalf("Expected the backend to be alive: %s", check.lastError)
+		}
+	}
+	if !reflect.DeepEqual(methods, []string{"HEAD", "GET", "GET"}) {
+		t.Errorf("Expected a single HEAD then GET, got %v", methods)
+	}
+}
+
+func TestProbeDeadline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		}))
+	defer srv.Close()
+	// Accepts the connections but never answers the TLS handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	probeDeadline = 50 * time.Millisecond
+	defer func() { probeDeadline = 0 }()
+	for backendUrl, reason := range map[string]string{
+		srv.URL:                        "deadline (response)",
+		"https://" + l.Addr().String(): "deadline (tls)",
+	} {
+		check := &Check{BackendUrl: backendUrl}
+		if check.checkStatus() == true || check.lastReason != reason {
+			t.Errorf("Expected %q for %s, got %q", reason, backendUrl,
+				check.lastReason)
+		}
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	var remote string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			remote, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}))
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	sourceAddress = "127.0.0.2"
+	sourceIPs, _ = resolveSource(sourceAddress)
+	defer func() {
+		sourceAddress, sourceIPs = "", nil
+	}()
+	check := &Check{BackendUrl: srv.URL}
+	if check.checkStatus() == false {
+		t.Fatal(check.lastError)
+	}
+	if remote != "127.0.0.2" {
+		t.Errorf("Expected the probe to come from 127.0.0.2, got %s", remote)
+	}
+	if _, err := resolveSource("nonexistent0"); err == nil {
+		t.Error("Expected an unknown interface to be rejected")
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	connectionTimeout = time.Second
+	if d := newDialer(); d.FallbackDelay != 300*time.Millisecond ||
+		d.Timeout != time.Second || d.Control != nil {
+		t.Errorf("Expected the default delay of the fallback, got %+v", d)
+	}
+	// Addresses tried one after the other
+	happyEyeballsDelay = -1
+	defer func() {
+		happyEyeballsDelay = time.Duration(HAPPY_EYEBALLS_DELAY) * time.Millisecond
+	}()
+	if d := newDialer(); d.FallbackDelay >= 0 {
+		t.Errorf("Expected the racing to be disabled, got %s", d.FallbackDelay)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	check := &Check{BackendUrl: srv.URL}
+	if check.checkStatus() == false {
+		t.Errorf("Expected the backend to be alive, got %q", check.lastError)
+	}
+}
+
+func TestVhostMapping(t *testing.T) {
+	var host, serverName string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			host = r.Host
+		}))
+	srv.TLS = &tls.Config{GetConfigForClient: func(
+		hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverName = hello.ServerName
+		return nil, nil
+	}}
+	srv.StartTLS()
+	defer srv.Close()
+	// Trust the test certificate, valid for example.com and *.example.com
+	rootCAs := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	for _, name := range []string{"example.com", "www.example.com"} {
+		getTransport(HTTP2_OFF, name).TLSClientConfig.RootCAs = rootCAs
+		defer delete(httpTransports, HTTP2_OFF+";"+name)
+	}
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	frontendConfigs = map[string]*FrontendConfig{
+		"*.foo.com": {Host: "www.example.com", SNI: "example.com"}}
+	defer func() { frontendConfigs = make(map[string]*FrontendConfig) }()
+	check := &Check{BackendUrl: srv.URL, FrontendKey: "www.foo.com"}
+	if check.checkStatus() == false {
+		t.Fatal(check.lastError)
+	}
+	if host != "www.example.com" || serverName != "example.com" {
+		t.Errorf("Expected www.example.com and example.com, got %q and %q",
+			host, serverName)
+	}
+	frontendConfigs["*.foo.com"].SNI = ""
+	if check.checkStatus() == false {
+		t.Fatal(check.lastError)
+	}
+	if serverName != "www.example.com" {
+		t.Errorf("Expected the host as server name, got %q", serverName)
+	}
+}
+
+func TestHealthPort(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	healthPort := srv.Listener.Addr().(*net.TCPAddr).Port
+	// The traffic port, nobody listens on it
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	backendUrl := "http://" + l.Addr().String()
+	l.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	check := &Check{BackendUrl: backendUrl, FrontendKey: "www.foo.com"}
+	if check.checkStatus() == true {
+		t.Fatal("Expected the traffic port to be probed")
+	}
+	frontendConfigs = map[string]*FrontendConfig{
+		"www.foo.com": {HealthPort: healthPort}}
+	defer func() { frontendConfigs = make(map[string]*FrontendConfig) }()
+	if check.checkStatus() == false {
+		t.Fatal(check.lastError)
+	}
+	if _, err := parseFrontendConfigs([]byte(
+		`{"www.foo.com": {"health_port": 70000}}`)); err == nil {
+		t.Error("Expected an invalid health port to be rejected")
+	}
+}
+
+func TestProbeCredentials(t *testing.T) {
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			if authorization == "" {
+				// Only the 5xx are failures
+				w.WriteHeader(502)
+			}
+		}))
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	defer func() { frontendConfigs = make(map[string]*FrontendConfig) }()
+	check := &Check{BackendUrl: srv.URL, FrontendKey: "www.foo.com"}
+	if check.checkStatus() == true {
+		t.Error("Expected the probe without credentials to be rejected")
+	}
+	for _, test := range []struct {
+		config   *FrontendConfig
+		expected string
+	}{
+		// "hchecker:s3cr3t"
+		{&FrontendConfig{Username: "hchecker", Password: "s3cr3t"},
+			"Basic aGNoZWNrZXI6czNjcjN0"},
+		{&FrontendConfig{Token: "abc123"}, "Bearer abc123"},
+	} {
+		frontendConfigs = map[string]*FrontendConfig{"www.foo.com": test.config}
+		if check.checkStatus() == false {
+			t.Errorf("Expected the probe to pass with %+v: %s", test.config,
+				check.lastError)
+		}
+		if authorization != test.expected {
+			t.Errorf("Expected Authorization %q, got %q", test.expected,
+				authorization)
+		}
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	var proto int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.StoreInt32(&proto, int32(r.ProtoMajor))
+		}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	defer func() {
+		httpVersion = HTTP2_OFF
+		frontendConfigs = make(map[string]*FrontendConfig)
+	}()
+	off, h2c := HTTP2_OFF, HTTP2_H2C
+	check := &Check{BackendUrl: srv.URL, FrontendKey: "www.foo.com"}
+	for _, test := range []struct {
+		mode     string
+		override *string
+		expected int32
+	}{
+		{HTTP2_OFF, nil, 1},
+		// Only negotiated on TLS
+		{HTTP2_AUTO, nil, 1},
+		{HTTP2_H2C, nil, 2},
+		{HTTP2_H2C, &off, 1},
+		{HTTP2_OFF, &h2c, 2},
+	} {
+		httpVersion = test.mode
+		frontendConfigs = map[string]*FrontendConfig{
+			"www.foo.com": {HTTP2: test.override}}
+		if check.checkStatus() == false {
+			t.Fatal(check.lastError)
+		}
+		if p := atomic.LoadInt32(&proto); p != test.expected {
+			t.Errorf("Expected HTTP/%d with -http2=%q and %v, got HTTP/%d",
+				test.expected, test.mode, test.override, p)
+		}
+	}
+	if _, err := parseFrontendConfigs([]byte(
+		`{"www.foo.com": {"http2": "h3"}}`)); err == nil {
+		t.Error("Expected an invalid HTTP/2 mode to be rejected")
+	}
+}
+
+func TestLastResult(t *testing.T) {
+	check := NewBackendCheck("www.foo.com", "http://10.0.0.1:80", 0, 2)
+	done := make(chan struct{})
+	// Written by the check loop, read by the admin and the event paths
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			check.setLastResult("timeout", "i/o timeout")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		check.lastResult()
+	}
+	<-done
+	reason, err, code := check.lastResult()
+	if reason != "timeout" || err != "i/o timeout" || code != reasonCode("timeout") {
+		t.Errorf("Unexpected result %q %q %q", reason, err, code)
+	}
+}
+
+func TestCheckCertificate(t *testing.T) {
+	certExpiringMetric.Set(0)
+	defer func() { certExpiryWindow, certExpiryDead = 0, false }()
+	check := &Check{BackendUrl: "https://10.0.0.1:443"}
+	soon := time.Now().Add(24 * time.Hour)
+	if check.checkCertificate(soon) == false {
+		t.Error("Expected the expiry to be ignored without -cert_expiry")
+	}
+	if v := certExpiryMetric.Get(check.BackendUrl); v == nil ||
+		v.String() != strconv.FormatInt(soon.Unix(), 10) {
+		t.Errorf("Expected the expiry to be recorded, got %v", v)
+	}
+	certExpiryWindow = 14 * 24 * time.Hour
+	if check.checkCertificate(time.Now().Add(30*24*time.Hour)) == false ||
+		certExpiringMetric.Value() != 0 {
+		t.Error("Expected a certificate valid for a month to pass")
+	}
+	if check.checkCertificate(soon) == false {
+		t.Error("Expected an expiring certificate to only be reported")
+	}
+	if certExpiringMetric.Value() != 1 || check.lastCertWarning.IsZero() {
+		t.Error("Expected the expiring certificate to be counted and logged")
+	}
+	certExpiryDead = true
+	if check.checkCertificate(soon) == true {
+		t.Error("Expected an expiring certificate to fail the probe")
+	}
+}
+
+func TestBlacklist(t *testing.T) {
+	defer func() { blacklist = nil }()
+	for _, test := range []struct {
+		spec        string
+		blacklisted map[string]bool
+	}{
+		{"http://placeholder*, *:1",
+			map[string]bool{"http://placeholder.example.com": true,
+				"https://10.0.0.1:1": true, "http://10.0.0.1:10": false,
+				"http://www.example.com": false}},
+		{`/\.invalid(:\d+)?$/`,
+			map[string]bool{"http://backend.invalid:8080": true,
+				"http://backend.invalid.example.com": false}},
+	} {
+		var err error
+		if blacklist, err = parseBlacklist(test.spec); err != nil {
+			t.Fatalf("Cannot parse %q: %s", test.spec, err)
+		}
+		for backendUrl, expected := range test.blacklisted {
+			err := validateBackendUrl(backendUrl)
+			if (err != nil) != expected {
+				t.Errorf("%q: expected %s blacklisted: %t, got %v", test.spec,
+					backendUrl, expected, err)
+			}
+		}
+	}
+	if _, err := parseBlacklist("http://a,,http://b"); err == nil {
+		t.Error("Expected an empty pattern to be rejected")
+	}
+}
+
+func TestAliveBurst(t *testing.T) {
+	var probes int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Crashes after a few requests, as a failed start
+			if atomic.AddInt32(&probes, 1) > 3 {
+				w.WriteHeader(502)
+			}
+		}))
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	aliveBurst, aliveBurstPeriod = 2, 20*time.Millisecond
+	defer func() { aliveBurst = 0 }()
+	check := &Check{BackendUrl: srv.URL}
+	if check.confirmAlive() == false {
+		t.Errorf("Expected the backend to pass the burst: %s", check.lastError)
+	}
+	if check.confirmAlive() == true || check.lastReason != "502" {
+		t.Errorf("Expected the backend to fail the burst, got %q",
+			check.lastReason)
+	}
+	if probes != 4 || check.probes != 4 || check.failures != 1 {
+		t.Errorf("Expected 4 probes with 1 failure, got %d and %d",
+			check.probes, check.failures)
+	}
+	aliveBurst = 0
+	if check.confirmAlive() == false || probes != 4 {
+		t.Error("Expected no burst when disabled")
+	}
+}
+
+/*
+ * Runs the loop of a check, returns the function stopping it
+ */
+func runTestLoop(check *Check) func() {
+	ctl := newBackendController(check.BackendUrl)
+	done := make(chan struct{})
+	check.SetExitCallback(func() { close(done) })
+	go check.PingUrl(ctl)
+	return func() {
+		check.Stop()
+		check.Recheck()
+		<-done
+		ctl.stop()
+	}
+}
+
+func TestAliveBurstLoop(t *testing.T) {
+	var failing int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&failing) == 1 {
+				w.WriteHeader(502)
+			}
+		}))
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	checkInterval = 5 * time.Millisecond
+	aliveBurst, aliveBurstPeriod = 2, 10*time.Millisecond
+	defer func() {
+		aliveBurst = 0
+		checkInterval = time.Duration(CHECK_INTERVAL) * time.Second
+	}()
+	aliveBurstsMetric.Init()
+	check := newTestCheck(t, "www.foo.com;"+srv.URL+";0;2")
+	stop := runTestLoop(check)
+	defer stop()
+	// Alive from the start, not a recovery
+	waitFor(t, "the first probes", func() bool {
+		return atomic.LoadInt64(&check.probes) >= 3
+	})
+	if v := aliveBurstsMetric.Get("passed"); v != nil {
+		t.Errorf("Expected no burst for a new check, got %v", v)
+	}
+	atomic.StoreInt32(&failing, 1)
+	waitFor(t, "the failure", func() bool {
+		return atomic.LoadInt64(&check.deadSince) > 0
+	})
+	atomic.StoreInt32(&failing, 0)
+	waitFor(t, "the recovery", func() bool {
+		return atomic.LoadInt64(&check.deadSince) == 0
+	})
+	if v := aliveBurstsMetric.Get("passed"); v == nil || v.String() != "1" {
+		t.Errorf("Expected a burst after the failure, got %v", v)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(502)
+		}))
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	checkInterval = 5 * time.Millisecond
+	defer func() { checkInterval = time.Duration(CHECK_INTERVAL) * time.Second }()
+	for _, test := range []struct {
+		warmupEnd time.Time
+		dead      bool
+	}{
+		{time.Now().Add(time.Hour), false},
+		{time.Now().Add(-time.Second), true},
+	} {
+		var dead int32
+		check := NewBackendCheck("www.foo.com", srv.URL, 0, 2)
+		check.SetDeadCallback(func() bool {
+			atomic.AddInt32(&dead, 1)
+			return true
+		})
+		check.warmupEnd = test.warmupEnd
+		stop := runTestLoop(check)
+		waitFor(t, "3 probes", func() bool {
+			return atomic.LoadInt64(&check.probes) >= 3
+		})
+		stop()
+		if (atomic.LoadInt32(&dead) > 0) != test.dead {
+			t.Errorf("Expected dead=%t with a warm-up until %s, got %d calls",
+				test.dead, test.warmupEnd, dead)
+		}
+	}
+}
+
+func TestFirstSeen(t *testing.T) {
+	r, c := setupCache(t)
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	r.strings["hchecker:seen:http://10.0.0.1:80"] = "1400000000"
+	if seen := c.FirstSeen(check); seen.Unix() != 1400000000 {
+		t.Errorf("Expected the first registration to be kept, got %s", seen)
+	}
+	delete(r.strings, "hchecker:seen:http://10.0.0.1:80")
+	if seen := c.FirstSeen(check); time.Since(seen) > time.Minute {
+		t.Errorf("Expected a new backend to be seen now, got %s", seen)
+	}
+	if ttl := r.ttls["hchecker:seen:http://10.0.0.1:80"]; ttl != SEEN_TTL {
+		t.Errorf("Expected the registration to expire, got %d", ttl)
+	}
+}
+
+func TestFastCheckInterval(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	checkInterval, fastCheckInterval = time.Hour, 5*time.Millisecond
+	defer func() {
+		checkInterval = time.Duration(CHECK_INTERVAL) * time.Second
+		fastCheckInterval, fastCheckWindow = 0, 0
+	}()
+	// Right after the first state change
+	fastCheckWindow = time.Minute
+	check := NewBackendCheck("www.foo.com", srv.URL, 0, 2)
+	stop := runTestLoop(check)
+	waitFor(t, "fast probes", func() bool {
+		return atomic.LoadInt64(&check.probes) >= 3
+	})
+	stop()
+	// Outside of the window, the normal interval applies
+	fastCheckWindow = 0
+	check = NewBackendCheck("www.foo.com", srv.URL, 0, 2)
+	stop = runTestLoop(check)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	if probes := atomic.LoadInt64(&check.probes); probes != 1 {
+		t.Errorf("Expected a single probe at the normal interval, got %d",
+			probes)
+	}
+}
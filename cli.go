@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type command struct {
+	usage string
+	help  string
+	run   func(cache *Cache, args []string) int
+}
+
+var commands = map[string]*command{
+	"check-frontend": {
+		usage: "check-frontend [-warning N] [-critical N] <frontend>",
+		help:  "Probe the backends of a frontend once, as a Nagios plugin",
+		run:   checkFrontendCommand,
+	},
+	"cluster": {
+		usage: "cluster",
+		help:  "List the running instances and the backends they check",
+		run:   clusterCommand,
+	},
+	"validate-config": {
+		usage: "validate-config",
+		help:  "Check the config file, the flags and the Redis connections without starting the checker",
+		run:   validateConfigCommand,
+	},
+	"unlock": {
+		usage: "unlock <backend_url>",
+		help:  "Remove the lock of a backend left by a crashed instance",
+		run:   unlockCommand,
+	},
+	"purge": {
+		usage: "purge [-instance ID] [-dryrun]",
+		help:  "Remove hchecker's keys, of one instance or all (-dryrun only lists them)",
+		run:   purgeCommand,
+	},
+	"report": {
+		usage: "report [-since 24h] [-until TIME] [-backend URL] [-format json|csv] [-hourly]",
+		help:  "Export the recorded probe results and state transitions (see -history)",
+		run:   reportCommand,
+	},
+	"simulate-dead": {
+		usage: "simulate-dead <frontend> <backend_url> <id> <total>",
+		help:  "Publish a dead notification, as Hipache does, to test the whole pipeline",
+		run:   simulateDeadCommand,
+	},
+}
+
+// Sorted for the usage message
+var commandNames = []string{"check-frontend", "cluster", "purge", "report",
+	"simulate-dead", "unlock", "validate-config"}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] [command]\n\nCommands:\n",
+		os.Args[0])
+	for _, name := range commandNames {
+		c := commands[name]
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", c.usage, c.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+/*
+ * Runs a one-shot command instead of the checker, returns the exit code
+ */
+func runCommand(args []string) int {
+	c, exists := commands[args[0]]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+		usage()
+		return 2
+	}
+	cache, err := NewCache()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return c.run(cache, args[1:])
+}
+
+/*
+ * Normalizes a backend URL the same way as the dead notifications
+ */
+func parseBackendUrl(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	address := u.Host
+	if u.Scheme == UNIX_SCHEME {
+		address = u.Path
+	}
+	if u.Scheme == "" || address == "" {
+		return "", fmt.Errorf("Invalid backend URL %q", s)
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, address), nil
+}
+
+func unlockCommand(cache *Cache, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: unlock <backend_url>")
+		return 2
+	}
+	backendUrl, err := parseBackendUrl(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	fields, err := cache.ForceUnlock(backendUrl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot unlock:", err.Error())
+		return 1
+	}
+	if len(fields) == 0 {
+		fmt.Println(backendUrl, "is not locked")
+		return 0
+	}
+	for _, field := range fields {
+		fmt.Println("Removed", field)
+	}
+	return 0
+}
+
+func purgeCommand(cache *Cache, args []string) int {
+	var (
+		instance string
+		removed  []string
+		err      error
+	)
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	flags.StringVar(&instance, "instance", "",
+		"Only remove the keys of this instance (host#pid)")
+	flags.BoolVar(&dryRun, "dryrun", dryRun,
+		"Only list the keys which would be removed")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+	if instance == "" {
+		removed, err = cache.PurgeAll(dryRun)
+	} else {
+		removed, err = cache.PurgeInstances(func(i string) bool {
+			return i == instance
+		}, dryRun)
+	}
+	prefix := "Removed"
+	if dryRun == true {
+		prefix = "Would remove"
+	}
+	for _, desc := range removed {
+		fmt.Println(prefix, desc)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot purge:", err.Error())
+		return 1
+	}
+	if len(removed) == 0 {
+		fmt.Println("Nothing to remove")
+	}
+	return 0
+}
+
+func simulateDeadCommand(cache *Cache, args []string) int {
+	if len(args) != 4 {
+		fmt.Fprintln(os.Stderr,
+			"Usage: simulate-dead <frontend> <backend_url> <id> <total>")
+		return 2
+	}
+	for _, n := range args[2:] {
+		if _, err := strconv.Atoi(n); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid number %q\n", n)
+			return 2
+		}
+	}
+	if isPattern(deadChannel) {
+		fmt.Fprintf(os.Stderr, "-channel %q is a pattern, use -channel to "+
+			"give the channel to publish on\n", deadChannel)
+		return 2
+	}
+	check, err := NewCheck(strings.Join(args, ";"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	// As the checkers read it
+	line := check.String()
+	receivers, err := cache.PublishDead(line)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot publish:", err.Error())
+		return 1
+	}
+	fmt.Printf("Published %q on %q (%d receivers)\n", line, deadChannel,
+		receivers)
+	return 0
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnlockCommand(t *testing.T) {
+	r, c := setupCache(t)
+	c.LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2"))
+	c.LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.10:80;1;2"))
+	for _, args := range [][]string{{}, {"10.0.0.1:80"},
+		{"http://10.0.0.1:80", "http://10.0.0.10:80"}} {
+		if code := unlockCommand(c, args); code != 2 {
+			t.Errorf("Expected a usage error for %q, got %d", args, code)
+		}
+	}
+	if len(r.hashes["hchecker"]) != 4 {
+		t.Fatalf("Expected the locks to stay, got %v", r.hashes["hchecker"])
+	}
+	// Normalized as the dead notifications
+	if code := unlockCommand(c, []string{"http://10.0.0.1:80/"}); code != 0 {
+		t.Errorf("Expected the backend to be unlocked, got %d", code)
+	}
+	if len(r.hashes["hchecker"]) != 2 {
+		t.Errorf("Expected the other backend to stay locked, got %v",
+			r.hashes["hchecker"])
+	}
+	if code := unlockCommand(c, []string{"http://10.0.0.1:80"}); code != 0 {
+		t.Errorf("Expected success when not locked, got %d", code)
+	}
+}
+
+func TestPurgeCommand(t *testing.T) {
+	r, _ := setupCache(t)
+	defer func() { dryRun = false }()
+	for id, backendUrl := range map[string]string{"host#1": "http://10.0.0.1:80",
+		"other#1": "http://10.0.0.2:80"} {
+		myId = id
+		r.cache().LockBackend(newTestCheck(t,
+			"www.foo.com;"+backendUrl+";0;2"))
+		r.strings["hchecker:state:"+id] = "{}"
+		r.cache().PingAlive(heartbeat{Instance: id}, time.Minute)
+	}
+	c := r.cache()
+	if code := purgeCommand(c, []string{"other#1"}); code != 2 {
+		t.Errorf("Expected a usage error, got %d", code)
+	}
+	// Only lists the keys
+	if code := purgeCommand(c, []string{"-instance", "other#1", "-dryrun"}); code != 0 {
+		t.Errorf("Expected success, got %d", code)
+	}
+	if len(r.hashes["hchecker"]) != 4 || !r.exists("hchecker:state:other#1") ||
+		len(r.hashes["hchecker:heartbeats"]) != 2 {
+		t.Errorf("Expected nothing to be removed in dry run, got %v", r.hashes)
+	}
+	dryRun = false
+	if code := purgeCommand(c, []string{"-instance", "other#1"}); code != 0 {
+		t.Errorf("Expected success, got %d", code)
+	}
+	if _, exists := r.hashes["hchecker"]["http://10.0.0.2:80"]; exists ||
+		len(r.hashes["hchecker"]) != 2 {
+		t.Errorf("Expected only the locks of other#1 to be removed, got %v",
+			r.hashes["hchecker"])
+	}
+	if r.exists("hchecker:state:other#1") || !r.exists("hchecker:state:host#1") {
+		t.Error("Expected only the state of other#1 to be removed")
+	}
+	if heartbeats := r.hashes["hchecker:heartbeats"]; len(heartbeats) != 1 ||
+		heartbeats["host#1"] == "" {
+		t.Errorf("Expected only the heartbeat of host#1 to remain, got %v",
+			heartbeats)
+	}
+	// All the instances
+	if code := purgeCommand(c, nil); code != 0 {
+		t.Errorf("Expected success, got %d", code)
+	}
+	if r.exists("hchecker") {
+		t.Errorf("Expected the locks to be removed, got %v", r.hashes["hchecker"])
+	}
+}
+
+func TestSimulateDeadCommand(t *testing.T) {
+	r, c := setupCache(t)
+	deadChannel = "dead"
+	defer func() { deadChannel = "" }()
+	for _, args := range [][]string{{"www.foo.com", "http://10.0.0.1:80", "0"},
+		{"www.foo.com", "http://10.0.0.1:80", "zero", "2"},
+		{"www.foo.com", "10.0.0.1:80", "0", "2"}} {
+		if code := simulateDeadCommand(c, args); code != 2 {
+			t.Errorf("Expected a usage error for %q, got %d", args, code)
+		}
+	}
+	// Published as Hipache does, with the URL normalized
+	code := simulateDeadCommand(c, []string{"www.foo.com", "http://10.0.0.1:80/",
+		"0", "2"})
+	if code != 0 {
+		t.Errorf("Expected success, got %d", code)
+	}
+	expected := []fakeMessage{{"dead", "www.foo.com;http://10.0.0.1:80;0;2"}}
+	if !reflect.DeepEqual(r.published, expected) {
+		t.Errorf("Expected %v to be published, got %v", expected, r.published)
+	}
+	// Cannot publish on a pattern
+	deadChannel = "dead-*"
+	code = simulateDeadCommand(c, []string{"www.foo.com", "http://10.0.0.1:80",
+		"0", "2"})
+	if code != 2 || len(r.published) != 1 {
+		t.Errorf("Expected a pattern to be refused, got %d and %v", code,
+			r.published)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Metric data of each PutMetricData call
+	CLOUDWATCH_BATCH = 20
+	// Instance metadata service of EC2, for the credentials of the role
+	EC2_METADATA = "http://169.254.169.254/latest"
+)
+
+/*
+ * AWS credentials, from the environment or the role of the EC2 instance
+ */
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+/*
+ * Publishes the dead backends and the latency of the probes per frontend to
+ * CloudWatch, with the PutMetricData API
+ */
+type cloudwatchSink struct {
+	namespace   string
+	region      string
+	endpoint    string
+	client      *http.Client
+	credentials *awsCredentials
+}
+
+func newCloudwatchSink(namespace, region string) (*cloudwatchSink, error) {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("The AWS region is needed for CloudWatch")
+	}
+	return &cloudwatchSink{namespace: namespace, region: region,
+		endpoint: "https://monitoring." + region + ".amazonaws.com/",
+		client:   &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (s *cloudwatchSink) String() string {
+	return "CloudWatch"
+}
+
+/*
+ * Returns the credentials of the environment, or those of the role of the
+ * EC2 instance (IMDSv2), renewed before they expire
+ */
+func (s *cloudwatchSink) getCredentials() (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{AccessKeyId: id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if c := s.credentials; c != nil &&
+		time.Until(c.Expiration) > 5*time.Minute {
+		return c, nil
+	}
+	get := func(method, path string, header http.Header) (string, error) {
+		req, _ := http.NewRequest(method, EC2_METADATA+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return strings.TrimSpace(string(data)), err
+	}
+	token, err := get("PUT", "/api/token", http.Header{
+		"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"}})
+	if err != nil {
+		return nil, fmt.Errorf("No AWS credentials: %s", err)
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {token}}
+	const path = "/meta-data/iam/security-credentials/"
+	role, err := get("GET", path, header)
+	if err != nil {
+		return nil, err
+	}
+	data, err := get("GET", path+strings.SplitN(role, "\n", 2)[0], header)
+	if err != nil {
+		return nil, err
+	}
+	c := &awsCredentials{}
+	if err := json.Unmarshal([]byte(data), c); err != nil {
+		return nil, err
+	}
+	s.credentials = c
+	return c, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+ * Signs a request with AWS Signature Version 4
+ */
+func signAWSRequest(req *http.Request, body, region, service string,
+	c *awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.Token)
+	}
+	var names []string
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{req.Method, path,
+		req.URL.RawQuery, canonicalHeaders, signedHeaders,
+		sha256Hex(body)}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		sha256Hex(canonical)
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyId, scope, signedHeaders,
+		hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+/*
+ * Returns the number of dead backends of frontends
+ */
+func (c *Cache) DeadBackendsCount(frontends []string) (map[string]int, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	for _, frontend := range frontends {
+		conn.Send("SCARD", "dead:"+frontend)
+	}
+	conn.Flush()
+	counts := make(map[string]int)
+	for _, frontend := range frontends {
+		n, err := redis.Int(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		counts[frontend] = n
+	}
+	return counts, nil
+}
+
+type cloudwatchDatum struct {
+	name     string
+	frontend string
+	value    float64
+	unit     string
+}
+
+/*
+ * Returns the metric data of a batch: the average latency of the probes
+ * and the dead backends (read from Redis) of each frontend of the checked
+ * backends
+ */
+func cloudwatchData(events []*Event, dead map[string]int) []cloudwatchDatum {
+	latency := make(map[string]float64)
+	probes := make(map[string]int)
+	for _, event := range events {
+		if event.Type != EVENT_PASSED && event.Type != EVENT_FAILED {
+			continue
+		}
+		for frontend := range event.Frontends {
+			latency[frontend] += event.LatencyMs
+			probes[frontend] += 1
+		}
+	}
+	var data []cloudwatchDatum
+	for frontend, n := range dead {
+		data = append(data, cloudwatchDatum{"DeadBackends", frontend,
+			float64(n), "Count"})
+	}
+	for frontend, n := range probes {
+		data = append(data, cloudwatchDatum{"CheckLatency", frontend,
+			latency[frontend] / float64(n), "Milliseconds"})
+	}
+	sort.Slice(data, func(i, j int) bool {
+		if data[i].name != data[j].name {
+			return data[i].name < data[j].name
+		}
+		return data[i].frontend < data[j].frontend
+	})
+	return data
+}
+
+func (s *cloudwatchSink) Send(events []*Event) error {
+	frontends := make(map[string]bool)
+	for _, event := range events {
+		for frontend := range event.Frontends {
+			frontends[frontend] = true
+		}
+	}
+	if len(frontends) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(frontends))
+	for frontend := range frontends {
+		names = append(names, frontend)
+	}
+	dead, err := cache.DeadBackendsCount(names)
+	if err != nil {
+		return err
+	}
+	data := cloudwatchData(events, dead)
+	for len(data) > 0 {
+		n := len(data)
+		if n > CLOUDWATCH_BATCH {
+			n = CLOUDWATCH_BATCH
+		}
+		if err := s.putMetricData(data[:n], time.Now()); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (s *cloudwatchSink) putMetricData(data []cloudwatchDatum,
+	now time.Time) error {
+	c, err := s.getCredentials()
+	if err != nil {
+		return err
+	}
+	form := url.Values{"Action": {"PutMetricData"},
+		"Version": {"2010-08-01"}, "Namespace": {s.namespace}}
+	for i, d := range data {
+		prefix := "MetricData.member." + strconv.Itoa(i+1) + "."
+		form.Set(prefix+"MetricName", d.name)
+		form.Set(prefix+"Dimensions.member.1.Name", "Frontend")
+		form.Set(prefix+"Dimensions.member.1.Value", d.frontend)
+		form.Set(prefix+"Value", strconv.FormatFloat(d.value, 'f', -1, 64))
+		form.Set(prefix+"Unit", d.unit)
+		form.Set(prefix+"Timestamp", now.UTC().Format(time.RFC3339))
+	}
+	body := form.Encode()
+	req, err := http.NewRequest("POST", s.endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type",
+		"application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, body, s.region, "monitoring", c, now)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// get-vanilla of the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	c := &awsCredentials{AccessKeyId: "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signAWSRequest(req, "", "us-east-1", "service", c, now)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Unexpected signature %q", auth)
+	}
+}
+
+func TestCloudwatchSink(t *testing.T) {
+	var form url.Values
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form, auth = r.PostForm, r.Header.Get("Authorization")
+		}))
+	defer srv.Close()
+	var r *fakeRedis
+	r, cache = setupCache(t)
+	defer func() { cache = nil }()
+	r.sets["dead:www.foo.com"] = map[string]bool{"1": true}
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	s, err := newCloudwatchSink("Hipache", "eu-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.endpoint = srv.URL + "/"
+	frontends := map[string]int{"www.foo.com": 0}
+	err = s.Send([]*Event{
+		{Type: EVENT_PASSED, Frontends: frontends, LatencyMs: 2},
+		{Type: EVENT_FAILED, Frontends: frontends, LatencyMs: 4},
+		{Type: EVENT_DEAD, Frontends: frontends},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"Action":                                        "PutMetricData",
+		"Namespace":                                     "Hipache",
+		"MetricData.member.1.MetricName":                "CheckLatency",
+		"MetricData.member.1.Value":                     "3",
+		"MetricData.member.1.Unit":                      "Milliseconds",
+		"MetricData.member.2.MetricName":                "DeadBackends",
+		"MetricData.member.2.Value":                     "1",
+		"MetricData.member.2.Dimensions.member.1.Name":  "Frontend",
+		"MetricData.member.2.Dimensions.member.1.Value": "www.foo.com",
+	} {
+		if form.Get(key) != value {
+			t.Errorf("Expected %s=%s, got %q", key, value, form.Get(key))
+		}
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+		!strings.Contains(auth, "/eu-west-1/monitoring/aws4_request") {
+		t.Errorf("Unexpected authorization %q", auth)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Heartbeat every 10 seconds, expiring after 3 missed ones
+	HEARTBEAT_INTERVAL = 10
+	HEARTBEAT_MISSED   = 3
+)
+
+/*
+ * Written every -heartbeat_interval to hchecker:alive:<instance> (see
+ * -heartbeat_key)
+ */
+type heartbeat struct {
+	Instance string `json:"instance"`
+	Time     int64  `json:"time"`
+	Backends int    `json:"backends"`
+	Draining bool   `json:"draining"`
+	// Memory obtained from the system and allocated on the heap (bytes)
+	MemorySys   uint64 `json:"memory_sys"`
+	MemoryAlloc uint64 `json:"memory_alloc"`
+	Goroutines  int    `json:"goroutines"`
+	// Dead notifications waiting to be handled
+	QueueDepth int `json:"queue_depth"`
+	// Last error of the instance itself (Redis...), not of a backend
+	LastError     string `json:"last_error,omitempty"`
+	LastErrorTime int64  `json:"last_error_time,omitempty"`
+}
+
+var (
+	heartbeatInterval = time.Duration(HEARTBEAT_INTERVAL) * time.Second
+	// Prefix of the heartbeat keys, default is hchecker:alive:
+	heartbeatKeyPrefix string
+	lastError          string
+	lastErrorTime      time.Time
+	lastErrorLock      sync.Mutex
+)
+
+/*
+ * Logs an error of the instance itself, reported in the heartbeat
+ */
+func logError(v ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	log.Println(msg)
+	lastErrorLock.Lock()
+	lastError, lastErrorTime = msg, time.Now()
+	lastErrorLock.Unlock()
+}
+
+/*
+ * An instance of the cluster, alive or holding locks
+ */
+type clusterInstance struct {
+	heartbeat
+	Alive bool `json:"alive"`
+	// Backends locked by the instance
+	Owns []string `json:"owns"`
+}
+
+func newHeartbeat() heartbeat {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	hb := heartbeat{
+		Instance:    myId,
+		Time:        time.Now().Unix(),
+		Backends:    len(watchedCheckList()),
+		Draining:    isDraining(),
+		MemorySys:   mem.Sys,
+		MemoryAlloc: mem.HeapAlloc,
+		Goroutines:  runtime.NumGoroutine(),
+		QueueDepth:  deadQueue.Len(),
+	}
+	lastErrorLock.Lock()
+	defer lastErrorLock.Unlock()
+	if lastError != "" {
+		hb.LastError, hb.LastErrorTime = lastError, lastErrorTime.Unix()
+	}
+	return hb
+}
+
+/*
+ * Returns the heartbeat key of an instance
+ */
+func (c *Cache) heartbeatKey(instance string) string {
+	if heartbeatKeyPrefix != "" {
+		return heartbeatKeyPrefix + instance
+	}
+	return c.metaKey("alive:" + instance)
+}
+
+/*
+ * Writes the heartbeat on its own loop, whatever the rest of the checker
+ * is doing. A failure or a panic only skips a beat.
+ */
+func runHeartbeat(cache *Cache) {
+	beat := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logError("Heartbeat failed:", r)
+			}
+		}()
+		err := cache.PingAlive(newHeartbeat(),
+			HEARTBEAT_MISSED*heartbeatInterval)
+		if err != nil {
+			logError("Cannot write the heartbeat:", err.Error())
+		}
+	}
+	for {
+		beat()
+		if !cache.wait(heartbeatInterval) {
+			return
+		}
+	}
+}
+
+/*
+ * Returns the instances with a heartbeat, and the ones without a heartbeat
+ * still holding locks (crashed), sorted by name
+ */
+func (c *Cache) Cluster() ([]*clusterInstance, error) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	keys, err := scanKeys(conn, c.heartbeatKey("*"))
+	if err != nil {
+		return nil, err
+	}
+	instances := make(map[string]*clusterInstance)
+	get := func(instance string) *clusterInstance {
+		if _, exists := instances[instance]; !exists {
+			instances[instance] = &clusterInstance{
+				heartbeat: heartbeat{Instance: instance}, Owns: []string{}}
+		}
+		return instances[instance]
+	}
+	for _, key := range keys {
+		data, err := redis.Bytes(conn.Do("GET", key))
+		if err != nil {
+			// Expired meanwhile
+			continue
+		}
+		i := get(strings.TrimPrefix(key, c.heartbeatKey("")))
+		json.Unmarshal(data, &i.heartbeat)
+		i.Alive = true
+	}
+	lockConn := c.lockNodes()[0].Get()
+	defer lockConn.Close()
+	locks, err := redis.StringMap(lockConn.Do("HGETALL", c.redisKey))
+	if err != nil {
+		return nil, err
+	}
+	for field, sig := range locks {
+		// Locks hold "instance;timestamp", skip the sync keys
+		i := strings.LastIndex(sig, ";")
+		if i < 0 {
+			continue
+		}
+		backendUrl := field
+		if j := strings.LastIndex(field, "#"); j >= 0 &&
+			isNumber(field[j+1:]) {
+			// Redundancy slot
+			backendUrl = field[:j]
+		}
+		owner := get(sig[:i])
+		owner.Owns = append(owner.Owns, backendUrl)
+	}
+	var cluster []*clusterInstance
+	for _, i := range instances {
+		sort.Strings(i.Owns)
+		cluster = append(cluster, i)
+	}
+	sort.Slice(cluster, func(a, b int) bool {
+		return cluster[a].Instance < cluster[b].Instance
+	})
+	return cluster, nil
+}
+
+/*
+ * GET /cluster returns the instances and the backends they own
+ */
+func clusterHandler(w http.ResponseWriter, r *http.Request) {
+	cluster, err := cache.Cluster()
+	if err != nil {
+		http.Error(w, "Cannot read the cluster: "+err.Error(),
+			http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cluster)
+}
+
+func clusterCommand(cache *Cache, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cluster")
+		return 2
+	}
+	cluster, err := cache.Cluster()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot read the cluster:", err.Error())
+		return 1
+	}
+	for _, i := range cluster {
+		state := "crashed (no heartbeat)"
+		if i.Alive == true {
+			state = fmt.Sprintf("alive, seen %s ago",
+				time.Since(time.Unix(i.Time, 0)).Truncate(time.Second))
+			if i.Draining == true {
+				state += ", draining"
+			}
+		}
+		fmt.Printf("%s: %s, %d backends\n", i.Instance, state, len(i.Owns))
+		for _, backendUrl := range i.Owns {
+			fmt.Println("   ", backendUrl)
+		}
+	}
+	if len(cluster) == 0 {
+		fmt.Println("No instance running")
+	}
+	return 0
+}
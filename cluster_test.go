@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCluster(t *testing.T) {
+	r, cache := setupCache(t)
+	redundancy = 2
+	defer func() { redundancy = 1 }()
+	cache.PingAlive(heartbeat{Instance: myId, Time: 1400000000, Backends: 2},
+		time.Minute)
+	cache.LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2"))
+	cache.LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.2:80;1;2"))
+	// Crashed instance, checking the first backend as well
+	r.hashes["hchecker"]["http://10.0.0.1:80#2"] = "other#1;1.1"
+	r.hashes["hchecker"]["http://10.0.0.1:80;other#1"] = "1"
+	cluster, err := cache.Cluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cluster) != 2 {
+		t.Fatalf("Expected 2 instances, got %d", len(cluster))
+	}
+	if i := cluster[0]; i.Instance != "host#1" || i.Alive == false ||
+		i.Backends != 2 || !reflect.DeepEqual(i.Owns,
+		[]string{"http://10.0.0.1:80", "http://10.0.0.2:80"}) {
+		t.Errorf("Unexpected live instance %+v", i)
+	}
+	if i := cluster[1]; i.Instance != "other#1" || i.Alive == true ||
+		!reflect.DeepEqual(i.Owns, []string{"http://10.0.0.1:80"}) {
+		t.Errorf("Unexpected crashed instance %+v", i)
+	}
+	if key := r.hashes["hchecker:heartbeats"]["host#1"]; key != "hchecker:alive:host#1" {
+		t.Errorf("Expected the heartbeat key to be recorded, got %q", key)
+	}
+	cache.ClearAlive()
+	if r.exists("hchecker:alive:host#1") || len(r.hashes["hchecker:heartbeats"]) > 0 {
+		t.Error("Expected the heartbeat to be removed")
+	}
+}
+
+func TestHeartbeatLastError(t *testing.T) {
+	defer func() { lastError = "" }()
+	if hb := newHeartbeat(); hb.LastError != "" || hb.Goroutines == 0 ||
+		hb.MemorySys == 0 {
+		t.Errorf("Unexpected heartbeat %+v", hb)
+	}
+	logError("Cannot reach Redis:", "i/o timeout")
+	if hb := newHeartbeat(); hb.LastError != "Cannot reach Redis: i/o timeout" ||
+		hb.LastErrorTime == 0 {
+		t.Errorf("Expected the last error in the heartbeat, got %+v", hb)
+	}
+}
+
+func TestHeartbeatKey(t *testing.T) {
+	r, cache := setupCache(t)
+	heartbeatKeyPrefix = "monitoring:hchecker:"
+	defer func() { heartbeatKeyPrefix = "" }()
+	cache.PingAlive(newHeartbeat(), 30*time.Second)
+	if !r.exists("monitoring:hchecker:host#1") {
+		t.Fatalf("Expected the heartbeat under the prefix, got %v", r.keys())
+	}
+	cluster, _ := cache.Cluster()
+	if len(cluster) != 1 || cluster[0].Instance != "host#1" {
+		t.Errorf("Expected host#1 in the cluster, got %v", cluster)
+	}
+}
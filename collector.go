@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Attempts of each batch before it's given up
+const COLLECTOR_ATTEMPTS = 4
+
+// Delay before the first retry, doubled after each attempt
+var collectorBackoff = time.Second
+
+/*
+ * POSTs the events as JSON to a remote collector, gathering the results
+ * of many instances and Redis clusters
+ */
+type collectorSink struct {
+	url    string
+	client *http.Client
+}
+
+/*
+ * Batch of events sent to the collector
+ */
+type collectorBatch struct {
+	Instance string   `json:"instance"`
+	Redis    string   `json:"redis"`
+	Events   []*Event `json:"events"`
+}
+
+func newCollectorSink(address string) (*collectorSink, error) {
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return nil, fmt.Errorf("Invalid collector URL %q", address)
+	}
+	return &collectorSink{url: address,
+		client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (s *collectorSink) String() string {
+	return "the collector"
+}
+
+func (s *collectorSink) Send(events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(&collectorBatch{Instance: myId,
+		Redis: getRedisAddress(), Events: events})
+	if err != nil {
+		return err
+	}
+	backoff := collectorBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(data)
+		if err == nil || !retry || attempt == COLLECTOR_ATTEMPTS {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+/*
+ * Sends a batch once, returns whether it's worth retrying on error: not
+ * when the collector rejects it
+ */
+func (s *collectorSink) post(data []byte) (bool, error) {
+	resp, err := s.client.Post(s.url, "application/json",
+		bytes.NewReader(data))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode/100 == 5:
+		return true, fmt.Errorf("%s", resp.Status)
+	}
+	return false, fmt.Errorf("%s", resp.Status)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCollectorSink(t *testing.T) {
+	var (
+		attempts int
+		batch    collectorBatch
+	)
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			attempts += 1
+			if attempts < 3 {
+				w.WriteHeader(status)
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&batch)
+		}))
+	defer srv.Close()
+	collectorBackoff = time.Millisecond
+	defer func() { collectorBackoff = time.Second }()
+	myId = "host#1"
+	s, err := newCollectorSink(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []*Event{{Type: EVENT_FAILED, BackendUrl: "http://10.0.0.1:80",
+		Reason: "timeout"}}
+	if err := s.Send(events); err != nil {
+		t.Fatalf("Expected the batch to be sent after 2 retries: %s", err)
+	}
+	if attempts != 3 || batch.Instance != "host#1" || len(batch.Events) != 1 ||
+		batch.Events[0].Reason != "timeout" {
+		t.Errorf("Unexpected batch after %d attempts: %+v", attempts, batch)
+	}
+	// Rejected batches are not retried
+	attempts, status = 0, http.StatusBadRequest
+	if err := s.Send(events); err == nil || attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d (%v)", attempts, err)
+	}
+	// Given up after the last attempt
+	attempts, status = -10, http.StatusInternalServerError
+	if err := s.Send(events); err == nil || attempts != -10+COLLECTOR_ATTEMPTS {
+		t.Errorf("Expected %d attempts, got %d (%v)", COLLECTOR_ATTEMPTS,
+			attempts+10, err)
+	}
+	if _, err := newCollectorSink("collector:8080"); err == nil {
+		t.Error("Expected a URL without scheme to be rejected")
+	}
+}
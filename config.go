@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Prefix of the environment variables setting the flags
+const ENV_PREFIX = "HCHECKER_"
+
+var configFile string
+
+/*
+ * Returns the environment variable of a flag: HCHECKER_REDIS for -redis
+ */
+func envName(flagName string) string {
+	return ENV_PREFIX + strings.ToUpper(flagName)
+}
+
+/*
+ * Sets the flags from the HCHECKER_* environment variables, e.g.
+ * HCHECKER_REDIS=10.0.0.1:6379 HCHECKER_INTERVAL=5. Flags given on the
+ * command line take precedence over the environment, which takes precedence
+ * over the config file (HCHECKER_CONFIG included).
+ */
+func loadEnv(fs *flag.FlagSet, environ []string) error {
+	isSet := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		isSet[f.Name] = true
+	})
+	names := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		names[envName(f.Name)] = f.Name
+	})
+	for _, v := range environ {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], ENV_PREFIX) {
+			continue
+		}
+		name, exists := names[parts[0]]
+		if !exists {
+			log.Printf("Warning: %s is not an option, ignored", parts[0])
+			continue
+		}
+		if isSet[name] {
+			continue
+		}
+		if err := fs.Set(name, parts[1]); err != nil {
+			return fmt.Errorf("Invalid value for option %q in %s: %s", name,
+				parts[0], err)
+		}
+	}
+	return nil
+}
+
+/*
+ * Loads the options from a JSON config file. Keys are the flag names:
+ * {"redis": "10.0.0.1:6379", "channel": "dead", "interval": 5}
+ * Flags given on the command line take precedence over the file.
+ * The "frontends" key holds the per-frontend settings (see FrontendConfig).
+ */
+func loadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var values map[string]interface{}
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("Cannot parse config file %q: %s", path, err)
+	}
+	isSet := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		isSet[f.Name] = true
+	})
+	frontends, hasFrontends := values["frontends"]
+	delete(values, "frontends")
+	for name, value := range values {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("Unknown option %q in config file %q", name, path)
+		}
+		if isSet[name] {
+			continue
+		}
+		if err := flag.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("Invalid value for option %q in config file %q: %s",
+				name, path, err)
+		}
+	}
+	// After the options, the frontends may use the plugins or Vault
+	if hasFrontends {
+		data, _ := json.Marshal(frontends)
+		configs, err := parseFrontendConfigs(data)
+		if err != nil {
+			return fmt.Errorf("Invalid frontends in config file %q: %s",
+				path, err)
+		}
+		frontendConfigs = configs
+	}
+	return nil
+}
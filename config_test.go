@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadEnv(t *testing.T) {
+	fs := flag.NewFlagSet("hchecker", flag.ContinueOnError)
+	redis := fs.String("redis", "localhost:6379", "")
+	interval := fs.Int("interval", 3, "")
+	dryRun := fs.Bool("dryrun", false, "")
+	channel := fs.String("channel", "dead", "")
+	if err := fs.Parse([]string{"-channel", "dead-cli"}); err != nil {
+		t.Fatal(err)
+	}
+	err := loadEnv(fs, []string{"PATH=/bin", "HCHECKER_REDIS=10.0.0.1:6379",
+		"HCHECKER_INTERVAL=5", "HCHECKER_DRYRUN=true",
+		"HCHECKER_CHANNEL=dead-env", "HCHECKER_UNKNOWN=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *redis != "10.0.0.1:6379" || *interval != 5 || *dryRun == false {
+		t.Errorf("Expected the flags from the environment, got %s %d %t",
+			*redis, *interval, *dryRun)
+	}
+	if *channel != "dead-cli" {
+		t.Errorf("Expected the command line to take precedence, got %s",
+			*channel)
+	}
+	fs = flag.NewFlagSet("hchecker", flag.ContinueOnError)
+	fs.Int("interval", 3, "")
+	if err := loadEnv(fs, []string{"HCHECKER_INTERVAL=" +
+		time.Second.String()}); err == nil {
+		t.Error("Expected an invalid value to be rejected")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	commandLine := flag.CommandLine
+	defer func() { flag.CommandLine = commandLine }()
+	flag.CommandLine = flag.NewFlagSet("hchecker", flag.ContinueOnError)
+	channel := flag.String("channel", "dead", "")
+	interval := flag.Int("interval", 3, "")
+	if err := flag.CommandLine.Parse([]string{"-interval=7"}); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "hchecker.json")
+	write := func(data string) {
+		if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"channel": "dead-shop", "interval": 5}`)
+	if err := loadConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if *channel != "dead-shop" {
+		t.Errorf("Expected the channel of the config file, got %s", *channel)
+	}
+	if *interval != 7 {
+		t.Errorf("Expected the command line to take precedence, got %d",
+			*interval)
+	}
+	for _, invalid := range []string{`{"no_such_option": 1}`,
+		`{"channel": "dead", "interval": "soon"}`, `{"channel": `} {
+		write(invalid)
+		flag.CommandLine = flag.NewFlagSet("hchecker", flag.ContinueOnError)
+		flag.String("channel", "dead", "")
+		flag.Int("interval", 3, "")
+		if err := loadConfig(filename); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+	if err := loadConfig(filename + ".missing"); err == nil {
+		t.Error("Expected a missing config file to be reported")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"sync"
+)
+
+// Commands of a backend controller
+const (
+	CONTROL_ADD = iota
+	CONTROL_SET_ID
+	CONTROL_REMOVE
+	CONTROL_NOTIFY
+	CONTROL_FRONTENDS
+	CONTROL_COUNT
+	CONTROL_UPDATED
+)
+
+type controlCommand struct {
+	op          int
+	frontendKey string
+	id          int
+	reply       chan controlReply
+}
+
+type controlReply struct {
+	// Copy of the frontends of the backend
+	frontends map[string]int
+	// Number of frontends left
+	count   int
+	updated bool
+}
+
+/*
+ * Owns the frontends of a backend, map[FRONTEND_NAME] = BACKEND_ID. The
+ * subscribers and the check loop never touch the frontends, they send their
+ * commands to the goroutine of the controller on its control channel, in
+ * order. The check loop asks on each cycle if frontends have been added since
+ * its last one, so no update is lost however many come in between.
+ */
+type backendController struct {
+	backendUrl string
+	control    chan controlCommand
+	// Closed by stop, then the goroutine exits and closes done
+	stopping chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newBackendController(backendUrl string) *backendController {
+	c := &backendController{backendUrl: backendUrl,
+		control:  make(chan controlCommand),
+		stopping: make(chan struct{}),
+		done:     make(chan struct{})}
+	go c.run()
+	return c
+}
+
+func (c *backendController) run() {
+	defer close(c.done)
+	frontends := make(map[string]int)
+	// A frontend has been added since the last cycle of the check
+	updated := false
+	for {
+		var cmd controlCommand
+		select {
+		case cmd = <-c.control:
+		case <-c.stopping:
+			return
+		}
+		var r controlReply
+		switch cmd.op {
+		case CONTROL_ADD:
+			frontends[cmd.frontendKey] = cmd.id
+			updated = true
+		case CONTROL_SET_ID:
+			frontends[cmd.frontendKey] = cmd.id
+		case CONTROL_REMOVE:
+			delete(frontends, cmd.frontendKey)
+		case CONTROL_NOTIFY:
+			updated = true
+		case CONTROL_FRONTENDS:
+			r.frontends = make(map[string]int, len(frontends))
+			for frontendKey, id := range frontends {
+				r.frontends[frontendKey] = id
+			}
+		case CONTROL_COUNT:
+		case CONTROL_UPDATED:
+			r.updated = updated
+			updated = false
+		}
+		r.count = len(frontends)
+		cmd.reply <- r
+	}
+}
+
+/*
+ * Sends a command to the controller and waits for its reply. Once the
+ * controller is stopped, the commands are dropped and the reply is empty.
+ */
+func (c *backendController) send(cmd controlCommand) controlReply {
+	if c == nil {
+		return controlReply{}
+	}
+	cmd.reply = make(chan controlReply, 1)
+	select {
+	case c.control <- cmd:
+		return <-cmd.reply
+	case <-c.stopping:
+		return controlReply{}
+	}
+}
+
+func (c *backendController) Add(frontendKey string, id int) {
+	c.send(controlCommand{op: CONTROL_ADD, frontendKey: frontendKey, id: id})
+}
+
+func (c *backendController) SetId(frontendKey string, id int) {
+	c.send(controlCommand{op: CONTROL_SET_ID, frontendKey: frontendKey,
+		id: id})
+}
+
+/*
+ * Removes a frontend, returns the number of frontends left
+ */
+func (c *backendController) Remove(frontendKey string) int {
+	return c.send(controlCommand{op: CONTROL_REMOVE,
+		frontendKey: frontendKey}).count
+}
+
+/*
+ * Tells the check loop to write the state of the backend on its next cycle,
+ * as if a frontend was added
+ */
+func (c *backendController) Notify() {
+	c.send(controlCommand{op: CONTROL_NOTIFY})
+}
+
+/*
+ * Returns a copy of the frontends, nil once stopped
+ */
+func (c *backendController) Frontends() map[string]int {
+	return c.send(controlCommand{op: CONTROL_FRONTENDS}).frontends
+}
+
+func (c *backendController) Count() int {
+	return c.send(controlCommand{op: CONTROL_COUNT}).count
+}
+
+/*
+ * Returns true if a frontend has been added or a rewrite of the state asked
+ * since the last call
+ */
+func (c *backendController) Updated() bool {
+	return c.send(controlCommand{op: CONTROL_UPDATED}).updated
+}
+
+/*
+ * Stops the goroutine of the controller and waits for it to exit. The
+ * pending commands get an empty reply.
+ */
+func (c *backendController) stop() {
+	c.stopOnce.Do(func() { close(c.stopping) })
+	<-c.done
+}
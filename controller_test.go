@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestBackendController(t *testing.T) {
+	ctl := newBackendController("http://10.0.0.1:80")
+	// No update is lost, however many are sent between two cycles
+	var wg sync.WaitGroup
+	for i, frontendKey := range []string{"www.foo.com", "www.bar.com",
+		"www.baz.com"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctl.Add(frontendKey, i)
+		}()
+	}
+	wg.Wait()
+	expected := map[string]int{"www.foo.com": 0, "www.bar.com": 1,
+		"www.baz.com": 2}
+	if f := ctl.Frontends(); !reflect.DeepEqual(f, expected) {
+		t.Errorf("Expected frontends %v, got %v", expected, f)
+	}
+	if ctl.Updated() == false || ctl.Updated() == true {
+		t.Error("Expected a single update for the cycle")
+	}
+	if n := ctl.Remove("www.baz.com"); n != 2 || ctl.Updated() == true {
+		t.Errorf("Expected 2 frontends left and no update, got %d", n)
+	}
+	ctl.Notify()
+	if ctl.Updated() == false {
+		t.Error("Expected the check loop to be notified")
+	}
+	// The commands sent after the stop are dropped, they don't block
+	ctl.stop()
+	ctl.stop()
+	ctl.Add("www.qux.com", 3)
+	if ctl.Frontends() != nil || ctl.Count() != 0 || ctl.Updated() == true {
+		t.Error("Expected the controller to be stopped")
+	}
+}
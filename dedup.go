@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dead notifications of a backend within 1 second collapse into one
+const DEDUP_WINDOW = 1000
+
+var (
+	// 0 = every dead notification is handled
+	dedupWindow time.Duration
+	dedup       = &notificationDedup{seen: make(map[string]time.Time)}
+)
+
+/*
+ * Collapses the bursts of dead notifications: Hipache publishes a backend
+ * on each failed request, only the first one of each -dedup_window is
+ * handled (locking the backend, updating the mapping).
+ */
+type notificationDedup struct {
+	lock sync.Mutex
+	// The first notification of each (frontend, backend) in the window
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+/*
+ * Returns true if the backend of the frontend has already been notified
+ * within the window
+ */
+func (d *notificationDedup) isDuplicate(check *Check, now time.Time) bool {
+	if dedupWindow <= 0 {
+		return false
+	}
+	key := check.FrontendKey + ";" + check.BackendUrl + ";" +
+		strconv.Itoa(check.BackendId)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if now.Sub(d.lastSweep) >= dedupWindow {
+		// Forget the expired notifications, once per window
+		for k, t := range d.seen {
+			if now.Sub(t) >= dedupWindow {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	if t, exists := d.seen[key]; exists && now.Sub(t) < dedupWindow {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
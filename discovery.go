@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Probe the Redis endpoints every 5 seconds, with a 2 seconds timeout
+	REDIS_FAILOVER_INTERVAL = 5
+	REDIS_PROBE_TIMEOUT     = 2
+)
+
+var (
+	redisSRV         string
+	redisSRVInterval time.Duration
+	// Given with -redis as a comma separated list, by order of preference
+	redisAddresses []string
+	// Replaced by the tests
+	lookupSRV  = net.LookupSRV
+	probeRedis = func(address string, password string) error {
+		timeout := time.Duration(REDIS_PROBE_TIMEOUT) * time.Second
+		options := append([]redis.DialOption{
+			redis.DialConnectTimeout(timeout),
+			redis.DialReadTimeout(timeout),
+			redis.DialWriteTimeout(timeout),
+			redis.DialPassword(password)}, redisTLSOptions()...)
+		conn, err := redis.Dial("tcp", address, options...)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Do("PING")
+		return err
+	}
+)
+
+/*
+ * Resolves the Redis address from a DNS SRV name (e.g.
+ * "_redis._tcp.example.com"): the target with the lowest priority, then the
+ * highest weight
+ */
+func resolveRedisSRV(name string) (string, error) {
+	_, records, err := lookupSRV("", "", name)
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", errors.New("No SRV record for " + name)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Priority != records[j].Priority {
+			return records[i].Priority < records[j].Priority
+		}
+		return records[i].Weight > records[j].Weight
+	})
+	target := strings.TrimSuffix(records[0].Target, ".")
+	return net.JoinHostPort(target, fmt.Sprint(records[0].Port)), nil
+}
+
+/*
+ * Re-resolves the SRV name at a regular interval, and switches to the new
+ * Redis when the target changes
+ */
+func watchRedisSRV(cache *Cache) {
+	for {
+		if !cache.wait(redisSRVInterval) {
+			return
+		}
+		address, err := resolveRedisSRV(redisSRV)
+		if err != nil {
+			logError("Cannot resolve the Redis SRV name:", err.Error())
+			continue
+		}
+		if address == getRedisAddress() {
+			continue
+		}
+		log.Printf("Redis moved to %s (SRV %s)", address, redisSRV)
+		redisLock.Lock()
+		password := redisPassword
+		redisLock.Unlock()
+		if err := cache.SetRedis(address, password); err != nil {
+			logError("Cannot switch to", address+":", err.Error())
+		}
+	}
+}
+
+/*
+ * Returns the first Redis answering among -redis, or the first one if none
+ * answers
+ */
+func pickRedisAddress(password string) string {
+	for _, address := range redisAddresses {
+		err := probeRedis(address, getSecret(password, redisPasswordFile))
+		if err == nil {
+			return address
+		}
+		log.Printf("Redis on %s is unavailable: %s", address, err.Error())
+	}
+	return redisAddresses[0]
+}
+
+/*
+ * Probes the Redis endpoints at a regular interval, and switches to the
+ * first one answering: to a standby when the current Redis fails, back to
+ * the preferred one when it's available again
+ */
+func watchRedisFailover(cache *Cache) {
+	for {
+		if !cache.wait(time.Duration(REDIS_FAILOVER_INTERVAL) * time.Second) {
+			return
+		}
+		redisLock.Lock()
+		current, password := redisAddress, redisPassword
+		redisLock.Unlock()
+		address := pickRedisAddress(password)
+		if address == current {
+			continue
+		}
+		log.Printf("Failing over from Redis on %s to %s", current, address)
+		if err := cache.SetRedis(address, password); err != nil {
+			logError("Cannot switch to", address+":", err.Error())
+		}
+	}
+}
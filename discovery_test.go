@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestResolveRedisSRV(t *testing.T) {
+	defer func() { lookupSRV = net.LookupSRV }()
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return name, []*net.SRV{
+			{Target: "backup.example.com.", Port: 6379, Priority: 20, Weight: 100},
+			{Target: "light.example.com.", Port: 6380, Priority: 10, Weight: 1},
+			{Target: "main.example.com.", Port: 6381, Priority: 10, Weight: 10},
+		}, nil
+	}
+	address, err := resolveRedisSRV("_redis._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "main.example.com:6381" {
+		t.Errorf("Expected main.example.com:6381, got %q", address)
+	}
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return name, nil, nil
+	}
+	if _, err := resolveRedisSRV("_redis._tcp.example.com"); err == nil {
+		t.Error("Expected an error without SRV record")
+	}
+}
+
+func TestPickRedisAddress(t *testing.T) {
+	probe := probeRedis
+	defer func() {
+		probeRedis, redisAddresses = probe, nil
+	}()
+	redisAddresses = []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"}
+	up := map[string]bool{"10.0.0.2:6379": true, "10.0.0.3:6379": true}
+	probeRedis = func(address string, password string) error {
+		if up[address] {
+			return nil
+		}
+		return errors.New("connection refused")
+	}
+	if address := pickRedisAddress(""); address != "10.0.0.2:6379" {
+		t.Errorf("Expected to fail over to 10.0.0.2:6379, got %q", address)
+	}
+	up["10.0.0.1:6379"] = true
+	if address := pickRedisAddress(""); address != "10.0.0.1:6379" {
+		t.Errorf("Expected to go back to 10.0.0.1:6379, got %q", address)
+	}
+	up = nil
+	if address := pickRedisAddress(""); address != "10.0.0.1:6379" {
+		t.Errorf("Expected the first address when none answers, got %q", address)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DOCKER_GRACE = 300
+	// Published on all the addresses of the host
+	DOCKER_ANY_HOST = "*"
+)
+
+var (
+	dockerAddress string
+	// How long the backends of a stopped container are spared
+	dockerGrace time.Duration
+	// Addresses (host:port) of the containers stopped on purpose, with
+	// when they were stopped
+	stoppedContainers     = make(map[string]time.Time)
+	stoppedContainersLock sync.Mutex
+)
+
+/*
+ * Client of the Docker Engine API, on "unix:///var/run/docker.sock" or
+ * "tcp://host:2375"
+ */
+type dockerClient struct {
+	client  *http.Client
+	baseUrl string
+}
+
+func newDockerClient(address string) (*dockerClient, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	d := &dockerClient{client: &http.Client{}}
+	switch u.Scheme {
+	case "unix":
+		d.baseUrl = "http://docker"
+		d.client.Transport = &http.Transport{DialContext: func(
+			ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", u.Path)
+		}}
+	case "tcp", "http":
+		d.baseUrl = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("Invalid Docker address %q", address)
+	}
+	return d, nil
+}
+
+func (d *dockerClient) get(path string) (*http.Response, error) {
+	resp, err := d.client.Get(d.baseUrl + path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+/*
+ * Returns the addresses a container is reachable on: its IP on each network
+ * with the exposed ports, and the ports published on the host
+ */
+func (d *dockerClient) containerAddresses(id string) ([]string, error) {
+	resp, err := d.get("/containers/" + url.PathEscape(id) + "/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var container struct {
+		NetworkSettings struct {
+			Ports map[string][]struct {
+				HostIp   string
+				HostPort string
+			}
+			Networks map[string]struct {
+				IPAddress string
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&container); err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for port, bindings := range container.NetworkSettings.Ports {
+		// e.g. "8080/tcp"
+		port = strings.SplitN(port, "/", 2)[0]
+		for _, network := range container.NetworkSettings.Networks {
+			if network.IPAddress != "" {
+				addresses = append(addresses,
+					net.JoinHostPort(network.IPAddress, port))
+			}
+		}
+		for _, b := range bindings {
+			host := b.HostIp
+			if host == "" || host == "0.0.0.0" || host == "::" {
+				host = DOCKER_ANY_HOST
+			}
+			addresses = append(addresses, net.JoinHostPort(host, b.HostPort))
+		}
+	}
+	return addresses, nil
+}
+
+/*
+ * Follows the container events. A container stopped on purpose ("docker
+ * stop", "docker kill", a deploy...) gets a "kill" event before it dies, a
+ * crashed one only dies.
+ */
+func (d *dockerClient) watchEvents() error {
+	filters := url.QueryEscape(`{"type":["container"],` +
+		`"event":["kill","stop","start"]}`)
+	resp, err := d.get("/events?filters=" + filters)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	log.Println("Following the Docker events on", dockerAddress)
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Action string
+			Actor  struct {
+				ID string
+			}
+		}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		addresses, err := d.containerAddresses(event.Actor.ID)
+		if err != nil {
+			logError("Cannot inspect the container", event.Actor.ID+":",
+				err.Error())
+			continue
+		}
+		setContainerStopped(addresses, event.Action != "start")
+	}
+}
+
+func setContainerStopped(addresses []string, stopped bool) {
+	stoppedContainersLock.Lock()
+	defer stoppedContainersLock.Unlock()
+	for _, address := range addresses {
+		if stopped {
+			stoppedContainers[address] = time.Now()
+		} else {
+			delete(stoppedContainers, address)
+		}
+	}
+}
+
+/*
+ * Returns true if the backend is a container stopped on purpose less than
+ * -docker_grace ago
+ */
+func isContainerStopped(backendUrl string) bool {
+	u, err := url.Parse(backendUrl)
+	if err != nil || u.Scheme == UNIX_SCHEME {
+		return false
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	stoppedContainersLock.Lock()
+	defer stoppedContainersLock.Unlock()
+	for _, address := range []string{net.JoinHostPort(u.Hostname(), port),
+		net.JoinHostPort(DOCKER_ANY_HOST, port)} {
+		since, exists := stoppedContainers[address]
+		if !exists {
+			continue
+		}
+		if time.Since(since) < dockerGrace {
+			return true
+		}
+		delete(stoppedContainers, address)
+	}
+	return false
+}
+
+/*
+ * Follows the Docker events, reconnecting after the errors
+ */
+func watchDocker() {
+	d, err := newDockerClient(dockerAddress)
+	if err != nil {
+		logError(err.Error())
+		return
+	}
+	for {
+		err := d.watchEvents()
+		logError("Lost the Docker events:", err.Error())
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDockerEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/events":
+				io.WriteString(w, `{"Type":"container","Action":"kill","Actor":{"ID":"web1"}}`+"\n"+
+					`{"Type":"container","Action":"kill","Actor":{"ID":"web2"}}`+"\n"+
+					`{"Type":"container","Action":"start","Actor":{"ID":"web2"}}`+"\n")
+			case "/containers/web1/json":
+				io.WriteString(w, `{"NetworkSettings": {
+					"Ports": {"8080/tcp": [{"HostIp": "0.0.0.0", "HostPort": "32768"}]},
+					"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}}`)
+			case "/containers/web2/json":
+				io.WriteString(w, `{"NetworkSettings": {
+					"Ports": {"8080/tcp": null},
+					"Networks": {"bridge": {"IPAddress": "172.17.0.3"}}}}`)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer srv.Close()
+	dockerGrace = time.Minute
+	defer func() {
+		dockerGrace = 0
+		stoppedContainers = make(map[string]time.Time)
+	}()
+	d, err := newDockerClient("tcp://" + strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.watchEvents(); err != io.EOF {
+		t.Fatalf("Expected the stream to end, got %v", err)
+	}
+	for backendUrl, stopped := range map[string]bool{
+		"http://172.17.0.2:8080":  true,
+		"http://10.0.0.1:32768":   true,
+		"http://172.17.0.3:8080":  false,
+		"http://172.17.0.2:8081":  false,
+		"https://172.17.0.2:8080": true,
+	} {
+		if isContainerStopped(backendUrl) != stopped {
+			t.Errorf("Expected %s to be stopped: %t", backendUrl, stopped)
+		}
+	}
+	dockerGrace = 0
+	if isContainerStopped("http://172.17.0.2:8080") {
+		t.Error("Expected the failures to count after the grace period")
+	}
+	if _, err := newDockerClient("ftp://docker"); err == nil {
+		t.Error("Expected an invalid Docker address to be rejected")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// While draining, the instance keeps checking its backends but doesn't lock
+// new ones
+var draining int32
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+func setDraining(enabled bool) {
+	var v int32
+	if enabled == true {
+		v = 1
+	}
+	if atomic.SwapInt32(&draining, v) != v {
+		if enabled == true {
+			log.Println("Draining: new backends are left to the other instances")
+		} else {
+			log.Println("Not draining anymore")
+		}
+	}
+}
+
+/*
+ * GET /drain returns the drain mode, POST enables it and DELETE disables it
+ */
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		setDraining(true)
+	case "DELETE":
+		setDraining(false)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"draining": isDraining()})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDrainHandler(t *testing.T) {
+	defer setDraining(false)
+	for _, test := range []struct {
+		method   string
+		code     int
+		draining bool
+	}{
+		{"GET", 200, false},
+		{"POST", 200, true},
+		{"GET", 200, true},
+		{"PUT", 405, true},
+		{"DELETE", 200, false},
+	} {
+		w := httptest.NewRecorder()
+		drainHandler(w, httptest.NewRequest(test.method, "/drain", nil))
+		if w.Code != test.code || isDraining() != test.draining {
+			t.Errorf("%s /drain: expected %d (draining: %t), got %d (%t)",
+				test.method, test.code, test.draining, w.Code, isDraining())
+		}
+		if w.Code == 200 && !strings.Contains(w.Body.String(), `"draining"`) {
+			t.Errorf("%s /drain: unexpected body %q", test.method, w.Body)
+		}
+	}
+}
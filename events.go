@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EVENT_DEAD  = "dead"
+	EVENT_ALIVE = "alive"
+	// Results of the probes, only streamed on the admin listener
+	EVENT_PASSED = "passed"
+	EVENT_FAILED = "failed"
+	// Events buffered for each client of the stream, the slow ones miss
+	// the next events
+	EVENT_STREAM_BUFFER = 100
+)
+
+var (
+	eventStreams     = make(map[chan *Event]bool)
+	eventStreamsLock sync.Mutex
+)
+
+/*
+ * State transition published on the hchecker:events channel
+ */
+type Event struct {
+	Type       string         `json:"type"`
+	BackendUrl string         `json:"backend_url"`
+	Frontends  map[string]int `json:"frontends"`
+	Instance   string         `json:"instance"`
+	Time       int64          `json:"time"`
+	// Why the probe failed, and its failure code (see reasons.go), for the
+	// failed probes and the dead backends
+	Reason string `json:"reason,omitempty"`
+	Code   string `json:"code,omitempty"`
+	// Only set for the probe results
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+}
+
+func NewEvent(eventType string, check *Check) *Event {
+	frontends := cache.mapping.Frontends(check.BackendUrl)
+	if frontends == nil {
+		frontends = make(map[string]int)
+	}
+	return &Event{
+		Type:       eventType,
+		BackendUrl: check.BackendUrl,
+		Frontends:  frontends,
+		Instance:   myId,
+		Time:       time.Now().Unix(),
+	}
+}
+
+func publishEvent(event *Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println(event.BackendUrl, "Cannot encode event:", err)
+		return
+	}
+	cache.PublishEvent(data)
+	streamEvent(event)
+	recordHistory(event)
+	queueSinkEvent(event)
+}
+
+/*
+ * Streams the result of a probe to the clients of /events, records it with
+ * -history and sends it to the metrics systems
+ */
+func recordResult(check *Check, ok bool) {
+	streaming := hasEventStreams()
+	recording := historyEnabled == true && dryRun == false
+	if !streaming && !recording && len(sinks) == 0 {
+		return
+	}
+	event := NewEvent(EVENT_PASSED, check)
+	if !ok {
+		event.Type = EVENT_FAILED
+		event.Reason, _, event.Code = check.lastResult()
+	}
+	event.LatencyMs = float64(atomic.LoadInt64(&check.lastLatency)) /
+		float64(time.Millisecond)
+	if streaming {
+		streamEvent(event)
+	}
+	recordHistory(event)
+	queueSinkEvent(event)
+}
+
+func hasEventStreams() bool {
+	eventStreamsLock.Lock()
+	defer eventStreamsLock.Unlock()
+	return len(eventStreams) > 0
+}
+
+func streamEvent(event *Event) {
+	eventStreamsLock.Lock()
+	defer eventStreamsLock.Unlock()
+	for ch := range eventStreams {
+		select {
+		case ch <- event:
+		default:
+			// Don't block the checks on a slow client
+		}
+	}
+}
+
+/*
+ * GET /events streams the probe results and the state transitions as
+ * Server-Sent Events, one JSON event per message
+ */
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan *Event, EVENT_STREAM_BUFFER)
+	eventStreamsLock.Lock()
+	eventStreams[ch] = true
+	eventStreamsLock.Unlock()
+	defer func() {
+		eventStreamsLock.Lock()
+		delete(eventStreams, ch)
+		eventStreamsLock.Unlock()
+	}()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	// Keeps the idle connections open through the proxies
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-ch:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
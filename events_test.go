@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventsHandler(t *testing.T) {
+	_, cache = setupCache(t)
+	defer func() { cache = nil }()
+	srv := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	for !hasEventStreams() {
+		time.Sleep(time.Millisecond)
+	}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	check.lastReason = "connection refused"
+	recordResult(check, false)
+	streamEvent(NewEvent(EVENT_DEAD, check))
+	lines := bufio.NewScanner(resp.Body)
+	for _, expected := range []string{
+		"event: failed",
+		`data: {"type":"failed","backend_url":"http://10.0.0.1:80"`,
+		"",
+		"event: dead",
+	} {
+		if !lines.Scan() {
+			t.Fatal(lines.Err())
+		}
+		if !strings.HasPrefix(lines.Text(), expected) ||
+			(expected == "" && lines.Text() != "") {
+			t.Errorf("Expected %q, got %q", expected, lines.Text())
+		}
+	}
+	resp.Body.Close()
+	srv.Close()
+	if hasEventStreams() {
+		t.Error("Expected the stream to be removed with its client")
+	}
+}
+
+func TestPublishEvent(t *testing.T) {
+	r, c := setupCache(t)
+	cache = c
+	defer func() { cache = nil }()
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;1;2")
+	c.LockBackend(check)
+	event := NewEvent(EVENT_DEAD, check)
+	event.Reason, event.Code = "HTTP 503", "http_5xx"
+	publishEvent(event)
+	if len(r.published) != 1 || r.published[0].channel != "hchecker:events" {
+		t.Fatalf("Expected the event on hchecker:events, got %v", r.published)
+	}
+	var published Event
+	if err := json.Unmarshal([]byte(r.published[0].data), &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.Type != EVENT_DEAD || published.BackendUrl != "http://10.0.0.1:80" ||
+		published.Frontends["www.foo.com"] != 1 || published.Instance != "host#1" ||
+		published.Code != "http_5xx" || published.Time == 0 {
+		t.Errorf("Unexpected event %+v", published)
+	}
+}
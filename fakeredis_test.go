@@ -0,0 +1,1127 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+/*
+ * In-memory Redis, implementing the commands used by hchecker. Expiration is
+ * recorded but never applied.
+ */
+type fakeRedis struct {
+	lock      sync.Mutex
+	strings   map[string]string
+	hashes    map[string]map[string]string
+	sets      map[string]map[string]bool
+	lists     map[string][]string
+	zsets     map[string]map[string]float64
+	streams   map[string]*fakeStream
+	ttls      map[string]int64
+	published []fakeMessage
+	// Number of the next commands failing, as if Redis was unreachable
+	failures int
+}
+
+var errFakeDown = errors.New("fake: connection refused")
+
+type fakeMessage struct {
+	channel string
+	data    string
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		sets:    make(map[string]map[string]bool),
+		lists:   make(map[string][]string),
+		zsets:   make(map[string]map[string]float64),
+		streams: make(map[string]*fakeStream),
+		ttls:    make(map[string]int64),
+	}
+}
+
+/*
+ * Returns a pool of connections to the fake
+ */
+func (r *fakeRedis) pool() *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return &fakeConn{redis: r}, nil
+		},
+	}
+}
+
+/*
+ * Returns a Cache using the fake for both Hipache's and hchecker's data
+ */
+func (r *fakeRedis) cache() *Cache {
+	c, _ := NewCache()
+	c.pool = r.pool()
+	c.metaPool = c.pool
+	return c
+}
+
+/*
+ * Serves the fake over TCP, for the code dialing Redis itself. Returns the
+ * address, the listener is closed at the end of the test.
+ */
+func (r *fakeRedis) serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serveConn(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (r *fakeRedis) serveConn(conn net.Conn) {
+	defer conn.Close()
+	fc := &fakeConn{redis: r}
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		cmdArgs := make([]interface{}, len(args)-1)
+		for i, arg := range args[1:] {
+			cmdArgs[i] = arg
+		}
+		if _, err := conn.Write(encodeReply(fc.run(args[0],
+			cmdArgs))); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	readInt := func(prefix byte) (int, error) {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		if len(line) < 2 || line[0] != prefix {
+			return 0, fmt.Errorf("fake: unexpected %q", line)
+		}
+		return strconv.Atoi(line[1:])
+	}
+	n, err := readInt('*')
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return nil, errors.New("fake: empty command")
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readInt('$')
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func encodeReply(reply interface{}) []byte {
+	switch v := reply.(type) {
+	case nil:
+		return []byte("$-1\r\n")
+	case error:
+		return []byte("-" + v.Error() + "\r\n")
+	case string:
+		return []byte("+" + v + "\r\n")
+	case []byte:
+		return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(v), v))
+	case int64:
+		return []byte(fmt.Sprintf(":%d\r\n", v))
+	case int:
+		return []byte(fmt.Sprintf(":%d\r\n", v))
+	case []interface{}:
+		data := []byte(fmt.Sprintf("*%d\r\n", len(v)))
+		for _, item := range v {
+			data = append(data, encodeReply(item)...)
+		}
+		return data
+	case []string:
+		data := []byte(fmt.Sprintf("*%d\r\n", len(v)))
+		for _, item := range v {
+			data = append(data, encodeReply([]byte(item))...)
+		}
+		return data
+	}
+	return encodeReply([]byte(fmt.Sprint(reply)))
+}
+
+func (r *fakeRedis) exists(key string) bool {
+	_, s := r.strings[key]
+	_, h := r.hashes[key]
+	_, set := r.sets[key]
+	_, l := r.lists[key]
+	_, z := r.zsets[key]
+	_, x := r.streams[key]
+	return s || h || set || l || z || x
+}
+
+func (r *fakeRedis) del(key string) int {
+	if !r.exists(key) {
+		return 0
+	}
+	delete(r.strings, key)
+	delete(r.hashes, key)
+	delete(r.sets, key)
+	delete(r.lists, key)
+	delete(r.zsets, key)
+	delete(r.streams, key)
+	delete(r.ttls, key)
+	return 1
+}
+
+func (r *fakeRedis) keys() []string {
+	var keys []string
+	for _, m := range []interface{}{r.strings, r.hashes, r.sets, r.lists,
+		r.zsets, r.streams} {
+		switch m := m.(type) {
+		case map[string]string:
+			for k := range m {
+				keys = append(keys, k)
+			}
+		case map[string]map[string]string:
+			for k := range m {
+				keys = append(keys, k)
+			}
+		case map[string]map[string]bool:
+			for k := range m {
+				keys = append(keys, k)
+			}
+		case map[string][]string:
+			for k := range m {
+				keys = append(keys, k)
+			}
+		case map[string]map[string]float64:
+			for k := range m {
+				keys = append(keys, k)
+			}
+		case map[string]*fakeStream:
+			for k := range m {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+ * A stream and its consumer groups
+ */
+type fakeStream struct {
+	entries []fakeEntry
+	groups  map[string]*fakeGroup
+	// Sequence of the last id added, kept when trimming
+	seq int
+}
+
+type fakeEntry struct {
+	id     string
+	fields []string
+}
+
+type fakeGroup struct {
+	// Index of the next entry delivered
+	next int
+	// Entries delivered and not acknowledged, by id, and their consumer
+	pending map[string]string
+	// Last time each consumer read or claimed entries
+	seen map[string]time.Time
+}
+
+func (e fakeEntry) reply() interface{} {
+	fields := make([]interface{}, len(e.fields))
+	for i, f := range e.fields {
+		fields[i] = []byte(f)
+	}
+	return []interface{}{[]byte(e.id), fields}
+}
+
+/*
+ * Runs the stream commands: XADD, XTRIM MINID, XGROUP CREATE/DELCONSUMER,
+ * XREADGROUP (never blocks), XACK, XPENDING (summary), XAUTOCLAIM (ignoring
+ * the idle time) and XINFO GROUPS/CONSUMERS
+ */
+func (r *fakeRedis) doStream(cmd string, args []string) (interface{}, error) {
+	if cmd == "XINFO" {
+		return r.xinfo(args)
+	}
+	if cmd == "XREADGROUP" {
+		// GROUP <group> <consumer> [COUNT n] [BLOCK ms] STREAMS <key> <id>
+		if len(args) < 6 {
+			return nil, errWrongArgs
+		}
+		group, consumer := args[1], args[2]
+		key, id := args[len(args)-2], args[len(args)-1]
+		count := 0
+		for i := 3; i < len(args)-3; i++ {
+			if strings.ToUpper(args[i]) == "COUNT" {
+				count, _ = strconv.Atoi(args[i+1])
+			}
+		}
+		st := r.streams[key]
+		if st == nil || st.groups[group] == nil {
+			return nil, errors.New("NOGROUP No such key or consumer group")
+		}
+		g := st.groups[group]
+		g.seen[consumer] = time.Now()
+		var entries []interface{}
+		for i := range st.entries {
+			if count > 0 && len(entries) == count {
+				break
+			}
+			e := st.entries[i]
+			if id == ">" && i >= g.next {
+				g.pending[e.id] = consumer
+				g.next = i + 1
+				entries = append(entries, e.reply())
+			} else if id != ">" && g.pending[e.id] == consumer {
+				entries = append(entries, e.reply())
+			}
+		}
+		if len(entries) == 0 && id == ">" {
+			return nil, nil
+		}
+		return []interface{}{[]interface{}{[]byte(key), entries}}, nil
+	}
+	if len(args) < 2 {
+		return nil, errWrongArgs
+	}
+	if cmd == "XGROUP" && strings.ToUpper(args[0]) == "DELCONSUMER" {
+		// DELCONSUMER <key> <group> <consumer>
+		if len(args) != 4 {
+			return nil, errWrongArgs
+		}
+		st := r.streams[args[1]]
+		if st == nil || st.groups[args[2]] == nil {
+			return nil, errors.New("NOGROUP No such key or consumer group")
+		}
+		g := st.groups[args[2]]
+		n := int64(0)
+		for id, c := range g.pending {
+			if c == args[3] {
+				delete(g.pending, id)
+				n += 1
+			}
+		}
+		delete(g.seen, args[3])
+		return n, nil
+	}
+	if cmd == "XGROUP" {
+		// CREATE <key> <group> <id> [MKSTREAM]
+		if strings.ToUpper(args[0]) != "CREATE" || len(args) < 4 {
+			return nil, errWrongArgs
+		}
+		st := r.streams[args[1]]
+		if st == nil {
+			if len(args) < 5 || strings.ToUpper(args[4]) != "MKSTREAM" {
+				return nil, errors.New("ERR The XGROUP subcommand requires the key to exist")
+			}
+			st = &fakeStream{groups: make(map[string]*fakeGroup)}
+			r.streams[args[1]] = st
+		}
+		if _, exists := st.groups[args[2]]; exists {
+			return nil, errors.New("BUSYGROUP Consumer Group name already exists")
+		}
+		g := &fakeGroup{pending: make(map[string]string),
+			seen: make(map[string]time.Time)}
+		if args[3] == "$" {
+			g.next = len(st.entries)
+		}
+		st.groups[args[2]] = g
+		return "OK", nil
+	}
+	st := r.streams[args[0]]
+	if cmd == "XADD" {
+		// <key> * <field> <value>...
+		if st == nil {
+			st = &fakeStream{groups: make(map[string]*fakeGroup)}
+			r.streams[args[0]] = st
+		}
+		st.seq += 1
+		e := fakeEntry{fmt.Sprintf("%d-0", st.seq), args[2:]}
+		st.entries = append(st.entries, e)
+		return []byte(e.id), nil
+	}
+	if cmd == "XTRIM" {
+		// <key> MINID <id>
+		if strings.ToUpper(args[1]) != "MINID" || len(args) != 3 {
+			return nil, errWrongArgs
+		}
+		if st == nil {
+			return int64(0), nil
+		}
+		n := 0
+		for n < len(st.entries) && streamIdLess(st.entries[n].id, args[2]) {
+			n += 1
+		}
+		st.entries = st.entries[n:]
+		for _, g := range st.groups {
+			if g.next -= n; g.next < 0 {
+				g.next = 0
+			}
+		}
+		return int64(n), nil
+	}
+	if st == nil || st.groups[args[1]] == nil {
+		return nil, errors.New("NOGROUP No such key or consumer group")
+	}
+	g := st.groups[args[1]]
+	switch cmd {
+	case "XACK":
+		n := int64(0)
+		for _, id := range args[2:] {
+			if _, exists := g.pending[id]; exists {
+				delete(g.pending, id)
+				n += 1
+			}
+		}
+		return n, nil
+	case "XPENDING":
+		if len(g.pending) == 0 {
+			return []interface{}{int64(0), nil, nil, nil}, nil
+		}
+		var ids []string
+		for id := range g.pending {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return streamIdLess(ids[i], ids[j])
+		})
+		return []interface{}{int64(len(ids)), []byte(ids[0]),
+			[]byte(ids[len(ids)-1]), nil}, nil
+	case "XAUTOCLAIM":
+		// <key> <group> <consumer> <min-idle> <start> [COUNT n]
+		if len(args) < 5 {
+			return nil, errWrongArgs
+		}
+		g.seen[args[2]] = time.Now()
+		entries := []interface{}{}
+		for _, e := range st.entries {
+			if c, exists := g.pending[e.id]; exists && c != args[2] {
+				g.pending[e.id] = args[2]
+				entries = append(entries, e.reply())
+			}
+		}
+		return []interface{}{[]byte("0-0"), entries, []interface{}{}}, nil
+	}
+	return nil, fmt.Errorf("ERR unknown command '%s'", cmd)
+}
+
+/*
+ * XINFO GROUPS <key> and XINFO CONSUMERS <key> <group>, the fields read by
+ * the checkers only
+ */
+func (r *fakeRedis) xinfo(args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errWrongArgs
+	}
+	st := r.streams[args[1]]
+	if st == nil {
+		return nil, errors.New("ERR no such key")
+	}
+	reply := []interface{}{}
+	switch strings.ToUpper(args[0]) {
+	case "GROUPS":
+		for name, g := range st.groups {
+			// Before the first entry kept if none was delivered since
+			// the trimming
+			last := fmt.Sprintf("%d-0", st.seq-len(st.entries))
+			if g.next > 0 {
+				last = st.entries[g.next-1].id
+			}
+			reply = append(reply, []interface{}{
+				[]byte("name"), []byte(name),
+				[]byte("consumers"), int64(len(g.seen)),
+				[]byte("pending"), int64(len(g.pending)),
+				[]byte("last-delivered-id"), []byte(last)})
+		}
+	case "CONSUMERS":
+		if len(args) != 3 {
+			return nil, errWrongArgs
+		}
+		g := st.groups[args[2]]
+		if g == nil {
+			return nil, errors.New("NOGROUP No such consumer group")
+		}
+		var names []string
+		for name := range g.seen {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			pending := int64(0)
+			for _, c := range g.pending {
+				if c == name {
+					pending += 1
+				}
+			}
+			idle := time.Since(g.seen[name]).Nanoseconds() / 1e6
+			reply = append(reply, []interface{}{
+				[]byte("name"), []byte(name),
+				[]byte("pending"), pending,
+				[]byte("idle"), idle})
+		}
+	default:
+		return nil, errWrongArgs
+	}
+	return reply, nil
+}
+
+/*
+ * Members of a sorted set, by score
+ */
+func (r *fakeRedis) zmembers(key string) []string {
+	z := r.zsets[key]
+	members := make([]string, 0, len(z))
+	for member := range z {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if z[members[i]] != z[members[j]] {
+			return z[members[i]] < z[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+/*
+ * Parses the bounds of ZRANGEBYSCORE, "(" for an exclusive one
+ */
+func scoreRange(min, max string) (float64, float64, error) {
+	bounds := []float64{0, 0}
+	for i, b := range []string{min, max} {
+		switch b {
+		case "-inf":
+			bounds[i] = math.Inf(-1)
+		case "+inf", "inf":
+			bounds[i] = math.Inf(1)
+		default:
+			exclusive := strings.HasPrefix(b, "(")
+			v, err := strconv.ParseFloat(strings.TrimPrefix(b, "("), 64)
+			if err != nil {
+				return 0, 0, errors.New("ERR min or max is not a float")
+			}
+			if exclusive && i == 0 {
+				v = math.Nextafter(v, math.Inf(1))
+			} else if exclusive {
+				v = math.Nextafter(v, math.Inf(-1))
+			}
+			bounds[i] = v
+		}
+	}
+	return bounds[0], bounds[1], nil
+}
+
+func globToRegexp(pattern string) *regexp.Regexp {
+	p := regexp.QuoteMeta(pattern)
+	p = strings.Replace(p, `\*`, ".*", -1)
+	p = strings.Replace(p, `\?`, ".", -1)
+	return regexp.MustCompile("^" + p + "$")
+}
+
+func toString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	}
+	return fmt.Sprint(arg)
+}
+
+var errWrongArgs = errors.New("ERR wrong number of arguments")
+
+/*
+ * Go versions of the Lua scripts, by SHA1 of the script
+ */
+var fakeScripts = make(map[string]func(r *fakeRedis, keys, args []string) (interface{}, error))
+
+func init() {
+	fakeScripts[fmt.Sprintf("%x", sha1.Sum([]byte(LOCK_SCRIPT)))] = fakeLockScript
+	fakeScripts[fmt.Sprintf("%x", sha1.Sum([]byte(UNLOCK_SCRIPT)))] = fakeUnlockScript
+}
+
+func fakeUnlockScript(r *fakeRedis, keys, args []string) (interface{}, error) {
+	if r.hashes[keys[0]][args[0]] == args[2] {
+		r.do("HDEL", []string{keys[0], args[0]})
+	}
+	r.do("HDEL", []string{keys[0], args[1]})
+	return int64(1), nil
+}
+
+func fakeLockScript(r *fakeRedis, keys, args []string) (interface{}, error) {
+	url, syncKey, sig := args[0], args[1], args[2]
+	field := url
+	locked, _ := r.do("HSETNX", []string{keys[0], url, sig})
+	if locked.(int64) == 0 {
+		if mine, _ := r.do("HEXISTS", []string{keys[0], syncKey}); mine.(int64) == 1 {
+			return []byte(""), nil
+		}
+		n, _ := strconv.Atoi(args[3])
+		for i := 2; i <= n && locked.(int64) == 0; i++ {
+			field = fmt.Sprintf("%s#%d", url, i)
+			locked, _ = r.do("HSETNX", []string{keys[0], field, sig})
+		}
+		if locked.(int64) == 0 {
+			return nil, nil
+		}
+	}
+	r.do("HSET", []string{keys[0], syncKey, "1"})
+	return []byte(field), nil
+}
+
+/*
+ * Runs a command, the caller must hold the lock
+ */
+func (r *fakeRedis) do(cmd string, args []string) (interface{}, error) {
+	argc := map[string]int{"GET": 1, "SETEX": 3, "SETNX": 2,
+		"HSET": 3, "HSETNX": 3, "HGET": 2, "HEXISTS": 2, "HKEYS": 1,
+		"HVALS": 1, "HGETALL": 1, "SCARD": 1, "SMEMBERS": 1,
+		"SISMEMBER": 2, "LINDEX": 2, "LRANGE": 3, "LLEN": 1, "RPOPLPUSH": 2, "BRPOPLPUSH": 3, "LREM": 3, "EXPIRE": 2,
+		"TTL": 1, "PUBLISH": 2, "ZSCORE": 2, "ZCARD": 1, "ZRANGEBYSCORE": 3,
+		"ZREMRANGEBYSCORE": 3, "ZREMRANGEBYRANK": 3}
+	if n, exists := argc[cmd]; exists && len(args) != n {
+		return nil, errWrongArgs
+	}
+	switch cmd {
+	case "PING":
+		return "PONG", nil
+	case "GET":
+		if v, exists := r.strings[args[0]]; exists {
+			return []byte(v), nil
+		}
+		return nil, nil
+	case "SET":
+		if len(args) < 2 {
+			return nil, errWrongArgs
+		}
+		var ttl int64
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if r.exists(args[0]) {
+					return nil, nil
+				}
+			case "EX":
+				if i+1 >= len(args) {
+					return nil, errWrongArgs
+				}
+				i += 1
+				ttl, _ = strconv.ParseInt(args[i], 10, 64)
+			}
+		}
+		r.del(args[0])
+		r.strings[args[0]] = args[1]
+		if ttl > 0 {
+			r.ttls[args[0]] = ttl
+		}
+		return "OK", nil
+	case "SETEX":
+		r.del(args[0])
+		r.strings[args[0]] = args[2]
+		r.ttls[args[0]], _ = strconv.ParseInt(args[1], 10, 64)
+		return "OK", nil
+	case "SETNX":
+		if r.exists(args[0]) {
+			return int64(0), nil
+		}
+		r.strings[args[0]] = args[1]
+		return int64(1), nil
+	case "EXISTS":
+		n := int64(0)
+		for _, key := range args {
+			if r.exists(key) {
+				n += 1
+			}
+		}
+		return n, nil
+	case "DEL":
+		n := int64(0)
+		for _, key := range args {
+			n += int64(r.del(key))
+		}
+		return n, nil
+	case "EXPIRE":
+		if !r.exists(args[0]) {
+			return int64(0), nil
+		}
+		r.ttls[args[0]], _ = strconv.ParseInt(args[1], 10, 64)
+		return int64(1), nil
+	case "TTL":
+		if !r.exists(args[0]) {
+			return int64(-2), nil
+		}
+		if ttl, exists := r.ttls[args[0]]; exists {
+			return ttl, nil
+		}
+		return int64(-1), nil
+	case "SCAN":
+		var keys []interface{}
+		re := globToRegexp("*")
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				re = globToRegexp(args[i+1])
+			}
+		}
+		for _, key := range r.keys() {
+			if re.MatchString(key) {
+				keys = append(keys, []byte(key))
+			}
+		}
+		return []interface{}{[]byte("0"), keys}, nil
+	case "HSET", "HSETNX", "HMSET":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return nil, errWrongArgs
+		}
+		h, exists := r.hashes[args[0]]
+		if !exists {
+			h = make(map[string]string)
+			r.hashes[args[0]] = h
+		}
+		n := int64(0)
+		for i := 1; i < len(args); i += 2 {
+			if _, exists := h[args[i]]; exists {
+				if cmd == "HSETNX" {
+					continue
+				}
+			} else {
+				n += 1
+			}
+			h[args[i]] = args[i+1]
+		}
+		if cmd == "HMSET" {
+			return "OK", nil
+		}
+		return n, nil
+	case "HGET":
+		if v, exists := r.hashes[args[0]][args[1]]; exists {
+			return []byte(v), nil
+		}
+		return nil, nil
+	case "HMGET":
+		values := make([]interface{}, len(args)-1)
+		for i, field := range args[1:] {
+			if v, exists := r.hashes[args[0]][field]; exists {
+				values[i] = []byte(v)
+			}
+		}
+		return values, nil
+	case "HEXISTS":
+		if _, exists := r.hashes[args[0]][args[1]]; exists {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "HDEL":
+		n := int64(0)
+		h := r.hashes[args[0]]
+		for _, field := range args[1:] {
+			if _, exists := h[field]; exists {
+				delete(h, field)
+				n += 1
+			}
+		}
+		if h != nil && len(h) == 0 {
+			r.del(args[0])
+		}
+		return n, nil
+	case "HKEYS", "HVALS", "HGETALL":
+		h := r.hashes[args[0]]
+		fields := make([]string, 0, len(h))
+		for field := range h {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		values := []interface{}{}
+		for _, field := range fields {
+			if cmd != "HVALS" {
+				values = append(values, []byte(field))
+			}
+			if cmd != "HKEYS" {
+				values = append(values, []byte(h[field]))
+			}
+		}
+		return values, nil
+	case "SADD":
+		set, exists := r.sets[args[0]]
+		if !exists {
+			set = make(map[string]bool)
+			r.sets[args[0]] = set
+		}
+		n := int64(0)
+		for _, member := range args[1:] {
+			if !set[member] {
+				set[member] = true
+				n += 1
+			}
+		}
+		return n, nil
+	case "SREM":
+		n := int64(0)
+		set := r.sets[args[0]]
+		for _, member := range args[1:] {
+			if set[member] {
+				delete(set, member)
+				n += 1
+			}
+		}
+		if set != nil && len(set) == 0 {
+			r.del(args[0])
+		}
+		return n, nil
+	case "SCARD":
+		return int64(len(r.sets[args[0]])), nil
+	case "SISMEMBER":
+		if r.sets[args[0]][args[1]] {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "SMEMBERS":
+		var members []string
+		for member := range r.sets[args[0]] {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		values := []interface{}{}
+		for _, member := range members {
+			values = append(values, []byte(member))
+		}
+		return values, nil
+	case "RPUSH":
+		r.lists[args[0]] = append(r.lists[args[0]], args[1:]...)
+		return int64(len(r.lists[args[0]])), nil
+	case "LPUSH":
+		for _, value := range args[1:] {
+			r.lists[args[0]] = append([]string{value}, r.lists[args[0]]...)
+		}
+		return int64(len(r.lists[args[0]])), nil
+	case "RPOPLPUSH", "BRPOPLPUSH":
+		// Never blocks, as if the timeout expired on an empty list
+		l := r.lists[args[0]]
+		if len(l) == 0 {
+			return nil, nil
+		}
+		value := l[len(l)-1]
+		if len(l) == 1 {
+			delete(r.lists, args[0])
+		} else {
+			r.lists[args[0]] = l[:len(l)-1]
+		}
+		r.lists[args[1]] = append([]string{value}, r.lists[args[1]]...)
+		return []byte(value), nil
+	case "LREM":
+		n, _ := strconv.Atoi(args[1])
+		var kept []string
+		removed := 0
+		for _, value := range r.lists[args[0]] {
+			if value == args[2] && (n <= 0 || removed < n) {
+				removed += 1
+				continue
+			}
+			kept = append(kept, value)
+		}
+		if len(kept) == 0 {
+			delete(r.lists, args[0])
+		} else {
+			r.lists[args[0]] = kept
+		}
+		return int64(removed), nil
+	case "LLEN":
+		return int64(len(r.lists[args[0]])), nil
+	case "LINDEX":
+		l := r.lists[args[0]]
+		i, _ := strconv.Atoi(args[1])
+		if i < 0 {
+			i += len(l)
+		}
+		if i < 0 || i >= len(l) {
+			return nil, nil
+		}
+		return []byte(l[i]), nil
+	case "LRANGE":
+		l := r.lists[args[0]]
+		start, _ := strconv.Atoi(args[1])
+		stop, _ := strconv.Atoi(args[2])
+		if stop < 0 {
+			stop += len(l)
+		}
+		if stop >= len(l) {
+			stop = len(l) - 1
+		}
+		values := []interface{}{}
+		for i := start; i <= stop; i++ {
+			values = append(values, []byte(l[i]))
+		}
+		return values, nil
+	case "PUBLISH":
+		r.published = append(r.published, fakeMessage{args[0], args[1]})
+		return int64(0), nil
+	case "ZADD":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return nil, errWrongArgs
+		}
+		z, exists := r.zsets[args[0]]
+		if !exists {
+			z = make(map[string]float64)
+			r.zsets[args[0]] = z
+		}
+		n := int64(0)
+		for i := 1; i < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return nil, errors.New("ERR value is not a valid float")
+			}
+			if _, exists := z[args[i+1]]; !exists {
+				n += 1
+			}
+			z[args[i+1]] = score
+		}
+		return n, nil
+	case "ZREM":
+		if len(args) < 2 {
+			return nil, errWrongArgs
+		}
+		n := int64(0)
+		z := r.zsets[args[0]]
+		for _, member := range args[1:] {
+			if _, exists := z[member]; exists {
+				delete(z, member)
+				n += 1
+			}
+		}
+		if z != nil && len(z) == 0 {
+			r.del(args[0])
+		}
+		return n, nil
+	case "ZSCORE":
+		score, exists := r.zsets[args[0]][args[1]]
+		if !exists {
+			return nil, nil
+		}
+		return []byte(strconv.FormatFloat(score, 'f', -1, 64)), nil
+	case "ZRANGE":
+		// Whole set only, by score
+		if len(args) < 3 {
+			return nil, errWrongArgs
+		}
+		z := r.zsets[args[0]]
+		values := []interface{}{}
+		for _, member := range r.zmembers(args[0]) {
+			values = append(values, []byte(member))
+			if len(args) == 4 && strings.ToUpper(args[3]) == "WITHSCORES" {
+				values = append(values,
+					[]byte(strconv.FormatFloat(z[member], 'f', -1, 64)))
+			}
+		}
+		return values, nil
+	case "ZCARD":
+		return int64(len(r.zsets[args[0]])), nil
+	case "ZRANGEBYSCORE":
+		min, max, err := scoreRange(args[1], args[2])
+		if err != nil {
+			return nil, err
+		}
+		z := r.zsets[args[0]]
+		values := []interface{}{}
+		for _, member := range r.zmembers(args[0]) {
+			if z[member] >= min && z[member] <= max {
+				values = append(values, []byte(member))
+			}
+		}
+		return values, nil
+	case "ZREMRANGEBYSCORE":
+		min, max, err := scoreRange(args[1], args[2])
+		if err != nil {
+			return nil, err
+		}
+		z := r.zsets[args[0]]
+		n := int64(0)
+		for member, score := range z {
+			if score >= min && score <= max {
+				delete(z, member)
+				n += 1
+			}
+		}
+		if z != nil && len(z) == 0 {
+			r.del(args[0])
+		}
+		return n, nil
+	case "ZREMRANGEBYRANK":
+		members := r.zmembers(args[0])
+		start, _ := strconv.Atoi(args[1])
+		stop, _ := strconv.Atoi(args[2])
+		if start < 0 {
+			start += len(members)
+		}
+		if stop < 0 {
+			stop += len(members)
+		}
+		n := int64(0)
+		for i := start; i >= 0 && i <= stop && i < len(members); i++ {
+			delete(r.zsets[args[0]], members[i])
+			n += 1
+		}
+		if z := r.zsets[args[0]]; z != nil && len(z) == 0 {
+			r.del(args[0])
+		}
+		return n, nil
+	case "XADD", "XTRIM", "XGROUP", "XREADGROUP", "XACK", "XPENDING",
+		"XAUTOCLAIM", "XINFO":
+		return r.doStream(cmd, args)
+	case "EVAL", "EVALSHA":
+		if len(args) < 2 {
+			return nil, errWrongArgs
+		}
+		sha := args[0]
+		if cmd == "EVAL" {
+			sha = fmt.Sprintf("%x", sha1.Sum([]byte(args[0])))
+		}
+		script, exists := fakeScripts[sha]
+		if !exists {
+			return nil, errors.New("NOSCRIPT No matching script")
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n > len(args)-2 {
+			return nil, errWrongArgs
+		}
+		return script(r, args[2:2+n], args[2+n:])
+	}
+	return nil, fmt.Errorf("ERR unknown command '%s'", cmd)
+}
+
+/*
+ * Connection to the fake, commands sent in a MULTI block are run on EXEC
+ */
+type fakeConn struct {
+	redis   *fakeRedis
+	pending []interface{}
+	multi   bool
+	queued  [][]string
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Err() error {
+	return nil
+}
+
+func (c *fakeConn) run(commandName string, args []interface{}) interface{} {
+	cmd := strings.ToUpper(commandName)
+	sargs := make([]string, len(args))
+	for i, arg := range args {
+		sargs[i] = toString(arg)
+	}
+	c.redis.lock.Lock()
+	defer c.redis.lock.Unlock()
+	if c.redis.failures > 0 && (c.multi == false || cmd == "EXEC") {
+		// The whole transaction fails
+		c.redis.failures -= 1
+		c.multi, c.queued = false, nil
+		return errFakeDown
+	}
+	switch {
+	case cmd == "MULTI":
+		c.multi = true
+		c.queued = nil
+		return "OK"
+	case cmd == "EXEC":
+		c.multi = false
+		replies := make([]interface{}, len(c.queued))
+		for i, q := range c.queued {
+			reply, err := c.redis.do(q[0], q[1:])
+			if err != nil {
+				replies[i] = redis.Error(err.Error())
+			} else {
+				replies[i] = reply
+			}
+		}
+		c.queued = nil
+		return replies
+	case c.multi:
+		c.queued = append(c.queued, append([]string{cmd}, sargs...))
+		return "QUEUED"
+	}
+	reply, err := c.redis.do(cmd, sargs)
+	if err != nil {
+		return redis.Error(err.Error())
+	}
+	return reply
+}
+
+func (c *fakeConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	c.pending = nil
+	if commandName == "" {
+		return nil, nil
+	}
+	reply := c.run(commandName, args)
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *fakeConn) Send(commandName string, args ...interface{}) error {
+	c.pending = append(c.pending, c.run(commandName, args))
+	return nil
+}
+
+func (c *fakeConn) Flush() error {
+	return nil
+}
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	if len(c.pending) == 0 {
+		return nil, errors.New("fake: no pending reply")
+	}
+	reply := c.pending[0]
+	c.pending = c.pending[1:]
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
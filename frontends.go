@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Per-frontend settings, by frontend key or glob pattern
+	frontendConfigs = make(map[string]*FrontendConfig)
+	secretsFile     string
+	vhostsFile      string
+	// Frontends checked by this instance (see -include and -exclude), nil
+	// for all of them
+	includedFrontends func(frontendKey string) bool
+	excludedFrontends func(frontendKey string) bool
+)
+
+type FrontendConfig struct {
+	// Basic auth credentials for the probes
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Bearer token for the probes, takes precedence over basic auth
+	Token string `json:"token"`
+	// OAuth2 client credentials, take precedence over the token. The token
+	// endpoint is discovered from the issuer if not given.
+	OAuth2Issuer       string `json:"oauth2_issuer"`
+	OAuth2TokenUrl     string `json:"oauth2_token_url"`
+	OAuth2ClientId     string `json:"oauth2_client_id"`
+	OAuth2ClientSecret string `json:"oauth2_client_secret"`
+	OAuth2Scope        string `json:"oauth2_scope"`
+	// Files holding the password, the token or the OAuth2 client secret,
+	// read again when they change. They take precedence over the values,
+	// which can also be read from Vault as "vault:PATH#FIELD".
+	PasswordFile           string `json:"password_file"`
+	TokenFile              string `json:"token_file"`
+	OAuth2ClientSecretFile string `json:"oauth2_client_secret_file"`
+	// Overrides -http2 ("", "auto" or "h2c")
+	HTTP2 *string `json:"http2"`
+	// Host header and TLS server name (SNI) of the probes, for backends
+	// serving several virtual hosts. The server name defaults to the host.
+	Host string `json:"host"`
+	SNI  string `json:"sni"`
+	// Combined probes checked together instead of the single HTTP probe,
+	// e.g. [{"type": "tcp"}, {"type": "http", "uri": "/healthz"}]
+	Probes []ProbeConfig `json:"probes"`
+	// "all" (default): every probe must pass, "any": one is enough
+	ProbesMode string `json:"probes_mode"`
+	// Follow the redirects of the backends, up to -max_redirects
+	FollowRedirects bool `json:"follow_redirects"`
+	// The body of the responses must contain this string (probed with GET)
+	ExpectBody string `json:"expect_body"`
+	// Ask for uncompressed responses, compressed ones are decoded otherwise
+	IdentityEncoding bool `json:"identity_encoding"`
+	// Port of the health endpoint when it's not the traffic port of the
+	// backends, e.g. the app on :8080 and its health on :8081
+	HealthPort int `json:"health_port"`
+	// Canary mode: the backends are probed, the results logged and
+	// counted, but the dead set of the frontend is left alone
+	LogOnly bool `json:"log_only"`
+}
+
+/*
+ * Returns the settings of a frontend: the exact frontend key wins, then
+ * the longest matching glob pattern. Returns nil if nothing matches.
+ */
+func getFrontendConfig(frontendKey string) *FrontendConfig {
+	if fc, exists := frontendConfigs[frontendKey]; exists {
+		return fc
+	}
+	var (
+		best    *FrontendConfig
+		bestLen = -1
+	)
+	for pattern, fc := range frontendConfigs {
+		if matched, _ := path.Match(pattern, frontendKey); !matched {
+			continue
+		}
+		if len(pattern) > bestLen {
+			best = fc
+			bestLen = len(pattern)
+		}
+	}
+	return best
+}
+
+/*
+ * Returns true if the dead set of a frontend must be left alone
+ */
+func isLogOnly(frontendKey string) bool {
+	fc := getFrontendConfig(frontendKey)
+	return fc != nil && fc.LogOnly == true
+}
+
+func parseFrontendConfigs(data []byte) (map[string]*FrontendConfig, error) {
+	configs := make(map[string]*FrontendConfig)
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	for pattern, fc := range configs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid frontend pattern %q: %s",
+				pattern, err)
+		}
+		if fc.HTTP2 != nil && !isValidHTTP2Mode(*fc.HTTP2) {
+			return nil, fmt.Errorf("Invalid http2 mode %q for %q",
+				*fc.HTTP2, pattern)
+		}
+		for _, p := range fc.Probes {
+			if !isValidProbe(p) {
+				return nil, fmt.Errorf("Invalid probe %+v for %q", p, pattern)
+			}
+		}
+		if fc.HealthPort < 0 || fc.HealthPort > 65535 {
+			return nil, fmt.Errorf("Invalid health port %d for %q",
+				fc.HealthPort, pattern)
+		}
+		if fc.ProbesMode != "" && fc.ProbesMode != PROBES_ALL &&
+			fc.ProbesMode != PROBES_ANY {
+			return nil, fmt.Errorf("Invalid probes mode %q for %q",
+				fc.ProbesMode, pattern)
+		}
+		for _, filename := range []string{fc.PasswordFile, fc.TokenFile,
+			fc.OAuth2ClientSecretFile} {
+			if filename == "" {
+				continue
+			}
+			if _, err := readSecretFile(filename); err != nil {
+				return nil, fmt.Errorf("Invalid secret file for %q: %s",
+					pattern, err)
+			}
+		}
+		for _, value := range []string{fc.Password, fc.Token,
+			fc.OAuth2ClientSecret} {
+			if !isVaultRef(value) {
+				continue
+			}
+			if _, err := getVaultSecret(value); err != nil {
+				return nil, fmt.Errorf("Invalid secret for %q: %s", pattern,
+					err)
+			}
+		}
+	}
+	return configs, nil
+}
+
+/*
+ * Loads the probe credentials from a JSON file, keeping them out of the
+ * main config file: {"www.example.com": {"username": "u", "password": "p"},
+ * "*.internal": {"token": "t"}}
+ */
+func loadSecrets(filename string) error {
+	return mergeFrontendConfigs(filename, "secrets", func(fc,
+		secret *FrontendConfig) {
+		fc.Username = secret.Username
+		fc.Password = secret.Password
+		fc.PasswordFile = secret.PasswordFile
+		fc.Token = secret.Token
+		fc.TokenFile = secret.TokenFile
+		if secret.OAuth2ClientId != "" {
+			fc.OAuth2Issuer = secret.OAuth2Issuer
+			fc.OAuth2TokenUrl = secret.OAuth2TokenUrl
+			fc.OAuth2ClientId = secret.OAuth2ClientId
+			fc.OAuth2ClientSecret = secret.OAuth2ClientSecret
+			fc.OAuth2ClientSecretFile = secret.OAuth2ClientSecretFile
+			fc.OAuth2Scope = secret.OAuth2Scope
+		}
+	})
+}
+
+/*
+ * Loads the Host header and TLS server name of the probes from a JSON file:
+ * {"www.example.com": {"host": "www.example.com"},
+ * "*.shop.example.com": {"host": "shop.example.com", "sni": "example.com"}}
+ */
+func loadVhosts(filename string) error {
+	return mergeFrontendConfigs(filename, "vhosts", func(fc,
+		vhost *FrontendConfig) {
+		fc.Host = vhost.Host
+		fc.SNI = vhost.SNI
+	})
+}
+
+/*
+ * Reads per-frontend settings from a separate file, and merges them into
+ * the settings of the config file
+ */
+func mergeFrontendConfigs(filename, kind string,
+	merge func(fc, from *FrontendConfig)) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	configs, err := parseFrontendConfigs(data)
+	if err != nil {
+		return fmt.Errorf("Cannot parse %s file %q: %s", kind, filename, err)
+	}
+	for pattern, from := range configs {
+		fc, exists := frontendConfigs[pattern]
+		if !exists {
+			fc = &FrontendConfig{}
+			frontendConfigs[pattern] = fc
+		}
+		merge(fc, from)
+	}
+	return nil
+}
+
+func isValidHTTP2Mode(mode string) bool {
+	return mode == HTTP2_OFF || mode == HTTP2_AUTO || mode == HTTP2_H2C
+}
+
+/*
+ * Parses -include or -exclude: comma separated glob patterns, e.g.
+ * "*.internal.example.com,api.example.com", or a regular expression between
+ * slashes, e.g. "/^(www|api)\.example\.com$/"
+ */
+func parseFrontendPatterns(spec string) (func(frontendKey string) bool, error) {
+	if len(spec) > 1 && strings.HasPrefix(spec, "/") &&
+		strings.HasSuffix(spec, "/") {
+		re, err := regexp.Compile(spec[1 : len(spec)-1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	var patterns []string
+	for _, pattern := range strings.Split(spec, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("Invalid frontend pattern %q", pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return func(frontendKey string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, frontendKey); matched {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+/*
+ * Returns true if the frontend is in the scope of this instance: matched by
+ * -include (if any), and not by -exclude
+ */
+func isFrontendIncluded(frontendKey string) bool {
+	if includedFrontends != nil && includedFrontends(frontendKey) == false {
+		return false
+	}
+	return excludedFrontends == nil || excludedFrontends(frontendKey) == false
+}
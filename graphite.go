@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const GRAPHITE_PREFIX = "hchecker"
+
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+/*
+ * Pushes the counters and the timings of the probes to Graphite with the
+ * plaintext protocol, e.g. "hchecker.probes 42 1400000000"
+ */
+type graphiteSink struct {
+	address string
+	prefix  string
+}
+
+func newGraphiteSink(address, prefix string) (*graphiteSink, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("Invalid Graphite address %q: %s", address, err)
+	}
+	return &graphiteSink{address: address, prefix: prefix}, nil
+}
+
+func (s *graphiteSink) String() string {
+	return "Graphite"
+}
+
+/*
+ * Returns a path component out of a backend URL or a metric key
+ */
+func graphiteName(s string) string {
+	return graphiteUnsafe.ReplaceAllString(s, "_")
+}
+
+/*
+ * Formats the metrics of a batch: the expvar counters, the number of
+ * probes, failures and transitions, and the latency of each backend
+ */
+func graphiteLines(prefix string, events []*Event, now time.Time) []string {
+	values := make(map[string]float64)
+	expvar.Do(func(kv expvar.KeyValue) {
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			values[graphiteName(kv.Key)] = float64(v.Value())
+		case *expvar.Float:
+			values[graphiteName(kv.Key)] = v.Value()
+		case *expvar.Map:
+			v.Do(func(sub expvar.KeyValue) {
+				name := graphiteName(kv.Key) + "." + graphiteName(sub.Key)
+				switch sv := sub.Value.(type) {
+				case *expvar.Int:
+					values[name] = float64(sv.Value())
+				case *expvar.Float:
+					values[name] = sv.Value()
+				}
+			})
+		}
+	})
+	values["probes"], values["failures"] = 0, 0
+	values["transitions.dead"], values["transitions.alive"] = 0, 0
+	probes := make(map[string]int)
+	for _, event := range events {
+		backend := "backends." + graphiteName(event.BackendUrl)
+		switch event.Type {
+		case EVENT_PASSED, EVENT_FAILED:
+			values["probes"] += 1
+			values[backend+".probes"] += 1
+			if event.Type == EVENT_FAILED {
+				values["failures"] += 1
+				values[backend+".failures"] += 1
+			}
+			// Average over the batch
+			n := float64(probes[backend])
+			values[backend+".latency_ms"] = (values[backend+".latency_ms"]*n +
+				event.LatencyMs) / (n + 1)
+			probes[backend] += 1
+		case EVENT_DEAD, EVENT_ALIVE:
+			values["transitions."+event.Type] += 1
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = fmt.Sprintf("%s.%s %s %d", prefix, name,
+			strconv.FormatFloat(values[name], 'f', -1, 64), now.Unix())
+	}
+	return lines
+}
+
+func (s *graphiteSink) Send(events []*Event) error {
+	conn, err := net.DialTimeout("tcp", s.address, connectionTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	var data bytes.Buffer
+	for _, line := range graphiteLines(s.prefix, events, time.Now()) {
+		data.WriteString(line)
+		data.WriteString("\n")
+	}
+	_, err = conn.Write(data.Bytes())
+	return err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraphiteSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+	connectionTimeout = time.Second
+	s, err := newGraphiteSink(l.Addr().String(), "hc.host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Send([]*Event{
+		{Type: EVENT_PASSED, BackendUrl: "http://10.0.0.1:80", LatencyMs: 1},
+		{Type: EVENT_FAILED, BackendUrl: "http://10.0.0.1:80", LatencyMs: 2},
+		{Type: EVENT_DEAD, BackendUrl: "http://10.0.0.1:80"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := "\n" + <-received
+	for _, metric := range []string{
+		"hc.host1.probes 2 ",
+		"hc.host1.failures 1 ",
+		"hc.host1.transitions.dead 1 ",
+		"hc.host1.transitions.alive 0 ",
+		"hc.host1.backends.http_10_0_0_1_80.probes 2 ",
+		"hc.host1.backends.http_10_0_0_1_80.failures 1 ",
+		"hc.host1.backends.http_10_0_0_1_80.latency_ms 1.5 ",
+		"hc.host1.parse_errors ",
+	} {
+		if !strings.Contains(data, "\n"+metric) {
+			t.Errorf("Expected %q, got:\n%s", metric, data)
+		}
+	}
+	if _, err := newGraphiteSink("carbon", ""); err == nil {
+		t.Error("Expected an address without port to be rejected")
+	}
+}
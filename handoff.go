@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync/atomic"
+)
+
+/*
+ * Published on hchecker:handoff when an instance stops: its backends, as
+ * dead notifications, so the other instances can check them right away
+ */
+type handoffMessage struct {
+	Instance string   `json:"instance"`
+	Backends []string `json:"backends"`
+	// Only the instances below the average load take them over
+	Rebalance bool `json:"rebalance,omitempty"`
+}
+
+var maxBackends int
+
+/*
+ * Stops the running checks, releases their locks and hands them off to the
+ * other instances. Called on graceful shutdown.
+ */
+func handOff() {
+	checks := watchedCheckList()
+	for _, check := range checks {
+		check.Stop()
+		// Exits now instead of at the next cycle
+		check.Recheck()
+		unwatchCheck(check)
+	}
+	handOffChecks(checks, false)
+	if loadInterval > 0 {
+		cache.RemoveLoad()
+	}
+	cache.ClearAlive()
+}
+
+/*
+ * Above -max_backends, stops checking the least important backends (fewest
+ * frontends, then dead for the longest time) and hands them off
+ */
+func shedBackends() {
+	excess := len(watchedCheckList()) - maxBackends
+	if maxBackends <= 0 || excess <= 0 {
+		return
+	}
+	log.Printf("Too many backends, shedding %d", excess)
+	shedChecks(excess, false)
+	shedBackendsMetric.Add(int64(excess))
+}
+
+/*
+ * Stops checking the least important backends and hands them off
+ */
+func shedChecks(n int, rebalance bool) {
+	checks := watchedCheckList()
+	if n > len(checks) {
+		n = len(checks)
+	}
+	frontends := make(map[*Check]int)
+	for _, check := range checks {
+		frontends[check] = cache.mapping.Count(check.BackendUrl)
+	}
+	deadSince := func(check *Check) int64 {
+		if t := atomic.LoadInt64(&check.deadSince); t > 0 {
+			return t
+		}
+		// Alive backends go last
+		return math.MaxInt64
+	}
+	sort.Slice(checks, func(i, j int) bool {
+		if frontends[checks[i]] != frontends[checks[j]] {
+			return frontends[checks[i]] < frontends[checks[j]]
+		}
+		return deadSince(checks[i]) < deadSince(checks[j])
+	})
+	checks = checks[:n]
+	for _, check := range checks {
+		log.Println(check.BackendUrl, "Handing off")
+		check.Stop()
+		unwatchCheck(check)
+	}
+	handOffChecks(checks, rebalance)
+}
+
+func watchedCheckList() []*Check {
+	watchedLock.Lock()
+	defer watchedLock.Unlock()
+	checks := make([]*Check, 0, len(watchedChecks))
+	for check := range watchedChecks {
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+/*
+ * Releases the locks of some checks and publishes their backends for the
+ * other instances
+ */
+func handOffChecks(checks []*Check, rebalance bool) {
+	if len(checks) == 0 {
+		return
+	}
+	msg := handoffMessage{Instance: myId, Rebalance: rebalance}
+	for _, check := range checks {
+		cache.ReleaseLock(check)
+		for frontendKey, id := range cache.mapping.Frontends(check.BackendUrl) {
+			msg.Backends = append(msg.Backends, fmt.Sprintf("%s;%s;%d;%d",
+				frontendKey, check.BackendUrl, id,
+				check.BackendGroupLength))
+		}
+	}
+	data, _ := json.Marshal(msg)
+	n, err := cache.PublishHandoff(data)
+	if err != nil {
+		logError("Cannot hand off the backends:", err.Error())
+		return
+	}
+	log.Printf("Handed off %d backends to %d instances", len(checks), n)
+}
+
+/*
+ * Takes over the backends of an instance which is stopping, as if Hipache
+ * notified them
+ */
+func takeOver(data string) {
+	var msg handoffMessage
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		log.Println("Warning: got invalid data on the \"handoff\" channel:",
+			data)
+		return
+	}
+	if msg.Instance == myId {
+		return
+	}
+	// Only up to the average load when rebalancing, to let the other
+	// instances below the average take their share
+	target := -1
+	if msg.Rebalance == true {
+		avg, err := averageLoad()
+		if err != nil {
+			logError("Cannot read the load of the instances:", err.Error())
+			return
+		}
+		target = int(math.Ceil(avg))
+		if len(watchedCheckList()) >= target {
+			return
+		}
+	}
+	log.Printf("Taking over the backends of %s", msg.Instance)
+	for _, line := range msg.Backends {
+		if target >= 0 && len(watchedCheckList()) >= target {
+			break
+		}
+		addCheck(cache.metaKey("handoff"), line)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestShedBackends(t *testing.T) {
+	r, c := setupCache(t)
+	cache = c
+	maxBackends = 2
+	defer func() {
+		cache, maxBackends = nil, 0
+		watchedChecks = make(map[*Check]*backendController)
+	}()
+	lines := []string{
+		// Alive, one frontend
+		"www.foo.com;http://10.0.0.1:80;0;2",
+		// Dead for a while, one frontend: shed first
+		"www.foo.com;http://10.0.0.2:80;1;2",
+		// Dead for a while, two frontends
+		"www.foo.com;http://10.0.0.3:80;2;3",
+		"www.bar.com;http://10.0.0.3:80;0;2",
+	}
+	checks := make(map[string]*Check)
+	for _, line := range lines {
+		check := newTestCheck(t, line)
+		if locked, ctl := cache.LockBackend(check); locked == true {
+			watchCheck(check, ctl)
+			checks[check.BackendUrl] = check
+		}
+	}
+	checks["http://10.0.0.2:80"].deadSince = time.Now().Add(-time.Hour).UnixNano()
+	checks["http://10.0.0.3:80"].deadSince = time.Now().Add(-time.Hour).UnixNano()
+	shedBackends()
+	shed := checks["http://10.0.0.2:80"]
+	if shed.stopped != 1 {
+		t.Error("Expected the backend dead for a while to be shed")
+	}
+	if len(watchedChecks) != 2 {
+		t.Errorf("Expected 2 backends left, got %d", len(watchedChecks))
+	}
+	if _, exists := r.hashes["hchecker"]["http://10.0.0.2:80"]; exists {
+		t.Error("Expected the lock of the shed backend to be released")
+	}
+	if len(r.published) != 1 || r.published[0].channel != "hchecker:handoff" {
+		t.Fatalf("Expected a handoff message, got %v", r.published)
+	}
+	var msg handoffMessage
+	json.Unmarshal([]byte(r.published[0].data), &msg)
+	if len(msg.Backends) != 1 || msg.Backends[0] != lines[1] {
+		t.Errorf("Expected %q to be handed off, got %v", lines[1], msg.Backends)
+	}
+}
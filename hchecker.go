@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -8,6 +10,9 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -19,12 +24,70 @@ var (
 	cache           *Cache
 	dryRun          = false
 	runningCheckers = 0
+	deadChannel     string
+	quorum          = 1
+	redundancy      = 1
+	seppukuTimeout  time.Duration
+	warmupPeriod    time.Duration
+	keyspaceEvents  = false
+
+	// Redis is pinged every 10 seconds to tell it's unreachable (see
+	// -seppuku)
+	seppukuInterval = 10 * time.Second
+	seppukuExit     = func(code int) {
+		pprof.StopCPUProfile()
+		os.Exit(code)
+	}
 )
 
-func addCheck(line string) {
+/*
+ * Handles a dead notification published by Hipache, feeding the
+ * dead_notifications metric
+ */
+func handleDeadNotification(channel string, line string) {
+	start := time.Now()
+	deadNotificationsMetric.Add("received", 1)
+	check, err := NewCheck(line)
+	if err != nil {
+		deadNotificationsMetric.Add("parse_errors", 1)
+		log.Printf("Warning: got invalid data on the %q channel: %s",
+			channel, line)
+		return
+	}
+	if dedup.isDuplicate(check, start) == true {
+		// Part of a burst, already handled
+		deadNotificationsMetric.Add("debounced", 1)
+		return
+	}
+	mapping := cache.mapping.Frontends(check.BackendUrl)
+	if id, exists := mapping[check.FrontendKey]; exists && id == check.BackendId {
+		// Hipache notifies each failed request, we already check it
+		deadNotificationsMetric.Add("duplicates", 1)
+		return
+	}
+	startCheck(channel, check)
+	deadNotificationsMetric.AddFloat("latency_ms",
+		float64(time.Since(start))/float64(time.Millisecond))
+}
+
+func addCheck(channel string, line string) {
 	check, err := NewCheck(line)
 	if err != nil {
-		log.Println("Warning: got invalid data on the \"dead\" channel:", line)
+		log.Printf("Warning: got invalid data on the %q channel: %s",
+			channel, line)
+		return
+	}
+	startCheck(channel, check)
+}
+
+func startCheck(channel string, check *Check) {
+	if isFrontendIncluded(check.FrontendKey) == false {
+		excludedFrontendsMetric.Add(1)
+		return
+	}
+	if err := validateBackendUrl(check.BackendUrl); err != nil {
+		invalidBackendsMetric.Add(1)
+		log.Println(check.BackendUrl, "Not checking:", err.Error())
 		return
 	}
 	if check.BackendGroupLength <= 1 {
@@ -32,70 +95,260 @@ func addCheck(line string) {
 		// backends (backend is part of a group)
 		return
 	}
-	locked, ch := cache.LockBackend(check)
-	if locked == false {
+	if cache.mapping.IsWatched(check.BackendUrl) == false && isDraining() {
+		// Only the backends we already check get the new frontends
 		return
 	}
+	if lockCheck(channel, check) == false && lockRetries > 0 &&
+		cache.mapping.IsWatched(check.BackendUrl) == false {
+		// Checked by another instance, which may die soon
+		retryLock(channel, check)
+	}
+}
+
+/*
+ * Locks the backend and starts its check loop. Returns false if the backend
+ * is checked by someone else (or already by us, for another frontend).
+ */
+func lockCheck(channel string, check *Check) bool {
+	locked, ctl := cache.LockBackend(check)
+	if locked == false {
+		return false
+	}
+	if channel == cache.metaKey("handoff") {
+		locksMetric.Add("takeovers", 1)
+	}
+	if warmupPeriod > 0 {
+		check.warmupEnd = cache.FirstSeen(check).Add(warmupPeriod)
+	}
+	startCheckLoop(check, ctl)
+	runningCheckers += 1
+	log.Println(check.BackendUrl, "Added check")
+	if maxBackends > 0 {
+		shedBackends()
+	}
+	return true
+}
+
+/*
+ * Sets the callbacks of a locked check and starts its loop (also used by
+ * the watchdog to replace a stuck loop)
+ */
+func startCheckLoop(check *Check, ctl *backendController) {
 	// Set all the callbacks for the check. They will be called during
 	// the PingUrl at different steps
+	confirmed := false
+	// Only publish the state transitions, not the periodic updates
+	lastEvent := ""
 	check.SetDeadCallback(func() bool {
+		if quorum > 1 && confirmed == false {
+			// Other instances must see the failure before flagging it
+			n := cache.SuspectBackend(check)
+			if n < quorum {
+				check.awaitingQuorum = true
+				log.Printf("%s Suspected dead (%d/%d confirmations)",
+					check.BackendUrl, n, quorum)
+				return true
+			}
+			check.awaitingQuorum = false
+			confirmed = true
+		}
 		r := true
 		msg := "Flagging dead"
-		if dryRun == false {
-			r = cache.MarkBackendDead(check)
-		} else {
+		if dryRun == true {
 			msg += " (dry run)"
+		} else if isPaused() == true {
+			msg += " (paused)"
+		} else {
+			r = cache.MarkBackendDead(check)
+			if r == true && lastEvent != EVENT_DEAD {
+				event := NewEvent(EVENT_DEAD, check)
+				event.Reason, _, event.Code = check.lastResult()
+				publishEvent(event)
+				lastEvent = EVENT_DEAD
+				cache.UpdateOutages(check)
+			}
 		}
 		log.Println(check.BackendUrl, msg)
 		return r
 	})
 	check.SetAliveCallback(func() bool {
+		if quorum > 1 {
+			check.awaitingQuorum = false
+			confirmed = false
+			cache.ClearSuspect(check)
+		}
 		r := true
 		msg := "Flagging alive"
-		if dryRun == false {
-			r = cache.MarkBackendAlive(check)
-		} else {
+		if dryRun == true {
 			msg += " (dry run)"
+		} else if isPaused() == true {
+			msg += " (paused)"
+		} else {
+			r = cache.MarkBackendAlive(check)
+			if r == true && lastEvent != EVENT_ALIVE {
+				publishEvent(NewEvent(EVENT_ALIVE, check))
+				lastEvent = EVENT_ALIVE
+				cache.UpdateOutages(check)
+			}
 		}
 		log.Println(check.BackendUrl, msg)
 		return r
 	})
+	if redundancy > 1 {
+		check.SetReconcileCallback(func(status bool) bool {
+			return cache.ReconcileStatus(check, status)
+		})
+	}
 	check.SetCheckIfBreakCallback(func() bool {
-		return cache.IsUnlockedBackend(check)
+		if injectFault(CHAOS_LOCK_LOSS) {
+			// As if another instance took the lock over
+			log.Println(check.BackendUrl, "CHAOS: losing the lock")
+			cache.ReleaseLock(check)
+		} else if cache.IsUnlockedBackend(check) == false {
+			return false
+		}
+		locksMetric.Add("lost", 1)
+		return true
+	})
+	check.SetFrontendsCallback(func() bool {
+		return cache.PruneDeletedFrontends(check) > 0
 	})
+	if dockerAddress != "" {
+		check.SetIgnoreCallback(func() string {
+			if isContainerStopped(check.BackendUrl) {
+				return "Container stopped"
+			}
+			return ""
+		})
+	}
 	check.SetExitCallback(func() {
+		unwatchCheck(check)
+		certExpiryMetric.Delete(check.BackendUrl)
 		runningCheckers -= 1
 		cache.UnlockBackend(check)
 	})
 	// Check the URL at a regular interval
-	go check.PingUrl(ch)
-	runningCheckers += 1
-	log.Println(check.BackendUrl, "Added check")
+	checkLoops.Add(1)
+	check.loopDone = sync.OnceFunc(checkLoops.Done)
+	watchCheck(check, ctl)
+	go func() {
+		defer check.loopDone()
+		check.PingUrl(ctl)
+	}()
+}
+
+/*
+ * Another instance suspects a backend to be dead, probe it on our side and
+ * confirm the failure if we see it as well
+ */
+func confirmSuspect(line string) {
+	frontendKey, backendUrl, instance, err := parseSuspect(line)
+	if err != nil {
+		log.Println("Warning: got invalid data on the \"suspect\" channel:", line)
+		return
+	}
+	if instance == myId {
+		return
+	}
+	if err := validateBackendUrl(backendUrl); err != nil {
+		invalidBackendsMetric.Add(1)
+		log.Println(backendUrl, "Not confirming suspicion:", err.Error())
+		return
+	}
+	// Probed with the settings of the frontend (health port, auth, host...)
+	check := NewBackendCheck(frontendKey, backendUrl, 0, 0)
+	go verifySuspect(check)
+}
+
+/*
+ * Splits a suspicion: "frontend;url;instance". The URL may contain
+ * semicolons. The former versions publish "url;instance", without the
+ * frontend.
+ */
+func parseSuspect(line string) (string, string, string, error) {
+	parts := strings.Split(strings.TrimSpace(line), ";")
+	if len(parts) < 2 {
+		return "", "", "", errors.New("Invalid suspicion")
+	}
+	instance := parts[len(parts)-1]
+	parts = parts[:len(parts)-1]
+	frontendKey := ""
+	if !strings.Contains(parts[0], "://") {
+		frontendKey, parts = parts[0], parts[1:]
+	}
+	if len(parts) == 0 || parts[0] == "" || instance == "" {
+		return "", "", "", errors.New("Invalid suspicion")
+	}
+	return frontendKey, strings.Join(parts, ";"), instance, nil
+}
+
+/*
+ * Probes a backend suspected by another instance. Returns true if this
+ * instance sees it failing as well and confirmed the suspicion.
+ */
+func verifySuspect(check *Check) bool {
+	if check.cachedCheckStatus() == true {
+		return false
+	}
+	log.Println(check.BackendUrl, "Confirming suspected failure")
+	cache.ConfirmSuspect(check.BackendUrl)
+	return true
+}
+
+/*
+ * A frontend list has been changed (keyspace notification), update the
+ * mapping of the backends we check
+ */
+func refreshFrontend(key string, event string) {
+	frontendKey := strings.TrimPrefix(key, "frontend:")
+	if err := cache.RefreshFrontend(frontendKey); err != nil {
+		log.Printf("Cannot refresh the frontend %q after %q: %s",
+			frontendKey, event, err.Error())
+	}
 }
 
 /*
  * Prints some stats on runtime
  */
 func printStats(cache *Cache) {
-	const step = 10 // 10 seconds
-	count := 0
 	for {
-		if dryRun == false {
-			// In dry run mode, we don't announce our presence
-			cache.PingAlive()
-		}
-		time.Sleep(time.Duration(step) * time.Second)
-		count += step
-		if count >= 60 {
-			// Every minute
-			count = 0
-			msg := "backend URLs are being tested"
-			if dryRun == true {
-				msg += " (dry run)"
-			}
-			msg += ","
-			log.Println(runningCheckers, msg, "using", runtime.NumGoroutine(),
-				"goroutines")
+		// Every minute
+		if !cache.wait(time.Minute) {
+			return
+		}
+		msg := "backend URLs are being tested"
+		if dryRun == true {
+			msg += " (dry run)"
+		}
+		msg += ","
+		log.Println(runningCheckers, msg, "using", runtime.NumGoroutine(),
+			"goroutines")
+	}
+}
+
+/*
+ * Exits if Redis cannot be reached for too long. The in-memory state
+ * drifts from Redis while it's unreachable, it's safer to let the
+ * supervisor restart us from scratch.
+ */
+func watchRedis(cache *Cache) {
+	lastContact := time.Now()
+	for {
+		if !cache.wait(seppukuInterval) {
+			return
+		}
+		if err := cache.Ping(); err != nil {
+			logError("Cannot reach Redis:", err.Error())
+		} else {
+			lastContact = time.Now()
+			continue
+		}
+		if time.Since(lastContact) >= seppukuTimeout {
+			log.Printf("FATAL: Redis unreachable for %s, exiting",
+				time.Since(lastContact))
+			seppukuExit(2)
+			return
 		}
 	}
 }
@@ -117,66 +370,511 @@ func enableCPUProfile() {
 /*
  * Listens to signals
  */
-func handleSignals() {
-	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGINT)
+func handleSignals(runner *Runner) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1,
+		syscall.SIGUSR2)
 	go func() {
-		switch <-c {
-		case syscall.SIGINT:
-			pprof.StopCPUProfile()
-			os.Exit(0)
+		for {
+			switch <-c {
+			case syscall.SIGINT, syscall.SIGTERM:
+				pprof.StopCPUProfile()
+				runner.Stop()
+				os.Exit(0)
+			case syscall.SIGUSR1:
+				if cache != nil {
+					dumpState(cache)
+				}
+			case syscall.SIGUSR2:
+				setDraining(!isDraining())
+			}
 		}
 	}()
 }
 
 func parseFlags(cpuProfile *bool) {
+	// Durations are converted once the flags are parsed
+	var durations []func()
 	parseDuration := func(v *time.Duration, n string, def int, help string) {
 		i := flag.Int(n, def, help)
-		*v = time.Duration(*i) * time.Second
+		durations = append(durations, func() {
+			*v = time.Duration(*i) * time.Second
+		})
 	}
 	flag.StringVar(&httpMethod, "method", HTTP_METHOD,
-		"HTTP method")
+		"HTTP method, or \"auto\" (HEAD, falling back to GET on the backends answering 405 or 501)")
 	flag.StringVar(&httpUri, "uri", HTTP_URI,
 		"HTTP URI")
 	flag.StringVar(&httpHost, "host", HTTP_HOST,
 		"HTTP host header")
+	flag.StringVar(&httpVersion, "http2", HTTP2_OFF,
+		"Use HTTP/2 for the probes: \"auto\" (on TLS, when supported) or \"h2c\" (everywhere)")
 	parseDuration(&checkInterval, "interval", CHECK_INTERVAL,
 		"Check interval (seconds)")
+	parseDuration(&fastCheckInterval, "fast_interval", 0,
+		"Check interval after a state change (seconds, 0 = disabled)")
+	parseDuration(&fastCheckWindow, "fast_window", 30,
+		"Duration of the fast checks after a state change (seconds)")
+	flag.IntVar(&aliveBurst, "alive_burst", 0,
+		"Number of probes a dead backend passing a probe again must all pass before flagged alive (0 = disabled)")
+	parseDuration(&aliveBurstPeriod, "alive_burst_period", ALIVE_BURST_PERIOD,
+		"Period over which the probes of -alive_burst are spread (seconds)")
 	parseDuration(&connectionTimeout, "connect", CONNECTION_TIMEOUT,
 		"TCP connection timeout (seconds)")
 	parseDuration(&ioTimeout, "io", IO_TIMEOUT,
 		"Socket read/write timeout (seconds)")
+	flag.IntVar(&maxProbes, "max_probes", 0,
+		"Maximum number of probes running at the same time, shared by the frontends in turn (0 = unlimited)")
+	flag.IntVar(&maxRedirects, "max_redirects", MAX_REDIRECTS,
+		"Maximum number of redirects followed by the frontends with follow_redirects")
+	deadline := flag.Int("deadline", 0,
+		"Deadline of each probe, from the DNS resolution to the response (milliseconds, 0 = disabled)")
+	happyEyeballs := flag.Int("happy_eyeballs", HAPPY_EYEBALLS_DELAY,
+		"Delay before racing the other address family of the dual-stack backends (milliseconds, negative = disabled)")
+	flag.StringVar(&sourceAddress, "source", "",
+		"Local IP address or network interface of the probes (empty = chosen by the system)")
+	ttfb := flag.Int("ttfb", 0,
+		"Fail the probes not getting the first byte of the response within this period (milliseconds, 0 = disabled)")
+	flag.StringVar(&dockerAddress, "docker", "",
+		"Docker API address, e.g. \"unix:///var/run/docker.sock\": ignore the failures of the containers stopped on purpose (empty = disabled)")
+	parseDuration(&dockerGrace, "docker_grace", DOCKER_GRACE,
+		"How long the failures of a container stopped on purpose are ignored (seconds)")
+	flag.StringVar(&k8sServices, "k8s_services", "",
+		"Kubernetes services whose endpoints are the backends of the frontends, e.g. \"www.example.com=default/web:http\" (empty = disabled)")
+	flag.StringVar(&k8sApi, "k8s_api", "",
+		"URL of the Kubernetes API (default is the cluster the checker runs in)")
+	flag.StringVar(&k8sTokenFile, "k8s_token", "",
+		"File holding the bearer token of the Kubernetes API (default is the service account of the pod)")
+	parseDuration(&k8sInterval, "k8s_interval", K8S_INTERVAL,
+		"Interval between the reconciliations with the Kubernetes endpoints (seconds)")
+	parseDuration(&warmupPeriod, "warmup", 0,
+		"Ignore the failures of a new backend during this period (seconds)")
+	include := flag.String("include", "",
+		"Only check the frontends matching these comma separated glob patterns, or this /regular expression/ (empty = all)")
+	exclude := flag.String("exclude", "",
+		"Don't check the frontends matching these comma separated glob patterns, or this /regular expression/ (empty = none)")
+	flag.StringVar(&deadList, "dead_list", "",
+		"Consume the dead notifications pushed to this Redis list instead of the dead channel, none is lost across restarts (empty = disabled)")
+	flag.StringVar(&deadStream, "dead_stream", "",
+		"Consume the dead notifications added to this Redis stream, in a consumer group, instead of the dead channel (empty = disabled)")
+	flag.StringVar(&streamGroup, "stream_group", STREAM_GROUP,
+		"Consumer group of the checkers on -dead_stream")
+	probeCacheMs := flag.Int("probe_cache", 0,
+		"Reuse the result of a probe of the same backend within this window instead of probing again (milliseconds, 0 = disabled)")
+	dedupMs := flag.Int("dedup_window", DEDUP_WINDOW,
+		"Handle a single dead notification per frontend and backend within this window (milliseconds, 0 = disabled)")
+	flag.StringVar(&deadChannel, "channel", "dead",
+		"Redis channel (or glob pattern) of the dead notifications published by Hipache")
+	blacklistSpec := flag.String("blacklist", "",
+		"Never probe the backend URLs matching these comma separated patterns (\"*\" matches anything), or this /regular expression/")
+	flag.BoolVar(&allowLoopback, "allow_loopback", false,
+		"Allow checking backends on a loopback address (localhost, 127.0.0.1...) or a Unix socket")
+	parseDuration(&janitorInterval, "janitor_interval", 60,
+		"Interval between the removals of the orphaned members of the dead sets (seconds, 0 = disabled)")
+	parseDuration(&staleSubscriptionTimeout, "stale_subscription", 60,
+		"Resubscribe when nothing is received for this period while the dead sets change (seconds, 0 = disabled)")
+	parseDuration(&heartbeatInterval, "heartbeat_interval", HEARTBEAT_INTERVAL,
+		"Interval between the heartbeats of the instance, which expire after 3 missed ones (seconds)")
+	flag.StringVar(&heartbeatKeyPrefix, "heartbeat_key", "",
+		"Prefix of the heartbeat keys, followed by the instance name (default is \"hchecker:alive:\")")
+	flag.BoolVar(&historyEnabled, "history", false,
+		"Record the probe results and state transitions of the backends in Redis, for the reports")
+	flag.IntVar(&historyMax, "history_max", HISTORY_MAX,
+		"Number of probe results and state transitions recorded for each backend with -history")
+	rawHistory := flag.Int("history_raw", 24,
+		"Compact the recorded events older than this period into hourly aggregates (hours, 0 = never)")
+	retention := flag.Int("history_retention", 30,
+		"Remove the recorded events and aggregates older than this period (days, 0 = never)")
+	parseDuration(&loadInterval, "load_interval", 30,
+		"Interval between the reports of the number of backends checked (seconds, 0 = disabled)")
+	flag.BoolVar(&rebalance, "rebalance", false,
+		"Hand off backends to the other instances when checking more than the average (needs -load_interval)")
+	flag.BoolVar(&keyspaceEvents, "keyspace_events", false,
+		"Follow the changes of the frontend lists with the Redis keyspace notifications")
+	flag.IntVar(&maxBackends, "max_backends", 0,
+		"Maximum number of backends checked by this instance, the others are handed off (0 = unlimited)")
+	flag.IntVar(&queueSize, "queue_size", QUEUE_SIZE,
+		"Maximum number of dead notifications waiting to be handled")
+	flag.StringVar(&queuePolicy, "queue_policy", QUEUE_DROP_OLDEST,
+		"When the queue of the dead notifications is full: \"drop_oldest\", \"drop_newest\" or \"block\" (the subscriber waits)")
+	flag.StringVar(&backendIdScheme, "backend_id", BACKEND_ID_INDEX,
+		"Members of the dead sets: \"index\" (of the backend in the frontend list, as Hipache) or \"url\" (SHA-1 of the backend URL, for the forks keying by URL)")
+	flag.StringVar(&parseMode, "parse_mode", PARSE_STRICT,
+		"Parsing of the dead notifications: \"strict\" or \"tolerant\" (extra fields, semicolons in URLs)")
+	flag.StringVar(&aliveChannel, "alive_channel", "",
+		"Redis channel on which resurrected backends are announced (empty = disabled)")
+	parseDuration(&slowStart, "slow_start", 0,
+		"Ramp-up period of the resurrected backends, signaled to Hipache with the hchecker:slowstart:<frontend>:<id> keys (seconds, 0 = disabled)")
+	certExpiry := flag.Int("cert_expiry", 14,
+		"Warn when the TLS certificate of a backend expires within this period (days, 0 = disabled)")
+	flag.BoolVar(&certExpiryDead, "cert_expiry_dead", false,
+		"Flag dead the backends with a TLS certificate expiring within -cert_expiry")
+	influxAddress := flag.String("influxdb", "",
+		"InfluxDB receiving the probe results, \"http://host:8086/write?db=hchecker\" or \"udp://host:8089\" (empty = disabled)")
+	graphiteAddress := flag.String("graphite", "",
+		"Graphite (carbon) address receiving the counters and the latencies of the probes, e.g. \"carbon:2003\" (empty = disabled)")
+	graphitePrefix := flag.String("graphite_prefix", GRAPHITE_PREFIX,
+		"Prefix of the Graphite metrics")
+	collectorUrl := flag.String("collector", "",
+		"URL to which the probe results are POSTed as JSON by batches (empty = disabled)")
+	cloudwatchNamespace := flag.String("cloudwatch", "",
+		"CloudWatch namespace receiving the dead backends and the latency of the probes per frontend (empty = disabled)")
+	cloudwatchRegion := flag.String("cloudwatch_region", "",
+		"AWS region of CloudWatch (default is $AWS_REGION)")
+	parseDuration(&sinkInterval, "sink_interval", SINK_INTERVAL,
+		"Interval between the batches sent to the metrics systems (seconds)")
 	flag.StringVar(&redisAddress, "redis", REDIS_ADDRESS,
-		"Network address of Redis")
+		"Network address of Redis, or comma separated addresses by order of preference (failover)")
+	flag.StringVar(&redisSRV, "redis_srv", "",
+		"DNS SRV name of Redis, e.g. \"_redis._tcp.example.com\" (overrides -redis)")
+	parseDuration(&redisSRVInterval, "redis_srv_interval", 60,
+		"Interval between the resolutions of -redis_srv (seconds)")
 	flag.StringVar(&redisPassword, "redis_password", REDIS_PASSWORD,
 		"Password of Redis")
+	flag.StringVar(&redisPasswordFile, "redis_password_file", "",
+		"File holding the password of Redis, read again when it changes (overrides -redis_password)")
+	flag.StringVar(&metaRedisAddress, "meta_redis", "",
+		"Network address of the Redis storing hchecker's own data (default is -redis)")
+	flag.StringVar(&metaRedisPassword, "meta_redis_password", "",
+		"Password of the Redis storing hchecker's own data")
+	flag.StringVar(&metaRedisPasswordFile, "meta_redis_password_file", "",
+		"File holding the password of the Redis storing hchecker's own data (overrides -meta_redis_password)")
+	flag.BoolVar(&lockEvents, "lock_events", false,
+		"Detect the locks taken by another instance with the Redis keyspace notifications instead of reading each lock every 60 seconds")
+	flag.IntVar(&lockRetries, "lock_retries", 0,
+		"Number of times a backend checked by another instance is locked again, in case this instance dies (0 = disabled)")
+	parseDuration(&lockRetryDelay, "lock_retry_delay", LOCK_RETRY_DELAY,
+		"Delay before the first retry of -lock_retries, doubled after each one up to 60 seconds (seconds)")
+	flag.StringVar(&lockStrategy, "lock_strategy", LOCK_REDIS,
+		"Where the backend locks are kept: \"redis\" (hchecker's Redis) or \"redlock\" (a majority of -redlock_nodes)")
+	flag.StringVar(&redlockNodes, "redlock_nodes", "",
+		"Comma separated network addresses of the independent Redis nodes used by -lock_strategy=redlock")
+	flag.StringVar(&redlockPassword, "redlock_password", "",
+		"Password of the Redlock nodes")
+	flag.StringVar(&redlockPasswordFile, "redlock_password_file", "",
+		"File holding the password of the Redlock nodes (overrides -redlock_password)")
+	flag.StringVar(&vaultAddr, "vault_addr", "",
+		"Address of Vault, e.g. \"https://vault.example.com:8200\", for the secrets given as \"vault:PATH#FIELD\" (default is $VAULT_ADDR)")
+	flag.StringVar(&vaultTokenFile, "vault_token_file", "",
+		"File holding the Vault token (default is $VAULT_TOKEN)")
+	parseDuration(&vaultInterval, "vault_interval", VAULT_INTERVAL,
+		"Interval between the renewals of the Vault token and the reads of the secrets (seconds)")
+	flag.BoolVar(&redisTLS, "redis_tls", false,
+		"Connect to Redis over TLS, with the client certificate of -tls_cert and the CA bundle of -tls_ca")
+	flag.StringVar(&tlsCertFile, "tls_cert", "",
+		"PEM file holding the client certificate of the probes (and Redis with -redis_tls), reloaded when it changes")
+	flag.StringVar(&tlsKeyFile, "tls_key", "",
+		"PEM file holding the private key of -tls_cert")
+	flag.StringVar(&tlsCAFile, "tls_ca", "",
+		"PEM bundle of the CAs verifying the backends (and Redis with -redis_tls), reloaded when it changes (default is the system roots)")
 	flag.StringVar(&redisSuffix, "redis_suffix", "",
 		"Redis key suffix - use unique identifier to avoid hchecker overlap each other on restart.")
 	flag.IntVar(&redisIdleTimeout, "redis_idle_timeout", REDIS_IDLE_TIMEOUT,
 		"Close redis connections after remaining idle for this duration (0 = no connection close)")
 	flag.IntVar(&redisMaxIdle, "redis_max_idle", REDIS_MAX_IDLE,
 		"Maximum number of idle redis connections in the pool")
+	flag.IntVar(&quorum, "quorum", 1,
+		"Number of checker instances which must see a backend failing before flagging it dead")
+	flag.IntVar(&redundancy, "redundancy", 1,
+		"Number of checker instances allowed to check the same backend concurrently")
+	seppuku := flag.Int("seppuku", 0,
+		"Exit if Redis is unreachable for this duration (minutes, 0 = never exit)")
+	parseDuration(&stateExportInterval, "state_interval", 30,
+		"Interval between state exports to Redis (seconds, 0 = disabled)")
+	flag.StringVar(&dumpFile, "dump_file", "",
+		"Write the state dump to this file on SIGUSR1 (default is to log it)")
+	flag.StringVar(&configFile, "config", "",
+		"JSON config file, keys are the flag names (command line flags and HCHECKER_* variables take precedence)")
+	chaosSpec := flag.String("chaos", "",
+		"Testing only: inject faults at random, e.g. \"probe_delay=0.1,redis_drop=0.05,lock_loss=0.01\" (comma separated faults and their rate)")
+	chaosMaxDelay := flag.Int("chaos_delay", CHAOS_DELAY,
+		"Maximum delay of the probes with -chaos probe_delay (milliseconds)")
+	flag.StringVar(&tenantsFile, "tenants", "",
+		"JSON file of the tenants, each checked by its own checker with its own options, e.g. {\"shop\": {\"redis\": \"10.0.0.1:6379\", \"admin\": \":8081\"}}")
+	flag.StringVar(&pluginPaths, "plugins", "",
+		"Comma separated executables of the probe and notifier plugins")
+	flag.StringVar(&secretsFile, "secrets", "",
+		"JSON file holding the per-frontend credentials of the probes")
+	flag.StringVar(&vhostsFile, "vhosts", "",
+		"JSON file mapping the frontends to the Host header and TLS server name of the probes")
+	flag.StringVar(&adminAddress, "admin", "",
+		"Network address of the metrics and admin HTTP listener, or \"unix:<path>\" for a Unix socket (empty = disabled)")
+	socketMode := flag.String("admin_socket_mode", "0660",
+		"Permissions of the admin Unix socket (octal)")
+	flag.StringVar(&adminTokensFile, "admin_tokens", "",
+		"JSON file mapping the bearer tokens of the admin API to their role, \"read\" or \"admin\" (empty = no authentication)")
 	flag.BoolVar(cpuProfile, "cpuprofile", false,
 		"Write CPU profile to \"hchecker.prof\" (current directory)")
 	flag.BoolVar(&dryRun, "dryrun", false,
 		"Enable dry run (or simulation mode). Do not update the Redis.")
+	flag.Usage = usage
 	flag.Parse()
+	if err := loadEnv(flag.CommandLine, os.Environ()); err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	if pluginPaths != "" {
+		// Before the config file, which may use the probe plugins
+		if err := initPlugins(); err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+	if configFile != "" {
+		if err := loadConfig(configFile); err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+	for _, filename := range []string{redisPasswordFile,
+		metaRedisPasswordFile, redlockPasswordFile} {
+		if filename == "" {
+			continue
+		}
+		if _, err := readSecretFile(filename); err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+	if len(tlsFilenames()) > 0 {
+		if _, err := tlsMaterial.reload(); err != nil {
+			log.Println("Cannot load the TLS files:", err.Error())
+			os.Exit(1)
+		}
+	}
+	for _, password := range []string{redisPassword, metaRedisPassword,
+		redlockPassword} {
+		if !isVaultRef(password) {
+			continue
+		}
+		if _, err := getVaultSecret(password); err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+	if secretsFile != "" {
+		if err := loadSecrets(secretsFile); err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+	if vhostsFile != "" {
+		if err := loadVhosts(vhostsFile); err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+	if adminTokensFile != "" {
+		if err := loadAdminTokens(adminTokensFile); err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+	if mode, err := strconv.ParseUint(*socketMode, 8, 32); err != nil {
+		log.Printf("Invalid -admin_socket_mode %q", *socketMode)
+		os.Exit(1)
+	} else {
+		adminSocketMode = os.FileMode(mode)
+	}
+	switch lockStrategy {
+	case LOCK_REDIS:
+	case LOCK_REDLOCK:
+		if len(strings.Split(redlockNodes, ",")) < 3 {
+			log.Println("-lock_strategy=redlock needs at least 3 -redlock_nodes")
+			os.Exit(1)
+		}
+		if lockEvents == true {
+			// The locks are spread over the Redlock nodes
+			log.Println("-lock_events cannot be used with -lock_strategy=redlock")
+			os.Exit(1)
+		}
+	default:
+		log.Printf("Invalid -lock_strategy %q", lockStrategy)
+		os.Exit(1)
+	}
+	if deadList != "" && deadStream != "" {
+		log.Println("-dead_list and -dead_stream cannot be used together")
+		os.Exit(1)
+	}
+	if (deadList != "" || deadStream != "") && dryRun == true {
+		// The notifications taken from the list or the stream would be lost
+		// for the other instances
+		log.Println("-dead_list and -dead_stream cannot be used in dry run mode")
+		os.Exit(1)
+	}
+	if queueSize < 1 {
+		log.Println("Invalid -queue_size, at least 1 is needed")
+		os.Exit(1)
+	}
+	if !isValidQueuePolicy(queuePolicy) {
+		log.Printf("Invalid -queue_policy %q", queuePolicy)
+		os.Exit(1)
+	}
+	if parseMode != PARSE_STRICT && parseMode != PARSE_TOLERANT {
+		log.Printf("Invalid -parse_mode %q", parseMode)
+		os.Exit(1)
+	}
+	if !isValidHTTP2Mode(httpVersion) {
+		log.Printf("Invalid -http2 mode %q", httpVersion)
+		os.Exit(1)
+	}
+	if !isValidBackendIdScheme(backendIdScheme) {
+		log.Printf("Invalid -backend_id scheme %q", backendIdScheme)
+		os.Exit(1)
+	}
+	if dockerAddress != "" {
+		if _, err := newDockerClient(dockerAddress); err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+	if *influxAddress != "" {
+		s, err := newInfluxSink(*influxAddress)
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		sinks = append(sinks, s)
+	}
+	if *graphiteAddress != "" {
+		s, err := newGraphiteSink(*graphiteAddress, *graphitePrefix)
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		sinks = append(sinks, s)
+	}
+	if *collectorUrl != "" {
+		s, err := newCollectorSink(*collectorUrl)
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		sinks = append(sinks, s)
+	}
+	if *cloudwatchNamespace != "" {
+		s, err := newCloudwatchSink(*cloudwatchNamespace, *cloudwatchRegion)
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+		sinks = append(sinks, s)
+	}
+	if err := initPlugins(); err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	for _, plugin := range notifierPlugins {
+		sinks = append(sinks, plugin)
+	}
+	if *chaosSpec != "" {
+		var err error
+		if chaosRates, err = parseChaos(*chaosSpec); err != nil {
+			log.Println("Invalid -chaos:", err.Error())
+			os.Exit(1)
+		}
+		log.Printf("WARNING: chaos mode, injecting faults %s", *chaosSpec)
+	}
+	chaosDelay = time.Duration(*chaosMaxDelay) * time.Millisecond
+	if *blacklistSpec != "" {
+		var err error
+		if blacklist, err = parseBlacklist(*blacklistSpec); err != nil {
+			log.Println("Invalid -blacklist:", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *include != "" {
+		var err error
+		if includedFrontends, err = parseFrontendPatterns(*include); err != nil {
+			log.Println("Invalid -include:", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *exclude != "" {
+		var err error
+		if excludedFrontends, err = parseFrontendPatterns(*exclude); err != nil {
+			log.Println("Invalid -exclude:", err.Error())
+			os.Exit(1)
+		}
+	}
+	if k8sServices != "" {
+		if _, err := parseK8sServices(k8sServices); err != nil {
+			log.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+	if sourceAddress != "" {
+		var err error
+		if sourceIPs, err = resolveSource(sourceAddress); err != nil {
+			log.Println("Invalid -source:", err.Error())
+			os.Exit(1)
+		}
+	}
+	for _, convert := range durations {
+		convert()
+	}
+	seppukuTimeout = time.Duration(*seppuku) * time.Minute
+	certExpiryWindow = time.Duration(*certExpiry) * 24 * time.Hour
+	ttfbTimeout = time.Duration(*ttfb) * time.Millisecond
+	dedupWindow = time.Duration(*dedupMs) * time.Millisecond
+	probeCacheWindow = time.Duration(*probeCacheMs) * time.Millisecond
+	probeDeadline = time.Duration(*deadline) * time.Millisecond
+	happyEyeballsDelay = time.Duration(*happyEyeballs) * time.Millisecond
+	historyRaw = time.Duration(*rawHistory) * time.Hour
+	historyRetention = time.Duration(*retention) * 24 * time.Hour
+	if historyMax <= 0 {
+		log.Println("-history_max must be positive")
+		os.Exit(1)
+	}
+	if heartbeatInterval <= 0 {
+		log.Println("-heartbeat_interval must be positive")
+		os.Exit(1)
+	}
+	if len(sinks) > 0 && sinkInterval <= 0 {
+		log.Println("-sink_interval must be positive")
+		os.Exit(1)
+	}
+	if k8sServices != "" && k8sInterval <= 0 {
+		log.Println("-k8s_interval must be positive")
+		os.Exit(1)
+	}
+	if strings.Contains(redisAddress, ",") {
+		for _, address := range strings.Split(redisAddress, ",") {
+			redisAddresses = append(redisAddresses,
+				strings.TrimSpace(address))
+		}
+		redisAddress = pickRedisAddress(redisPassword)
+	}
+	if redisSRV != "" {
+		address, err := resolveRedisSRV(redisSRV)
+		if err != nil {
+			log.Println("Cannot resolve the Redis SRV name:", err.Error())
+			os.Exit(1)
+		}
+		redisAddress = address
+	}
 }
 
 func main() {
 	var (
-		err        error
 		hostname   string
 		cpuProfile bool
 	)
-	fmt.Println("hchecker version", VERSION)
 	for _, arg := range os.Args {
 		if !(arg == "-v" || arg == "--version" || arg == "-version") {
 			continue
 		}
+		fmt.Println("hchecker version", VERSION)
 		os.Exit(0)
 	}
 	parseFlags(&cpuProfile)
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+	if tenantsFile != "" {
+		os.Exit(runTenants(tenantsFile))
+	}
+	fmt.Println("hchecker version", VERSION)
 	if dryRun == true {
 		fmt.Println("Enabled dry run mode (simulation)")
 	}
@@ -190,17 +888,15 @@ func main() {
 	if cpuProfile == true {
 		enableCPUProfile()
 	}
-	handleSignals()
-	cache, err = NewCache()
+	runner, err := NewRunner(RunnerConfig{Id: myId})
 	if err != nil {
 		log.Println(err.Error())
 		os.Exit(1)
 	}
-	err = cache.ListenToChannel("dead", addCheck)
-	if err != nil {
+	handleSignals(runner)
+	if err := runner.Start(context.Background()); err != nil {
 		log.Println(err.Error())
 		os.Exit(1)
 	}
-	// This function will block and print the stats every minute
-	printStats(cache)
+	<-runner.Done()
 }
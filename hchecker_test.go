@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeadNotificationsMetric(t *testing.T) {
+	r, c := setupCache(t)
+	cache = c
+	defer func() { cache = nil }()
+	deadNotificationsMetric.Init()
+	cache.LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2"))
+	// Dropped, the backend is not locked again
+	r.failures = 1
+	handleDeadNotification("dead", "www.foo.com;http://10.0.0.1:80;0;2")
+	if r.failures != 1 {
+		t.Error("Expected the duplicate not to reach Redis")
+	}
+	handleDeadNotification("dead", "www.foo.com;http://10.0.0.1:80")
+	handleDeadNotification("dead", "www.bar.com;http://10.0.0.1:80;0;2")
+	for name, expected := range map[string]string{
+		"received": "3", "duplicates": "1", "parse_errors": "1"} {
+		if v := deadNotificationsMetric.Get(name); v == nil ||
+			v.String() != expected {
+			t.Errorf("Expected %s %s, got %v", expected, name, v)
+		}
+	}
+	if deadNotificationsMetric.Get("latency_ms") == nil {
+		t.Error("Expected the handling time to be recorded")
+	}
+}
+
+func TestDeadNotificationsDedup(t *testing.T) {
+	_, c := setupCache(t)
+	cache = c
+	dedupWindow = time.Second
+	defer func() {
+		cache, dedupWindow = nil, 0
+		dedup = &notificationDedup{seen: make(map[string]time.Time)}
+	}()
+	deadNotificationsMetric.Init()
+	cache.LockBackend(newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2"))
+	for i := 0; i < 5; i++ {
+		handleDeadNotification("dead", "www.foo.com;http://10.0.0.1:80;0;2")
+	}
+	// Another frontend of the backend is not part of the burst
+	handleDeadNotification("dead", "www.bar.com;http://10.0.0.1:80;0;2")
+	if v := deadNotificationsMetric.Get("debounced"); v == nil ||
+		v.String() != "4" {
+		t.Errorf("Expected 4 debounced notifications, got %v", v)
+	}
+	expected := map[string]int{"www.foo.com": 0, "www.bar.com": 0}
+	if m := cache.mapping.Frontends("http://10.0.0.1:80"); !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected mapping %v, got %v", expected, m)
+	}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	if dedup.isDuplicate(check, time.Now().Add(time.Second)) == true {
+		t.Error("Expected the notification to be handled after the window")
+	}
+}
+
+func TestFrontendPatterns(t *testing.T) {
+	for _, test := range []struct {
+		include, exclude string
+		included         map[string]bool
+	}{
+		{"*.internal.example.com", "",
+			map[string]bool{"api.internal.example.com": true,
+				"www.example.com": false}},
+		{"*.example.com, www.example.org", "admin.*",
+			map[string]bool{"www.example.com": true, "www.example.org": true,
+				"admin.example.com": false, "www.example.net": false}},
+		{"", `/^(www|api)\.example\.com$/`,
+			map[string]bool{"www.example.com": false, "app.example.com": true}},
+	} {
+		includedFrontends, excludedFrontends = nil, nil
+		if test.include != "" {
+			includedFrontends, _ = parseFrontendPatterns(test.include)
+		}
+		if test.exclude != "" {
+			excludedFrontends, _ = parseFrontendPatterns(test.exclude)
+		}
+		for frontendKey, expected := range test.included {
+			if isFrontendIncluded(frontendKey) != expected {
+				t.Errorf("-include=%q -exclude=%q: expected %s included: %t",
+					test.include, test.exclude, frontendKey, expected)
+			}
+		}
+	}
+	includedFrontends, excludedFrontends = nil, nil
+	for _, spec := range []string{"[a-", "/(/", "a,,b"} {
+		if _, err := parseFrontendPatterns(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestStartCheckExcluded(t *testing.T) {
+	r, c := setupCache(t)
+	cache = c
+	excludedFrontends, _ = parseFrontendPatterns("*.foo.com")
+	defer func() {
+		cache, excludedFrontends = nil, nil
+	}()
+	excluded := excludedFrontendsMetric.Value()
+	startCheck("dead", newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2"))
+	if len(r.hashes["hchecker"]) != 0 || cache.mapping.Len() != 0 {
+		t.Error("Expected the backend of an excluded frontend not to be checked")
+	}
+	if excludedFrontendsMetric.Value() != excluded+1 {
+		t.Error("Expected the excluded notification to be counted")
+	}
+}
+
+func TestParseSuspect(t *testing.T) {
+	for line, expected := range map[string][]string{
+		"www.foo.com;http://10.0.0.1:80;host#2": {"www.foo.com",
+			"http://10.0.0.1:80", "host#2"},
+		"www.foo.com;http://10.0.0.1:80/?a=1;b=2;host#2": {"www.foo.com",
+			"http://10.0.0.1:80/?a=1;b=2", "host#2"},
+		// Published by the former versions
+		"http://10.0.0.1:80;host#2": {"", "http://10.0.0.1:80", "host#2"},
+	} {
+		frontendKey, backendUrl, instance, err := parseSuspect(line)
+		if err != nil {
+			t.Errorf("Cannot parse %q: %s", line, err)
+		} else if got := []string{frontendKey, backendUrl,
+			instance}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected %v for %q, got %v", expected, line, got)
+		}
+	}
+	for _, line := range []string{"", "host#2", "www.foo.com;;host#2"} {
+		if _, _, _, err := parseSuspect(line); err == nil {
+			t.Errorf("Expected %q to be rejected", line)
+		}
+	}
+}
+
+func TestQuorumHealthPort(t *testing.T) {
+	r, c := setupCache(t)
+	cache = c
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	defer func() {
+		cache, myId = nil, "host#1"
+		frontendConfigs = make(map[string]*FrontendConfig)
+	}()
+	// The health endpoint fails while the traffic port answers
+	health := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+	defer health.Close()
+	traffic := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer traffic.Close()
+	frontendConfigs = map[string]*FrontendConfig{"www.foo.com": {
+		HealthPort: health.Listener.Addr().(*net.TCPAddr).Port}}
+	check := NewBackendCheck("www.foo.com", traffic.URL, 0, 1)
+	if n := c.SuspectBackend(check); n != 1 {
+		t.Fatalf("Expected a single confirmation, got %d", n)
+	}
+	line := r.published[len(r.published)-1].data
+	frontendKey, backendUrl, _, err := parseSuspect(line)
+	if err != nil || frontendKey != "www.foo.com" || backendUrl != traffic.URL {
+		t.Fatalf("Expected the frontend in the suspicion, got %q", line)
+	}
+	// Another instance probes the health port of the frontend
+	myId = "host#2"
+	if verifySuspect(NewBackendCheck(frontendKey, backendUrl, 0, 0)) == false {
+		t.Error("Expected the failure of the health port to be confirmed")
+	}
+	myId = "host#1"
+	if n := c.SuspectBackend(check); n != 2 {
+		t.Errorf("Expected 2 confirmations, got %d", n)
+	}
+	// Without the override, the traffic port answers: the suspicion is
+	// vetoed
+	c.ClearSuspect(check)
+	frontendConfigs = make(map[string]*FrontendConfig)
+	c.SuspectBackend(check)
+	myId = "host#3"
+	if verifySuspect(NewBackendCheck(frontendKey, backendUrl, 0, 0)) == true {
+		t.Error("Expected the suspicion to be vetoed")
+	}
+	myId = "host#1"
+	if n := c.SuspectBackend(check); n != 1 {
+		t.Errorf("Expected a single confirmation after the veto, got %d", n)
+	}
+	// A suspicion cleared meanwhile is not confirmed
+	c.ClearSuspect(check)
+	c.ConfirmSuspect(check.BackendUrl)
+	if r.exists("hchecker:suspect:" + check.BackendUrl) {
+		t.Error("Expected a cleared suspicion to stay cleared")
+	}
+}
+
+func TestSeppuku(t *testing.T) {
+	r, c := setupCache(t)
+	seppukuTimeout, seppukuInterval = 20*time.Millisecond, 5*time.Millisecond
+	exitCode, exit := 0, seppukuExit
+	seppukuExit = func(code int) { exitCode = code }
+	defer func() {
+		seppukuTimeout, seppukuInterval = 0, 10*time.Second
+		seppukuExit = exit
+	}()
+	// Reachable, until the cache is closed
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.Close()
+	}()
+	watchRedis(c)
+	if exitCode != 0 {
+		t.Fatalf("Expected no exit while Redis is reachable, got %d", exitCode)
+	}
+	// Unreachable for longer than the timeout
+	r.failures = 1000
+	c = r.cache()
+	start := time.Now()
+	watchRedis(c)
+	if exitCode != 2 {
+		t.Fatalf("Expected to exit with 2, got %d", exitCode)
+	}
+	if elapsed := time.Since(start); elapsed < seppukuTimeout {
+		t.Errorf("Expected to exit after %s, exited after %s", seppukuTimeout,
+			elapsed)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	HISTORY_MAX   = 10000
+	REPORT_JSON   = "json"
+	REPORT_CSV    = "csv"
+	REPORT_WINDOW = "24h"
+)
+
+var historyEnabled = false
+
+func (c *Cache) historyKey(backendUrl string) string {
+	return c.metaKey("history:" + backendUrl)
+}
+
+/*
+ * Records an event in the history of its backend, a sorted set by time.
+ * The backends having a history are listed in the hchecker:history set.
+ */
+func (c *Cache) RecordHistory(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	key := c.historyKey(event.BackendUrl)
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	// Sub-second scores keep the events of a same second in order
+	score := float64(event.Time)
+	if now := time.Now(); now.Unix() == event.Time {
+		score = float64(now.UnixNano()) / float64(time.Second)
+	}
+	conn.Send("ZADD", key, strconv.FormatFloat(score, 'f', 6, 64), data)
+	conn.Send("ZREMRANGEBYRANK", key, 0, -historyMax-1)
+	conn.Send("SADD", c.metaKey("history"), event.BackendUrl)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+/*
+ * Returns the recorded events between two times, of one backend or all of
+ * them (empty backend URL), by time
+ */
+func (c *Cache) History(backendUrl string, since, until time.Time) ([]*Event, error) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	backends, err := c.historyBackends(conn, backendUrl)
+	if err != nil {
+		return nil, err
+	}
+	events := []*Event{}
+	for _, backend := range backends {
+		values, err := redis.Strings(conn.Do("ZRANGEBYSCORE",
+			c.historyKey(backend), since.Unix(), until.Unix()))
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			event := &Event{}
+			if err := json.Unmarshal([]byte(value), event); err != nil {
+				// Written by another version, skip it
+				continue
+			}
+			events = append(events, event)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time < events[j].Time
+	})
+	return events, nil
+}
+
+/*
+ * Returns the backends having a history, or only the given one
+ */
+func (c *Cache) historyBackends(conn redis.Conn, backendUrl string) ([]string, error) {
+	if backendUrl != "" {
+		return []string{backendUrl}, nil
+	}
+	return redis.Strings(conn.Do("SMEMBERS", c.metaKey("history")))
+}
+
+func (c *Cache) HistoryBackends() ([]string, error) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	return c.historyBackends(conn, "")
+}
+
+/*
+ * Takes the compaction of the history for an interval, returns false if
+ * another instance did
+ */
+func (c *Cache) LockHistoryCompaction() (bool, error) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	// Expires a bit before the next round
+	ttl := int(HISTORY_COMPACT_INTERVAL/time.Second) - 60
+	reply, err := conn.Do("SET", c.metaKey("history_compaction"), myId,
+		"EX", ttl, "NX")
+	return reply != nil, err
+}
+
+/*
+ * Records the events when -history is set
+ */
+func recordHistory(event *Event) {
+	if historyEnabled == false || dryRun == true {
+		return
+	}
+	if err := cache.RecordHistory(event); err != nil {
+		logError(event.BackendUrl, "Cannot record the history:", err.Error())
+	}
+}
+
+/*
+ * Parses the bounds of a report: an RFC 3339 time, a Unix timestamp, or a
+ * duration before now (e.g. "24h")
+ */
+func parseReportTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return now, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid time %q", s)
+}
+
+/*
+ * Writes the events as a JSON array, or as CSV with a header line
+ */
+func writeReport(w io.Writer, events []*Event, format string) error {
+	if format == REPORT_JSON {
+		return json.NewEncoder(w).Encode(events)
+	}
+	out := csv.NewWriter(w)
+	out.Write([]string{"time", "backend_url", "type", "reason",
+		"latency_ms", "instance", "code"})
+	for _, event := range events {
+		latency := ""
+		if event.LatencyMs > 0 {
+			latency = strconv.FormatFloat(event.LatencyMs, 'f', 3, 64)
+		}
+		out.Write([]string{
+			time.Unix(event.Time, 0).UTC().Format(time.RFC3339),
+			event.BackendUrl, event.Type, event.Reason, latency,
+			event.Instance, event.Code})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+/*
+ * GET /history?since=24h&until=&backend=&format=json|csv&hourly=1 exports
+ * the recorded events, or their hourly aggregates
+ */
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	window := r.FormValue("since")
+	if window == "" {
+		window = REPORT_WINDOW
+	}
+	since, err := parseReportTime(window, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseReportTime(r.FormValue("until"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	backendUrl := r.FormValue("backend")
+	if backendUrl != "" {
+		if backendUrl, err = parseBackendUrl(backendUrl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	format := r.FormValue("format")
+	switch format {
+	case "", REPORT_JSON:
+		format = REPORT_JSON
+		w.Header().Set("Content-Type", "application/json")
+	case REPORT_CSV:
+		w.Header().Set("Content-Type", "text/csv")
+	default:
+		http.Error(w, "Invalid format, expected json or csv",
+			http.StatusBadRequest)
+		return
+	}
+	hourly := r.FormValue("hourly") == "1" || r.FormValue("hourly") == "true"
+	err = exportHistory(w, cache, backendUrl, since, until, hourly, format)
+	if err != nil {
+		http.Error(w, "Cannot read the history: "+err.Error(),
+			http.StatusBadGateway)
+	}
+}
+
+/*
+ * Writes the events, or the hourly aggregates, of a time window
+ */
+func exportHistory(w io.Writer, cache *Cache, backendUrl string,
+	since, until time.Time, hourly bool, format string) error {
+	if hourly {
+		aggregates, err := cache.HourlyHistory(backendUrl, since, until)
+		if err != nil {
+			return err
+		}
+		return writeHourlyReport(w, aggregates, format)
+	}
+	events, err := cache.History(backendUrl, since, until)
+	if err != nil {
+		return err
+	}
+	return writeReport(w, events, format)
+}
+
+func reportCommand(cache *Cache, args []string) int {
+	var since, until, backendUrl, format string
+	var hourly bool
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	flags.StringVar(&since, "since", REPORT_WINDOW,
+		"Start of the report: RFC 3339 time, Unix timestamp or duration before now")
+	flags.StringVar(&until, "until", "",
+		"End of the report, same format (default is now)")
+	flags.StringVar(&backendUrl, "backend", "",
+		"Only report this backend")
+	flags.StringVar(&format, "format", REPORT_JSON,
+		"Output format: \"json\" or \"csv\"")
+	flags.BoolVar(&hourly, "hourly", false,
+		"Report the hourly aggregates of the compacted events (see -history_raw)")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+	now := time.Now()
+	from, err := parseReportTime(since, now)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	to, err := parseReportTime(until, now)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	if backendUrl != "" {
+		if backendUrl, err = parseBackendUrl(backendUrl); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
+	}
+	if format != REPORT_JSON && format != REPORT_CSV {
+		fmt.Fprintf(os.Stderr, "Invalid format %q\n", format)
+		return 2
+	}
+	err = exportHistory(os.Stdout, cache, backendUrl, from, to, hourly, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot read the history:", err.Error())
+		return 1
+	}
+	return 0
+}
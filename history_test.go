@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	r, c := setupCache(t)
+	now := time.Unix(1400000000, 0)
+	for i, event := range []*Event{
+		{Type: EVENT_FAILED, BackendUrl: "http://10.0.0.1:80",
+			Reason: "connection refused", Time: now.Unix() - 7200},
+		{Type: EVENT_DEAD, BackendUrl: "http://10.0.0.1:80",
+			Reason: "connect refused", Code: CODE_CONNECT,
+			Time: now.Unix() - 60},
+		{Type: EVENT_PASSED, BackendUrl: "http://10.0.0.2:80",
+			LatencyMs: 1.5, Time: now.Unix() - 30},
+	} {
+		event.Instance = myId
+		if err := c.RecordHistory(event); err != nil {
+			t.Fatalf("Event %d: %s", i, err)
+		}
+	}
+	if !r.exists("hchecker:history:http://10.0.0.1:80") {
+		t.Fatalf("Expected the history to be recorded, got %v", r.keys())
+	}
+	since, _ := parseReportTime("1h", now)
+	events, err := c.History("", since, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Type != EVENT_DEAD ||
+		events[1].Type != EVENT_PASSED {
+		t.Fatalf("Expected the last hour of both backends, got %v", events)
+	}
+	var out bytes.Buffer
+	if err := writeReport(&out, events, REPORT_CSV); err != nil {
+		t.Fatal(err)
+	}
+	expected := "time,backend_url,type,reason,latency_ms,instance,code\n" +
+		"2014-05-13T16:52:20Z,http://10.0.0.1:80,dead,connect refused,,host#1,connect\n" +
+		"2014-05-13T16:52:50Z,http://10.0.0.2:80,passed,,1.500,host#1,\n"
+	if out.String() != expected {
+		t.Errorf("Unexpected CSV report:\n%s", out.String())
+	}
+	events, _ = c.History("http://10.0.0.1:80", time.Unix(0, 0), now)
+	if len(events) != 2 || events[0].Reason != "connection refused" {
+		t.Errorf("Expected the whole history of the backend, got %v", events)
+	}
+}
+
+func TestParseReportTime(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+	for s, expected := range map[string]int64{
+		"":                     1400000000,
+		"24h":                  1400000000 - 86400,
+		"1399990000":           1399990000,
+		"2014-05-13T16:53:20Z": 1400000000,
+	} {
+		if v, err := parseReportTime(s, now); err != nil || v.Unix() != expected {
+			t.Errorf("Expected %d for %q, got %d (%v)", expected, s, v.Unix(), err)
+		}
+	}
+	if _, err := parseReportTime("yesterday", now); err == nil ||
+		!strings.Contains(err.Error(), "yesterday") {
+		t.Errorf("Expected an invalid time, got %v", err)
+	}
+}
+
+func TestCompactHistory(t *testing.T) {
+	r, c := setupCache(t)
+	backendUrl := "http://10.0.0.1:80"
+	hour := time.Unix(1400000000, 0).Truncate(time.Hour)
+	for _, event := range []*Event{
+		{Type: EVENT_FAILED, Reason: "timeout", LatencyMs: 30,
+			Time: hour.Add(-47 * time.Hour).Unix()},
+		{Type: EVENT_PASSED, LatencyMs: 10, Time: hour.Add(-2 * time.Hour).Unix()},
+		{Type: EVENT_FAILED, Reason: "timeout", Code: CODE_TIMEOUT,
+			LatencyMs: 20, Time: hour.Add(-2*time.Hour + time.Minute).Unix()},
+		{Type: EVENT_DEAD, Time: hour.Add(-2*time.Hour + time.Minute).Unix()},
+		{Type: EVENT_PASSED, LatencyMs: 10, Time: hour.Add(-time.Hour).Unix()},
+		{Type: EVENT_PASSED, LatencyMs: 10, Time: hour.Unix()},
+	} {
+		event.BackendUrl = backendUrl
+		c.RecordHistory(event)
+	}
+	// Compact the whole hours, forget the events of 2 days ago
+	err := c.CompactHistory(backendUrl, hour.Add(10*time.Minute),
+		hour.Add(-46*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ := c.History(backendUrl, time.Unix(0, 0), hour)
+	if len(events) != 1 || events[0].Time != hour.Unix() {
+		t.Errorf("Expected the events of the last hour only, got %v", events)
+	}
+	aggregates, err := c.HourlyHistory("", time.Unix(0, 0), hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aggregates) != 2 {
+		t.Fatalf("Expected 2 hourly aggregates, got %v", aggregates)
+	}
+	a := aggregates[0]
+	if a.Hour != hour.Add(-2*time.Hour).Unix() || a.Passed != 1 ||
+		a.Failed != 1 || a.Dead != 1 || a.LatencyMs != 15 ||
+		a.Reasons["timeout"] != 1 || a.Codes[CODE_TIMEOUT] != 1 {
+		t.Errorf("Unexpected aggregate %+v", a)
+	}
+	// Another round merges the late events of the same hours
+	c.RecordHistory(&Event{Type: EVENT_PASSED, BackendUrl: backendUrl,
+		LatencyMs: 18, Time: hour.Add(-2 * time.Hour).Unix()})
+	c.CompactHistory(backendUrl, hour.Add(10*time.Minute), time.Time{})
+	aggregates, _ = c.HourlyHistory(backendUrl, time.Unix(0, 0), hour)
+	if len(aggregates) != 2 || aggregates[0].Passed != 2 ||
+		aggregates[0].LatencyMs != 16 {
+		t.Errorf("Expected the aggregates to be merged, got %+v", aggregates[0])
+	}
+	// Nothing left once everything expired
+	c.CompactHistory(backendUrl, time.Time{}, hour.Add(time.Hour))
+	if r.exists("hchecker:history") {
+		t.Errorf("Expected the backend to be forgotten, got %v", r.keys())
+	}
+}
+
+func TestLockHistoryCompaction(t *testing.T) {
+	_, c := setupCache(t)
+	if locked, err := c.LockHistoryCompaction(); !locked || err != nil {
+		t.Fatalf("Expected to lock the compaction: %v", err)
+	}
+	if locked, _ := c.LockHistoryCompaction(); locked {
+		t.Error("Expected the compaction to be locked for the interval")
+	}
+}
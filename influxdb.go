@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size of the UDP packets, below the usual MTU
+const INFLUXDB_UDP_PAYLOAD = 1400
+
+/*
+ * Writes the events to InfluxDB with the line protocol, over HTTP
+ * ("http://host:8086/write?db=hchecker") or UDP ("udp://host:8089")
+ */
+type influxSink struct {
+	address string
+	client  *http.Client
+}
+
+func newInfluxSink(address string) (*influxSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "udp":
+	default:
+		return nil, fmt.Errorf("Invalid InfluxDB address %q", address)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid InfluxDB address %q", address)
+	}
+	return &influxSink{address: address,
+		client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (s *influxSink) String() string {
+	return "InfluxDB"
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+/*
+ * Formats an event as a line: the probe results in "hchecker_probe", the
+ * transitions in "hchecker_state"
+ */
+func influxLine(event *Event) string {
+	measurement, alive := "hchecker_probe", "1i"
+	switch event.Type {
+	case EVENT_FAILED, EVENT_DEAD:
+		alive = "0i"
+	}
+	if event.Type == EVENT_DEAD || event.Type == EVENT_ALIVE {
+		measurement = "hchecker_state"
+	}
+	line := measurement + ",backend=" + influxTagEscaper.Replace(event.BackendUrl) +
+		",instance=" + influxTagEscaper.Replace(event.Instance)
+	if event.Reason != "" {
+		line += ",reason=" + influxTagEscaper.Replace(event.Reason)
+	}
+	if event.Code != "" {
+		line += ",code=" + event.Code
+	}
+	line += " alive=" + alive
+	if measurement == "hchecker_probe" {
+		line += ",latency_ms=" + strconv.FormatFloat(event.LatencyMs, 'f', -1, 64)
+	}
+	return line + " " + strconv.FormatInt(event.Time*int64(time.Second), 10)
+}
+
+func (s *influxSink) Send(events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, event := range events {
+		lines = append(lines, influxLine(event))
+	}
+	if strings.HasPrefix(s.address, "udp://") {
+		return s.sendUDP(lines)
+	}
+	resp, err := s.client.Post(s.address, "text/plain",
+		strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+func (s *influxSink) sendUDP(lines []string) error {
+	conn, err := net.Dial("udp", strings.TrimPrefix(s.address, "udp://"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > INFLUXDB_UDP_PAYLOAD {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		packet.WriteString(line)
+		packet.WriteString("\n")
+	}
+	if packet.Len() > 0 {
+		_, err = conn.Write(packet.Bytes())
+	}
+	return err
+}
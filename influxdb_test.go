@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInfluxSink(t *testing.T) {
+	events := []*Event{
+		{Type: EVENT_FAILED, BackendUrl: "http://10.0.0.1:80",
+			Instance: "host#1", Time: 1400000000, Reason: "connect refused",
+			LatencyMs: 0.25},
+		{Type: EVENT_DEAD, BackendUrl: "http://10.0.0.1:80",
+			Instance: "host#1", Time: 1400000000},
+	}
+	expected := `hchecker_probe,backend=http://10.0.0.1:80,instance=host#1,reason=connect\ refused alive=0i,latency_ms=0.25 1400000000000000000` + "\n" +
+		`hchecker_state,backend=http://10.0.0.1:80,instance=host#1 alive=0i 1400000000000000000`
+	var body, query string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, _ := io.ReadAll(r.Body)
+			body, query = string(data), r.URL.RawQuery
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	defer srv.Close()
+	s, err := newInfluxSink(srv.URL + "/write?db=hchecker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(events); err != nil {
+		t.Fatal(err)
+	}
+	if body != expected || query != "db=hchecker" {
+		t.Errorf("Unexpected write on %q:\n%s", query, body)
+	}
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s, _ = newInfluxSink("udp://" + l.LocalAddr().String())
+	if err := s.Send(events); err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, INFLUXDB_UDP_PAYLOAD)
+	n, _, err := l.ReadFrom(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(packet[:n]) != expected+"\n" {
+		t.Errorf("Unexpected packet:\n%s", packet[:n])
+	}
+	for _, address := range []string{"tcp://host:8086", "http://"} {
+		if _, err := newInfluxSink(address); err == nil ||
+			!strings.Contains(err.Error(), "InfluxDB") {
+			t.Errorf("Expected %q to be rejected", address)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// BRPOPLPUSH timeout (seconds)
+	LIST_TIMEOUT = 5
+	// The processing lists of the stopped instances are requeued every
+	// minute
+	LIST_REQUEUE_INTERVAL = 60
+)
+
+// List of the dead notifications, consumed instead of the dead channel
+// (empty = pubsub)
+var deadList string
+
+/*
+ * Returns the processing list of an instance: the notifications it took
+ * from the dead list and didn't handle yet
+ */
+func processingList(list string, instance string) string {
+	return list + ":processing:" + instance
+}
+
+/*
+ * Takes the next notification of the list, moved to our processing list
+ * until it's handled. Returns false if none came before the timeout.
+ */
+func (c *Cache) handleListNotification(conn redis.Conn, list string,
+	callback func(channel string, line string)) (bool, error) {
+	processing := processingList(list, myId)
+	line, err := redis.String(conn.Do("BRPOPLPUSH", list, processing,
+		LIST_TIMEOUT))
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	deadListMetric.Add("consumed", 1)
+	callback(list, line)
+	_, err = conn.Do("LREM", processing, 1, line)
+	return true, err
+}
+
+/*
+ * Consumes the dead notifications pushed to a list: unlike the pubsub, a
+ * notification is only removed once handled, the ones left by an instance
+ * stopped meanwhile are requeued by the others
+ */
+func (c *Cache) ConsumeList(list string,
+	callback func(channel string, line string)) {
+	c.listeners.Add(1)
+	go func() {
+		defer c.listeners.Done()
+		for {
+			conn, err := c.getConn()
+			if err == nil {
+				// Those we took before losing the connection are handled
+				// again
+				_, err = requeueList(conn, processingList(list, myId), list)
+			}
+			for err == nil && !c.isClosed() {
+				_, err = c.handleListNotification(conn, list, callback)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			if c.isClosed() {
+				return
+			}
+			logError("Error consuming the list", list+":", err.Error(),
+				"Reconnecting...")
+			if !c.wait(5 * time.Second) {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			n, err := c.RequeueNotifications(list)
+			if err != nil {
+				logError("Cannot requeue the dead notifications:", err.Error())
+			} else if n > 0 {
+				log.Printf("Requeued %d dead notification(s) of stopped "+
+					"instances", n)
+			}
+			if !c.wait(time.Duration(LIST_REQUEUE_INTERVAL) * time.Second) {
+				return
+			}
+		}
+	}()
+}
+
+/*
+ * Pushes back to the list the notifications taken by the instances without
+ * a heartbeat: they stopped before handling them. Returns the number of
+ * notifications requeued.
+ */
+func (c *Cache) RequeueNotifications(list string) (int, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	keys, err := scanKeys(conn, processingList(list, "*"))
+	if err != nil {
+		return 0, err
+	}
+	metaConn := c.metaPool.Get()
+	defer metaConn.Close()
+	requeued := 0
+	for _, key := range keys {
+		instance := strings.TrimPrefix(key, processingList(list, ""))
+		if instance == myId {
+			continue
+		}
+		alive, err := redis.Bool(metaConn.Do("EXISTS",
+			c.heartbeatKey(instance)))
+		if err != nil {
+			return requeued, err
+		} else if alive == true {
+			continue
+		}
+		n, err := requeueList(conn, key, list)
+		requeued += n
+		if err != nil {
+			return requeued, err
+		}
+	}
+	return requeued, nil
+}
+
+/*
+ * Moves all the notifications of a processing list back to the list
+ */
+func requeueList(conn redis.Conn, processing string, list string) (int, error) {
+	n := 0
+	for {
+		_, err := redis.String(conn.Do("RPOPLPUSH", processing, list))
+		if err == redis.ErrNil {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		n += 1
+		deadListMetric.Add("requeued", 1)
+	}
+}
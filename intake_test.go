@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListIntake(t *testing.T) {
+	r, cache := setupCache(t)
+	deadListMetric.Init()
+	conn := cache.pool.Get()
+	defer conn.Close()
+	conn.Do("LPUSH", "hchecker:dead", "www.foo.com;http://10.0.0.1:80;0;2")
+	conn.Do("LPUSH", "hchecker:dead", "www.foo.com;http://10.0.0.2:80;1;2")
+	var handled []string
+	callback := func(channel string, line string) {
+		if channel != "hchecker:dead" {
+			t.Errorf("Unexpected channel %q", channel)
+		}
+		// Kept in the processing list while being handled
+		if l := r.lists["hchecker:dead:processing:host#1"]; len(l) != 1 ||
+			l[0] != line {
+			t.Errorf("Expected %q to be processed, got %v", line, l)
+		}
+		handled = append(handled, line)
+	}
+	for {
+		ok, err := cache.handleListNotification(conn, "hchecker:dead",
+			callback)
+		if err != nil {
+			t.Fatal(err)
+		} else if ok == false {
+			break
+		}
+	}
+	expected := []string{"www.foo.com;http://10.0.0.1:80;0;2",
+		"www.foo.com;http://10.0.0.2:80;1;2"}
+	if !reflect.DeepEqual(handled, expected) {
+		t.Errorf("Expected %v to be handled in order, got %v", expected,
+			handled)
+	}
+	if r.exists("hchecker:dead:processing:host#1") {
+		t.Error("Expected the handled notifications to be removed")
+	}
+	if v := deadListMetric.Get("consumed"); v == nil || v.String() != "2" {
+		t.Errorf("Expected 2 notifications consumed, got %v", v)
+	}
+}
+
+func TestRequeueNotifications(t *testing.T) {
+	r, cache := setupCache(t)
+	deadListMetric.Init()
+	r.lists["hchecker:dead"] = []string{"www.foo.com;http://10.0.0.3:80;2;3"}
+	// Stopped while handling its notifications
+	r.lists["hchecker:dead:processing:other#1"] = []string{
+		"www.foo.com;http://10.0.0.2:80;1;3",
+		"www.foo.com;http://10.0.0.1:80;0;3"}
+	// Still alive
+	r.lists["hchecker:dead:processing:other#2"] = []string{
+		"www.bar.com;http://10.0.0.1:80;0;2"}
+	r.strings["hchecker:alive:other#2"] = "{}"
+	n, err := cache.RequeueNotifications("hchecker:dead")
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 notifications requeued, got %d (%v)", n, err)
+	}
+	// Handled after those waiting (from the tail), in their order
+	expected := []string{"www.foo.com;http://10.0.0.2:80;1;3",
+		"www.foo.com;http://10.0.0.1:80;0;3",
+		"www.foo.com;http://10.0.0.3:80;2;3"}
+	if l := r.lists["hchecker:dead"]; !reflect.DeepEqual(l, expected) {
+		t.Errorf("Expected the list %v, got %v", expected, l)
+	}
+	if r.exists("hchecker:dead:processing:other#1") ||
+		!r.exists("hchecker:dead:processing:other#2") {
+		t.Error("Expected only the list of the stopped instance to be requeued")
+	}
+}
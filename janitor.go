@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+var janitorInterval time.Duration
+
+/*
+ * Removes the orphaned members of the dead sets at a regular interval.
+ * Hipache doesn't remove them when a frontend list is edited, they linger
+ * until the set expires.
+ */
+func runJanitor(cache *Cache) {
+	for {
+		if !cache.wait(janitorInterval) {
+			return
+		}
+		if isPaused() == true {
+			continue
+		}
+		removed, err := cache.CleanDeadSets(dryRun)
+		if err != nil {
+			logError("Cannot clean the dead sets:", err.Error())
+		}
+		for _, r := range removed {
+			log.Println("Removed orphaned dead backend", r)
+		}
+		orphansMetric.Add(int64(len(removed)))
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	K8S_INTERVAL = 10
+	// Credentials mounted in the pods
+	K8S_SERVICE_ACCOUNT = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+var (
+	k8sServices  string
+	k8sApi       string
+	k8sTokenFile string
+	k8sInterval  time.Duration
+)
+
+/*
+ * Kubernetes service whose endpoints are the backends of a frontend
+ */
+type k8sService struct {
+	frontend  string
+	namespace string
+	name      string
+	// Name or number of the port, the first one if empty
+	port string
+}
+
+func (s *k8sService) String() string {
+	return s.namespace + "/" + s.name
+}
+
+/*
+ * Parses "www.example.com=default/web:http,api.example.com=prod/api"
+ */
+func parseK8sServices(spec string) ([]*k8sService, error) {
+	var services []*k8sService
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid Kubernetes service %q, expected "+
+				"frontend=namespace/service[:port]", entry)
+		}
+		s := &k8sService{frontend: parts[0]}
+		name := parts[1]
+		if i := strings.LastIndex(name, ":"); i != -1 {
+			name, s.port = name[:i], name[i+1:]
+		}
+		names := strings.SplitN(name, "/", 2)
+		if len(names) != 2 || names[0] == "" || names[1] == "" {
+			return nil, fmt.Errorf("Invalid Kubernetes service %q, expected "+
+				"frontend=namespace/service[:port]", entry)
+		}
+		s.namespace, s.name = names[0], names[1]
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+type k8sClient struct {
+	client  *http.Client
+	baseUrl string
+	token   string
+}
+
+/*
+ * Returns a client of the Kubernetes API, given by -k8s_api or the one of
+ * the cluster the checker runs in
+ */
+func newK8sClient() (*k8sClient, error) {
+	k := &k8sClient{client: &http.Client{Timeout: 10 * time.Second},
+		baseUrl: strings.TrimSuffix(k8sApi, "/")}
+	if k.baseUrl == "" {
+		host := os.Getenv("KUBERNETES_SERVICE_HOST")
+		port := os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("Not running in Kubernetes, set -k8s_api")
+		}
+		k.baseUrl = "https://" + net.JoinHostPort(host, port)
+		ca, err := ioutil.ReadFile(K8S_SERVICE_ACCOUNT + "/ca.crt")
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		k.client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	tokenFile := k8sTokenFile
+	if tokenFile == "" && k8sApi == "" {
+		tokenFile = K8S_SERVICE_ACCOUNT + "/token"
+	}
+	if tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		k.token = strings.TrimSpace(string(token))
+	}
+	return k, nil
+}
+
+/*
+ * Returns the backend URLs of the ready and not ready endpoints of a
+ * service
+ */
+func (k *k8sClient) endpoints(s *k8sService) ([]string, []string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf(
+		"%s/api/v1/namespaces/%s/endpoints/%s", k.baseUrl, s.namespace,
+		s.name), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s: %s", s, resp.Status)
+	}
+	type address struct {
+		IP string `json:"ip"`
+	}
+	var endpoints struct {
+		Subsets []struct {
+			Addresses         []address `json:"addresses"`
+			NotReadyAddresses []address `json:"notReadyAddresses"`
+			Ports             []struct {
+				Name string `json:"name"`
+				Port int    `json:"port"`
+			} `json:"ports"`
+		} `json:"subsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&endpoints); err != nil {
+		return nil, nil, err
+	}
+	var ready, notReady []string
+	for _, subset := range endpoints.Subsets {
+		port, scheme := 0, "http"
+		for _, p := range subset.Ports {
+			if s.port == "" || s.port == p.Name ||
+				s.port == strconv.Itoa(p.Port) {
+				port = p.Port
+				if p.Name == "https" || p.Port == 443 {
+					scheme = "https"
+				}
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		backendUrl := func(a address) string {
+			return scheme + "://" + net.JoinHostPort(a.IP, strconv.Itoa(port))
+		}
+		for _, a := range subset.Addresses {
+			ready = append(ready, backendUrl(a))
+		}
+		for _, a := range subset.NotReadyAddresses {
+			notReady = append(notReady, backendUrl(a))
+		}
+	}
+	sort.Strings(ready)
+	sort.Strings(notReady)
+	return ready, notReady, nil
+}
+
+/*
+ * Applies the endpoints of a service to the frontend list. The backends
+ * still there keep their place, the new ones are appended. Returns the
+ * members of the dead set of the not ready endpoints, to flag them dead.
+ */
+func (c *Cache) ReconcileFrontend(frontendKey string, backends []string,
+	notReady map[string]bool) ([]string, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	key := "frontend:" + frontendKey
+	current, err := redis.Strings(conn.Do("LRANGE", key, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, b := range backends {
+		wanted[b] = true
+	}
+	list := []string{frontendKey}
+	if len(current) > 0 {
+		// The identifier of the frontend
+		list[0] = current[0]
+		current = current[1:]
+	}
+	removed, listed := false, make(map[string]bool)
+	for _, b := range current {
+		if wanted[b] {
+			list = append(list, b)
+			listed[b] = true
+		} else {
+			removed = true
+		}
+	}
+	for _, b := range backends {
+		if !listed[b] {
+			list = append(list, b)
+		}
+	}
+	var ids []string
+	for id, b := range list[1:] {
+		if notReady[b] {
+			ids = append(ids, deadMember(b, id))
+		}
+	}
+	if len(list)-1 == len(current) && !removed {
+		return ids, nil
+	}
+	log.Printf("Frontend %q now has %d backends", frontendKey, len(list)-1)
+	if dryRun == true {
+		return ids, nil
+	}
+	args := []interface{}{key}
+	for _, b := range list {
+		args = append(args, b)
+	}
+	conn.Send("MULTI")
+	conn.Send("DEL", key)
+	conn.Send("RPUSH", args...)
+	if removed {
+		// The backend ids have changed
+		conn.Send("DEL", "dead:"+frontendKey)
+	}
+	_, err = conn.Do("EXEC")
+	return ids, err
+}
+
+/*
+ * Flags dead the not ready endpoints, and alive those which were not ready
+ * in the previous round
+ */
+func (c *Cache) SetEndpointsReadiness(frontendKey string,
+	dead, alive []string) error {
+	if dryRun == true || len(dead)+len(alive) == 0 {
+		return nil
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	deadKey := "dead:" + frontendKey
+	conn.Send("MULTI")
+	for _, id := range alive {
+		conn.Send("SREM", deadKey, id)
+	}
+	for _, id := range dead {
+		conn.Send("SADD", deadKey, id)
+	}
+	if len(dead) > 0 {
+		conn.Send("EXPIRE", deadKey, 60)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func reconcileService(cache *Cache, k *k8sClient, s *k8sService,
+	previous []string) ([]string, error) {
+	ready, notReady, err := k.endpoints(s)
+	if err != nil {
+		return previous, err
+	}
+	unready := make(map[string]bool)
+	for _, b := range notReady {
+		unready[b] = true
+	}
+	ids, err := cache.ReconcileFrontend(s.frontend, append(ready,
+		notReady...), unready)
+	if err != nil {
+		return previous, err
+	}
+	dead := make(map[string]bool)
+	for _, id := range ids {
+		dead[id] = true
+	}
+	var alive []string
+	for _, id := range previous {
+		if !dead[id] {
+			alive = append(alive, id)
+		}
+	}
+	return ids, cache.SetEndpointsReadiness(s.frontend, ids, alive)
+}
+
+/*
+ * Reconciles the frontend lists and dead sets with the endpoints of the
+ * Kubernetes services every -k8s_interval
+ */
+func watchKubernetes(cache *Cache) {
+	services, _ := parseK8sServices(k8sServices)
+	k, err := newK8sClient()
+	if err != nil {
+		logError("Cannot reach Kubernetes:", err.Error())
+		return
+	}
+	// Dead set members of the not ready endpoints of each service in the
+	// previous round
+	notReady := make(map[*k8sService][]string)
+	for {
+		for _, s := range services {
+			if isPaused() == true {
+				break
+			}
+			ids, err := reconcileService(cache, k, s, notReady[s])
+			if err != nil {
+				logError("Cannot reconcile", s.frontend, "with", s.String()+":",
+					err.Error())
+			}
+			notReady[s] = ids
+		}
+		if !cache.wait(k8sInterval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseK8sServices(t *testing.T) {
+	services, err := parseK8sServices("www.foo.com=default/web:http, api.foo.com=prod/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || *services[0] != (k8sService{"www.foo.com",
+		"default", "web", "http"}) || *services[1] != (k8sService{
+		"api.foo.com", "prod", "api", ""}) {
+		t.Errorf("Unexpected services %v", services)
+	}
+	for _, spec := range []string{"www.foo.com", "www.foo.com=web",
+		"=default/web", "www.foo.com=/web"} {
+		if _, err := parseK8sServices(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestReconcileService(t *testing.T) {
+	endpoints := `{"subsets": [{
+		"addresses": [{"ip": "10.1.0.1"}, {"ip": "10.1.0.3"}],
+		"notReadyAddresses": [{"ip": "10.1.0.4"}],
+		"ports": [{"name": "metrics", "port": 9090}, {"name": "http", "port": 8080}]}]}`
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			auth = r.Header.Get("Authorization")
+			if r.URL.Path != "/api/v1/namespaces/default/endpoints/web" {
+				http.NotFound(w, r)
+				return
+			}
+			io.WriteString(w, endpoints)
+		}))
+	defer srv.Close()
+	k := &k8sClient{client: srv.Client(), baseUrl: srv.URL, token: "t0k3n"}
+	r, c := setupCache(t)
+	r.lists["frontend:www.foo.com"] = []string{"www", "http://10.1.0.2:8080",
+		"http://10.1.0.3:8080"}
+	r.sets["dead:www.foo.com"] = map[string]bool{"0": true}
+	s := &k8sService{"www.foo.com", "default", "web", "http"}
+	ids, err := reconcileService(c, k, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer t0k3n" {
+		t.Errorf("Expected the token to be sent, got %q", auth)
+	}
+	expected := []string{"www", "http://10.1.0.3:8080", "http://10.1.0.1:8080",
+		"http://10.1.0.4:8080"}
+	if !reflect.DeepEqual(r.lists["frontend:www.foo.com"], expected) {
+		t.Errorf("Expected %v, got %v", expected, r.lists["frontend:www.foo.com"])
+	}
+	// The ids changed, the former dead backend is gone
+	if !reflect.DeepEqual(ids, []string{"2"}) ||
+		!reflect.DeepEqual(r.sets["dead:www.foo.com"], map[string]bool{"2": true}) {
+		t.Errorf("Expected only the not ready endpoint to be dead, got %v %v",
+			ids, r.sets["dead:www.foo.com"])
+	}
+	// The endpoint gets ready
+	endpoints = `{"subsets": [{
+		"addresses": [{"ip": "10.1.0.1"}, {"ip": "10.1.0.3"}, {"ip": "10.1.0.4"}],
+		"ports": [{"name": "http", "port": 8080}]}]}`
+	if ids, err = reconcileService(c, k, s, ids); err != nil || len(ids) > 0 {
+		t.Fatalf("Expected no dead endpoint, got %v (%v)", ids, err)
+	}
+	if !reflect.DeepEqual(r.lists["frontend:www.foo.com"], expected) ||
+		len(r.sets["dead:www.foo.com"]) > 0 {
+		t.Errorf("Expected the backend alive in place, got %v %v",
+			r.lists["frontend:www.foo.com"], r.sets["dead:www.foo.com"])
+	}
+}
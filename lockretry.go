@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// First delay before trying again to lock a backend checked by another
+	// instance, doubled after each attempt up to 60 seconds
+	LOCK_RETRY_DELAY     = 5
+	LOCK_RETRY_MAX_DELAY = 60
+)
+
+var (
+	// 0 = a backend checked by another instance is left to it
+	lockRetries    int
+	lockRetryDelay = time.Duration(LOCK_RETRY_DELAY) * time.Second
+	// Backends with a pending lock retry
+	lockRetrying     = make(map[string]bool)
+	lockRetryingLock sync.Mutex
+)
+
+/*
+ * Tries again to lock a backend checked by another instance, up to
+ * -lock_retries times with a backoff. If the other instance stopped
+ * checking it (or died, see ReleaseStaleLock) meanwhile, the backend is
+ * checked without waiting for another dead notification.
+ */
+func retryLock(channel string, check *Check) {
+	lockRetryingLock.Lock()
+	defer lockRetryingLock.Unlock()
+	if lockRetrying[check.BackendUrl] == true {
+		return
+	}
+	lockRetrying[check.BackendUrl] = true
+	c := cache
+	go func() {
+		defer func() {
+			lockRetryingLock.Lock()
+			delete(lockRetrying, check.BackendUrl)
+			lockRetryingLock.Unlock()
+		}()
+		delay := lockRetryDelay
+		for i := 0; i < lockRetries; i++ {
+			if !c.wait(delay) {
+				return
+			}
+			if c.mapping.IsWatched(check.BackendUrl) == true || isDraining() {
+				return
+			}
+			locksMetric.Add("retries", 1)
+			c.ReleaseStaleLock(check.BackendUrl)
+			if lockCheck(channel, check) == true {
+				log.Println(check.BackendUrl, "Locked after", i+1, "retries")
+				return
+			}
+			delay *= 2
+			if max := time.Duration(LOCK_RETRY_MAX_DELAY) * time.Second; delay > max {
+				delay = max
+			}
+		}
+	}()
+}
+
+/*
+ * Removes the locks of a backend held by the instances without a heartbeat:
+ * they crashed, and nobody checks the backend anymore. Only the owners which
+ * recorded their heartbeat key in hchecker:heartbeats are considered: the
+ * instances in dry run or of the former versions never write one, their
+ * locks are left alone.
+ */
+func (c *Cache) ReleaseStaleLock(backendUrl string) {
+	fields := []string{backendUrl}
+	for i := 2; i <= redundancy; i++ {
+		fields = append(fields, backendUrl+"#"+strconv.Itoa(i))
+	}
+	metaConn := c.metaPool.Get()
+	defer metaConn.Close()
+	for _, pool := range c.lockNodes() {
+		conn := pool.Get()
+		for _, field := range fields {
+			sig, err := redis.String(conn.Do("HGET", c.redisKey, field))
+			if err != nil {
+				continue
+			}
+			// Locks hold "instance;timestamp"
+			i := strings.LastIndex(sig, ";")
+			if i < 0 || sig[:i] == myId {
+				continue
+			}
+			owner := sig[:i]
+			// Its own -heartbeat_key, which may not be ours
+			key, err := redis.String(metaConn.Do("HGET",
+				c.metaKey("heartbeats"), owner))
+			if err != nil {
+				continue
+			}
+			alive, err := redis.Bool(metaConn.Do("EXISTS", key))
+			if err != nil || alive == true {
+				continue
+			}
+			log.Println(backendUrl, "Releasing the lock of", owner,
+				"(no heartbeat)")
+			unlockScript.Do(conn, c.redisKey, field, backendUrl+";"+owner, sig)
+			locksMetric.Add("stale", 1)
+		}
+		conn.Close()
+	}
+}
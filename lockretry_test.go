@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReleaseStaleLock(t *testing.T) {
+	r, c := setupCache(t)
+	r.hashes["hchecker"] = map[string]string{
+		"http://10.0.0.1:80":         "dead#1;1400000000.1",
+		"http://10.0.0.1:80;dead#1":  "1",
+		"http://10.0.0.2:80":         "alive#1;1400000000.1",
+		"http://10.0.0.2:80;alive#1": "1",
+	}
+	r.strings["hchecker:alive:alive#1"] = "{}"
+	r.hashes["hchecker:heartbeats"] = map[string]string{
+		"dead#1":  "hchecker:alive:dead#1",
+		"alive#1": "hchecker:alive:alive#1",
+	}
+	c.ReleaseStaleLock("http://10.0.0.1:80")
+	c.ReleaseStaleLock("http://10.0.0.2:80")
+	if len(r.hashes["hchecker"]) != 2 {
+		t.Errorf("Expected only the locks of alive#1 to remain, got %v",
+			r.hashes["hchecker"])
+	}
+}
+
+func TestReleaseStaleLockUnknownHeartbeat(t *testing.T) {
+	r, c := setupCache(t)
+	locks := map[string]string{
+		// In dry run, without a heartbeat
+		"http://10.0.0.1:80":          "dryrun#1;1400000000.1",
+		"http://10.0.0.1:80;dryrun#1": "1",
+		// With another -heartbeat_key
+		"http://10.0.0.2:80":         "other#1;1400000000.1",
+		"http://10.0.0.2:80;other#1": "1",
+	}
+	r.hashes["hchecker"] = make(map[string]string)
+	for field, value := range locks {
+		r.hashes["hchecker"][field] = value
+	}
+	r.hashes["hchecker:heartbeats"] = map[string]string{
+		"other#1": "monitoring:other#1"}
+	r.strings["monitoring:other#1"] = "{}"
+	c.ReleaseStaleLock("http://10.0.0.1:80")
+	c.ReleaseStaleLock("http://10.0.0.2:80")
+	if !reflect.DeepEqual(r.hashes["hchecker"], locks) {
+		t.Errorf("Expected the live locks to be left alone, got %v",
+			r.hashes["hchecker"])
+	}
+}
+
+func TestRetryLock(t *testing.T) {
+	r, c := setupCache(t)
+	cache = c
+	lockRetries, lockRetryDelay = 2, time.Millisecond
+	defer func() {
+		cache, lockRetries = nil, 0
+		lockRetryDelay = time.Duration(LOCK_RETRY_DELAY) * time.Second
+	}()
+	r.hashes["hchecker"] = map[string]string{
+		"http://10.0.0.1:80":         "alive#1;1400000000.1",
+		"http://10.0.0.1:80;alive#1": "1",
+	}
+	r.strings["hchecker:alive:alive#1"] = "{}"
+	locksMetric.Init()
+	startCheck("dead", newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2"))
+	// A single retry loop per backend
+	startCheck("dead", newTestCheck(t, "www.bar.com;http://10.0.0.1:80;0;2"))
+	deadline := time.Now().Add(time.Second)
+	for {
+		lockRetryingLock.Lock()
+		retrying := len(lockRetrying)
+		lockRetryingLock.Unlock()
+		if retrying == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the retries to give up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v := locksMetric.Get("retries"); v == nil || v.String() != "2" {
+		t.Errorf("Expected 2 retries, got %v", v)
+	}
+	if v := locksMetric.Get("contended"); v == nil || v.String() != "4" {
+		t.Errorf("Expected 4 contended locks, got %v", v)
+	}
+	if c.mapping.Len() != 0 {
+		t.Error("Expected the backend to be left to the other instance")
+	}
+}
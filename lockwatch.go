@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// The notifications received meanwhile are handled by a single pass
+	// over the locks, at most once per second
+	LOCK_WATCH_INTERVAL = 1
+)
+
+var (
+	// false = each check loop reads its lock every CHECK_BREAK_INTERVAL
+	lockEvents bool
+	// Wakes the lock watcher up, buffered: one pending pass is enough
+	lockChanged = make(chan struct{}, 1)
+)
+
+/*
+ * Makes sure hchecker's Redis publishes the keyspace notifications of the
+ * hash commands and the generic ones (DEL...), for the lock hash
+ */
+func (c *Cache) EnableLockEvents() error {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	values, err := redis.Strings(conn.Do("CONFIG", "GET",
+		"notify-keyspace-events"))
+	if err != nil {
+		return err
+	}
+	current := ""
+	if len(values) == 2 {
+		current = values[1]
+	}
+	flags := mergeKeyspaceFlags(current, "Kgh")
+	if flags == current {
+		return nil
+	}
+	_, err = conn.Do("CONFIG", "SET", "notify-keyspace-events", flags)
+	return err
+}
+
+/*
+ * Follows the changes of the lock hash (keyspace notifications) instead of
+ * reading the lock of each check every CHECK_BREAK_INTERVAL: the locks
+ * taken by another instance are pushed to their check loop
+ */
+func (c *Cache) WatchLocks() error {
+	err := c.listen(c.getMetaConn, "__keyspace@0__:"+c.redisKey, false,
+		func(_ string, event string) {
+			select {
+			case lockChanged <- struct{}{}:
+			default:
+				// A pass is already pending
+			}
+		})
+	if err != nil {
+		return err
+	}
+	go c.runLockWatcher()
+	return nil
+}
+
+func (c *Cache) runLockWatcher() {
+	for {
+		select {
+		case <-c.closing:
+			return
+		case <-lockChanged:
+		case <-time.After(checkBreakInterval):
+			// The notifications are lost while reconnecting
+		}
+		c.CheckLocks()
+		if !c.wait(time.Duration(LOCK_WATCH_INTERVAL) * time.Second) {
+			return
+		}
+	}
+}
+
+/*
+ * Reads the locks of all the running checks at once, the checks whose lock
+ * is gone or held by someone else are flagged to stop at their next cycle
+ */
+func (c *Cache) CheckLocks() {
+	watchedLock.Lock()
+	checks := make([]*Check, 0, len(watchedChecks))
+	for check := range watchedChecks {
+		if atomic.LoadInt32(&check.lockLost) == 0 {
+			checks = append(checks, check)
+		}
+	}
+	watchedLock.Unlock()
+	if len(checks) == 0 {
+		return
+	}
+	args := redis.Args{c.redisKey}
+	for _, check := range checks {
+		args = args.Add(check.lockField)
+	}
+	var sigs [][]byte
+	err := retryRedis("lock_check", func() error {
+		conn := c.metaPool.Get()
+		defer conn.Close()
+		var err error
+		sigs, err = redis.ByteSlices(conn.Do("HMGET", args...))
+		return err
+	})
+	if err != nil {
+		// Redis failed, it doesn't mean we lost the locks
+		logError("Cannot check the locks:", err.Error())
+		return
+	}
+	for i, check := range checks {
+		if i < len(sigs) && string(sigs[i]) != check.routineSig {
+			log.Println(check.BackendUrl, "Lock released or taken by another instance")
+			atomic.StoreInt32(&check.lockLost, 1)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckLocks(t *testing.T) {
+	r, c := setupCache(t)
+	lockEvents = true
+	defer func() { lockEvents = false }()
+	kept := NewBackendCheck("www.foo.com", "http://10.0.0.1:80", 0, 2)
+	kept.routineSig = "host#1;1400000000.1"
+	taken := NewBackendCheck("www.foo.com", "http://10.0.0.2:80", 1, 2)
+	taken.routineSig = "host#1;1400000000.2"
+	released := NewBackendCheck("www.foo.com", "http://10.0.0.3:80", 2, 2)
+	released.routineSig = "host#1;1400000000.3"
+	r.hashes["hchecker"] = map[string]string{
+		"http://10.0.0.1:80": "host#1;1400000000.1",
+		"http://10.0.0.2:80": "host#2;1400000000.4",
+	}
+	for _, check := range []*Check{kept, taken, released} {
+		watchCheck(check, nil)
+		defer unwatchCheck(check)
+	}
+	c.CheckLocks()
+	if c.IsUnlockedBackend(kept) == true {
+		t.Errorf("Expected to keep the lock of %s", kept.BackendUrl)
+	}
+	for _, check := range []*Check{taken, released} {
+		if c.IsUnlockedBackend(check) == false {
+			t.Errorf("Expected to lose the lock of %s", check.BackendUrl)
+		}
+	}
+	// Pushed by the watcher only
+	delete(r.hashes["hchecker"], "http://10.0.0.1:80")
+	if c.IsUnlockedBackend(kept) == true {
+		t.Errorf("Expected the lock of %s to be read by the watcher",
+			kept.BackendUrl)
+	}
+}
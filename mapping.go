@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sync"
+)
+
+/*
+ * Maintains the mapping between the backends we check and their frontends:
+ * the controller of each backend (see controller.go) owns its frontends, the
+ * mapping only registers the controllers. It's shared by the subscribers, the
+ * check loops and the admin API, the frontends never leave the controllers,
+ * only copies do.
+ */
+type backendMapping struct {
+	lock        sync.Mutex
+	controllers map[string]*backendController
+	// The backends with a check loop
+	watched map[string]bool
+}
+
+func newBackendMapping() *backendMapping {
+	return &backendMapping{controllers: make(map[string]*backendController),
+		watched: make(map[string]bool)}
+}
+
+/*
+ * Returns the controller of a backend, nil if we don't know the backend
+ */
+func (m *backendMapping) controller(backendUrl string) *backendController {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.controllers[backendUrl]
+}
+
+/*
+ * Returns the controller of a backend, started if we didn't know the
+ * backend. Its check loop uses it when watch is set.
+ */
+func (m *backendMapping) startController(backendUrl string,
+	watch bool) *backendController {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ctl, exists := m.controllers[backendUrl]
+	if !exists {
+		ctl = newBackendController(backendUrl)
+		m.controllers[backendUrl] = ctl
+	}
+	if watch == true {
+		m.watched[backendUrl] = true
+	}
+	return ctl
+}
+
+/*
+ * Returns a copy of the frontends of a backend with its id in each of them,
+ * nil if we don't know the backend
+ */
+func (m *backendMapping) Frontends(backendUrl string) map[string]int {
+	return m.controller(backendUrl).Frontends()
+}
+
+/*
+ * Returns the number of frontends using a backend
+ */
+func (m *backendMapping) Count(backendUrl string) int {
+	return m.controller(backendUrl).Count()
+}
+
+/*
+ * Returns a copy of the whole mapping
+ */
+func (m *backendMapping) All() map[string]map[string]int {
+	m.lock.Lock()
+	controllers := make([]*backendController, 0, len(m.controllers))
+	for _, ctl := range m.controllers {
+		controllers = append(controllers, ctl)
+	}
+	m.lock.Unlock()
+	all := make(map[string]map[string]int, len(controllers))
+	for _, ctl := range controllers {
+		if frontends := ctl.Frontends(); frontends != nil {
+			all[ctl.backendUrl] = frontends
+		}
+	}
+	return all
+}
+
+/*
+ * Returns the number of backends in the mapping
+ */
+func (m *backendMapping) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.controllers)
+}
+
+/*
+ * Maps a backend to a frontend, and notifies its check loop that a frontend
+ * has been added
+ */
+func (m *backendMapping) Add(backendUrl, frontendKey string, id int) {
+	m.startController(backendUrl, false).Add(frontendKey, id)
+}
+
+/*
+ * Notifies the check loop of a backend, its next cycle writes the state of
+ * the backend as if it was the first one
+ */
+func (m *backendMapping) Notify(backendUrl string) {
+	m.controller(backendUrl).Notify()
+}
+
+/*
+ * Updates the id of a backend in one of its frontends, the list has been
+ * rewritten. Nothing is done if the backend has been removed meanwhile.
+ */
+func (m *backendMapping) SetId(backendUrl, frontendKey string, id int) {
+	m.controller(backendUrl).SetId(frontendKey, id)
+}
+
+/*
+ * Removes a frontend of a backend. Returns the number of frontends left.
+ */
+func (m *backendMapping) RemoveFrontend(backendUrl, frontendKey string) int {
+	return m.controller(backendUrl).Remove(frontendKey)
+}
+
+/*
+ * Returns the controller of a backend for its check loop
+ */
+func (m *backendMapping) Watch(backendUrl string) *backendController {
+	return m.startController(backendUrl, true)
+}
+
+/*
+ * Returns true if a check loop runs for the backend
+ */
+func (m *backendMapping) IsWatched(backendUrl string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.watched[backendUrl]
+}
+
+/*
+ * Forgets a backend and its frontends. Returns once its controller is
+ * stopped: a command sent afterwards is dropped.
+ */
+func (m *backendMapping) Remove(backendUrl string) {
+	m.lock.Lock()
+	ctl := m.controllers[backendUrl]
+	delete(m.controllers, backendUrl)
+	delete(m.watched, backendUrl)
+	m.lock.Unlock()
+	if ctl != nil {
+		ctl.stop()
+	}
+}
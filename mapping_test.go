@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestBackendMapping(t *testing.T) {
+	m := newBackendMapping()
+	ctl := m.Watch("http://10.0.0.1:80")
+	m.Add("http://10.0.0.1:80", "www.foo.com", 0)
+	m.Add("http://10.0.0.1:80", "www.bar.com", 1)
+	if ctl.Updated() == false || ctl.Updated() == true {
+		t.Error("Expected the check loop to be notified of the new frontends")
+	}
+	frontends := m.Frontends("http://10.0.0.1:80")
+	frontends["www.baz.com"] = 2
+	expected := map[string]int{"www.foo.com": 0, "www.bar.com": 1}
+	if f := m.Frontends("http://10.0.0.1:80"); !reflect.DeepEqual(f, expected) {
+		t.Errorf("Expected a copy of the frontends, got %v", f)
+	}
+	m.SetId("http://10.0.0.2:80", "www.foo.com", 1)
+	if m.Frontends("http://10.0.0.2:80") != nil || m.Len() != 1 {
+		t.Error("Expected the id of an unknown backend not to be set")
+	}
+	if n := m.RemoveFrontend("http://10.0.0.1:80", "www.bar.com"); n != 1 ||
+		m.Count("http://10.0.0.1:80") != 1 {
+		t.Errorf("Expected 1 frontend left, got %d", n)
+	}
+	m.Remove("http://10.0.0.1:80")
+	if m.Len() != 0 || m.IsWatched("http://10.0.0.1:80") == true {
+		t.Error("Expected the backend to be removed")
+	}
+	select {
+	case <-ctl.done:
+	default:
+		t.Error("Expected the controller to be stopped")
+	}
+}
+
+/*
+ * The subscribers, the check loops and the admin API use the mapping at the
+ * same time, run with -race
+ */
+func TestBackendMappingConcurrency(t *testing.T) {
+	r, c := setupCache(t)
+	cache = c
+	defer func() { cache = nil }()
+	const n = 20
+	var checks []*Check
+	for i := 0; i < n; i++ {
+		backendUrl := fmt.Sprintf("http://10.0.0.%d:80", i+1)
+		r.lists[fmt.Sprintf("frontend:www.%d.com", i)] = []string{"www",
+			backendUrl, "http://10.0.1.1:80"}
+		checks = append(checks, newTestCheck(t, fmt.Sprintf(
+			"www.%d.com;%s;0;2", i, backendUrl)))
+	}
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				f(i)
+			}
+		}()
+	}
+	// Dead notifications
+	run(func(i int) {
+		c.LockBackend(checks[i])
+		c.LockBackend(newTestCheck(t, fmt.Sprintf("www.%d.com;%s;0;2",
+			(i+1)%n, checks[i].BackendUrl)))
+	})
+	// Check loops
+	run(func(i int) {
+		c.MarkBackendDead(checks[i])
+		c.PruneDeletedFrontends(checks[i])
+		backendFanout(checks[i])
+		NewEvent(EVENT_ALIVE, checks[i])
+	})
+	// Keyspace notifications
+	run(func(i int) {
+		c.RefreshFrontend(fmt.Sprintf("www.%d.com", i))
+	})
+	// Admin API and handoffs
+	run(func(i int) {
+		getState(c)
+		c.mapping.IsWatched(checks[i].BackendUrl)
+	})
+	// Exiting checks
+	run(func(i int) {
+		if i%2 == 0 {
+			c.UnlockBackend(checks[i])
+		}
+	})
+	wg.Wait()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"expvar"
+)
+
+/*
+ * Metrics are published with expvar, on /debug/vars of the admin listener
+ */
+var (
+	// TLS certificates expiry (unix timestamp) by backend URL
+	certExpiryMetric = expvar.NewMap("cert_expiry")
+	// Number of probes which found a certificate expiring soon
+	certExpiringMetric = expvar.NewInt("cert_expiring")
+	// Reloads of the TLS files of the probes and Redis (see -tls_cert)
+	tlsReloadsMetric = expvar.NewInt("tls_reloads")
+	// Dead notifications rejected, and accepted only in tolerant mode
+	parseErrorsMetric    = expvar.NewInt("parse_errors")
+	parseToleratedMetric = expvar.NewInt("parse_tolerated")
+	// Backends skipped because of an invalid or forbidden URL
+	invalidBackendsMetric = expvar.NewInt("invalid_backends")
+	// Notifications ignored because of -include and -exclude
+	excludedFrontendsMetric = expvar.NewInt("excluded_frontends")
+	// Backends handed off above -max_backends
+	shedBackendsMetric = expvar.NewInt("shed_backends")
+	// Backends handed off to the instances below the average load
+	rebalancedBackendsMetric = expvar.NewInt("rebalanced_backends")
+	// Notifications of -dead_list: consumed, and requeued (left by a
+	// stopped instance)
+	deadListMetric = expvar.NewMap("dead_list")
+	// Notifications of -dead_stream: consumed, claimed (pending on a
+	// stopped instance), pending (not acknowledged by the group), trimmed
+	// (handled entries removed) and removed_consumers (stopped instances)
+	deadStreamMetric = expvar.NewMap("dead_stream")
+	// Queue of the dead notifications: depth (waiting), queued, dropped
+	// (queue full) and blocked (subscriber waiting, with -queue_policy block)
+	deadQueueMetric = expvar.NewMap("dead_queue")
+	// Dead notifications received from Hipache: received, parse_errors,
+	// duplicates (for a backend already checked), debounced (collapsed in a
+	// burst) and latency_ms (total handling time)
+	deadNotificationsMetric = expvar.NewMap("dead_notifications")
+	// Subscriptions found silently dead and established again
+	staleSubscriptionsMetric = expvar.NewInt("stale_subscriptions")
+	// Outcomes of the backend locks: attempts, acquired, joined (already
+	// ours, for another frontend), contended (locked by another instance),
+	// errors, takeovers (handed off by another instance), lost (taken by
+	// another instance while checking), retries (see -lock_retries) and
+	// stale (released, held by an instance without a heartbeat)
+	locksMetric = expvar.NewMap("locks")
+	// Bursts of probes confirming a resurrected backend (see -alive_burst):
+	// passed and failed
+	aliveBurstsMetric = expvar.NewMap("alive_bursts")
+	// Frontends found with all their backends dead (frontend_down), and up
+	// again (frontend_up)
+	outagesMetric = expvar.NewMap("frontend_outages")
+	// Faults injected by -chaos: probe_delay, redis_drop and lock_loss
+	chaosMetric = expvar.NewMap("chaos")
+	// Failed attempts of the Redis operations the state of the backends
+	// depends on: lock_check, unlock, mapping_check, mark_dead, mark_alive,
+	// dead_reason, slow_start and suspect
+	redisErrorsMetric = expvar.NewMap("redis_errors")
+	// Members of the dead sets not matching a backend of their frontend
+	orphansMetric = expvar.NewInt("dead_orphans")
+	// Dead marks removed because their backend id now maps to another
+	// backend
+	staleDeadMarksMetric = expvar.NewInt("stale_dead_marks")
+	// Events of the external metrics systems: sent, errors (failed
+	// batches) and dropped (buffer full)
+	sinksMetric = expvar.NewMap("sinks")
+	// Probes answered with the result of a recent probe of the backend (see
+	// -probe_cache): hits and misses
+	probeCacheMetric = expvar.NewMap("probe_cache")
+	// Failed probes by failure code: dns, connect, tls, timeout, 5xx,
+	// body_mismatch, redirect, plugin and other
+	failureCodesMetric = expvar.NewMap("failure_codes")
+	// Checks waiting for a probe slot (see -max_probes), and the number of
+	// times a check had to wait
+	probeQueueMetric = expvar.NewMap("probe_queue")
+	// Backends which would have been flagged dead or alive on the log-only
+	// frontends
+	logOnlyMetric = expvar.NewMap("log_only")
+)
+
+func setGauge(m *expvar.Map, key string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	m.Set(key, v)
+}
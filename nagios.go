@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Exit codes of the Nagios plugins
+const (
+	NAGIOS_OK       = 0
+	NAGIOS_WARNING  = 1
+	NAGIOS_CRITICAL = 2
+	NAGIOS_UNKNOWN  = 3
+)
+
+var nagiosStatus = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+/*
+ * Returns the backends of a frontend, in the order of their ids
+ */
+func (c *Cache) FrontendBackends(frontendKey string) ([]string, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("LRANGE", "frontend:"+frontendKey, 1, -1))
+}
+
+/*
+ * Probes all the backends of a frontend once, concurrently. Returns the
+ * checks, in the order of the backend ids.
+ */
+func checkFrontend(frontendKey string, backends []string) []*Check {
+	checks := make([]*Check, len(backends))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		backendUrl, err := parseBackendUrl(backend)
+		if err != nil {
+			backendUrl = backend
+		}
+		check := NewBackendCheck(frontendKey, backendUrl, i, len(backends))
+		checks[i] = check
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if check.checkStatus() {
+				atomic.StoreInt32(&check.lastStatus, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	return checks
+}
+
+/*
+ * Formats the result of the checks as a Nagios plugin: the status line with
+ * the performance data, then one line per backend. Returns the exit code.
+ */
+func nagiosReport(frontendKey string, checks []*Check, warning,
+	critical int) (int, string) {
+	dead := 0
+	var details []string
+	perfdata := []string{}
+	for _, check := range checks {
+		latency := float64(atomic.LoadInt64(&check.lastLatency)) /
+			float64(time.Millisecond)
+		status := "alive"
+		if atomic.LoadInt32(&check.lastStatus) == 0 {
+			dead += 1
+			reason, _, _ := check.lastResult()
+			status = "dead (" + reason + ")"
+		}
+		details = append(details, fmt.Sprintf("%s: %s in %.1fms",
+			check.BackendUrl, status, latency))
+		perfdata = append(perfdata, fmt.Sprintf("'backend_%d'=%.3fms",
+			check.BackendId, latency))
+	}
+	if critical <= 0 || critical > len(checks) {
+		// All of them
+		critical = len(checks)
+	}
+	code := NAGIOS_OK
+	if dead >= critical {
+		code = NAGIOS_CRITICAL
+	} else if dead >= warning {
+		code = NAGIOS_WARNING
+	}
+	perfdata = append([]string{
+		fmt.Sprintf("alive=%d;;;0;%d", len(checks)-dead, len(checks)),
+		fmt.Sprintf("dead=%d;%d;%d;0;%d", dead, warning, critical,
+			len(checks))}, perfdata...)
+	out := fmt.Sprintf("%s - %s: %d/%d backends alive | %s\n%s",
+		nagiosStatus[code], frontendKey, len(checks)-dead, len(checks),
+		strings.Join(perfdata, " "), strings.Join(details, "\n"))
+	return code, out
+}
+
+func checkFrontendCommand(cache *Cache, args []string) int {
+	var warning, critical int
+	flags := flag.NewFlagSet("check-frontend", flag.ContinueOnError)
+	flags.IntVar(&warning, "warning", 1,
+		"Number of dead backends for a WARNING")
+	flags.IntVar(&critical, "critical", 0,
+		"Number of dead backends for a CRITICAL (0 = all of them)")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Println("UNKNOWN - Usage: check-frontend [-warning N] [-critical N] <frontend>")
+		return NAGIOS_UNKNOWN
+	}
+	frontendKey := flags.Arg(0)
+	backends, err := cache.FrontendBackends(frontendKey)
+	if err != nil {
+		fmt.Println("UNKNOWN - Cannot read the frontend:", err.Error())
+		return NAGIOS_UNKNOWN
+	}
+	if len(backends) == 0 {
+		fmt.Printf("UNKNOWN - Frontend %q has no backends\n", frontendKey)
+		return NAGIOS_UNKNOWN
+	}
+	code, out := nagiosReport(frontendKey, checkFrontend(frontendKey,
+		backends), warning, critical)
+	fmt.Println(out)
+	return code
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckFrontend(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	dead := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	checks := checkFrontend("www.foo.com", []string{srv.URL, dead.URL})
+	for _, test := range []struct {
+		warning  int
+		critical int
+		code     int
+		status   string
+	}{
+		{1, 0, NAGIOS_WARNING, "WARNING - www.foo.com: 1/2 backends alive | alive=1;;;0;2 dead=1;1;2;0;2 "},
+		{1, 1, NAGIOS_CRITICAL, "CRITICAL - www.foo.com: 1/2 backends alive | alive=1;;;0;2 dead=1;1;1;0;2 "},
+		{2, 0, NAGIOS_OK, "OK - www.foo.com: 1/2 backends alive | alive=1;;;0;2 dead=1;2;2;0;2 "},
+	} {
+		code, out := nagiosReport("www.foo.com", checks, test.warning,
+			test.critical)
+		if code != test.code || !strings.HasPrefix(out, test.status) {
+			t.Errorf("Expected %d %q, got %d %q", test.code, test.status,
+				code, out)
+		}
+		if !strings.Contains(out, "\n"+dead.URL+": dead (connect refused)") {
+			t.Errorf("Expected the details of the dead backend, got %q", out)
+		}
+	}
+}
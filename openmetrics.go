@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const OPENMETRICS_CONTENT_TYPE = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+var (
+	metricNameUnsafe  = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+/*
+ * Number of backends of a frontend, and how many are dead
+ */
+type frontendHealth struct {
+	Backends int
+	Dead     int
+}
+
+/*
+ * Returns the health of all the frontends of Hipache
+ */
+func (c *Cache) FrontendsHealth() (map[string]*frontendHealth, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	keys, err := scanKeys(conn, "frontend:*")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		conn.Send("LLEN", key)
+		conn.Send("SCARD", "dead:"+strings.TrimPrefix(key, "frontend:"))
+	}
+	conn.Flush()
+	health := make(map[string]*frontendHealth)
+	for _, key := range keys {
+		n, err := redis.Int(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		dead, err := redis.Int(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		// The first element is the identifier of the frontend
+		h := &frontendHealth{Backends: n - 1, Dead: dead}
+		if h.Backends < 0 {
+			h.Backends = 0
+		}
+		if h.Dead > h.Backends {
+			// Orphaned members, see the janitor
+			h.Dead = h.Backends
+		}
+		health[strings.TrimPrefix(key, "frontend:")] = h
+	}
+	return health, nil
+}
+
+func metricName(s string) string {
+	return "hchecker_" + strings.Trim(metricNameUnsafe.ReplaceAllString(s,
+		"_"), "_")
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+/*
+ * Writes the numeric expvar metrics, the maps with a "key" label
+ */
+func writeProcessMetrics(w *bytes.Buffer) {
+	expvar.Do(func(kv expvar.KeyValue) {
+		name := metricName(kv.Key)
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			fmt.Fprintf(w, "# TYPE %s unknown\n%s %d\n", name, name, v.Value())
+		case *expvar.Float:
+			fmt.Fprintf(w, "# TYPE %s unknown\n%s %s\n", name, name,
+				formatMetricValue(v.Value()))
+		case *expvar.Map:
+			header := false
+			v.Do(func(sub expvar.KeyValue) {
+				var value string
+				switch sv := sub.Value.(type) {
+				case *expvar.Int:
+					value = strconv.FormatInt(sv.Value(), 10)
+				case *expvar.Float:
+					value = formatMetricValue(sv.Value())
+				default:
+					return
+				}
+				if !header {
+					fmt.Fprintf(w, "# TYPE %s unknown\n", name)
+					header = true
+				}
+				fmt.Fprintf(w, "%s{key=\"%s\"} %s\n", name,
+					labelValueEscaper.Replace(sub.Key), value)
+			})
+		}
+	})
+	fmt.Fprintf(w, "# TYPE hchecker_goroutines gauge\nhchecker_goroutines %d\n",
+		runtime.NumGoroutine())
+	fmt.Fprintf(w, "# TYPE hchecker_checked_backends gauge\n"+
+		"hchecker_checked_backends %d\n", len(watchedCheckList()))
+}
+
+/*
+ * Writes the number of backends and dead backends of each frontend
+ */
+func writeFrontendMetrics(w *bytes.Buffer, health map[string]*frontendHealth) {
+	frontends := make([]string, 0, len(health))
+	for frontend := range health {
+		frontends = append(frontends, frontend)
+	}
+	sort.Strings(frontends)
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value func(h *frontendHealth) int
+	}{
+		{"hipache_frontend_backends", "Backends of the frontend",
+			func(h *frontendHealth) int { return h.Backends }},
+		{"hipache_frontend_dead_backends", "Backends of the frontend flagged dead",
+			func(h *frontendHealth) int { return h.Dead }},
+		{"hipache_frontend_down", "1 if all the backends of the frontend are dead",
+			func(h *frontendHealth) int {
+				if h.Backends > 0 && h.Dead == h.Backends {
+					return 1
+				}
+				return 0
+			}},
+	} {
+		fmt.Fprintf(w, "# TYPE %s gauge\n# HELP %s %s\n", metric.name,
+			metric.name, metric.help)
+		for _, frontend := range frontends {
+			fmt.Fprintf(w, "%s{frontend=\"%s\"} %d\n", metric.name,
+				labelValueEscaper.Replace(frontend),
+				metric.value(health[frontend]))
+		}
+	}
+}
+
+/*
+ * GET /metrics serves the metrics of the process and the health of the
+ * Hipache frontends, read from Redis, in the OpenMetrics format
+ */
+func openMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	health, err := cache.FrontendsHealth()
+	if err != nil {
+		http.Error(w, "Cannot read the frontends: "+err.Error(),
+			http.StatusBadGateway)
+		return
+	}
+	var out bytes.Buffer
+	writeProcessMetrics(&out)
+	writeFrontendMetrics(&out, health)
+	out.WriteString("# EOF\n")
+	w.Header().Set("Content-Type", OPENMETRICS_CONTENT_TYPE)
+	w.Write(out.Bytes())
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenMetricsHandler(t *testing.T) {
+	var r *fakeRedis
+	r, cache = setupCache(t)
+	defer func() { cache = nil }()
+	r.lists["frontend:www.foo.com"] = []string{"www", "http://10.0.0.1:80",
+		"http://10.0.0.2:80"}
+	r.sets["dead:www.foo.com"] = map[string]bool{"1": true}
+	r.lists["frontend:api.\"foo\".com"] = []string{"api", "http://10.0.0.3:80"}
+	w := httptest.NewRecorder()
+	openMetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != OPENMETRICS_CONTENT_TYPE {
+		t.Fatalf("Unexpected response %d %q", w.Code, w.Header())
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE hipache_frontend_backends gauge",
+		`hipache_frontend_backends{frontend="api.\"foo\".com"} 1`,
+		`hipache_frontend_backends{frontend="www.foo.com"} 2`,
+		`hipache_frontend_dead_backends{frontend="api.\"foo\".com"} 0`,
+		`hipache_frontend_dead_backends{frontend="www.foo.com"} 1`,
+		"# TYPE hchecker_parse_errors unknown",
+		"hchecker_checked_backends 0",
+	} {
+		if !strings.Contains(body, "\n"+line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, body)
+		}
+	}
+	if !strings.HasSuffix(body, "\n# EOF\n") {
+		t.Error("Expected the exposition to end with # EOF")
+	}
+}
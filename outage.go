@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// All the backends of a frontend are dead, and one of them came back
+	EVENT_FRONTEND_DOWN = "frontend_down"
+	EVENT_FRONTEND_UP   = "frontend_up"
+)
+
+/*
+ * Returns true if all the backends of a frontend are flagged dead
+ */
+func (c *Cache) isFrontendDown(frontendKey string) (bool, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	conn.Send("LLEN", "frontend:"+frontendKey)
+	conn.Send("SCARD", "dead:"+frontendKey)
+	conn.Flush()
+	n, err := redis.Int(conn.Receive())
+	if err != nil {
+		return false, err
+	}
+	dead, err := redis.Int(conn.Receive())
+	if err != nil {
+		return false, err
+	}
+	// The first element is the identifier of the frontend
+	return n > 1 && dead >= n-1, nil
+}
+
+/*
+ * Follows the outages of the frontends of a backend just flagged dead or
+ * alive. The frontends with all their backends dead are kept in the
+ * hchecker:outages hash, with the time they went down: the instance adding
+ * or removing a frontend publishes the frontend_down or frontend_up event.
+ */
+func (c *Cache) UpdateOutages(check *Check) {
+	m := c.mapping.Frontends(check.BackendUrl)
+	if m == nil {
+		return
+	}
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	for frontendKey, id := range m {
+		if isLogOnly(frontendKey) == true {
+			continue
+		}
+		down, err := c.isFrontendDown(frontendKey)
+		if err != nil {
+			logError(check.BackendUrl, "Cannot check the outage of",
+				frontendKey+":", err.Error())
+			continue
+		}
+		eventType := EVENT_FRONTEND_UP
+		var changed int
+		if down == true {
+			eventType = EVENT_FRONTEND_DOWN
+			changed, err = redis.Int(conn.Do("HSETNX", c.metaKey("outages"),
+				frontendKey, time.Now().Unix()))
+		} else {
+			changed, err = redis.Int(conn.Do("HDEL", c.metaKey("outages"),
+				frontendKey))
+		}
+		if err != nil {
+			logError(check.BackendUrl, "Cannot update the outage of",
+				frontendKey+":", err.Error())
+			continue
+		} else if changed == 0 {
+			continue
+		}
+		if down == true {
+			log.Println(check.BackendUrl, "All the backends of", frontendKey,
+				"are dead, frontend down")
+		} else {
+			log.Println(check.BackendUrl, "Frontend", frontendKey, "is up again")
+		}
+		outagesMetric.Add(eventType, 1)
+		event := NewEvent(eventType, check)
+		event.Frontends = map[string]int{frontendKey: id}
+		publishOutage(event)
+	}
+}
+
+/*
+ * Publishes an outage on the hchecker:events channel and to the clients of
+ * /events. The metrics systems and the history only get the backends.
+ */
+func publishOutage(event *Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println(event.BackendUrl, "Cannot encode event:", err)
+		return
+	}
+	cache.PublishEvent(data)
+	streamEvent(event)
+}
+
+/*
+ * Returns the frontends down, with the time they went down
+ */
+func (c *Cache) Outages() (map[string]int64, error) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	values, err := redis.StringMap(conn.Do("HGETALL", c.metaKey("outages")))
+	if err != nil {
+		return nil, err
+	}
+	outages := make(map[string]int64)
+	for frontendKey, since := range values {
+		outages[frontendKey], _ = strconv.ParseInt(since, 10, 64)
+	}
+	return outages, nil
+}
+
+/*
+ * GET /outages returns the frontends with all their backends dead, with the
+ * time they went down (unix timestamp)
+ */
+func outagesHandler(w http.ResponseWriter, r *http.Request) {
+	outages, err := cache.Outages()
+	if err != nil {
+		http.Error(w, "Cannot read the outages: "+err.Error(),
+			http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(outages)
+}
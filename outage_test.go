@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOutages(t *testing.T) {
+	r, c := setupCache(t)
+	cache = c
+	defer func() { cache = nil }()
+	outagesMetric.Init()
+	r.lists["frontend:www.foo.com"] = []string{"foo", "http://10.0.0.1:80",
+		"http://10.0.0.2:80"}
+	r.sets["dead:www.foo.com"] = map[string]bool{"0": true}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.2:80;1;2")
+	c.LockBackend(check)
+	c.MarkBackendDead(check)
+	c.UpdateOutages(check)
+	outages, err := c.Outages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, down := outages["www.foo.com"]; !down {
+		t.Fatalf("Expected the frontend to be down, got %v", outages)
+	}
+	// Only once
+	c.UpdateOutages(check)
+	if len(r.published) != 1 || r.published[0].channel != "hchecker:events" {
+		t.Fatalf("Expected a single event, got %v", r.published)
+	}
+	var event Event
+	json.Unmarshal([]byte(r.published[0].data), &event)
+	if event.Type != EVENT_FRONTEND_DOWN || event.Frontends["www.foo.com"] != 1 {
+		t.Errorf("Expected the frontend_down event, got %+v", event)
+	}
+	c.MarkBackendAlive(check)
+	c.UpdateOutages(check)
+	if outages, _ := c.Outages(); len(outages) != 0 {
+		t.Errorf("Expected the frontend to be up, got %v", outages)
+	}
+	if v := outagesMetric.Get(EVENT_FRONTEND_UP); v == nil || v.String() != "1" {
+		t.Error("Expected the frontend to be counted up again")
+	}
+}
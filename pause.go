@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// The pause key is read every 2 seconds
+const PAUSE_INTERVAL = 2
+
+// While hchecker:paused exists, the probes go on but the dead sets are left
+// alone, by all the instances
+var paused int32
+
+func isPaused() bool {
+	return atomic.LoadInt32(&paused) == 1
+}
+
+func setPaused(enabled bool) {
+	var v int32
+	if enabled == true {
+		v = 1
+	}
+	if atomic.SwapInt32(&paused, v) == v {
+		return
+	}
+	if enabled == true {
+		log.Println("Paused: the dead and alive backends are not flagged anymore")
+		return
+	}
+	log.Println("Not paused anymore, flagging the current state of the backends")
+	// As if a frontend was added, the next cycle writes the current state
+	watchedLock.Lock()
+	defer watchedLock.Unlock()
+	for _, ctl := range watchedChecks {
+		ctl.Notify()
+	}
+}
+
+/*
+ * Returns true if the operators paused the checkers
+ */
+func (c *Cache) IsPaused() (bool, error) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	return redis.Bool(conn.Do("EXISTS", c.metaKey("paused")))
+}
+
+/*
+ * Follows the pause key. When Redis cannot be read, the last known state is
+ * kept.
+ */
+func watchPause(cache *Cache) {
+	for {
+		if p, err := cache.IsPaused(); err != nil {
+			logError("Cannot read the pause key:", err.Error())
+		} else {
+			setPaused(p)
+		}
+		if !cache.wait(time.Duration(PAUSE_INTERVAL) * time.Second) {
+			return
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPause(t *testing.T) {
+	r, cache := setupCache(t)
+	defer setPaused(false)
+	if p, err := cache.IsPaused(); err != nil || p == true {
+		t.Fatalf("Expected not to be paused, got %t (%v)", p, err)
+	}
+	r.strings["hchecker:paused"] = "1"
+	if p, err := cache.IsPaused(); err != nil || p == false {
+		t.Fatalf("Expected to be paused, got %t (%v)", p, err)
+	}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	ctl := newBackendController(check.BackendUrl)
+	defer ctl.stop()
+	watchCheck(check, ctl)
+	defer unwatchCheck(check)
+	setPaused(true)
+	if isPaused() == false || ctl.Updated() == true {
+		t.Fatal("Expected the checks to be paused")
+	}
+	// The checks write their current state when resumed
+	setPaused(false)
+	if isPaused() == true || ctl.Updated() == false {
+		t.Error("Expected the checks to be notified of the resume")
+	}
+}
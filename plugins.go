@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Kinds of plugins
+	PLUGIN_PROBE    = "probe"
+	PLUGIN_NOTIFIER = "notifier"
+	// Timeout of the plugins, and of the probes without -deadline
+	PLUGIN_TIMEOUT = 10
+)
+
+var (
+	// Comma separated executables implementing the plugin protocol
+	pluginPaths string
+	// Probes of the plugins by type, the notifiers are sinks
+	probePlugins    = make(map[string]*probePlugin)
+	notifierPlugins []*notifierPlugin
+	pluginsOnce     sync.Once
+	pluginsErr      error
+)
+
+/*
+ * Answer of a plugin to "describe"
+ */
+type pluginInfo struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+/*
+ * Runs a plugin command. Returns its output, stdout and stderr combined.
+ */
+func runPlugin(ctx context.Context, path string, stdin []byte,
+	args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, path, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	output, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(output)), err
+}
+
+/*
+ * Site-specific checks and notifiers, without maintaining a fork: the
+ * executables of -plugins are asked what they implement with "describe",
+ * which prints {"name": "NAME", "kind": "probe"} or "notifier". A probe
+ * plugin is used as the probe type NAME of the frontends, a notifier plugin
+ * receives the events like the metrics systems.
+ */
+func loadPlugins(spec string) error {
+	for _, path := range strings.Split(spec, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Duration(PLUGIN_TIMEOUT)*time.Second)
+		output, err := runPlugin(ctx, path, nil, "describe")
+		cancel()
+		if err != nil {
+			return fmt.Errorf("Cannot load plugin %s: %s", path, err)
+		}
+		var info pluginInfo
+		if err := json.Unmarshal([]byte(output), &info); err != nil {
+			return fmt.Errorf("Invalid description of plugin %s: %s", path,
+				err)
+		}
+		switch {
+		case info.Name == "":
+			return fmt.Errorf("Plugin %s has no name", path)
+		case info.Kind == PLUGIN_PROBE:
+			if info.Name == "http" || info.Name == "tcp" ||
+				probePlugins[info.Name] != nil {
+				return fmt.Errorf("Probe %q of plugin %s already exists",
+					info.Name, path)
+			}
+			probePlugins[info.Name] = &probePlugin{name: info.Name,
+				path: path}
+		case info.Kind == PLUGIN_NOTIFIER:
+			notifierPlugins = append(notifierPlugins,
+				&notifierPlugin{name: info.Name, path: path})
+		default:
+			return fmt.Errorf("Unknown kind %q of plugin %s", info.Kind, path)
+		}
+		log.Printf("Loaded %s plugin %q from %s", info.Kind, info.Name, path)
+	}
+	return nil
+}
+
+/*
+ * Loads the plugins of -plugins on the first call, the probe types of the
+ * config file are checked once -plugins is known
+ */
+func initPlugins() error {
+	pluginsOnce.Do(func() {
+		pluginsErr = loadPlugins(pluginPaths)
+	})
+	return pluginsErr
+}
+
+type probePlugin struct {
+	name string
+	path string
+}
+
+/*
+ * Runs "probe BACKEND_URL FRONTEND": the backend is alive if the plugin
+ * exits with 0, its output tells why otherwise
+ */
+func (p *probePlugin) probe(c *Check) probeResult {
+	timeout := time.Duration(PLUGIN_TIMEOUT) * time.Second
+	if probeDeadline > 0 {
+		timeout = probeDeadline
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	output, err := runPlugin(ctx, p.path, nil, "probe", c.BackendUrl,
+		c.FrontendKey)
+	if err == nil {
+		log.Println(c.BackendUrl, "plugin", p.name, "OK")
+		return probeResult{ok: true}
+	}
+	reason := "plugin error"
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		reason = "timeout"
+	}
+	if line, _, _ := strings.Cut(output, "\n"); line != "" {
+		err = errors.New(line)
+	}
+	log.Println(c.BackendUrl, "plugin", p.name, "error:", err.Error())
+	return probeResult{reason: reason, err: err.Error()}
+}
+
+/*
+ * Receives the batches of events on its standard input with "notify", one
+ * JSON event per line
+ */
+type notifierPlugin struct {
+	name string
+	path string
+}
+
+func (p *notifierPlugin) Send(events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var input bytes.Buffer
+	encoder := json.NewEncoder(&input)
+	for _, event := range events {
+		encoder.Encode(event)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(PLUGIN_TIMEOUT)*time.Second)
+	defer cancel()
+	output, err := runPlugin(ctx, p.path, input.Bytes(), "notify")
+	if err != nil && output != "" {
+		return fmt.Errorf("%s: %s", err, output)
+	}
+	return err
+}
+
+func (p *notifierPlugin) String() string {
+	return "plugin " + p.name
+}
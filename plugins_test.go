@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePlugin(t *testing.T, dir, name, script string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPlugins(t *testing.T) {
+	dir := t.TempDir()
+	received := filepath.Join(dir, "received")
+	probe := writePlugin(t, dir, "probe", `
+case "$1" in
+describe) echo '{"name": "grpc", "kind": "probe"}' ;;
+probe) [ "$2" = "http://10.0.0.1:80" ] && exit 0; echo "NOT_SERVING $3"; exit 1 ;;
+esac
+`)
+	notifier := writePlugin(t, dir, "notifier", `
+case "$1" in
+describe) echo '{"name": "pager", "kind": "notifier"}' ;;
+notify) cat >> `+received+` ;;
+esac
+`)
+	defer func() {
+		probePlugins = make(map[string]*probePlugin)
+		notifierPlugins = nil
+	}()
+	if err := loadPlugins(probe + ", " + notifier); err != nil {
+		t.Fatal(err)
+	}
+	if !isValidProbe(ProbeConfig{Type: "grpc"}) {
+		t.Error("Expected the probe of the plugin to be valid")
+	}
+	if isValidProbe(ProbeConfig{Type: "grpc", Port: 8080}) {
+		t.Error("Expected a port on a plugin probe to be rejected")
+	}
+	alive := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	if r := alive.runProbes([]ProbeConfig{{Type: "grpc"}}, PROBES_ALL); !r.ok {
+		t.Errorf("Expected the backend to be alive, got %+v", r)
+	}
+	dead := newTestCheck(t, "www.foo.com;http://10.0.0.2:80;1;2")
+	r := dead.runProbes([]ProbeConfig{{Type: "grpc"}}, PROBES_ALL)
+	if r.ok || r.reason != "plugin error" ||
+		r.err != "grpc: NOT_SERVING www.foo.com" {
+		t.Errorf("Expected the output of the plugin, got %+v", r)
+	}
+	if len(notifierPlugins) != 1 {
+		t.Fatalf("Expected a notifier, got %d", len(notifierPlugins))
+	}
+	events := []*Event{{Type: "dead", BackendUrl: "http://10.0.0.2:80"},
+		{Type: "alive", BackendUrl: "http://10.0.0.1:80"}}
+	if err := notifierPlugins[0].Send(events); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(received)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"type":"dead"`) {
+		t.Errorf("Expected the events as JSON lines, got %q", data)
+	}
+	// A plugin name must be unique
+	if err := loadPlugins(probe); err == nil {
+		t.Error("Expected a duplicate probe to be rejected")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// 0 = every check probes the backend
+	probeCacheWindow time.Duration
+	probeCache       = &probeResultCache{results: make(map[probeCacheKey]*cachedProbe)}
+)
+
+/*
+ * Backends probed the same way: the frontends sharing their settings (or
+ * having none) share the results
+ */
+type probeCacheKey struct {
+	backendUrl string
+	config     *FrontendConfig
+}
+
+type cachedProbe struct {
+	probeResult
+	latency int64
+	time    time.Time
+}
+
+/*
+ * Results of the last probe of each backend. During an incident, the checks
+ * started for the same backend by several frontends (and the suspicions of
+ * the other instances) reuse a result fresher than -probe_cache instead of
+ * probing again.
+ */
+type probeResultCache struct {
+	lock      sync.Mutex
+	results   map[probeCacheKey]*cachedProbe
+	lastSweep time.Time
+}
+
+func newProbeCacheKey(c *Check) probeCacheKey {
+	return probeCacheKey{c.BackendUrl, getFrontendConfig(c.FrontendKey)}
+}
+
+/*
+ * Returns the result of the last probe of the backend if it's still fresh
+ */
+func (p *probeResultCache) get(c *Check, now time.Time) (*cachedProbe, bool) {
+	if probeCacheWindow <= 0 {
+		return nil, false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	r, exists := p.results[newProbeCacheKey(c)]
+	if !exists || now.Sub(r.time) >= probeCacheWindow {
+		probeCacheMetric.Add("misses", 1)
+		return nil, false
+	}
+	probeCacheMetric.Add("hits", 1)
+	return r, true
+}
+
+func (p *probeResultCache) set(c *Check, r probeResult, now time.Time) {
+	if probeCacheWindow <= 0 {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if now.Sub(p.lastSweep) >= probeCacheWindow {
+		// Forget the stale results, once per window
+		for k, cached := range p.results {
+			if now.Sub(cached.time) >= probeCacheWindow {
+				delete(p.results, k)
+			}
+		}
+		p.lastSweep = now
+	}
+	p.results[newProbeCacheKey(c)] = &cachedProbe{probeResult: r,
+		latency: atomic.LoadInt64(&c.lastLatency), time: now}
+}
+
+/*
+ * Probes the backend once, unless it has been probed within -probe_cache.
+ * Returns true if the backend is alive
+ */
+func (c *Check) cachedCheckStatus() bool {
+	if r, hit := probeCache.get(c, time.Now()); hit {
+		atomic.StoreInt64(&c.lastLatency, r.latency)
+		c.setLastResult(r.reason, r.err)
+		return r.ok
+	}
+	return c.checkStatus()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeCache(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(502)
+		}))
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	probeCacheWindow = time.Minute
+	frontendConfigs["www.bar.com"] = &FrontendConfig{Host: "bar"}
+	defer func() {
+		probeCacheWindow = 0
+		probeCache = &probeResultCache{results: make(map[probeCacheKey]*cachedProbe)}
+		delete(frontendConfigs, "www.bar.com")
+	}()
+	foo := NewBackendCheck("www.foo.com", srv.URL, 0, 1)
+	other := NewBackendCheck("www.other.com", srv.URL, 0, 1)
+	bar := NewBackendCheck("www.bar.com", srv.URL, 0, 1)
+	if foo.cachedCheckStatus() == true || other.cachedCheckStatus() == true {
+		t.Fatal("Expected the backend to be dead")
+	}
+	if requests != 1 || other.lastReason != "502" {
+		t.Errorf("Expected the result to be reused, got %d requests (%q)",
+			requests, other.lastReason)
+	}
+	// Probed another way
+	bar.cachedCheckStatus()
+	// Always probed when fresh
+	foo.checkStatus()
+	if requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests)
+	}
+	// The probes of the check loops are always sent, the others reuse them
+	if foo.probe(true) == true || other.cachedCheckStatus() == true {
+		t.Fatal("Expected the backend to be dead")
+	}
+	if requests != 4 {
+		t.Errorf("Expected 4 requests, got %d", requests)
+	}
+	probeCacheWindow = 0
+	other.cachedCheckStatus()
+	if requests != 5 {
+		t.Error("Expected the backend to be probed when disabled")
+	}
+}
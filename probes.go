@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Composite checks: all the probes must pass, or one is enough
+	PROBES_ALL = "all"
+	PROBES_ANY = "any"
+)
+
+/*
+ * A probe of a composite check (see FrontendConfig.Probes)
+ */
+type ProbeConfig struct {
+	// "http", "tcp" or the name of a probe plugin (see -plugins)
+	Type string `json:"type"`
+	// URI of the HTTP probes (default is -uri)
+	Uri string `json:"uri"`
+	// Port of the TCP probes (default is the port of the backend)
+	Port int `json:"port"`
+}
+
+func (p ProbeConfig) String() string {
+	switch {
+	case p.Type == "http" && p.Uri != "":
+		return "http " + p.Uri
+	case p.Type == "tcp" && p.Port != 0:
+		return "tcp " + strconv.Itoa(p.Port)
+	}
+	return p.Type
+}
+
+type probeResult struct {
+	ok     bool
+	reason string
+	err    string
+}
+
+func isValidProbe(p ProbeConfig) bool {
+	if p.Type == "http" || p.Type == "tcp" {
+		return (p.Type == "http" && p.Port == 0) ||
+			(p.Type == "tcp" && p.Uri == "")
+	}
+	// The plugins are loaded first, their errors are reported on startup
+	initPlugins()
+	return probePlugins[p.Type] != nil && p.Uri == "" && p.Port == 0
+}
+
+/*
+ * Returns how long a probe of the backend can last at most: the connection
+ * and IO timeouts of each request (HEAD then GET in -method=auto, each
+ * redirect followed), within -deadline. The probes of a composite check run
+ * concurrently, the slowest one counts.
+ */
+func (c *Check) probeTimeout() time.Duration {
+	requests := 1
+	if httpMethod == METHOD_AUTO {
+		requests *= 2
+	}
+	fc := getFrontendConfig(c.FrontendKey)
+	if fc != nil && fc.FollowRedirects == true {
+		requests *= maxRedirects + 1
+	}
+	httpTimeout := time.Duration(requests) * (connectionTimeout + ioTimeout)
+	tcpTimeout := connectionTimeout
+	pluginTimeout := time.Duration(PLUGIN_TIMEOUT) * time.Second
+	if probeDeadline > 0 {
+		httpTimeout = minDuration(httpTimeout, probeDeadline)
+		tcpTimeout = minDuration(tcpTimeout, probeDeadline)
+		pluginTimeout = probeDeadline
+	}
+	timeout := httpTimeout
+	if fc != nil && len(fc.Probes) > 0 {
+		timeout = 0
+		for _, p := range fc.Probes {
+			t := pluginTimeout
+			if p.Type == "http" {
+				t = httpTimeout
+			} else if p.Type == "tcp" {
+				t = tcpTimeout
+			}
+			if t > timeout {
+				timeout = t
+			}
+		}
+	}
+	// See -chaos_delay
+	return timeout + chaosDelay
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+/*
+ * Runs the probes of a composite check concurrently and combines their
+ * results. A failing probe is reported with its own reason.
+ */
+func (c *Check) runProbes(probes []ProbeConfig, mode string) probeResult {
+	results := make([]chan probeResult, len(probes))
+	for i, p := range probes {
+		results[i] = make(chan probeResult, 1)
+		go func(p ProbeConfig, ch chan probeResult) {
+			if p.Type == "tcp" {
+				ch <- c.probeTCP(p.Port)
+				return
+			}
+			if plugin := probePlugins[p.Type]; plugin != nil {
+				ch <- plugin.probe(c)
+				return
+			}
+			uri := p.Uri
+			if uri == "" {
+				uri = httpUri
+			}
+			ch <- c.probeHTTP(uri)
+		}(p, results[i])
+	}
+	var failed *probeResult
+	passed := 0
+	for i, ch := range results {
+		r := <-ch
+		if r.ok == true {
+			passed += 1
+		} else if failed == nil {
+			r.err = fmt.Sprintf("%s: %s", probes[i], r.err)
+			failed = &r
+		}
+	}
+	if failed == nil || (mode == PROBES_ANY && passed > 0) {
+		return probeResult{ok: true}
+	}
+	return *failed
+}
+
+/*
+ * Opens a TCP connection to the backend (or another port of its host)
+ */
+func (c *Check) probeTCP(port int) probeResult {
+	proto, address := "tcp", ""
+	if strings.HasPrefix(c.BackendUrl, UNIX_SCHEME+"://") {
+		proto = "unix"
+		address = strings.TrimPrefix(c.BackendUrl, UNIX_SCHEME+"://")
+	} else {
+		u, err := url.Parse(c.BackendUrl)
+		if err != nil {
+			return probeResult{reason: "connection error", err: err.Error()}
+		}
+		host, p := u.Hostname(), u.Port()
+		if p == "" {
+			p = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+		}
+		if port != 0 {
+			p = strconv.Itoa(port)
+		}
+		address = net.JoinHostPort(host, p)
+	}
+	ctx := context.Background()
+	if probeDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, probeDeadline)
+		defer cancel()
+	}
+	conn, err := newDialer().DialContext(ctx, proto, address)
+	if err != nil {
+		log.Println(c.BackendUrl, "TCP error on", address+":", err.Error())
+		return probeResult{reason: errorReason(err), err: err.Error()}
+	}
+	conn.Close()
+	log.Println(c.BackendUrl, "TCP OK on", address)
+	return probeResult{ok: true}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCompositeProbes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/healthz" {
+				w.WriteHeader(500)
+			}
+		}))
+	defer srv.Close()
+	// A port nobody listens on
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	defer func() { frontendConfigs = make(map[string]*FrontendConfig) }()
+	check := &Check{BackendUrl: srv.URL, FrontendKey: "www.foo.com"}
+	for _, test := range []struct {
+		probes []ProbeConfig
+		mode   string
+		ok     bool
+		reason string
+	}{
+		{[]ProbeConfig{{Type: "tcp"}, {Type: "http", Uri: "/healthz"}},
+			"", true, ""},
+		{[]ProbeConfig{{Type: "tcp"}, {Type: "http"}}, PROBES_ALL, false, "500"},
+		{[]ProbeConfig{{Type: "tcp", Port: closedPort},
+			{Type: "http", Uri: "/healthz"}}, PROBES_ALL, false,
+			"connect refused"},
+		{[]ProbeConfig{{Type: "tcp", Port: closedPort},
+			{Type: "http", Uri: "/healthz"}}, PROBES_ANY, true, ""},
+	} {
+		frontendConfigs = map[string]*FrontendConfig{
+			"www.foo.com": {Probes: test.probes, ProbesMode: test.mode}}
+		if ok := check.checkStatus(); ok != test.ok ||
+			check.lastReason != test.reason {
+			t.Errorf("%v (%q): expected %t (%q), got %t (%q)", test.probes,
+				test.mode, test.ok, test.reason, ok, check.lastReason)
+		}
+	}
+}
+
+func TestInvalidProbes(t *testing.T) {
+	for _, data := range []string{
+		`{"www.foo.com": {"probes": [{"type": "icmp"}]}}`,
+		`{"www.foo.com": {"probes": [{"type": "tcp", "uri": "/"}]}}`,
+		`{"www.foo.com": {"probes": [{"type": "tcp"}], "probes_mode": "most"}}`,
+	} {
+		if _, err := parseFrontendConfigs([]byte(data)); err == nil {
+			t.Errorf("Expected %s to be rejected", data)
+		}
+	}
+}
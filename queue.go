@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Dead notifications waiting to be handled
+	QUEUE_SIZE = 10000
+	// What to do when the queue is full
+	QUEUE_DROP_OLDEST = "drop_oldest"
+	QUEUE_DROP_NEWEST = "drop_newest"
+	QUEUE_BLOCK       = "block"
+)
+
+var (
+	queueSize   = QUEUE_SIZE
+	queuePolicy = QUEUE_DROP_OLDEST
+	deadQueue   *notificationQueue
+)
+
+type queuedNotification struct {
+	channel string
+	line    string
+}
+
+/*
+ * Decouples the subscriber of the dead channel from the handling of the
+ * notifications (locking the backends, starting the checks): the subscriber
+ * only queues them, a worker handles them in order. A mass outage floods
+ * the channel, the queue is bounded and once full, depending on
+ * -queue_policy, the oldest or the newest notification is dropped (Hipache
+ * notifies again on the next failed request), or the subscriber waits,
+ * leaving the messages in Redis' output buffer.
+ */
+type notificationQueue struct {
+	items    chan queuedNotification
+	policy   string
+	callback func(channel string, line string)
+	// Last time a full queue was logged
+	lastFull int64
+	// Closed by Stop, then by Run once it returns
+	stopping chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newNotificationQueue(size int, policy string,
+	callback func(channel string, line string)) *notificationQueue {
+	return &notificationQueue{items: make(chan queuedNotification, size),
+		policy: policy, callback: callback, stopping: make(chan struct{}),
+		stopped: make(chan struct{})}
+}
+
+func isValidQueuePolicy(policy string) bool {
+	return policy == QUEUE_DROP_OLDEST || policy == QUEUE_DROP_NEWEST ||
+		policy == QUEUE_BLOCK
+}
+
+/*
+ * Queues a notification, called by the subscriber
+ */
+func (q *notificationQueue) Push(channel string, line string) {
+	n := queuedNotification{channel, line}
+	select {
+	case q.items <- n:
+		q.pushed()
+		return
+	default:
+	}
+	q.logFull()
+	switch q.policy {
+	case QUEUE_BLOCK:
+		deadQueueMetric.Add("blocked", 1)
+		q.items <- n
+		q.pushed()
+		return
+	case QUEUE_DROP_OLDEST:
+		select {
+		case <-q.items:
+			deadQueueMetric.Add("depth", -1)
+		default:
+		}
+		select {
+		case q.items <- n:
+			q.pushed()
+		default:
+			// Filled again by the other subscribers meanwhile
+		}
+	}
+	deadQueueMetric.Add("dropped", 1)
+}
+
+func (q *notificationQueue) pushed() {
+	deadQueueMetric.Add("depth", 1)
+	deadQueueMetric.Add("queued", 1)
+}
+
+/*
+ * Logs a full queue, once a minute at most
+ */
+func (q *notificationQueue) logFull() {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&q.lastFull)
+	if now-last < int64(time.Minute) ||
+		!atomic.CompareAndSwapInt64(&q.lastFull, last, now) {
+		return
+	}
+	log.Printf("Warning: the queue of the dead notifications is full (%d), "+
+		"applying the %s policy", cap(q.items), q.policy)
+}
+
+/*
+ * Returns the number of notifications waiting
+ */
+func (q *notificationQueue) Len() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.items)
+}
+
+/*
+ * Handles the queued notifications, until stopped
+ */
+func (q *notificationQueue) Run() {
+	defer close(q.stopped)
+	for {
+		select {
+		case n, ok := <-q.items:
+			if !ok {
+				return
+			}
+			deadQueueMetric.Add("depth", -1)
+			q.callback(n.channel, n.line)
+		case <-q.stopping:
+			// Hipache notifies them again
+			for len(q.items) > 0 {
+				<-q.items
+				deadQueueMetric.Add("depth", -1)
+				deadQueueMetric.Add("dropped", 1)
+			}
+			return
+		}
+	}
+}
+
+/*
+ * Stops Run and waits for the notification being handled, the ones still
+ * queued are dropped. The subscriber must be stopped first.
+ */
+func (q *notificationQueue) Stop() {
+	q.stopOnce.Do(func() { close(q.stopping) })
+	<-q.stopped
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNotificationQueuePolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy   string
+		expected []string
+	}{
+		{QUEUE_DROP_OLDEST, []string{"2", "3"}},
+		{QUEUE_DROP_NEWEST, []string{"0", "1"}},
+	} {
+		deadQueueMetric.Init()
+		var handled []string
+		q := newNotificationQueue(2, test.policy, func(_ string, line string) {
+			handled = append(handled, line)
+		})
+		for _, line := range []string{"0", "1", "2", "3"} {
+			q.Push("dead", line)
+		}
+		if q.Len() != 2 {
+			t.Errorf("%s: expected 2 notifications waiting, got %d",
+				test.policy, q.Len())
+		}
+		close(q.items)
+		q.Run()
+		if !reflect.DeepEqual(handled, test.expected) {
+			t.Errorf("%s: expected %v handled, got %v", test.policy,
+				test.expected, handled)
+		}
+		for name, expected := range map[string]string{"dropped": "2",
+			"depth": "0"} {
+			if v := deadQueueMetric.Get(name); v == nil ||
+				v.String() != expected {
+				t.Errorf("%s: expected %s %s, got %v", test.policy, expected,
+					name, v)
+			}
+		}
+	}
+}
+
+func TestNotificationQueueBlock(t *testing.T) {
+	deadQueueMetric.Init()
+	handled := make(chan string)
+	q := newNotificationQueue(1, QUEUE_BLOCK, func(_ string, line string) {
+		handled <- line
+	})
+	q.Push("dead", "0")
+	pushed := make(chan bool)
+	go func() {
+		q.Push("dead", "1")
+		pushed <- true
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Expected the subscriber to wait for the queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	go q.Run()
+	for _, expected := range []string{"0", "1"} {
+		if line := <-handled; line != expected {
+			t.Errorf("Expected %s to be handled, got %s", expected, line)
+		}
+	}
+	<-pushed
+	if v := deadQueueMetric.Get("blocked"); v == nil || v.String() != "1" {
+		t.Errorf("Expected the subscriber to be blocked once, got %v", v)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+)
+
+/*
+ * Failure codes: the reasons of the failed probes, classified for the
+ * aggregations (metrics, events, history). The reason keeps the details,
+ * e.g. the "timeout" code for the "ttfb" or "deadline (tls)" reasons.
+ */
+const (
+	CODE_DNS           = "dns"
+	CODE_CONNECT       = "connect"
+	CODE_TLS           = "tls"
+	CODE_TIMEOUT       = "timeout"
+	CODE_5XX           = "5xx"
+	CODE_BODY_MISMATCH = "body_mismatch"
+	CODE_REDIRECT      = "redirect"
+	CODE_PLUGIN        = "plugin"
+	CODE_OTHER         = "other"
+)
+
+/*
+ * Returns the failure code of the reason of a failed probe (empty for a
+ * passed one)
+ */
+func reasonCode(reason string) string {
+	switch {
+	case reason == "":
+		return ""
+	case reason == "dns":
+		return CODE_DNS
+	case reason == "connect refused", reason == "connection error":
+		return CODE_CONNECT
+	case reason == "tls", reason == "certificate expiring":
+		return CODE_TLS
+	case reason == "timeout", reason == "ttfb",
+		strings.HasPrefix(reason, "deadline"):
+		return CODE_TIMEOUT
+	case len(reason) == 3 && reason[0] == '5' && isNumber(reason):
+		return CODE_5XX
+	case reason == "body mismatch":
+		return CODE_BODY_MISMATCH
+	case reason == "redirect loop", reason == "too many redirects":
+		return CODE_REDIRECT
+	case reason == "plugin error":
+		return CODE_PLUGIN
+	}
+	return CODE_OTHER
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReasonCode(t *testing.T) {
+	for reason, code := range map[string]string{
+		"":                     "",
+		"dns":                  CODE_DNS,
+		"connect refused":      CODE_CONNECT,
+		"connection error":     CODE_CONNECT,
+		"tls":                  CODE_TLS,
+		"certificate expiring": CODE_TLS,
+		"timeout":              CODE_TIMEOUT,
+		"ttfb":                 CODE_TIMEOUT,
+		"deadline (tls)":       CODE_TIMEOUT,
+		"502":                  CODE_5XX,
+		"body mismatch":        CODE_BODY_MISMATCH,
+		"redirect loop":        CODE_REDIRECT,
+		"plugin error":         CODE_PLUGIN,
+		"404":                  CODE_OTHER,
+	} {
+		if c := reasonCode(reason); c != code {
+			t.Errorf("Expected %q to be %q, got %q", reason, code, c)
+		}
+	}
+}
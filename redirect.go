@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Number of redirects followed by default
+const MAX_REDIRECTS = 5
+
+var maxRedirects = MAX_REDIRECTS
+
+/*
+ * A redirect chain which cannot end: a loop, or more than -max_redirects
+ * redirects
+ */
+type redirectError struct {
+	reason string
+	msg    string
+}
+
+func (e *redirectError) Error() string {
+	return e.msg
+}
+
+func isRedirect(code int) bool {
+	switch code {
+	case 301, 302, 303, 307, 308:
+		return true
+	}
+	return false
+}
+
+/*
+ * Follows the redirects of a response, as the frontends following them
+ * would. The probe ends on the first response which is not a redirect.
+ */
+func followRedirects(t http.RoundTripper,
+	resp *http.Response) (*http.Response, error) {
+	visited := map[string]bool{resp.Request.URL.String(): true}
+	for depth := 0; isRedirect(resp.StatusCode); depth++ {
+		location, err := resp.Location()
+		if err != nil {
+			// Nowhere to go, the redirect is the response
+			return resp, nil
+		}
+		resp.Body.Close()
+		if visited[location.String()] == true {
+			return nil, &redirectError{"redirect loop",
+				fmt.Sprintf("Redirect loop on %s", location)}
+		}
+		if depth >= maxRedirects {
+			return nil, &redirectError{"too many redirects",
+				fmt.Sprintf("More than %d redirects", maxRedirects)}
+		}
+		visited[location.String()] = true
+		req := resp.Request.Clone(resp.Request.Context())
+		if resp.StatusCode == 303 && req.Method != "HEAD" {
+			req.Method = "GET"
+		}
+		if location.Host != req.URL.Host {
+			// Our Host header and credentials are for the backend only
+			req.Host = ""
+			req.Header.Del("Authorization")
+		}
+		req.URL = location
+		if resp, err = t.RoundTrip(req); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFollowRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/CloudHealthCheck", http.RedirectHandler("/a", 302))
+	mux.Handle("/a", http.RedirectHandler("/b", 301))
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	})
+	mux.Handle("/loop", http.RedirectHandler("/loop2", 302))
+	mux.Handle("/loop2", http.RedirectHandler("/loop", 302))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	httpUri = "/CloudHealthCheck"
+	defer func() { httpUri = "" }()
+	check := &Check{BackendUrl: srv.URL, FrontendKey: "www.foo.com"}
+	if check.checkStatus() == false {
+		t.Error("Expected the redirect not to be followed by default")
+	}
+	frontendConfigs = map[string]*FrontendConfig{
+		"www.foo.com": {FollowRedirects: true}}
+	defer func() { frontendConfigs = make(map[string]*FrontendConfig) }()
+	if check.checkStatus() == true || check.lastReason != "500" {
+		t.Errorf("Expected the final response to fail, got %q",
+			check.lastReason)
+	}
+	maxRedirects = 1
+	defer func() { maxRedirects = MAX_REDIRECTS }()
+	if check.checkStatus() == true || check.lastReason != "too many redirects" {
+		t.Errorf("Expected too many redirects, got %q", check.lastReason)
+	}
+	maxRedirects = MAX_REDIRECTS
+	httpUri = "/loop"
+	if check.checkStatus() == true || check.lastReason != "redirect loop" {
+		t.Errorf("Expected a redirect loop, got %q", check.lastReason)
+	}
+}
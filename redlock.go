@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// Locking strategies: the locks are kept on hchecker's Redis, or on a
+	// majority of independent Redis nodes (Redlock)
+	LOCK_REDIS   = "redis"
+	LOCK_REDLOCK = "redlock"
+	// A Redlock node not answering within 1 second is skipped
+	REDLOCK_TIMEOUT = 1
+)
+
+var (
+	lockStrategy    = LOCK_REDIS
+	redlockNodes    string
+	redlockPassword string
+)
+
+/*
+ * Returns a pool per Redlock node
+ */
+func newRedlockPools() []*redis.Pool {
+	var pools []*redis.Pool
+	for _, address := range strings.Split(redlockNodes, ",") {
+		address := strings.TrimSpace(address)
+		pools = append(pools, newPool(func() (redis.Conn, error) {
+			timeout := time.Duration(REDLOCK_TIMEOUT) * time.Second
+			return redis.Dial("tcp", address,
+				redis.DialConnectTimeout(timeout),
+				redis.DialReadTimeout(timeout),
+				redis.DialWriteTimeout(timeout),
+				redis.DialPassword(getSecret(redlockPassword,
+					redlockPasswordFile)))
+		}))
+	}
+	return pools
+}
+
+/*
+ * Returns the Redis nodes holding the locks
+ */
+func (c *Cache) lockNodes() []*redis.Pool {
+	if len(c.redlockPools) > 0 {
+		return c.redlockPools
+	}
+	return []*redis.Pool{c.metaPool}
+}
+
+/*
+ * Runs the lock script on every node. The backend is locked once a majority
+ * of the nodes gave us the same lock field, the fields taken on the other
+ * nodes are released. Same results as the lock script: the locked field, ""
+ * if the backend is already ours, or ErrNil if someone else checks it.
+ * Unlike the original algorithm, the locks do not expire: they are released
+ * by their owner or purged when the instance restarts.
+ */
+func (c *Cache) redlock(backendUrl, syncKey, sig string) (string, error) {
+	fields := make([]*string, len(c.redlockPools))
+	votes := make(map[string]int)
+	failures := 0
+	for i, pool := range c.redlockPools {
+		conn := pool.Get()
+		field, err := redis.String(lockScript.Do(conn, c.redisKey,
+			backendUrl, syncKey, sig, redundancy))
+		conn.Close()
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			log.Println(backendUrl, "Cannot lock on a Redlock node:",
+				err.Error())
+			failures += 1
+			continue
+		}
+		fields[i] = &field
+		votes[field] += 1
+	}
+	quorum := len(c.redlockPools)/2 + 1
+	winner := ""
+	won := false
+	for field, n := range votes {
+		if n >= quorum {
+			winner, won = field, true
+		}
+	}
+	// Release what we took outside of the majority
+	for i, field := range fields {
+		if field == nil || *field == "" || (won && *field == winner) {
+			continue
+		}
+		conn := c.redlockPools[i].Get()
+		unlockScript.Do(conn, c.redisKey, *field, syncKey, sig)
+		conn.Close()
+	}
+	if won == true {
+		return winner, nil
+	}
+	if failures >= quorum {
+		return "", errors.New("No majority of Redlock nodes reachable")
+	}
+	return "", redis.ErrNil
+}
+
+/*
+ * Whether a majority of the nodes still hold our lock
+ */
+func (c *Cache) redlockHeld(check *Check) bool {
+	held := 0
+	for _, pool := range c.redlockPools {
+		conn := pool.Get()
+		sig, err := redis.String(conn.Do("HGET", c.redisKey, check.lockField))
+		conn.Close()
+		if err != nil && err != redis.ErrNil {
+			// A node failing doesn't mean we lost the lock on it
+			redisErrorsMetric.Add("lock_check", 1)
+			logError(check.BackendUrl, "Cannot check the lock:", err.Error())
+			held += 1
+		} else if sig == check.routineSig {
+			held += 1
+		}
+	}
+	return held >= len(c.redlockPools)/2+1
+}
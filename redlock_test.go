@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+/*
+ * Returns 3 Redlock nodes and a cache using them
+ */
+func setupRedlock(t *testing.T) ([]*fakeRedis, *Cache) {
+	_, cache := setupCache(t)
+	nodes := []*fakeRedis{newFakeRedis(), newFakeRedis(), newFakeRedis()}
+	for _, node := range nodes {
+		cache.redlockPools = append(cache.redlockPools, node.pool())
+	}
+	return nodes, cache
+}
+
+func TestRedlockLockBackend(t *testing.T) {
+	nodes, cache := setupRedlock(t)
+	// One node lost our lock and has been taken by someone else
+	nodes[2].hashes["hchecker"] = map[string]string{
+		"http://10.0.0.1:80": "other#1;1.1"}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	if locked, _ := cache.LockBackend(check); locked == false {
+		t.Fatal("Expected to lock the backend on a majority of nodes")
+	}
+	for _, node := range nodes[:2] {
+		if sig := node.hashes["hchecker"]["http://10.0.0.1:80"]; sig != check.routineSig {
+			t.Errorf("Expected the lock to hold %q, got %q", check.routineSig, sig)
+		}
+	}
+	if cache.IsUnlockedBackend(check) == true {
+		t.Error("Expected the lock to be held")
+	}
+	nodes[0].hashes["hchecker"]["http://10.0.0.1:80"] = "other#1;1.1"
+	if cache.IsUnlockedBackend(check) == false {
+		t.Error("Expected the lock to be lost with the majority")
+	}
+	cache.UnlockBackend(check)
+	if _, exists := nodes[1].hashes["hchecker"]["http://10.0.0.1:80"]; exists {
+		t.Error("Expected the lock to be removed")
+	}
+}
+
+func TestRedlockMinority(t *testing.T) {
+	nodes, cache := setupRedlock(t)
+	for _, node := range nodes[1:] {
+		node.hashes["hchecker"] = map[string]string{
+			"http://10.0.0.1:80": "other#1;1.1"}
+	}
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	if locked, _ := cache.LockBackend(check); locked == true {
+		t.Fatal("Expected the backend to be locked by someone else")
+	}
+	// The lock taken on the first node is released
+	if len(nodes[0].hashes["hchecker"]) != 0 {
+		t.Errorf("Expected no lock left, got %v", nodes[0].hashes["hchecker"])
+	}
+	if cache.mapping.Len() != 0 {
+		t.Error("Expected the backend not to be mapped")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Interval between the compactions of the history
+const HISTORY_COMPACT_INTERVAL = time.Hour
+
+var (
+	// Events kept for each backend, the oldest are removed
+	historyMax = HISTORY_MAX
+	// Age of the events compacted into hourly aggregates, 0 = never
+	historyRaw time.Duration
+	// Age of the removed events and aggregates, 0 = kept forever
+	historyRetention time.Duration
+)
+
+/*
+ * Probe results and transitions of a backend during an hour
+ */
+type historyAggregate struct {
+	Hour       int64          `json:"hour"`
+	BackendUrl string         `json:"backend_url"`
+	Passed     int            `json:"passed"`
+	Failed     int            `json:"failed"`
+	Dead       int            `json:"dead"`
+	Alive      int            `json:"alive"`
+	LatencyMs  float64        `json:"latency_ms"`
+	Reasons    map[string]int `json:"reasons,omitempty"`
+	Codes      map[string]int `json:"codes,omitempty"`
+}
+
+/*
+ * Adds an event to the aggregate, the latency is the average of the probes
+ */
+func (a *historyAggregate) add(event *Event) {
+	switch event.Type {
+	case EVENT_PASSED, EVENT_FAILED:
+		probes := float64(a.Passed + a.Failed)
+		a.LatencyMs = (a.LatencyMs*probes + event.LatencyMs) / (probes + 1)
+		if event.Type == EVENT_PASSED {
+			a.Passed += 1
+			return
+		}
+		a.Failed += 1
+		if a.Reasons == nil {
+			a.Reasons = make(map[string]int)
+		}
+		a.Reasons[event.Reason] += 1
+		if event.Code != "" {
+			if a.Codes == nil {
+				a.Codes = make(map[string]int)
+			}
+			a.Codes[event.Code] += 1
+		}
+	case EVENT_DEAD:
+		a.Dead += 1
+	case EVENT_ALIVE:
+		a.Alive += 1
+	}
+}
+
+func (a *historyAggregate) merge(b *historyAggregate) {
+	probes, other := float64(a.Passed+a.Failed), float64(b.Passed+b.Failed)
+	if probes+other > 0 {
+		a.LatencyMs = (a.LatencyMs*probes + b.LatencyMs*other) /
+			(probes + other)
+	}
+	a.Passed += b.Passed
+	a.Failed += b.Failed
+	a.Dead += b.Dead
+	a.Alive += b.Alive
+	for reason, n := range b.Reasons {
+		if a.Reasons == nil {
+			a.Reasons = make(map[string]int)
+		}
+		a.Reasons[reason] += n
+	}
+	for code, n := range b.Codes {
+		if a.Codes == nil {
+			a.Codes = make(map[string]int)
+		}
+		a.Codes[code] += n
+	}
+}
+
+func (c *Cache) hourlyHistoryKey(backendUrl string) string {
+	return c.metaKey("history_hourly:" + backendUrl)
+}
+
+/*
+ * Compacts the events of a backend older than a time into hourly
+ * aggregates, then removes the events and aggregates older than the
+ * retention (zero time = kept forever)
+ */
+func (c *Cache) CompactHistory(backendUrl string, before, expired time.Time) error {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	key, hourlyKey := c.historyKey(backendUrl), c.hourlyHistoryKey(backendUrl)
+	aggregates := make(map[int64]*historyAggregate)
+	if !before.IsZero() {
+		// Only whole hours are compacted
+		before = before.Truncate(time.Hour)
+		values, err := redis.Strings(conn.Do("ZRANGEBYSCORE", key, "-inf",
+			"("+strconv.FormatInt(before.Unix(), 10)))
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			event := &Event{}
+			if err := json.Unmarshal([]byte(value), event); err != nil {
+				continue
+			}
+			hour := time.Unix(event.Time, 0).Truncate(time.Hour).Unix()
+			a, exists := aggregates[hour]
+			if !exists {
+				a = &historyAggregate{Hour: hour, BackendUrl: backendUrl}
+				aggregates[hour] = a
+			}
+			a.add(event)
+		}
+	}
+	// Merge with the aggregates of the previous compactions, e.g. of the
+	// events recorded by another instance
+	var previous []*historyAggregate
+	if len(aggregates) > 0 {
+		var err error
+		previous, err = c.hourlyHistory(conn, backendUrl, time.Unix(0, 0),
+			before)
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range previous {
+		if a, exists := aggregates[p.Hour]; exists {
+			a.merge(p)
+		}
+	}
+	conn.Send("MULTI")
+	if len(aggregates) > 0 {
+		conn.Send("ZREMRANGEBYSCORE", key, "-inf",
+			"("+strconv.FormatInt(before.Unix(), 10))
+	}
+	for hour, a := range aggregates {
+		data, _ := json.Marshal(a)
+		conn.Send("ZREMRANGEBYSCORE", hourlyKey, hour, hour)
+		conn.Send("ZADD", hourlyKey, hour, data)
+	}
+	if !expired.IsZero() {
+		bound := "(" + strconv.FormatInt(expired.Unix(), 10)
+		conn.Send("ZREMRANGEBYSCORE", key, "-inf", bound)
+		conn.Send("ZREMRANGEBYSCORE", hourlyKey, "-inf", bound)
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+	// Forget the backends without any history left
+	conn.Send("ZCARD", key)
+	conn.Send("ZCARD", hourlyKey)
+	conn.Flush()
+	n, _ := redis.Int(conn.Receive())
+	m, _ := redis.Int(conn.Receive())
+	if n+m > 0 {
+		return nil
+	}
+	_, err := conn.Do("SREM", c.metaKey("history"), backendUrl)
+	return err
+}
+
+func (c *Cache) hourlyHistory(conn redis.Conn, backendUrl string,
+	since, until time.Time) ([]*historyAggregate, error) {
+	values, err := redis.Strings(conn.Do("ZRANGEBYSCORE",
+		c.hourlyHistoryKey(backendUrl), since.Unix(), until.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	aggregates := []*historyAggregate{}
+	for _, value := range values {
+		a := &historyAggregate{}
+		if err := json.Unmarshal([]byte(value), a); err == nil {
+			aggregates = append(aggregates, a)
+		}
+	}
+	return aggregates, nil
+}
+
+/*
+ * Returns the hourly aggregates between two times, of one backend or all
+ * of them (empty backend URL), by hour
+ */
+func (c *Cache) HourlyHistory(backendUrl string, since, until time.Time) ([]*historyAggregate, error) {
+	conn := c.metaPool.Get()
+	defer conn.Close()
+	backends, err := c.historyBackends(conn, backendUrl)
+	if err != nil {
+		return nil, err
+	}
+	aggregates := []*historyAggregate{}
+	for _, backend := range backends {
+		a, err := c.hourlyHistory(conn, backend,
+			since.Truncate(time.Hour), until)
+		if err != nil {
+			return nil, err
+		}
+		aggregates = append(aggregates, a...)
+	}
+	sort.SliceStable(aggregates, func(i, j int) bool {
+		return aggregates[i].Hour < aggregates[j].Hour
+	})
+	return aggregates, nil
+}
+
+/*
+ * Compacts and expires the history of all the backends every hour. A
+ * single instance does it, the one taking the hchecker:history_compaction
+ * lock.
+ */
+func runHistoryCompaction(cache *Cache) {
+	for {
+		if !cache.wait(HISTORY_COMPACT_INTERVAL) {
+			return
+		}
+		locked, err := cache.LockHistoryCompaction()
+		if err != nil {
+			logError("Cannot lock the history compaction:", err.Error())
+			continue
+		}
+		if !locked {
+			continue
+		}
+		var before, expired time.Time
+		if historyRaw > 0 {
+			before = time.Now().Add(-historyRaw)
+		}
+		if historyRetention > 0 {
+			expired = time.Now().Add(-historyRetention)
+		}
+		backends, err := cache.HistoryBackends()
+		if err != nil {
+			logError("Cannot list the backends with a history:", err.Error())
+			continue
+		}
+		for _, backendUrl := range backends {
+			if err := cache.CompactHistory(backendUrl, before, expired); err != nil {
+				logError(backendUrl, "Cannot compact the history:", err.Error())
+			}
+		}
+		log.Println("Compacted the history of", len(backends), "backends")
+	}
+}
+
+/*
+ * Writes the hourly aggregates as a JSON array, or as CSV with a header
+ * line
+ */
+func writeHourlyReport(w io.Writer, aggregates []*historyAggregate,
+	format string) error {
+	if format == REPORT_JSON {
+		return json.NewEncoder(w).Encode(aggregates)
+	}
+	out := csv.NewWriter(w)
+	out.Write([]string{"hour", "backend_url", "passed", "failed", "dead",
+		"alive", "latency_ms"})
+	for _, a := range aggregates {
+		out.Write([]string{
+			time.Unix(a.Hour, 0).UTC().Format(time.RFC3339), a.BackendUrl,
+			strconv.Itoa(a.Passed), strconv.Itoa(a.Failed),
+			strconv.Itoa(a.Dead), strconv.Itoa(a.Alive),
+			strconv.FormatFloat(a.LatencyMs, 'f', 3, 64)})
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+/*
+ * Settings of a Runner, the others are the options (see parseFlags)
+ */
+type RunnerConfig struct {
+	// Name of the instance in the cluster, "HOSTNAME#PID" by default
+	Id string
+}
+
+/*
+ * Lifecycle of the checker: Start subscribes to the dead notifications and
+ * starts the background tasks on the cache, Stop hands off the backends
+ * being checked to the other instances and stops everything started on the
+ * cache. The options and the checks are shared by the process: it has a
+ * single Runner at a time (NewRunner fails meanwhile), which is started once.
+ * Another one can be built once it's stopped.
+ */
+type Runner struct {
+	config RunnerConfig
+	// Replaced by the tests
+	newCache func() (*Cache, error)
+	lock     sync.Mutex
+	cache    *Cache
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+var (
+	// The tasks which are not tied to the cache are started once per process
+	processTasksOnce sync.Once
+	// The Runner of the process, until stopped
+	runnerLock    sync.Mutex
+	currentRunner *Runner
+)
+
+func NewRunner(config RunnerConfig) (*Runner, error) {
+	runnerLock.Lock()
+	defer runnerLock.Unlock()
+	if currentRunner != nil {
+		return nil, errors.New("A Runner already exists in this process, " +
+			"the options and the checks are process-wide")
+	}
+	currentRunner = &Runner{config: config, newCache: NewCache,
+		done: make(chan struct{})}
+	return currentRunner, nil
+}
+
+/*
+ * Lets another Runner be built
+ */
+func releaseRunner(r *Runner) {
+	runnerLock.Lock()
+	defer runnerLock.Unlock()
+	if currentRunner == r {
+		currentRunner = nil
+	}
+}
+
+/*
+ * Starts checking. Returns once running, the Runner is stopped when the
+ * context is done or by Stop.
+ */
+func (r *Runner) Start(ctx context.Context) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cache != nil {
+		return errors.New("The checker is already started")
+	}
+	runnerLock.Lock()
+	stopped := currentRunner != r
+	runnerLock.Unlock()
+	if stopped {
+		return errors.New("The checker is stopped")
+	}
+	myId = r.config.Id
+	if myId == "" {
+		hostname, _ := os.Hostname()
+		myId = fmt.Sprintf("%s#%d", hostname, os.Getpid())
+	}
+	c, err := r.newCache()
+	if err != nil {
+		return err
+	}
+	cache = c
+	c.ClearMetadata()
+	if err := startIntake(c); err != nil {
+		c.Close()
+		return err
+	}
+	r.cache = c
+	startTasks(c)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Stop()
+		case <-r.done:
+		}
+	}()
+	return nil
+}
+
+/*
+ * Stops checking, and hands off the backends to the other instances.
+ * Returns once the subscriptions, the consumers and the check loops
+ * returned.
+ */
+func (r *Runner) Stop() {
+	r.lock.Lock()
+	c := r.cache
+	if c == nil {
+		// Never started
+		releaseRunner(r)
+	}
+	r.lock.Unlock()
+	if c == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		c.Close()
+		// No notification is handled afterwards
+		c.WaitListeners()
+		if q := deadQueue; q != nil {
+			q.Stop()
+		}
+		handOff()
+		// Their exit callbacks use the cache, which the next Runner replaces
+		checkLoops.Wait()
+		close(r.done)
+		releaseRunner(r)
+	})
+}
+
+/*
+ * Closed once the Runner is stopped
+ */
+func (r *Runner) Done() <-chan struct{} {
+	return r.done
+}
+
+/*
+ * Subscribes to the dead notifications, or consumes them from -dead_list or
+ * -dead_stream, and to the channels of the cluster
+ */
+func startIntake(cache *Cache) error {
+	var err error
+	if deadList != "" {
+		cache.ConsumeList(deadList, handleDeadNotification)
+	} else if deadStream != "" {
+		err = cache.ConsumeStream(deadStream, handleDeadNotification)
+		if err != nil {
+			return fmt.Errorf("Cannot consume the stream %s: %s", deadStream,
+				err)
+		}
+	} else {
+		// The subscriber only queues the notifications
+		deadQueue = newNotificationQueue(queueSize, queuePolicy,
+			handleDeadNotification)
+		go deadQueue.Run()
+		err = cache.ListenToChannel(deadChannel, deadQueue.Push)
+		if err != nil {
+			return err
+		}
+	}
+	if keyspaceEvents == true {
+		if err := cache.EnableKeyspaceEvents(); err != nil {
+			log.Println("Cannot enable the keyspace notifications, make sure",
+				"notify-keyspace-events includes \"Klg\":", err.Error())
+		}
+		err = cache.ListenToKeyspace("frontend:*", refreshFrontend)
+		if err != nil {
+			return err
+		}
+	}
+	if lockEvents == true {
+		if err := cache.EnableLockEvents(); err != nil {
+			log.Println("Cannot enable the keyspace notifications, make sure",
+				"notify-keyspace-events of hchecker's Redis includes \"Kgh\":",
+				err.Error())
+		}
+		if err = cache.WatchLocks(); err != nil {
+			return err
+		}
+	}
+	err = cache.ListenToMetaChannel(cache.metaKey("handoff"), takeOver)
+	if err != nil {
+		return err
+	}
+	if quorum > 1 {
+		err = cache.ListenToMetaChannel(cache.metaKey("suspect"),
+			confirmSuspect)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Starts the background tasks, the ones using the cache stop once it's
+ * closed
+ */
+func startTasks(cache *Cache) {
+	processTasksOnce.Do(func() {
+		go runWatchdog()
+		if adminAddress != "" {
+			startAdmin()
+		}
+		if len(sinks) > 0 {
+			go runSinks()
+		}
+		if dockerAddress != "" {
+			go watchDocker()
+		}
+	})
+	go watchPause(cache)
+	if seppukuTimeout > 0 {
+		go watchRedis(cache)
+	}
+	if stateExportInterval > 0 && dryRun == false {
+		go exportState(cache)
+	}
+	if loadInterval > 0 && dryRun == false {
+		go reportLoad(cache)
+	}
+	if janitorInterval > 0 {
+		go runJanitor(cache)
+	}
+	if k8sServices != "" {
+		go watchKubernetes(cache)
+	}
+	if historyEnabled == true && dryRun == false {
+		go runHistoryCompaction(cache)
+	}
+	if staleSubscriptionTimeout > 0 {
+		go watchSubscriptions(cache)
+	}
+	if len(tlsFilenames()) > 0 {
+		go watchTLS(cache)
+	}
+	if getVaultAddr() != "" && vaultInterval > 0 {
+		go watchVault(cache)
+	}
+	if redisSRV != "" && redisSRVInterval > 0 {
+		go watchRedisSRV(cache)
+	} else if len(redisAddresses) > 1 {
+		go watchRedisFailover(cache)
+	}
+	if dryRun == false {
+		// In dry run mode, we don't announce our presence
+		go runHeartbeat(cache)
+	}
+	// Prints the stats every minute
+	go printStats(cache)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunner(t *testing.T) {
+	r, c := setupCache(t)
+	defer func() {
+		cache = nil
+		// The subscription failed, there's no Redis to dial
+		lastErrorLock.Lock()
+		lastError = ""
+		lastErrorLock.Unlock()
+		watchedChecks = make(map[*Check]*backendController)
+		runningCheckers = 0
+	}()
+	runner, err := NewRunner(RunnerConfig{Id: "host#2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRunner(RunnerConfig{Id: "host#3"}); err == nil {
+		t.Error("Expected a second Runner to be refused")
+	}
+	runner.newCache = func() (*Cache, error) { return c, nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := runner.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if myId != "host#2" || cache != c {
+		t.Errorf("Expected the runner to be set up, got %q", myId)
+	}
+	if err := runner.Start(ctx); err == nil {
+		t.Error("Expected a second start to fail")
+	}
+	// The heartbeat is written right away
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.lock.Lock()
+		_, alive := r.strings["hchecker:alive:host#2"]
+		r.lock.Unlock()
+		if alive {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the heartbeat to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	check := newTestCheck(t, "www.foo.com;"+srv.URL+";0;2")
+	r.lock.Lock()
+	r.lists["frontend:www.foo.com"] = []string{"www", srv.URL, "http://10.0.0.2:80"}
+	r.lock.Unlock()
+	locked, ctl := c.LockBackend(check)
+	if !locked {
+		t.Fatal("Expected to lock the backend")
+	}
+	// Waiting for the next cycle
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	checkInterval = time.Hour
+	defer func() { checkInterval = time.Duration(CHECK_INTERVAL) * time.Second }()
+	running := runningCheckers
+	startCheckLoop(check, ctl)
+	waitFor(t, "the first probe", func() bool {
+		return atomic.LoadInt64(&check.probes) == 1
+	})
+	// Stopped with its context
+	cancel()
+	select {
+	case <-runner.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the runner to stop")
+	}
+	if !c.isClosed() {
+		t.Error("Expected the cache to be closed")
+	}
+	if atomic.LoadInt32(&check.stopped) != 1 || len(watchedChecks) != 0 {
+		t.Error("Expected the check to be stopped")
+	}
+	// Before the next Runner replaces the cache
+	if runningCheckers != running-1 {
+		t.Error("Expected the check loop to exit")
+	}
+	select {
+	case <-deadQueue.stopped:
+	default:
+		t.Error("Expected the queue of the dead notifications to be stopped")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.hashes["hchecker"][srv.URL]; exists {
+		t.Error("Expected the lock of the backend to be released")
+	}
+	if _, alive := r.strings["hchecker:alive:host#2"]; alive {
+		t.Error("Expected the heartbeat to be removed")
+	}
+	// After its alive event
+	if n := len(r.published); n == 0 ||
+		r.published[n-1].channel != "hchecker:handoff" {
+		t.Errorf("Expected the backend to be handed off, got %v", r.published)
+	}
+	// Once stopped, another one can be built
+	if err := runner.Start(context.Background()); err == nil {
+		t.Error("Expected the stopped Runner not to start again")
+	}
+	next, err := NewRunner(RunnerConfig{Id: "host#3"})
+	if err != nil {
+		t.Fatalf("Expected a new Runner once stopped, got %s", err)
+	}
+	next.Stop()
+	if err := next.Start(context.Background()); err == nil {
+		t.Error("Expected a Runner stopped before starting not to start")
+	}
+}
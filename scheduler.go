@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// Maximum number of probes running at the same time (0 = unlimited)
+	maxProbes  int
+	probeSlots = &probeQueue{}
+)
+
+/*
+ * A check waiting for a probe slot
+ */
+type probeWaiter struct {
+	check *Check
+	// Number of frontends using the backend when it started waiting
+	priority int
+	ready    chan struct{}
+}
+
+/*
+ * The check queue: bounds the number of concurrent probes to -max_probes.
+ * When all the slots are taken, the frontends get the free ones in turn, so
+ * the huge backend list of a frontend doesn't starve the others. Within a
+ * frontend, the next slot goes to the backend used by the most frontends
+ * (the most users affected), then to the oldest waiting.
+ */
+type probeQueue struct {
+	lock    sync.Mutex
+	running int
+	waiting []*probeWaiter
+	// Frontends with waiting checks, in their turn order
+	turns []string
+}
+
+/*
+ * Number of frontends using a backend
+ */
+func backendFanout(check *Check) int {
+	if cache == nil {
+		return 0
+	}
+	return cache.mapping.Count(check.BackendUrl)
+}
+
+/*
+ * Waits for a probe slot, to be released once the probe is done
+ */
+func (q *probeQueue) acquire(check *Check) {
+	if maxProbes <= 0 {
+		return
+	}
+	q.lock.Lock()
+	if q.running < maxProbes {
+		q.running += 1
+		q.lock.Unlock()
+		return
+	}
+	w := &probeWaiter{check: check, priority: backendFanout(check),
+		ready: make(chan struct{})}
+	if q.next(check.FrontendKey) == -1 {
+		q.turns = append(q.turns, check.FrontendKey)
+	}
+	q.waiting = append(q.waiting, w)
+	q.lock.Unlock()
+	probeQueueMetric.Add("waiting", 1)
+	probeQueueMetric.Add("queued", 1)
+	// The watchdog must not take a queued check for a stuck one
+	atomic.StoreInt32(&check.queued, 1)
+	<-w.ready
+	atomic.StoreInt32(&check.queued, 0)
+	probeQueueMetric.Add("waiting", -1)
+}
+
+/*
+ * Returns the index of the next check of a frontend to probe, -1 if none is
+ * waiting
+ */
+func (q *probeQueue) next(frontendKey string) int {
+	next := -1
+	for i, w := range q.waiting {
+		if w.check.FrontendKey != frontendKey {
+			continue
+		}
+		if next == -1 || w.priority > q.waiting[next].priority {
+			next = i
+		}
+	}
+	return next
+}
+
+func (q *probeQueue) release() {
+	if maxProbes <= 0 {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.waiting) == 0 {
+		q.running -= 1
+		return
+	}
+	// The slot is handed over to the next check of the frontend whose turn
+	// it is, which goes to the end of the line if it has others waiting
+	frontendKey := q.turns[0]
+	q.turns = q.turns[1:]
+	next := q.next(frontendKey)
+	w := q.waiting[next]
+	q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+	if q.next(frontendKey) != -1 {
+		q.turns = append(q.turns, frontendKey)
+	}
+	close(w.ready)
+}
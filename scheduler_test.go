@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+ * Waits until n checks are waiting for a probe slot
+ */
+func waitQueued(t *testing.T, q *probeQueue, n int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		q.lock.Lock()
+		queued := len(q.waiting)
+		q.lock.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected %d checks waiting for a probe slot", n)
+}
+
+func TestProbeQueuePriority(t *testing.T) {
+	_, c := setupCache(t)
+	cache = c
+	maxProbes = 1
+	defer func() {
+		cache, maxProbes = nil, 0
+	}()
+	c.mapping.Add("http://10.0.0.2:80", "www.foo.com", 0)
+	for id, frontendKey := range []string{"www.foo.com", "www.bar.com",
+		"www.baz.com"} {
+		c.mapping.Add("http://10.0.0.3:80", frontendKey, id)
+	}
+	for id, frontendKey := range []string{"www.foo.com", "www.bar.com"} {
+		c.mapping.Add("http://10.0.0.4:80", frontendKey, id)
+	}
+	q := &probeQueue{}
+	q.acquire(&Check{BackendUrl: "http://10.0.0.1:80"})
+	probed := make(chan string)
+	for i, backend := range []string{"http://10.0.0.2:80",
+		"http://10.0.0.3:80", "http://10.0.0.4:80"} {
+		check := &Check{BackendUrl: backend}
+		go func() {
+			q.acquire(check)
+			probed <- check.BackendUrl
+		}()
+		waitQueued(t, q, i+1)
+	}
+	q.release()
+	// The most frontends first, even though it was queued after
+	for _, expected := range []string{"http://10.0.0.3:80",
+		"http://10.0.0.4:80", "http://10.0.0.2:80"} {
+		if backend := <-probed; backend != expected {
+			t.Errorf("Expected %s to be probed, got %s", expected, backend)
+		}
+		q.release()
+	}
+	if q.running != 0 || len(q.waiting) != 0 {
+		t.Errorf("Expected the queue to be empty, got %d running and %d "+
+			"waiting", q.running, len(q.waiting))
+	}
+}
+
+func TestProbeQueueFairness(t *testing.T) {
+	maxProbes = 1
+	defer func() {
+		maxProbes = 0
+	}()
+	q := &probeQueue{}
+	q.acquire(&Check{BackendUrl: "http://10.0.0.1:80"})
+	probed := make(chan string)
+	lines := []string{
+		// A big frontend in trouble, then a small one
+		"www.foo.com;http://10.0.0.2:80;0;3",
+		"www.foo.com;http://10.0.0.3:80;1;3",
+		"www.foo.com;http://10.0.0.4:80;2;3",
+		"www.bar.com;http://10.0.0.5:80;0;2",
+	}
+	for i, line := range lines {
+		check := newTestCheck(t, line)
+		go func() {
+			q.acquire(check)
+			probed <- check.BackendUrl
+		}()
+		waitQueued(t, q, i+1)
+	}
+	q.release()
+	for _, expected := range []string{"http://10.0.0.2:80",
+		"http://10.0.0.5:80", "http://10.0.0.3:80", "http://10.0.0.4:80"} {
+		if backend := <-probed; backend != expected {
+			t.Errorf("Expected %s to be probed, got %s", expected, backend)
+		}
+		q.release()
+	}
+	if len(q.turns) != 0 {
+		t.Errorf("Expected no frontend waiting, got %v", q.turns)
+	}
+}
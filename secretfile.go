@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// A secret file is looked at again at most every 5 seconds
+	SECRET_FILE_INTERVAL = 5
+)
+
+var (
+	redisPasswordFile     string
+	metaRedisPasswordFile string
+	redlockPasswordFile   string
+
+	secretFiles     = make(map[string]*secretFile)
+	secretFilesLock sync.Mutex
+)
+
+/*
+ * The last value read from a secret file
+ */
+type secretFile struct {
+	value   string
+	modTime time.Time
+	size    int64
+	// Last time the file was looked at
+	checked time.Time
+}
+
+/*
+ * Returns the content of a file holding a secret, without the trailing
+ * newline. The file is read again when it changes, so a rotated secret is
+ * picked up without a restart. If it cannot be read anymore, the last value
+ * is returned along with the error.
+ */
+func readSecretFile(filename string) (string, error) {
+	secretFilesLock.Lock()
+	defer secretFilesLock.Unlock()
+	now := time.Now()
+	f, exists := secretFiles[filename]
+	if exists && now.Sub(f.checked) <
+		time.Duration(SECRET_FILE_INTERVAL)*time.Second {
+		return f.value, nil
+	}
+	info, err := os.Stat(filename)
+	if err == nil && exists && info.ModTime().Equal(f.modTime) &&
+		info.Size() == f.size {
+		f.checked = now
+		return f.value, nil
+	}
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		if exists {
+			f.checked = now
+			return f.value, err
+		}
+		return "", err
+	}
+	if !exists {
+		f = &secretFile{}
+		secretFiles[filename] = f
+	}
+	f.value = strings.TrimRight(string(data), "\r\n")
+	f.modTime, f.size, f.checked = info.ModTime(), info.Size(), now
+	return f.value, nil
+}
+
+/*
+ * Returns the secret read from a file if one is given, from Vault if the
+ * value is a Vault reference (see vault.go), the value otherwise
+ */
+func getSecret(value, filename string) string {
+	if filename != "" {
+		secret, err := readSecretFile(filename)
+		if err != nil {
+			logError("Cannot read secret file", filename+":", err.Error())
+		}
+		return secret
+	}
+	if isVaultRef(value) {
+		secret, err := getVaultSecret(value)
+		if err != nil {
+			logError("Cannot read the Vault secret", value+":", err.Error())
+		}
+		return secret
+	}
+	return value
+}
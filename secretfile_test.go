@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecretFile(t *testing.T) {
+	lastError = ""
+	defer func() {
+		secretFiles = make(map[string]*secretFile)
+		frontendConfigs = make(map[string]*FrontendConfig)
+		lastError = ""
+	}()
+	filename := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(filename, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	frontendConfigs = map[string]*FrontendConfig{
+		"www.foo.com": {Token: "ignored", TokenFile: filename},
+	}
+	authorization := func() string {
+		req, _ := http.NewRequest("GET", "http://10.0.0.1/", nil)
+		getAuthenticator("www.foo.com").Authenticate(req)
+		return req.Header.Get("Authorization")
+	}
+	if a := authorization(); a != "Bearer s3cret" {
+		t.Errorf("Expected the token of the file, got %q", a)
+	}
+	// The rotated secret is picked up once the file is looked at again
+	if err := os.WriteFile(filename, []byte("rotated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if a := authorization(); a != "Bearer s3cret" {
+		t.Errorf("Expected the file not to be read again yet, got %q", a)
+	}
+	secretFiles[filename].checked = time.Time{}
+	if a := authorization(); a != "Bearer rotated" {
+		t.Errorf("Expected the rotated token, got %q", a)
+	}
+	// The last secret is kept if the file disappears
+	os.Remove(filename)
+	secretFiles[filename].checked = time.Time{}
+	if a := authorization(); a != "Bearer rotated" {
+		t.Errorf("Expected the last token, got %q", a)
+	}
+	if lastError == "" {
+		t.Error("Expected the missing secret file to be reported")
+	}
+	_, err := parseFrontendConfigs([]byte(
+		`{"www.bar.com": {"username": "u", "password_file": "/nonexistent"}}`))
+	if err == nil {
+		t.Error("Expected a missing secret file to be rejected")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	SINK_INTERVAL = 10
+	// Events kept while the sinks are unreachable, the next ones are
+	// dropped
+	SINK_BUFFER = 10000
+)
+
+/*
+ * External metrics system receiving the probe results and the state
+ * transitions by batches
+ */
+type sink interface {
+	Send(events []*Event) error
+	String() string
+}
+
+var (
+	sinkInterval time.Duration
+	sinks        []sink
+	sinkQueue    []*Event
+	sinkLock     sync.Mutex
+)
+
+func queueSinkEvent(event *Event) {
+	if len(sinks) == 0 {
+		return
+	}
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	if len(sinkQueue) >= SINK_BUFFER {
+		sinksMetric.Add("dropped", 1)
+		return
+	}
+	sinkQueue = append(sinkQueue, event)
+}
+
+/*
+ * Sends the queued events to the sinks every -sink_interval
+ */
+func runSinks() {
+	for {
+		time.Sleep(sinkInterval)
+		flushSinks()
+	}
+}
+
+func flushSinks() {
+	sinkLock.Lock()
+	batch := sinkQueue
+	sinkQueue = nil
+	sinkLock.Unlock()
+	// Even empty, some sinks send the counters
+	for _, s := range sinks {
+		if err := s.Send(batch); err != nil {
+			sinksMetric.Add("errors", 1)
+			logError("Cannot send", len(batch), "events to", s.String()+":",
+				err.Error())
+			continue
+		}
+		sinksMetric.Add("sent", int64(len(batch)))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+var (
+	// Local IP address or interface of the probes (see -source)
+	sourceAddress string
+	sourceIPs     []net.IP
+)
+
+/*
+ * Returns the local addresses of -source: the IP address itself, or the
+ * addresses of the interface
+ */
+func resolveSource(source string) ([]net.IP, error) {
+	if ip := net.ParseIP(source); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	iface, err := net.InterfaceByName(source)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither an IP address nor an interface",
+			source)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok &&
+			!ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("No usable address on interface %q", source)
+	}
+	return ips, nil
+}
+
+/*
+ * Binds a probe socket to the source address of its address family, before
+ * it connects
+ */
+func bindSource(network, address string, rc syscall.RawConn) error {
+	if !strings.HasPrefix(network, "tcp") {
+		// Unix sockets
+		return nil
+	}
+	var sa syscall.Sockaddr
+	for _, ip := range sourceIPs {
+		if ip4 := ip.To4(); ip4 != nil && network == "tcp4" {
+			sa4 := &syscall.SockaddrInet4{}
+			copy(sa4.Addr[:], ip4)
+			sa = sa4
+			break
+		} else if ip4 == nil && network == "tcp6" {
+			sa6 := &syscall.SockaddrInet6{}
+			copy(sa6.Addr[:], ip)
+			sa = sa6
+			break
+		}
+	}
+	if sa == nil {
+		return fmt.Errorf("No %s source address on %q to reach %s",
+			network, sourceAddress, address)
+	}
+	var err error
+	ctrlErr := rc.Control(func(fd uintptr) {
+		err = syscall.Bind(int(fd), sa)
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
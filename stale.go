@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+var staleSubscriptionTimeout time.Duration
+
+/*
+ * Catches the subscriptions silently dead (e.g. a half-open connection
+ * after a network failure): every -stale_subscription seconds, each
+ * subscription is pinged. The ones which got neither a pong nor a message
+ * since the previous round are subscribed again, provided the dead sets
+ * changed meanwhile (Redis is alive and Hipache is flagging backends).
+ */
+func watchSubscriptions(cache *Cache) {
+	var pinged time.Time
+	digest, _ := cache.DeadSetsDigest()
+	for {
+		if !cache.wait(staleSubscriptionTimeout) {
+			return
+		}
+		last := digest
+		var err error
+		if digest, err = cache.DeadSetsDigest(); err != nil {
+			logError("Cannot read the dead sets:", err.Error())
+		} else if !pinged.IsZero() && digest != last {
+			for _, channel := range cache.CloseStaleSubscriptions(pinged) {
+				log.Printf("Nothing received on %q for %s while the dead "+
+					"sets changed, subscribing again", channel,
+					time.Since(pinged))
+				staleSubscriptionsMetric.Add(1)
+			}
+		}
+		pinged = time.Now()
+		cache.PingSubscriptions()
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	dumpFile            string
+	stateExportInterval time.Duration
+)
+
+type checkState struct {
+	BackendUrl string
+	LockField  string
+	Signature  string
+	LastCycle  time.Time
+	Restarts   int32
+	Probes     int64
+	Failures   int64
+	Alive      bool
+	LatencyMs  float64
+}
+
+type channelState struct {
+	Messages int64
+	Errors   int64
+}
+
+type state struct {
+	Instance        string
+	Time            time.Time
+	DryRun          bool
+	Draining        bool
+	RunningCheckers int
+	Goroutines      int
+	// -> map[BACKEND_URL][FRONTEND_NAME] = BACKEND_ID
+	Backends map[string]map[string]int
+	Checks   []checkState
+	Channels map[string]channelState
+}
+
+/*
+ * Takes a snapshot of the internal state
+ */
+func getState(cache *Cache) *state {
+	s := &state{
+		Instance:        myId,
+		Time:            time.Now(),
+		DryRun:          dryRun,
+		Draining:        isDraining(),
+		RunningCheckers: runningCheckers,
+		Goroutines:      runtime.NumGoroutine(),
+		Backends:        cache.mapping.All(),
+		Channels:        make(map[string]channelState),
+	}
+	watchedLock.Lock()
+	for check := range watchedChecks {
+		s.Checks = append(s.Checks, checkState{
+			BackendUrl: check.BackendUrl,
+			LockField:  check.lockField,
+			Signature:  check.routineSig,
+			LastCycle:  time.Unix(0, atomic.LoadInt64(&check.lastCycle)),
+			Restarts:   atomic.LoadInt32(&check.generation),
+			Probes:     atomic.LoadInt64(&check.probes),
+			Failures:   atomic.LoadInt64(&check.failures),
+			Alive:      atomic.LoadInt32(&check.lastStatus) == 1,
+			LatencyMs: float64(atomic.LoadInt64(&check.lastLatency)) /
+				float64(time.Millisecond),
+		})
+	}
+	watchedLock.Unlock()
+	cache.statsLock.Lock()
+	for channel, n := range cache.channelMessages {
+		s.Channels[channel] = channelState{Messages: n,
+			Errors: cache.channelErrors[channel]}
+	}
+	for channel, n := range cache.channelErrors {
+		if _, exists := s.Channels[channel]; !exists {
+			s.Channels[channel] = channelState{Errors: n}
+		}
+	}
+	cache.statsLock.Unlock()
+	return s
+}
+
+/*
+ * Dumps the internal state as JSON to the log or to the -dump_file
+ */
+func dumpState(cache *Cache) {
+	data, err := json.MarshalIndent(getState(cache), "", "  ")
+	if err != nil {
+		log.Println("Cannot dump the state:", err)
+		return
+	}
+	if dumpFile == "" {
+		log.Printf("State dump:\n%s", data)
+		return
+	}
+	if err := ioutil.WriteFile(dumpFile, data, 0644); err != nil {
+		log.Println("Cannot dump the state:", err)
+		return
+	}
+	log.Printf("State dumped to \"%s\"", dumpFile)
+}
+
+/*
+ * Writes the state to Redis at a regular interval, so it can be read
+ * without querying the process
+ */
+func exportState(cache *Cache) {
+	for {
+		data, err := json.Marshal(getState(cache))
+		if err != nil {
+			log.Println("Cannot export the state:", err)
+		} else {
+			// Let the key expire if we stop refreshing it
+			cache.SaveState(data, 3*stateExportInterval)
+		}
+		if !cache.wait(stateExportInterval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDumpState(t *testing.T) {
+	_, c := setupCache(t)
+	dumpFile = filepath.Join(t.TempDir(), "state.json")
+	defer func() { dumpFile = "" }()
+	check := newTestCheck(t, "www.foo.com;http://10.0.0.1:80;0;2")
+	c.LockBackend(check)
+	check.probes, check.failures = 3, 1
+	watchCheck(check, nil)
+	defer unwatchCheck(check)
+	c.channelMessages["dead"], c.channelErrors["dead"] = 5, 1
+	dumpState(c)
+	data, err := os.ReadFile(dumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatalf("Expected the state as JSON, got %s (%s)", data, err)
+	}
+	if s.Instance != "host#1" || s.Backends["http://10.0.0.1:80"]["www.foo.com"] != 0 ||
+		len(s.Backends) != 1 {
+		t.Errorf("Unexpected state %+v", s)
+	}
+	if len(s.Checks) != 1 || s.Checks[0].Signature != check.routineSig ||
+		s.Checks[0].Probes != 3 || s.Checks[0].Failures != 1 {
+		t.Errorf("Unexpected checks %+v", s.Checks)
+	}
+	if s.Channels["dead"] != (channelState{Messages: 5, Errors: 1}) {
+		t.Errorf("Unexpected channels %+v", s.Channels)
+	}
+}
+
+func TestExportState(t *testing.T) {
+	r, c := setupCache(t)
+	stateExportInterval = time.Hour
+	defer func() { stateExportInterval = 0 }()
+	done := make(chan struct{})
+	go func() {
+		exportState(c)
+		close(done)
+	}()
+	waitFor(t, "the state export", func() bool {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return r.exists("hchecker:state:host#1")
+	})
+	c.Close()
+	<-done
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var s state
+	if err := json.Unmarshal([]byte(r.strings["hchecker:state:host#1"]), &s); err != nil ||
+		s.Instance != "host#1" {
+		t.Errorf("Expected the state of the instance, got %q (%v)",
+			r.strings["hchecker:state:host#1"], err)
+	}
+	// Expires if the instance stops refreshing it
+	if ttl := r.ttls["hchecker:state:host#1"]; ttl != 3*3600 {
+		t.Errorf("Expected a TTL of 3 intervals, got %d", ttl)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Consumer group of the checkers
+	STREAM_GROUP = "hchecker"
+	// Entries read at once, and how long XREADGROUP waits for them
+	// (milliseconds)
+	STREAM_COUNT = 100
+	STREAM_BLOCK = 5000
+	// The entries pending for a minute on a consumer (a stopped instance)
+	// are claimed by the others
+	STREAM_CLAIM_IDLE = 60
+	// The consumers idle for an hour, without pending entries nor
+	// heartbeat, are removed from the group
+	STREAM_CONSUMER_IDLE = 3600
+	// Field of the entries holding the notification
+	STREAM_FIELD = "notification"
+)
+
+var (
+	// Stream of the dead notifications, consumed instead of the dead
+	// channel (empty = pubsub)
+	deadStream  string
+	streamGroup = STREAM_GROUP
+)
+
+type streamEntry struct {
+	id   string
+	line string
+}
+
+/*
+ * Parses the entries of a stream reply, [[id, [field, value...]]...]. The
+ * notification is the "notification" field, or the first one.
+ */
+func parseStreamEntries(reply interface{}) ([]streamEntry, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	var entries []streamEntry
+	for _, v := range values {
+		entry, err := redis.Values(v, nil)
+		if err != nil || len(entry) != 2 {
+			return nil, fmt.Errorf("Invalid stream entry %v", v)
+		}
+		id, err := redis.String(entry[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := redis.Strings(entry[1], nil)
+		if err != nil || len(fields) < 2 {
+			return nil, fmt.Errorf("Invalid stream entry %s", id)
+		}
+		e := streamEntry{id: id, line: fields[1]}
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fields[i] == STREAM_FIELD {
+				e.line = fields[i+1]
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+/*
+ * Creates the consumer group of the checkers, and the stream, if needed.
+ * The group starts with the entries added from now on.
+ */
+func (c *Cache) CreateStreamGroup(stream string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("XGROUP", "CREATE", stream, streamGroup, "$",
+		"MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		// Created by another instance
+		return nil
+	}
+	return err
+}
+
+/*
+ * Handles the entries and acknowledges them
+ */
+func (c *Cache) handleStreamEntries(conn redis.Conn, stream string,
+	entries []streamEntry, callback func(channel string, line string)) error {
+	for _, e := range entries {
+		callback(stream, e.line)
+		if _, err := conn.Do("XACK", stream, streamGroup, e.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Reads and handles the next entries delivered to our consumer, waiting
+ * for them at most STREAM_BLOCK milliseconds. Returns the number of
+ * entries handled.
+ */
+func (c *Cache) readStream(conn redis.Conn, stream string,
+	callback func(channel string, line string)) (int, error) {
+	reply, err := redis.Values(conn.Do("XREADGROUP", "GROUP", streamGroup,
+		myId, "COUNT", STREAM_COUNT, "BLOCK", STREAM_BLOCK, "STREAMS",
+		stream, ">"))
+	if err == redis.ErrNil {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var entries []streamEntry
+	for _, s := range reply {
+		// [stream, entries]
+		v, err := redis.Values(s, nil)
+		if err != nil || len(v) != 2 {
+			return 0, fmt.Errorf("Invalid XREADGROUP reply %v", s)
+		}
+		e, err := parseStreamEntries(v[1])
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, e...)
+	}
+	deadStreamMetric.Add("consumed", int64(len(entries)))
+	return len(entries), c.handleStreamEntries(conn, stream, entries, callback)
+}
+
+/*
+ * Claims and handles the entries pending for STREAM_CLAIM_IDLE seconds on
+ * the other consumers: delivered to an instance which stopped before
+ * acknowledging them. Returns the number of entries claimed.
+ */
+func (c *Cache) ClaimStreamEntries(stream string,
+	callback func(channel string, line string)) (int, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	claimed := 0
+	cursor := "0-0"
+	for {
+		reply, err := redis.Values(conn.Do("XAUTOCLAIM", stream, streamGroup,
+			myId, STREAM_CLAIM_IDLE*1000, cursor, "COUNT", STREAM_COUNT))
+		if err != nil {
+			return claimed, err
+		}
+		if len(reply) < 2 {
+			return claimed, fmt.Errorf("Invalid XAUTOCLAIM reply %v", reply)
+		}
+		if cursor, err = redis.String(reply[0], nil); err != nil {
+			return claimed, err
+		}
+		entries, err := parseStreamEntries(reply[1])
+		if err != nil {
+			return claimed, err
+		}
+		claimed += len(entries)
+		deadStreamMetric.Add("claimed", int64(len(entries)))
+		err = c.handleStreamEntries(conn, stream, entries, callback)
+		if err != nil {
+			return claimed, err
+		}
+		if cursor == "0-0" {
+			return claimed, nil
+		}
+	}
+}
+
+/*
+ * Removes the entries of the stream handled by all its consumer groups: the
+ * ones before the first entry still pending, or before the last one
+ * delivered, in any group. The entries not delivered yet are kept. Returns
+ * the number of entries removed.
+ */
+func (c *Cache) TrimStream(stream string) (int64, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	groups, err := redis.Values(conn.Do("XINFO", "GROUPS", stream))
+	if err != nil {
+		return 0, err
+	}
+	minId, found := "", false
+	for _, g := range groups {
+		info, err := parseStreamInfo(g)
+		if err != nil {
+			return 0, err
+		}
+		if info["name"] == streamGroup {
+			found = true
+		}
+		id := info["last-delivered-id"]
+		if info["pending"] != "0" {
+			// [count, smallest id, greatest id, consumers]
+			reply, err := redis.Values(conn.Do("XPENDING", stream,
+				info["name"]))
+			if err != nil {
+				return 0, err
+			}
+			if len(reply) < 2 {
+				return 0, fmt.Errorf("Invalid XPENDING reply")
+			}
+			if pending, _ := redis.Int64(reply[0], nil); pending > 0 {
+				if id, err = redis.String(reply[1], nil); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if minId == "" || streamIdLess(id, minId) {
+			minId = id
+		}
+	}
+	if found == false {
+		return 0, fmt.Errorf("No group %q on %s", streamGroup, stream)
+	}
+	n, err := redis.Int64(conn.Do("XTRIM", stream, "MINID", minId))
+	if err != nil {
+		return 0, err
+	}
+	deadStreamMetric.Add("trimmed", n)
+	return n, nil
+}
+
+/*
+ * Compares the ids of two entries, "<ms>-<seq>"
+ */
+func streamIdLess(a, b string) bool {
+	var am, as, bm, bs uint64
+	fmt.Sscanf(a, "%d-%d", &am, &as)
+	fmt.Sscanf(b, "%d-%d", &bm, &bs)
+	return am < bm || (am == bm && as < bs)
+}
+
+/*
+ * Removes the consumers of the stopped instances from the group: idle for
+ * STREAM_CONSUMER_IDLE seconds, without pending entries (they have been
+ * claimed) nor heartbeat. Each restart of an instance adds a consumer, as
+ * its id changes. Returns the consumers removed.
+ */
+func (c *Cache) RemoveStreamConsumers(stream string) ([]string, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	consumers, err := redis.Values(conn.Do("XINFO", "CONSUMERS", stream,
+		streamGroup))
+	if err != nil {
+		return nil, err
+	}
+	metaConn := c.metaPool.Get()
+	defer metaConn.Close()
+	var removed []string
+	for _, v := range consumers {
+		info, err := parseStreamInfo(v)
+		if err != nil {
+			return removed, err
+		}
+		name := info["name"]
+		idle, _ := strconv.ParseInt(info["idle"], 10, 64)
+		if name == myId || info["pending"] != "0" ||
+			idle < STREAM_CONSUMER_IDLE*1000 {
+			continue
+		}
+		// Quiet but alive (see ReleaseStaleLock)
+		key, err := redis.String(metaConn.Do("HGET",
+			c.metaKey("heartbeats"), name))
+		if err == nil {
+			alive, err := redis.Bool(metaConn.Do("EXISTS", key))
+			if err != nil || alive == true {
+				continue
+			}
+		}
+		_, err = conn.Do("XGROUP", "DELCONSUMER", stream, streamGroup, name)
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	deadStreamMetric.Add("removed_consumers", int64(len(removed)))
+	return removed, nil
+}
+
+/*
+ * Parses the fields of an XINFO reply, [field, value...], as strings
+ */
+func parseStreamInfo(reply interface{}) (map[string]string, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil || len(values)%2 != 0 {
+		return nil, fmt.Errorf("Invalid XINFO reply %v", reply)
+	}
+	info := make(map[string]string)
+	for i := 0; i < len(values); i += 2 {
+		field, err := redis.String(values[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		switch v := values[i+1].(type) {
+		case int64:
+			info[field] = strconv.FormatInt(v, 10)
+		case []byte:
+			info[field] = string(v)
+		case string:
+			info[field] = v
+		}
+	}
+	return info, nil
+}
+
+/*
+ * Returns the number of entries delivered and not acknowledged yet, by all
+ * the consumers
+ */
+func (c *Cache) PendingStreamEntries(stream string) (int64, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("XPENDING", stream, streamGroup))
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) == 0 {
+		return 0, fmt.Errorf("Invalid XPENDING reply")
+	}
+	return redis.Int64(reply[0], nil)
+}
+
+/*
+ * Consumes the dead notifications added to a stream, in the consumer group
+ * of the checkers: each entry is delivered to a single instance, and
+ * claimed by another if it stopped before acknowledging it
+ */
+func (c *Cache) ConsumeStream(stream string,
+	callback func(channel string, line string)) error {
+	if err := c.CreateStreamGroup(stream); err != nil {
+		return err
+	}
+	c.listeners.Add(2)
+	go func() {
+		defer c.listeners.Done()
+		for {
+			conn, err := c.getConn()
+			for err == nil && !c.isClosed() {
+				_, err = c.readStream(conn, stream, callback)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			if c.isClosed() {
+				return
+			}
+			logError("Error consuming the stream", stream+":", err.Error(),
+				"Reconnecting...")
+			if !c.wait(5 * time.Second) {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer c.listeners.Done()
+		for {
+			if !c.wait(time.Duration(STREAM_CLAIM_IDLE) * time.Second) {
+				return
+			}
+			n, err := c.ClaimStreamEntries(stream, callback)
+			if err != nil {
+				logError("Cannot claim the pending dead notifications:",
+					err.Error())
+			} else if n > 0 {
+				log.Printf("Claimed %d dead notification(s) of stopped "+
+					"instances", n)
+			}
+			if pending, err := c.PendingStreamEntries(stream); err == nil {
+				setGauge(deadStreamMetric, "pending", pending)
+			}
+			if _, err := c.TrimStream(stream); err != nil {
+				logError("Cannot trim the stream", stream+":", err.Error())
+			}
+			removed, err := c.RemoveStreamConsumers(stream)
+			if err != nil {
+				logError("Cannot remove the stopped consumers:", err.Error())
+			}
+			for _, consumer := range removed {
+				log.Println("Removed the consumer", consumer,
+					"of a stopped instance")
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStreamIntake(t *testing.T) {
+	r, cache := setupCache(t)
+	deadStreamMetric.Init()
+	conn := cache.pool.Get()
+	defer conn.Close()
+	// Before the group, not delivered
+	conn.Do("XADD", "hchecker:dead", "*", "notification",
+		"www.foo.com;http://10.0.0.9:80;0;2")
+	if err := cache.CreateStreamGroup("hchecker:dead"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.CreateStreamGroup("hchecker:dead"); err != nil {
+		t.Fatalf("Expected the existing group to be used, got %s", err)
+	}
+	conn.Do("XADD", "hchecker:dead", "*", "notification",
+		"www.foo.com;http://10.0.0.1:80;0;2")
+	conn.Do("XADD", "hchecker:dead", "*", "data",
+		"www.foo.com;http://10.0.0.2:80;1;2")
+	var handled []string
+	callback := func(channel string, line string) {
+		if channel != "hchecker:dead" {
+			t.Errorf("Unexpected channel %q", channel)
+		}
+		handled = append(handled, line)
+	}
+	if n, err := cache.readStream(conn, "hchecker:dead", callback); err != nil ||
+		n != 2 {
+		t.Fatalf("Expected 2 entries read, got %d (%v)", n, err)
+	}
+	if n, err := cache.readStream(conn, "hchecker:dead", callback); err != nil ||
+		n != 0 {
+		t.Errorf("Expected no entry left, got %d (%v)", n, err)
+	}
+	expected := []string{"www.foo.com;http://10.0.0.1:80;0;2",
+		"www.foo.com;http://10.0.0.2:80;1;2"}
+	if !reflect.DeepEqual(handled, expected) {
+		t.Errorf("Expected %v to be handled, got %v", expected, handled)
+	}
+	if n, err := cache.PendingStreamEntries("hchecker:dead"); err != nil ||
+		n != 0 {
+		t.Errorf("Expected the entries to be acknowledged, got %d (%v)", n, err)
+	}
+	// Delivered to an instance which stopped before acknowledging it
+	conn.Do("XADD", "hchecker:dead", "*", "notification",
+		"www.foo.com;http://10.0.0.3:80;0;2")
+	conn.Do("XREADGROUP", "GROUP", "hchecker", "other#1", "STREAMS",
+		"hchecker:dead", ">")
+	if n, _ := cache.PendingStreamEntries("hchecker:dead"); n != 1 {
+		t.Errorf("Expected 1 pending entry, got %d", n)
+	}
+	handled = nil
+	if n, err := cache.ClaimStreamEntries("hchecker:dead", callback); err != nil ||
+		n != 1 {
+		t.Fatalf("Expected 1 entry claimed, got %d (%v)", n, err)
+	}
+	if len(handled) != 1 || handled[0] != "www.foo.com;http://10.0.0.3:80;0;2" {
+		t.Errorf("Expected the claimed entry to be handled, got %v", handled)
+	}
+	if n, _ := cache.PendingStreamEntries("hchecker:dead"); n != 0 {
+		t.Errorf("Expected no pending entry, got %d", n)
+	}
+	for name, expected := range map[string]string{"consumed": "2",
+		"claimed": "1"} {
+		if v := deadStreamMetric.Get(name); v == nil || v.String() != expected {
+			t.Errorf("Expected %s %s, got %v", expected, name, v)
+		}
+	}
+	if !r.exists("hchecker:dead") {
+		t.Error("Expected the stream to be kept")
+	}
+}
+
+func TestStreamCleanup(t *testing.T) {
+	r, cache := setupCache(t)
+	deadStreamMetric.Init()
+	conn := cache.pool.Get()
+	defer conn.Close()
+	if err := cache.CreateStreamGroup("hchecker:dead"); err != nil {
+		t.Fatal(err)
+	}
+	callback := func(channel string, line string) {}
+	for i := 0; i < 2; i++ {
+		conn.Do("XADD", "hchecker:dead", "*", "notification",
+			"www.foo.com;http://10.0.0.1:80;0;2")
+	}
+	cache.readStream(conn, "hchecker:dead", callback)
+	// Pending on a stopped instance, then not delivered yet
+	conn.Do("XADD", "hchecker:dead", "*", "notification",
+		"www.foo.com;http://10.0.0.2:80;1;2")
+	conn.Do("XREADGROUP", "GROUP", "hchecker", "other#1", "STREAMS",
+		"hchecker:dead", ">")
+	conn.Do("XADD", "hchecker:dead", "*", "notification",
+		"www.foo.com;http://10.0.0.3:80;2;2")
+	if n, err := cache.TrimStream("hchecker:dead"); err != nil || n != 2 {
+		t.Fatalf("Expected the 2 handled entries trimmed, got %d (%v)", n, err)
+	}
+	// Quiet consumers: one alive, one with pending entries
+	group := r.streams["hchecker:dead"].groups["hchecker"]
+	group.seen["alive#1"] = time.Now()
+	r.hashes["hchecker:heartbeats"] = map[string]string{
+		"alive#1": cache.heartbeatKey("alive#1")}
+	r.strings[cache.heartbeatKey("alive#1")] = "1"
+	for name := range group.seen {
+		group.seen[name] = time.Now().Add(-2 * time.Hour)
+	}
+	if removed, err := cache.RemoveStreamConsumers("hchecker:dead"); err != nil ||
+		len(removed) != 0 {
+		t.Fatalf("Expected no consumer removed, got %v (%v)", removed, err)
+	}
+	if n, _ := cache.ClaimStreamEntries("hchecker:dead", callback); n != 1 {
+		t.Fatalf("Expected 1 entry claimed, got %d", n)
+	}
+	group.seen[myId] = time.Now().Add(-2 * time.Hour)
+	removed, err := cache.RemoveStreamConsumers("hchecker:dead")
+	if err != nil || !reflect.DeepEqual(removed, []string{"other#1"}) {
+		t.Fatalf("Expected the stopped consumer removed, got %v (%v)",
+			removed, err)
+	}
+	if _, exists := group.seen["other#1"]; exists {
+		t.Error("Expected other#1 to leave the group")
+	}
+	// The claimed entry is the last delivered one, the next is kept
+	if n, err := cache.TrimStream("hchecker:dead"); err != nil || n != 0 {
+		t.Errorf("Expected nothing to trim, got %d (%v)", n, err)
+	}
+	if n := len(r.streams["hchecker:dead"].entries); n != 2 {
+		t.Errorf("Expected 2 entries kept, got %d", n)
+	}
+	for name, expected := range map[string]string{"trimmed": "2",
+		"removed_consumers": "1"} {
+		if v := deadStreamMetric.Get(name); v == nil || v.String() != expected {
+			t.Errorf("Expected %s %s, got %v", expected, name, v)
+		}
+	}
+}
+
+func TestTrimStreamGroups(t *testing.T) {
+	r, cache := setupCache(t)
+	deadStreamMetric.Init()
+	conn := cache.pool.Get()
+	defer conn.Close()
+	if err := cache.CreateStreamGroup("hchecker:dead"); err != nil {
+		t.Fatal(err)
+	}
+	// Another consumer of the stream, from its start
+	conn.Do("XGROUP", "CREATE", "hchecker:dead", "audit", "0")
+	for i := 0; i < 3; i++ {
+		conn.Do("XADD", "hchecker:dead", "*", "notification",
+			"www.foo.com;http://10.0.0.1:80;0;2")
+	}
+	cache.readStream(conn, "hchecker:dead", func(string, string) {})
+	if n, err := cache.TrimStream("hchecker:dead"); err != nil || n != 0 {
+		t.Errorf("Expected the entries not read by audit kept, got %d (%v)",
+			n, err)
+	}
+	// Read by audit, not acknowledged
+	conn.Do("XREADGROUP", "GROUP", "audit", "auditor", "STREAMS",
+		"hchecker:dead", ">")
+	if n, err := cache.TrimStream("hchecker:dead"); err != nil || n != 0 {
+		t.Errorf("Expected the entries pending in audit kept, got %d (%v)",
+			n, err)
+	}
+	for _, e := range r.streams["hchecker:dead"].entries[:2] {
+		conn.Do("XACK", "hchecker:dead", "audit", e.id)
+	}
+	if n, err := cache.TrimStream("hchecker:dead"); err != nil || n != 2 {
+		t.Errorf("Expected the entries handled by both groups trimmed, got %d (%v)",
+			n, err)
+	}
+	if n := len(r.streams["hchecker:dead"].entries); n != 1 {
+		t.Errorf("Expected the entry pending in audit kept, got %d entries", n)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Delay before restarting the checker of a tenant which exited
+	TENANT_RESTART_DELAY = 5
+)
+
+var (
+	tenantsFile string
+	// The lines of the tenants are written whole
+	tenantsOutputLock sync.Mutex
+	// Passed to the checkers through their environment, never on their
+	// command line (visible to all the users of the host)
+	secretOptions = map[string]bool{"redis_password": true,
+		"meta_redis_password": true, "redlock_password": true}
+)
+
+/*
+ * Loads the tenants: {"shop": {"redis": "10.0.0.1:6379", "admin": ":8081"},
+ * "blog": {"redis": "10.0.0.2:6379", "redis_suffix": "blog"}}. The options of
+ * a tenant are the ones of the command line.
+ */
+func loadTenants(fs *flag.FlagSet,
+	filename string) (map[string]map[string]interface{}, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var tenants map[string]map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&tenants); err != nil {
+		return nil, fmt.Errorf("Cannot parse tenants file %q: %s", filename,
+			err)
+	}
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("No tenant in %q", filename)
+	}
+	for name, options := range tenants {
+		if name == "" || strings.ContainsAny(name, " \t[]") {
+			return nil, fmt.Errorf("Invalid tenant name %q", name)
+		}
+		for option := range options {
+			if option == "tenants" || fs.Lookup(option) == nil {
+				return nil, fmt.Errorf("Invalid option %q for tenant %q",
+					option, name)
+			}
+		}
+	}
+	return tenants, nil
+}
+
+/*
+ * Command line of the checker of a tenant: the common arguments, then the
+ * options of the tenant, which take precedence. The secret options are
+ * returned as environment variables instead (HCHECKER_REDIS_PASSWORD...).
+ */
+func tenantArgs(common []string,
+	options map[string]interface{}) (args []string, env []string) {
+	args = append([]string{}, common...)
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if secretOptions[name] == true {
+			env = append(env, fmt.Sprintf("%s=%v", envName(name),
+				options[name]))
+			continue
+		}
+		args = append(args, fmt.Sprintf("-%s=%v", name, options[name]))
+	}
+	// Not a supervisor itself, whatever the environment or the config file
+	return append(args, "-tenants="), env
+}
+
+/*
+ * Returns the secret options given on a command line, "-redis_password=x"
+ * or "--redis_password x"
+ */
+func secretArgs(args []string) []string {
+	var secrets []string
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		name = strings.SplitN(name, "=", 2)[0]
+		if secretOptions[name] == true {
+			secrets = append(secrets, name)
+		}
+	}
+	return secrets
+}
+
+/*
+ * Prefixes each line of the output of a tenant with its name
+ */
+type tenantWriter struct {
+	prefix string
+	out    io.Writer
+	buf    []byte
+}
+
+func (w *tenantWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		tenantsOutputLock.Lock()
+		fmt.Fprintf(w.out, "%s%s\n", w.prefix, w.buf[:i])
+		tenantsOutputLock.Unlock()
+		w.buf = w.buf[i+1:]
+	}
+}
+
+/*
+ * The checker of a tenant, restarted when it exits
+ */
+type tenantProcess struct {
+	name string
+	args []string
+	// Added to the environment of the checker, after ours
+	env  []string
+	lock sync.Mutex
+	cmd  *exec.Cmd
+}
+
+func (t *tenantProcess) supervise(stopping chan struct{}) {
+	for {
+		select {
+		case <-stopping:
+			return
+		default:
+		}
+		w := &tenantWriter{prefix: "[" + t.name + "] ", out: os.Stderr}
+		cmd := exec.Command(os.Args[0], t.args...)
+		// The last value of a variable wins
+		cmd.Env = append(os.Environ(), t.env...)
+		cmd.Stdout, cmd.Stderr = w, w
+		t.lock.Lock()
+		err := cmd.Start()
+		if err == nil {
+			t.cmd = cmd
+		}
+		t.lock.Unlock()
+		if err == nil {
+			log.Printf("Started the checker of tenant %s (pid %d)", t.name,
+				cmd.Process.Pid)
+			err = cmd.Wait()
+			t.lock.Lock()
+			t.cmd = nil
+			t.lock.Unlock()
+		}
+		select {
+		case <-stopping:
+			return
+		default:
+		}
+		logError("The checker of tenant", t.name, "exited:", fmt.Sprint(err),
+			"Restarting...")
+		select {
+		case <-stopping:
+			return
+		case <-time.After(time.Duration(TENANT_RESTART_DELAY) * time.Second):
+		}
+	}
+}
+
+/*
+ * Stops the checker of the tenant, which hands off its backends
+ */
+func (t *tenantProcess) stop() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.cmd != nil {
+		t.cmd.Process.Signal(syscall.SIGTERM)
+	}
+}
+
+/*
+ * Runs a checker per tenant of -tenants, each in its own process with its
+ * own Redis, keys, channels, options and metrics. Returns the exit code once
+ * stopped by SIGINT or SIGTERM.
+ */
+func runTenants(filename string) int {
+	// Copied to the command line of each checker
+	if secrets := secretArgs(os.Args[1:]); len(secrets) > 0 {
+		log.Printf("-%s cannot be given on the command line with -tenants, "+
+			"use %s or -%s_file", secrets[0], envName(secrets[0]), secrets[0])
+		return 1
+	}
+	tenants, err := loadTenants(flag.CommandLine, filename)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopping := make(chan struct{})
+	var (
+		processes []*tenantProcess
+		wg        sync.WaitGroup
+	)
+	for _, name := range names {
+		t := &tenantProcess{name: name}
+		t.args, t.env = tenantArgs(os.Args[1:], tenants[name])
+		processes = append(processes, t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.supervise(stopping)
+		}()
+	}
+	<-signals
+	log.Printf("Stopping the checkers of %d tenants", len(processes))
+	close(stopping)
+	for _, t := range processes {
+		t.stop()
+	}
+	wg.Wait()
+	return 0
+}
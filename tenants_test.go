@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tenants.json")
+	write := func(data string) {
+		if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"shop": {"redis": "10.0.0.1:6379", "interval": 5,
+			"redis_password": "secret"},
+		"blog": {"redis": "10.0.0.2:6379", "redis_suffix": "blog"}}`)
+	fs := flag.NewFlagSet("hchecker", flag.ContinueOnError)
+	for _, name := range []string{"redis", "redis_suffix", "interval",
+		"redis_password", "tenants"} {
+		fs.String(name, "", "")
+	}
+	tenants, err := loadTenants(fs, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, env := tenantArgs([]string{"-tenants=" + filename, "-io=2"},
+		tenants["shop"])
+	expected := []string{"-tenants=" + filename, "-io=2", "-interval=5",
+		"-redis=10.0.0.1:6379", "-tenants="}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %v, got %v", expected, args)
+	}
+	// The password stays off the command line
+	if !reflect.DeepEqual(env, []string{"HCHECKER_REDIS_PASSWORD=secret"}) {
+		t.Errorf("Expected the password in the environment, got %v", env)
+	}
+	for _, test := range []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"-tenants=t.json", "-redis_password_file=/run/pass"}, nil},
+		{[]string{"-redis_password=x", "--meta_redis_password", "y"},
+			[]string{"redis_password", "meta_redis_password"}},
+		{[]string{"-io=2", "--", "-redlock_password=z"}, nil},
+	} {
+		if secrets := secretArgs(test.args); !reflect.DeepEqual(secrets,
+			test.expected) {
+			t.Errorf("Expected %v in %v, got %v", test.expected, test.args,
+				secrets)
+		}
+	}
+	for _, invalid := range []string{`{}`,
+		`{"shop": {"no_such_option": 1}}`,
+		`{"shop": {"tenants": "other.json"}}`,
+		`{"a shop": {}}`} {
+		write(invalid)
+		if _, err := loadTenants(fs, filename); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+	var out bytes.Buffer
+	w := &tenantWriter{prefix: "[shop] ", out: &out}
+	w.Write([]byte("first line\nsecond "))
+	w.Write([]byte("line\n"))
+	if out.String() != "[shop] first line\n[shop] second line\n" {
+		t.Errorf("Expected the lines to be prefixed, got %q", out.String())
+	}
+}
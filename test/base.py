@@ -41,10 +41,10 @@ class TestCase(unittest.TestCase):
 
     def check_ready(self):
         """ Makes sure the activechecker is running """
-        ping = self.redis.get('hchecker_ping')
-        if not ping or (int(time.time()) - int(ping)) > 30:
+        # The heartbeats expire after 30 seconds
+        if not self.redis.keys('hchecker:alive:*'):
             self.fail('hchecker is not running (Please launch the hchecker '
-                    'manually before starting the tests)')
+                    'manually with -allow_loopback before starting the tests)')
 
     def stop_all_httpd(self):
         if not self._httpd_pids:
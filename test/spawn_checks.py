@@ -14,6 +14,11 @@ if __name__ == '__main__':
     r = redis.StrictRedis()
     r.delete('hchecker')
     for i in range(n):
-        line = 'frontend{0};http://localhost:{1};0;2'.format(i, 4242 + i)
+        frontend = 'frontend{0}'.format(i)
+        backend_url = 'http://localhost:{0}'.format(4242 + i)
+        # Backends of removed frontends are not checked
+        r.delete('frontend:{0}'.format(frontend))
+        r.rpush('frontend:{0}'.format(frontend), frontend, backend_url)
+        line = '{0};{1};0;2'.format(frontend, backend_url)
         interval > 0 and time.sleep(interval)
         r.publish('dead', line)
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// The TLS files are looked at every 10 seconds
+	TLS_RELOAD_INTERVAL = 10
+)
+
+var (
+	// Client certificate and CA bundle of the probes, and of Redis with
+	// -redis_tls
+	tlsCertFile string
+	tlsKeyFile  string
+	tlsCAFile   string
+	redisTLS    bool
+	tlsMaterial = &tlsFiles{}
+)
+
+/*
+ * The TLS material loaded from -tls_cert, -tls_key and -tls_ca, loaded again
+ * when the files change so a rotated certificate doesn't need a restart
+ */
+type tlsFiles struct {
+	lock   sync.Mutex
+	config *tls.Config
+	// Modification time of each file when it was loaded
+	modTimes map[string]time.Time
+}
+
+func tlsFilenames() []string {
+	var filenames []string
+	for _, filename := range []string{tlsCertFile, tlsKeyFile, tlsCAFile} {
+		if filename != "" {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames
+}
+
+/*
+ * Reads the TLS files into a new config
+ */
+func loadTLSConfig() (*tls.Config, error) {
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return nil, errors.New("-tls_cert and -tls_key go together")
+	}
+	config := &tls.Config{}
+	if tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if tlsCAFile != "" {
+		data, err := ioutil.ReadFile(tlsCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificate found in %s", tlsCAFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+/*
+ * Loads the TLS files if one changed since the last load. Returns true if
+ * the config has been replaced. The current config is kept if the files
+ * cannot be loaded, e.g. while they are being written.
+ */
+func (m *tlsFiles) reload() (bool, error) {
+	modTimes := make(map[string]time.Time)
+	for _, filename := range tlsFilenames() {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return false, err
+		}
+		modTimes[filename] = info.ModTime()
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.config != nil && len(modTimes) == len(m.modTimes) {
+		changed := false
+		for filename, modTime := range modTimes {
+			if !modTime.Equal(m.modTimes[filename]) {
+				changed = true
+			}
+		}
+		if changed == false {
+			return false, nil
+		}
+	}
+	config, err := loadTLSConfig()
+	if err != nil {
+		return false, err
+	}
+	m.config, m.modTimes = config, modTimes
+	return true, nil
+}
+
+/*
+ * Returns a copy of the current TLS config, nil if no TLS file is given
+ */
+func (m *tlsFiles) get() *tls.Config {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.config == nil {
+		return nil
+	}
+	return m.config.Clone()
+}
+
+/*
+ * Options of the connections to Redis, over TLS with -redis_tls
+ */
+func redisTLSOptions() []redis.DialOption {
+	if redisTLS == false {
+		return nil
+	}
+	options := []redis.DialOption{redis.DialUseTLS(true)}
+	if config := tlsMaterial.get(); config != nil {
+		options = append(options, redis.DialTLSConfig(config))
+	}
+	return options
+}
+
+/*
+ * Drops the transports of the probes, the next probes get new ones with the
+ * current TLS config
+ */
+func resetTransports() {
+	httpTransportsLock.Lock()
+	httpTransports = make(map[string]*http.Transport)
+	httpTransportsLock.Unlock()
+}
+
+/*
+ * Loads the TLS files again when they change: the next probes and the new
+ * connections to Redis use the new certificates
+ */
+func watchTLS(cache *Cache) {
+	for {
+		if !cache.wait(time.Duration(TLS_RELOAD_INTERVAL) * time.Second) {
+			return
+		}
+		changed, err := tlsMaterial.reload()
+		if err != nil {
+			logError("Cannot reload the TLS files:", err.Error())
+			continue
+		}
+		if changed == false {
+			continue
+		}
+		log.Println("TLS files reloaded")
+		tlsReloadsMetric.Add(1)
+		resetTransports()
+		if redisTLS == true {
+			cache.Redial()
+		}
+	}
+}
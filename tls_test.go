@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, filename string, der []byte, modTime time.Time) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(
+		w http.ResponseWriter, r *http.Request) {
+	}))
+	defer backend.Close()
+	// A CA which didn't sign the certificate of the backend
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:   pkix.Name{CommonName: "Other CA"},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true}
+	other, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectionTimeout, ioTimeout = time.Second, time.Second
+	tlsCAFile = filepath.Join(t.TempDir(), "ca.pem")
+	defer func() {
+		tlsCAFile = ""
+		tlsMaterial = &tlsFiles{}
+		resetTransports()
+	}()
+	start := time.Now().Add(-time.Minute)
+	writePEM(t, tlsCAFile, other, start)
+	if changed, err := tlsMaterial.reload(); err != nil || !changed {
+		t.Fatalf("Expected the TLS files to be loaded, got %v", err)
+	}
+	probe := func() error {
+		client := &http.Client{Transport: getTransport(HTTP2_OFF, "")}
+		resp, err := client.Get(backend.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := probe(); err == nil {
+		t.Error("Expected the backend not to be trusted")
+	}
+	if changed, _ := tlsMaterial.reload(); changed {
+		t.Error("Expected the unchanged TLS files not to be loaded again")
+	}
+	// The rotated bundle trusts the backend once reloaded
+	writePEM(t, tlsCAFile, backend.Certificate().Raw, start.Add(time.Second))
+	if changed, err := tlsMaterial.reload(); err != nil || !changed {
+		t.Fatalf("Expected the TLS files to be reloaded, got %v", err)
+	}
+	resetTransports()
+	if err := probe(); err != nil {
+		t.Errorf("Expected the backend to be trusted, got %s", err)
+	}
+	// A broken file leaves the current config in place
+	os.WriteFile(tlsCAFile, []byte("garbage"), 0600)
+	if _, err := tlsMaterial.reload(); err == nil {
+		t.Error("Expected the broken CA bundle to be rejected")
+	}
+	if err := probe(); err != nil {
+		t.Errorf("Expected the backend to be trusted still, got %s", err)
+	}
+}
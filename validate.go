@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+/*
+ * Checks a Redis connection and its credentials
+ */
+func pingRedis(pool *redis.Pool) error {
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+/*
+ * Checks what the flags can't: the Redis connections and credentials and
+ * the channel names. The flags and the config file have been parsed and
+ * validated already. The summary of the config goes to out, returns the
+ * errors found.
+ */
+func validateConfig(cache *Cache, out io.Writer) []error {
+	var errs []error
+	check := func(what string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", what, err))
+			return
+		}
+		fmt.Fprintln(out, what+": OK")
+	}
+	check("Redis "+getRedisAddress(), pingRedis(cache.pool))
+	if metaRedisAddress != "" {
+		check("Meta Redis "+metaRedisAddress, pingRedis(cache.metaPool))
+	}
+	for i, pool := range cache.redlockPools {
+		check(fmt.Sprintf("Redlock node %d", i+1), pingRedis(pool))
+	}
+	for _, channel := range []string{deadChannel, aliveChannel} {
+		if strings.ContainsAny(channel, " \t\r\n") {
+			errs = append(errs, fmt.Errorf("Invalid channel %q", channel))
+		}
+	}
+	switch {
+	case deadChannel == "" && deadList == "" && deadStream == "":
+		errs = append(errs, fmt.Errorf("No dead channel"))
+	case deadList != "":
+		fmt.Fprintf(out, "Dead notifications: list %q\n", deadList)
+	case deadStream != "":
+		fmt.Fprintf(out, "Dead notifications: stream %q, group %q\n",
+			deadStream, streamGroup)
+	default:
+		fmt.Fprintf(out, "Dead notifications: channel %q\n", deadChannel)
+	}
+	if isPattern(aliveChannel) {
+		errs = append(errs, fmt.Errorf("-alive_channel %q is a pattern, "+
+			"the checkers publish on it", aliveChannel))
+	} else if aliveChannel != "" {
+		fmt.Fprintf(out, "Alive notifications: channel %q\n", aliveChannel)
+	}
+	fmt.Fprintf(out, "Lock strategy: %s\n", lockStrategy)
+	fmt.Fprintf(out, "Frontend settings: %d\n", len(frontendConfigs))
+	if blacklist != nil {
+		fmt.Fprintf(out, "Blacklist: %s\n", blacklist)
+	}
+	if dryRun == true {
+		fmt.Fprintln(out, "Dry run mode")
+	}
+	return errs
+}
+
+func validateConfigCommand(cache *Cache, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: validate-config")
+		return 2
+	}
+	errs := validateConfig(cache, os.Stdout)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "Error:", err.Error())
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("Config OK")
+	return 0
+}
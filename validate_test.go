@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	r, cache := setupCache(t)
+	deadChannel = "dead"
+	defer func() { deadChannel, aliveChannel = "", "" }()
+	var out bytes.Buffer
+	if errs := validateConfig(cache, &out); len(errs) != 0 {
+		t.Fatalf("Expected a valid config, got %v", errs)
+	}
+	if !strings.Contains(out.String(), `Dead notifications: channel "dead"`) {
+		t.Errorf("Expected the dead channel in the summary, got %q", out.String())
+	}
+	// Unreachable Redis and a pattern to publish on
+	r.failures = 1
+	aliveChannel = "alive-*"
+	errs := validateConfig(cache, &out)
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", errs)
+	}
+	if !strings.Contains(errs[0].Error(), "connection refused") {
+		t.Errorf("Expected the Redis error first, got %s", errs[0])
+	}
+}
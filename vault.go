@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Prefix of the secrets read from Vault, e.g.
+	// "vault:secret/data/hchecker#redis_password"
+	VAULT_PREFIX = "vault:"
+	// Interval between the reads of the secrets from Vault
+	VAULT_INTERVAL = 300
+	// Timeout of the requests to Vault
+	VAULT_TIMEOUT = 10
+)
+
+var (
+	vaultAddr      string
+	vaultTokenFile string
+	vaultInterval  time.Duration
+	// Last value of each secret read from Vault, by reference
+	vaultSecrets     = make(map[string]string)
+	vaultSecretsLock sync.Mutex
+	vaultHttpClient  = &http.Client{
+		Timeout: time.Duration(VAULT_TIMEOUT) * time.Second,
+	}
+)
+
+func isVaultRef(value string) bool {
+	return strings.HasPrefix(value, VAULT_PREFIX)
+}
+
+/*
+ * Splits a Vault reference into the path of the secret and its field
+ */
+func parseVaultRef(ref string) (string, string, error) {
+	i := strings.LastIndex(ref, "#")
+	if !isVaultRef(ref) || i == -1 || i == len(ref)-1 ||
+		i == len(VAULT_PREFIX) {
+		return "", "", fmt.Errorf("Invalid Vault secret %q, expected "+
+			"vault:PATH#FIELD", ref)
+	}
+	return strings.Trim(ref[len(VAULT_PREFIX):i], "/"), ref[i+1:], nil
+}
+
+func getVaultAddr() string {
+	if vaultAddr != "" {
+		return vaultAddr
+	}
+	return os.Getenv("VAULT_ADDR")
+}
+
+func getVaultToken() string {
+	return getSecret(os.Getenv("VAULT_TOKEN"), vaultTokenFile)
+}
+
+/*
+ * Sends a request to the Vault API and decodes its JSON response
+ */
+func vaultRequest(method, path string, v interface{}) error {
+	addr := getVaultAddr()
+	if addr == "" {
+		return fmt.Errorf("No Vault address, see -vault_addr")
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(addr, "/")+
+		"/v1/"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", getVaultToken())
+	resp, err := vaultHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Vault request on %s failed: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+/*
+ * Reads a field of a Vault secret, from the KV version 1 or 2 engines
+ */
+func readVaultSecret(ref string) (string, error) {
+	path, field, err := parseVaultRef(ref)
+	if err != nil {
+		return "", err
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := vaultRequest("GET", path, &secret); err != nil {
+		return "", err
+	}
+	data := secret.Data
+	// KV version 2 wraps the fields along with their metadata
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("No field %q in the Vault secret %s", field,
+			path)
+	}
+	return value, nil
+}
+
+/*
+ * Returns a secret read from Vault, from the last read if it has already
+ * been read
+ */
+func getVaultSecret(ref string) (string, error) {
+	vaultSecretsLock.Lock()
+	value, exists := vaultSecrets[ref]
+	vaultSecretsLock.Unlock()
+	if exists {
+		return value, nil
+	}
+	value, err := readVaultSecret(ref)
+	if err != nil {
+		return "", err
+	}
+	vaultSecretsLock.Lock()
+	vaultSecrets[ref] = value
+	vaultSecretsLock.Unlock()
+	return value, nil
+}
+
+/*
+ * Reads again all the secrets read from Vault so far. Returns the
+ * references of the ones which changed.
+ */
+func refreshVaultSecrets() []string {
+	vaultSecretsLock.Lock()
+	refs := make([]string, 0, len(vaultSecrets))
+	for ref := range vaultSecrets {
+		refs = append(refs, ref)
+	}
+	vaultSecretsLock.Unlock()
+	var changed []string
+	for _, ref := range refs {
+		value, err := readVaultSecret(ref)
+		if err != nil {
+			// The last value is kept until Vault answers again
+			logError("Cannot read the Vault secret", ref+":", err.Error())
+			continue
+		}
+		vaultSecretsLock.Lock()
+		if vaultSecrets[ref] != value {
+			vaultSecrets[ref] = value
+			changed = append(changed, ref)
+		}
+		vaultSecretsLock.Unlock()
+	}
+	return changed
+}
+
+/*
+ * Extends the lease of our Vault token, the token is kept as long as the
+ * checker runs
+ */
+func renewVaultToken() error {
+	var renewal struct{}
+	return vaultRequest("POST", "auth/token/renew-self", &renewal)
+}
+
+/*
+ * Renews our Vault token and reads the secrets again at a regular interval.
+ * When a Redis password rotates, the connections to Redis are opened again
+ * with the new one.
+ */
+func watchVault(cache *Cache) {
+	for {
+		if !cache.wait(vaultInterval) {
+			return
+		}
+		if err := renewVaultToken(); err != nil {
+			logError("Cannot renew the Vault token:", err.Error())
+		}
+		redisLock.Lock()
+		password := redisPassword
+		redisLock.Unlock()
+		redial := false
+		for _, ref := range refreshVaultSecrets() {
+			log.Println("Vault secret", ref, "rotated")
+			if ref == password || ref == metaRedisPassword ||
+				ref == redlockPassword {
+				redial = true
+			}
+		}
+		if redial == true {
+			cache.Redial()
+		}
+	}
+}
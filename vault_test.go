@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestVaultSecrets(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		password = "s3cret"
+		renewals int
+	)
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "t0ken" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Path {
+		case "/v1/auth/token/renew-self":
+			renewals += 1
+			w.Write([]byte(`{"auth": {"lease_duration": 3600}}`))
+		case "/v1/secret/data/hchecker":
+			// KV version 2
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     map[string]string{"redis_password": password},
+					"metadata": map[string]interface{}{"version": 1},
+				},
+			})
+		case "/v1/kv/probes":
+			// KV version 1
+			w.Write([]byte(`{"data": {"token": "abcdef"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_TOKEN", "t0ken")
+	vaultAddr = vault.URL
+	defer func() {
+		vaultAddr = ""
+		vaultSecrets = make(map[string]string)
+		lastError = ""
+	}()
+	ref := "vault:secret/data/hchecker#redis_password"
+	if secret := getSecret(ref, ""); secret != "s3cret" {
+		t.Errorf("Expected the password from Vault, got %q", secret)
+	}
+	if secret := getSecret("vault:kv/probes#token", ""); secret != "abcdef" {
+		t.Errorf("Expected the token from Vault, got %q", secret)
+	}
+	for _, invalid := range []string{"vault:secret/data/hchecker",
+		"vault:#token", "vault:kv/probes#"} {
+		if _, _, err := parseVaultRef(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+	if _, err := getVaultSecret("vault:kv/probes#password"); err == nil {
+		t.Error("Expected a missing field to be an error")
+	}
+	// The rotated password is picked up on the next refresh
+	lock.Lock()
+	password = "rotated"
+	lock.Unlock()
+	if secret := getSecret(ref, ""); secret != "s3cret" {
+		t.Errorf("Expected the last read password, got %q", secret)
+	}
+	changed := refreshVaultSecrets()
+	if len(changed) != 1 || changed[0] != ref {
+		t.Errorf("Expected the password to be rotated, got %v", changed)
+	}
+	if secret := getSecret(ref, ""); secret != "rotated" {
+		t.Errorf("Expected the rotated password, got %q", secret)
+	}
+	if err := renewVaultToken(); err != nil || renewals != 1 {
+		t.Errorf("Expected the token to be renewed, got %v", err)
+	}
+}
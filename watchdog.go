@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// A check is stuck when it missed 5 check cycles
+	WATCHDOG_CYCLES = 5
+	// Run the watchdog every 10 seconds
+	WATCHDOG_INTERVAL = 10
+	// Maximum size of the stack dump
+	WATCHDOG_STACK_SIZE = 1 << 20
+)
+
+var (
+	watchedChecks = make(map[*Check]*backendController)
+	watchedLock   sync.Mutex
+	// The check loops running, the abandoned ones excluded
+	checkLoops sync.WaitGroup
+)
+
+func watchCheck(check *Check, ctl *backendController) {
+	watchedLock.Lock()
+	defer watchedLock.Unlock()
+	atomic.StoreInt64(&check.lastCycle, time.Now().UnixNano())
+	watchedChecks[check] = ctl
+}
+
+func unwatchCheck(check *Check) {
+	watchedLock.Lock()
+	defer watchedLock.Unlock()
+	delete(watchedChecks, check)
+}
+
+/*
+ * Detects the check goroutines which did not complete a cycle for a while
+ * (stuck HTTP call, deadlock...), dumps the stacks and replaces their loop
+ */
+func runWatchdog() {
+	for {
+		time.Sleep(time.Duration(WATCHDOG_INTERVAL) * time.Second)
+		restartStuckChecks(time.Now())
+	}
+}
+
+/*
+ * Returns how long a cycle of a check can last: the interval between the
+ * probes (or between the probes of -alive_burst) and a probe
+ */
+func (c *Check) cycleBudget() time.Duration {
+	interval := checkInterval
+	if aliveBurst > 0 {
+		if burst := aliveBurstPeriod / time.Duration(aliveBurst); burst > interval {
+			interval = burst
+		}
+	}
+	return interval + c.probeTimeout()
+}
+
+/*
+ * Restarts the checks which missed WATCHDOG_CYCLES cycles. Returns the
+ * number of checks restarted.
+ */
+func restartStuckChecks(now time.Time) int {
+	var stuck []*Check
+	watchedLock.Lock()
+	for check := range watchedChecks {
+		if atomic.LoadInt32(&check.queued) == 1 {
+			// Waiting for a probe slot, not stuck
+			continue
+		}
+		last := time.Unix(0, atomic.LoadInt64(&check.lastCycle))
+		if now.Sub(last) >= WATCHDOG_CYCLES*check.cycleBudget() {
+			stuck = append(stuck, check)
+		}
+	}
+	watchedLock.Unlock()
+	if len(stuck) == 0 {
+		return 0
+	}
+	buf := make([]byte, WATCHDOG_STACK_SIZE)
+	buf = buf[:runtime.Stack(buf, true)]
+	log.Printf("Watchdog: %d stuck check(s), goroutines dump:\n%s",
+		len(stuck), buf)
+	restarted := 0
+	for _, check := range stuck {
+		if restartCheck(check) != nil {
+			restarted += 1
+		}
+	}
+	return restarted
+}
+
+/*
+ * Replaces a stuck check by a fresh one holding the same lock, with its own
+ * loop. The stuck loop is abandoned: if its blocking call ever returns, it
+ * exits without touching Redis nor the lock. Returns the fresh check, nil
+ * if the check stopped meanwhile.
+ */
+func restartCheck(check *Check) *Check {
+	watchedLock.Lock()
+	ctl, exists := watchedChecks[check]
+	delete(watchedChecks, check)
+	watchedLock.Unlock()
+	if !exists {
+		return nil
+	}
+	log.Println(check.BackendUrl, "Check is stuck, restarting it")
+	close(check.abandoned)
+	if check.loopDone != nil {
+		check.loopDone()
+	}
+	fresh := NewBackendCheck(check.FrontendKey, check.BackendUrl,
+		check.BackendId, check.BackendGroupLength)
+	fresh.routineSig, fresh.lockField = check.routineSig, check.lockField
+	fresh.warmupEnd = check.warmupEnd
+	if check.markedDead != nil {
+		fresh.markedDead = make(map[string]string)
+		for frontendKey, member := range check.markedDead {
+			fresh.markedDead[frontendKey] = member
+		}
+	}
+	fresh.generation = atomic.LoadInt32(&check.generation) + 1
+	fresh.probes = atomic.LoadInt64(&check.probes)
+	fresh.failures = atomic.LoadInt64(&check.failures)
+	fresh.deadSince = atomic.LoadInt64(&check.deadSince)
+	fresh.lockLost = atomic.LoadInt32(&check.lockLost)
+	startCheckLoop(fresh, ctl)
+	return fresh
+}
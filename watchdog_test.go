@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeTimeout(t *testing.T) {
+	connectionTimeout, ioTimeout = 3*time.Second, 3*time.Second
+	defer func() {
+		probeDeadline = 0
+		frontendConfigs = make(map[string]*FrontendConfig)
+	}()
+	check := NewBackendCheck("www.foo.com", "http://10.0.0.1:80", 0, 2)
+	for _, test := range []struct {
+		deadline time.Duration
+		config   *FrontendConfig
+		expected time.Duration
+	}{
+		{0, nil, 6 * time.Second},
+		{2 * time.Second, nil, 2 * time.Second},
+		{time.Minute, nil, 6 * time.Second},
+		{0, &FrontendConfig{FollowRedirects: true},
+			time.Duration(maxRedirects+1) * 6 * time.Second},
+		{0, &FrontendConfig{Probes: []ProbeConfig{{Type: "tcp"}}},
+			3 * time.Second},
+		// The plugins have their own timeout, or -deadline
+		{0, &FrontendConfig{Probes: []ProbeConfig{{Type: "tcp"},
+			{Type: "custom"}}}, time.Duration(PLUGIN_TIMEOUT) * time.Second},
+		{time.Minute, &FrontendConfig{Probes: []ProbeConfig{{Type: "custom"}}},
+			time.Minute},
+	} {
+		probeDeadline = test.deadline
+		frontendConfigs = map[string]*FrontendConfig{}
+		if test.config != nil {
+			frontendConfigs["www.foo.com"] = test.config
+		}
+		if timeout := check.probeTimeout(); timeout != test.expected {
+			t.Errorf("Expected %s with -deadline=%s and %+v, got %s",
+				test.expected, test.deadline, test.config, timeout)
+		}
+	}
+}
+
+func TestWatchdogRestart(t *testing.T) {
+	r, c := setupCache(t)
+	cache = c
+	checkInterval = 10 * time.Millisecond
+	connectionTimeout, ioTimeout = time.Second, 10*time.Second
+	defer func() {
+		cache, checkInterval = nil, time.Duration(CHECK_INTERVAL)*time.Second
+	}()
+	// The first probe hangs until released
+	var requests int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) == 1 {
+				<-release
+			}
+		}))
+	defer srv.Close()
+	r.lists["frontend:www.foo.com"] = []string{"www.foo.com", srv.URL,
+		"http://10.0.0.2:80"}
+	check := NewBackendCheck("www.foo.com", srv.URL, 0, 2)
+	locked, ctl := c.LockBackend(check)
+	if locked == false {
+		t.Fatal("Expected to lock the backend")
+	}
+	startCheckLoop(check, ctl)
+	waitFor(t, "the first probe", func() bool {
+		return atomic.LoadInt32(&requests) == 1
+	})
+	if n := restartStuckChecks(time.Now()); n != 0 {
+		t.Fatalf("Expected a check within its budget to be left alone, got %d", n)
+	}
+	n := restartStuckChecks(time.Now().Add(WATCHDOG_CYCLES *
+		check.cycleBudget()))
+	if n != 1 {
+		t.Fatalf("Expected the stuck check to be restarted, got %d", n)
+	}
+	var fresh *Check
+	for _, watched := range watchedCheckList() {
+		fresh = watched
+	}
+	if fresh == nil || fresh == check || fresh.routineSig != check.routineSig ||
+		atomic.LoadInt32(&fresh.generation) != 1 {
+		t.Fatalf("Expected a fresh check holding the lock, got %+v", fresh)
+	}
+	defer unwatchCheck(fresh)
+	waitFor(t, "a probe of the fresh check", func() bool {
+		return atomic.LoadInt64(&fresh.probes) > 0
+	})
+	// The stuck loop wakes up and leaves the lock to the fresh one
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	r.lock.Lock()
+	sig := r.hashes["hchecker"][srv.URL]
+	r.lock.Unlock()
+	if sig != check.routineSig {
+		t.Errorf("Expected the lock to be kept, got %q", sig)
+	}
+	if len(watchedCheckList()) != 1 {
+		t.Error("Expected the fresh check to keep running")
+	}
+	fresh.Stop()
+	waitFor(t, "the fresh check to release the lock", func() bool {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		_, exists := r.hashes["hchecker"][srv.URL]
+		return !exists
+	})
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}